@@ -0,0 +1,432 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/controller"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Interval at which the config file is checked for changes.
+const configPollIntvl = 10 * time.Second
+
+// Settings from the config file that are applied at runtime when the
+// file changes. Changes to any other setting require a restart.
+var runtimeSettings = map[string]bool{
+	"log-level":                     true,
+	"log-level-controller":          true,
+	"log-level-varnish":             true,
+	"log-level-monitor":             true,
+	"monitorintvl":                  true,
+	"event-verbosity":               true,
+	"default-connect-timeout":       true,
+	"default-first-byte-timeout":    true,
+	"default-between-bytes-timeout": true,
+	"default-probe-url":             true,
+	"default-probe-interval":        true,
+	"default-probe-timeout":         true,
+	"runtime-backends":              true,
+	"update-quiet-period":           true,
+	"update-max-delay":              true,
+	"max-vcl-loads-per-min":         true,
+	"canary":                        true,
+	"canary-soak":                   true,
+	"config-history":                true,
+	"update-concurrency":            true,
+	"instance-timeout":              true,
+	"liveness-timeout":              true,
+}
+
+// Options that may only be set on the command line.
+var cmdlineOnly = map[string]bool{
+	"config":  true,
+	"version": true,
+}
+
+// configFile is a YAML file with settings for the controller. The keys
+// are the names of command-line options, without the leading '-'.
+// Options set on the command line override the config file.
+type configFile struct {
+	path     string
+	data     []byte
+	cmdline  map[string]bool
+	settings map[string]string
+}
+
+// loadConfig reads the config file at path, and applies its settings.
+func loadConfig(path string) (*configFile, error) {
+	cfg := &configFile{
+		path:     path,
+		cmdline:  make(map[string]bool),
+		settings: make(map[string]string),
+	}
+	flag.Visit(func(f *flag.Flag) { cfg.cmdline[f.Name] = true })
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read config file %s: %v", path,
+			err)
+	}
+	settings, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+	if err = cfg.apply(settings, false); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+	cfg.data = data
+	return cfg, nil
+}
+
+// parseConfig returns the settings in a config file as strings, in
+// the form in which they would be given on the command line. All
+// errors are reported, not just the first one.
+func parseConfig(data []byte) (map[string]string, error) {
+	raw := make(map[string]interface{})
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	if err := decoder.Decode(&raw); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Cannot parse YAML: %v", err)
+	}
+
+	var errs []string
+	settings := make(map[string]string, len(raw))
+	for name, v := range raw {
+		f := flag.Lookup(name)
+		if f == nil {
+			errs = append(errs, fmt.Sprintf("unknown setting %s",
+				name))
+			continue
+		}
+		if cmdlineOnly[name] {
+			errs = append(errs, fmt.Sprintf("%s may only be set "+
+				"on the command line", name))
+			continue
+		}
+		val, err := configValue(v)
+		if err == nil {
+			err = checkValue(f, val)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		settings[name] = val
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return settings, nil
+}
+
+// configValue converts a scalar value decoded from YAML to its string
+// form.
+func configValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("value must be a string, number or "+
+			"boolean, not %T", v)
+	}
+}
+
+// checkValue returns an error if val cannot be parsed for the type of
+// the option f.
+func checkValue(f *flag.Flag, val string) error {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch getter.Get().(type) {
+	case bool:
+		_, err = strconv.ParseBool(val)
+	case uint:
+		_, err = strconv.ParseUint(val, 0, strconv.IntSize)
+	case int:
+		_, err = strconv.ParseInt(val, 0, strconv.IntSize)
+	case time.Duration:
+		_, err = time.ParseDuration(val)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for type %T", val,
+			getter.Get())
+	}
+	return nil
+}
+
+// apply sets the options from the config file, except for those given
+// on the command line. Options that were set by a previous version of
+// the file, but are no longer in the file, revert to their defaults.
+// If reload is true, settings that cannot be changed at runtime are
+// ignored with a warning. If the resulting settings are invalid, all
+// options are restored to their previous values.
+func (cfg *configFile) apply(settings map[string]string, reload bool) error {
+	names := make(map[string]struct{})
+	for name := range settings {
+		names[name] = struct{}{}
+	}
+	for name := range cfg.settings {
+		names[name] = struct{}{}
+	}
+
+	prev := make(map[string]string)
+	var restart []string
+	for name := range names {
+		if cfg.cmdline[name] {
+			continue
+		}
+		f := flag.Lookup(name)
+		val, ok := settings[name]
+		if !ok {
+			val = f.DefValue
+		}
+		if val == f.Value.String() {
+			continue
+		}
+		if reload && !runtimeSettings[name] {
+			restart = append(restart, name)
+			continue
+		}
+		prev[name] = f.Value.String()
+		if err := f.Value.Set(val); err != nil {
+			restoreFlags(prev)
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if err := checkSettings(); err != nil {
+		restoreFlags(prev)
+		return err
+	}
+
+	cfg.settings = settings
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		log.Warnf("Config file %s: changes to %s require a restart",
+			cfg.path, strings.Join(restart, ", "))
+	}
+	return nil
+}
+
+func restoreFlags(prev map[string]string) {
+	for name, val := range prev {
+		flag.Set(name, val)
+	}
+}
+
+// checkSettings returns an error if any of the current settings is
+// invalid.
+func checkSettings() error {
+	for _, lvl := range []string{*loglvlF, *ctlLogLvlF, *vcLogLvlF,
+		*monLogLvlF} {
+		if lvl == "" {
+			continue
+		}
+		if _, err := parseLogLevel(lvl); err != nil {
+			return err
+		}
+	}
+	if *logFmtF != "text" && *logFmtF != "json" {
+		return fmt.Errorf("Unknown log format %s, must be text or json",
+			*logFmtF)
+	}
+	if *ingressClassF == "" {
+		return fmt.Errorf("class may not be empty")
+	}
+	if *metricsPortF > math.MaxUint16 {
+		return fmt.Errorf("metricsport %d out of range (max %d)",
+			*metricsPortF, math.MaxUint16)
+	}
+	if *webhookPortF > math.MaxUint16 {
+		return fmt.Errorf("webhook-port %d out of range (max %d)",
+			*webhookPortF, math.MaxUint16)
+	}
+	if *webhookPortF != 0 && (*webhookCertF == "" || *webhookKeyF == "") {
+		return fmt.Errorf("webhook-port requires webhook-cert-file " +
+			"and webhook-key-file")
+	}
+	if _, err := controller.ParseEventVerbosity(*evtVerbosityF); err != nil {
+		return err
+	}
+	if _, _, err := varnish.ParseCanary(*canaryF); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseLogLevel(lvl string) (logrus.Level, error) {
+	switch strings.ToLower(lvl) {
+	case "panic":
+		return logrus.PanicLevel, nil
+	case "fatal":
+		return logrus.FatalLevel, nil
+	case "error":
+		return logrus.ErrorLevel, nil
+	case "warn":
+		return logrus.WarnLevel, nil
+	case "debug":
+		return logrus.DebugLevel, nil
+	case "trace":
+		return logrus.TraceLevel, nil
+	case "info":
+		return logrus.InfoLevel, nil
+	default:
+		return logrus.InfoLevel, fmt.Errorf("Unknown log level %s", lvl)
+	}
+}
+
+func newLogger() *logrus.Logger {
+	return &logrus.Logger{
+		Out:       os.Stdout,
+		Formatter: &logFormat,
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.InfoLevel,
+	}
+}
+
+// setLogFormat sets the formatter for all loggers, for output as text
+// or JSON. This must be called before logging begins.
+func setLogFormat(format string) {
+	var formatter logrus.Formatter = &logFormat
+	if format == "json" {
+		formatter = &logrus.JSONFormatter{}
+	}
+	for _, logger := range []*logrus.Logger{log, ctlLog, varnishLog,
+		monLog} {
+		logger.SetFormatter(formatter)
+	}
+}
+
+// setLogLevels sets the level of the logger for each component from
+// its option, or from -log-level if the option is not set.
+func setLogLevels() {
+	base, _ := parseLogLevel(*loglvlF)
+	log.SetLevel(base)
+	for _, comp := range []struct {
+		logger *logrus.Logger
+		lvl    string
+	}{
+		{ctlLog, *ctlLogLvlF},
+		{varnishLog, *vcLogLvlF},
+		{monLog, *monLogLvlF},
+	} {
+		lvl := base
+		if comp.lvl != "" {
+			lvl, _ = parseLogLevel(comp.lvl)
+		}
+		comp.logger.SetLevel(lvl)
+	}
+}
+
+// setRuntimeOpts applies the settings that may change at runtime.
+// ingc may be nil, if the Ingress controller has not yet been
+// created.
+func setRuntimeOpts(vc *varnish.Controller, ingc *controller.IngressController) {
+	setLogLevels()
+
+	vc.SetMonitorInterval(*monIntvlF)
+	vc.SetRuntimeBackends(*runtimeBesF)
+	vc.SetUpdateDelay(*updQuietF, *updMaxDelayF)
+	vc.SetMaxLoadsPerMin(*maxLoadsF)
+	vc.SetHistoryLen(*histLenF)
+	vc.SetUpdateConcurrency(*concurrencyF, *instDeadlineF)
+	vc.SetCanary(*canaryF, *canarySoakF)
+
+	if ingc == nil {
+		return
+	}
+	verbosity, _ := controller.ParseEventVerbosity(*evtVerbosityF)
+	ingc.SetEventVerbosity(verbosity)
+	ingc.SetLivenessTimeout(*liveTmoF)
+	ingc.SetBackendDefaults(controller.BackendDefaults{
+		ConnectTimeout:      *defConnectTmoF,
+		FirstByteTimeout:    *defFirstByteTmoF,
+		BetweenBytesTimeout: *defBetweenBytesTmoF,
+		ProbeURL:            *defProbeURLF,
+		ProbeInterval:       *defProbeIntvlF,
+		ProbeTimeout:        *defProbeTmoF,
+	})
+}
+
+// watch checks the config file for changes, and applies the settings
+// that may be changed at runtime. An invalid config is rejected, and
+// the current settings remain in effect.
+func (cfg *configFile) watch(vc *varnish.Controller,
+	ingc *controller.IngressController) {
+
+	for range time.Tick(configPollIntvl) {
+		data, err := ioutil.ReadFile(cfg.path)
+		if err != nil {
+			log.Errorf("Cannot read config file %s: %v", cfg.path,
+				err)
+			continue
+		}
+		if bytes.Equal(data, cfg.data) {
+			continue
+		}
+		cfg.data = data
+		log.Infof("Config file %s changed, reloading", cfg.path)
+		settings, err := parseConfig(data)
+		if err == nil {
+			err = cfg.apply(settings, true)
+		}
+		if err != nil {
+			log.Errorf("Invalid config file %s, settings "+
+				"unchanged: %v", cfg.path, err)
+			continue
+		}
+		setRuntimeOpts(vc, ingc)
+		log.Infof("Applied config file %s", cfg.path)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseConfig(t *testing.T) {
+	settings, err := parseConfig([]byte(`
+log-level: debug
+monitorintvl: 1m
+max-vcl-loads-per-min: 10
+runtime-backends: true
+canary: 25%
+`))
+	if err != nil {
+		t.Fatalf("parseConfig(): %v", err)
+	}
+	want := map[string]string{
+		"log-level":             "debug",
+		"monitorintvl":          "1m",
+		"max-vcl-loads-per-min": "10",
+		"runtime-backends":      "true",
+		"canary":                "25%",
+	}
+	if len(settings) != len(want) {
+		t.Errorf("parseConfig(): want %v got %v", want, settings)
+	}
+	for k, v := range want {
+		if settings[k] != v {
+			t.Errorf("parseConfig() %s: want=%s got=%s", k, v,
+				settings[k])
+		}
+	}
+
+	_, err = parseConfig([]byte(`
+no-such-option: 1
+monitorintvl: often
+config: other.yaml
+update-concurrency: -1
+`))
+	if err == nil {
+		t.Fatal("parseConfig() with invalid settings: expected error")
+	}
+	for _, name := range []string{"no-such-option", "monitorintvl",
+		"config", "update-concurrency"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("parseConfig() error %q does not mention %s",
+				err.Error(), name)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	defer func() {
+		for _, name := range []string{"log-level", "monitorintvl",
+			"class", "canary"} {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+		}
+	}()
+
+	cfg := &configFile{
+		path:     "test.yaml",
+		cmdline:  map[string]bool{"log-level": true},
+		settings: make(map[string]string),
+	}
+	err := cfg.apply(map[string]string{
+		"log-level":    "debug",
+		"monitorintvl": "1m",
+	}, false)
+	if err != nil {
+		t.Fatalf("apply(): %v", err)
+	}
+	if *loglvlF != "INFO" {
+		t.Errorf("apply(): command line log-level overridden: %s",
+			*loglvlF)
+	}
+	if *monIntvlF != time.Minute {
+		t.Errorf("apply(): monitorintvl want=1m got=%v", *monIntvlF)
+	}
+
+	// Invalid settings are rejected, and nothing is changed.
+	err = cfg.apply(map[string]string{
+		"monitorintvl": "2m",
+		"canary":       "200%",
+	}, true)
+	if err == nil {
+		t.Error("apply() with invalid canary: expected error")
+	}
+	if *monIntvlF != time.Minute || *canaryF != "" {
+		t.Errorf("apply() with invalid config changed settings: "+
+			"monitorintvl=%v canary=%s", *monIntvlF, *canaryF)
+	}
+
+	// Settings that require a restart are not changed by a reload,
+	// and settings removed from the file revert to the defaults.
+	err = cfg.apply(map[string]string{"class": "other"}, true)
+	if err != nil {
+		t.Fatalf("apply(): %v", err)
+	}
+	if *ingressClassF != "varnish" {
+		t.Errorf("apply() reload changed class: %s", *ingressClassF)
+	}
+	if *monIntvlF != 30*time.Second {
+		t.Errorf("apply() reload: monitorintvl want=30s got=%v",
+			*monIntvlF)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	defer func() {
+		for _, name := range []string{"log-level",
+			"log-level-monitor"} {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+		}
+		setLogLevels()
+	}()
+
+	flag.Set("log-level", "warn")
+	flag.Set("log-level-monitor", "trace")
+	if err := checkSettings(); err != nil {
+		t.Fatalf("checkSettings(): %v", err)
+	}
+	setLogLevels()
+	for _, test := range []struct {
+		name   string
+		logger *logrus.Logger
+		want   logrus.Level
+	}{
+		{"main", log, logrus.WarnLevel},
+		{"controller", ctlLog, logrus.WarnLevel},
+		{"varnish", varnishLog, logrus.WarnLevel},
+		{"monitor", monLog, logrus.TraceLevel},
+	} {
+		if lvl := test.logger.GetLevel(); lvl != test.want {
+			t.Errorf("%s log level want=%s got=%s", test.name,
+				test.want, lvl)
+		}
+	}
+
+	flag.Set("log-level-monitor", "verbose")
+	if err := checkSettings(); err == nil {
+		t.Error("checkSettings() with invalid log-level-monitor: " +
+			"expected error")
+	}
+}
+
+func TestWebhookSettings(t *testing.T) {
+	defer func() {
+		for _, name := range []string{"webhook-port",
+			"webhook-cert-file", "webhook-key-file"} {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+		}
+	}()
+
+	flag.Set("webhook-port", "8443")
+	if err := checkSettings(); err == nil {
+		t.Error("checkSettings() with webhook-port and no TLS " +
+			"files: expected error")
+	}
+	flag.Set("webhook-cert-file", "/etc/webhook/tls.crt")
+	flag.Set("webhook-key-file", "/etc/webhook/tls.key")
+	if err := checkSettings(); err != nil {
+		t.Errorf("checkSettings(): %v", err)
+	}
+	flag.Set("webhook-port", "65536")
+	if err := checkSettings(); err == nil {
+		t.Error("checkSettings() with webhook-port out of range: " +
+			"expected error")
+	}
+}
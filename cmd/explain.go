@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/explain"
+)
+
+const explainUsage = `Usage: %s explain [options] -f FILE|DIR|- [-f ...]
+
+Report what the VCL configuration of a Varnish Service, generated from
+Ingresses and related resources defined in YAML or JSON manifests as
+for the render subcommand, would do with a sample client request:
+which ACLs, authentication and request dispositions apply, which
+rewrites are executed in which order, and to which Service the request
+is routed.
+
+Options:
+`
+
+// Outcome returns a one-line summary of an explain.Result.
+func outcome(res *explain.Result) string {
+	switch {
+	case res.Failed:
+		return fmt.Sprintf("VCL failure, response status %d",
+			res.Status)
+	case res.Status != 0:
+		return fmt.Sprintf("synthetic response %d %s", res.Status,
+			res.Reason)
+	case res.Service != "":
+		svc := fmt.Sprintf("Service %s (director %s)", res.Service,
+			res.Director)
+		if res.Default {
+			svc = "default " + svc
+		}
+		return fmt.Sprintf("return(%s), backend %s", res.Recv, svc)
+	default:
+		return fmt.Sprintf("return(%s)", res.Recv)
+	}
+}
+
+// writeHeader writes the header in the request line format.
+func writeHeader(w io.Writer, hdr http.Header) {
+	names := make([]string, 0, len(hdr))
+	for name := range hdr {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, val := range hdr[name] {
+			fmt.Fprintf(w, "    %s: %s\n", name, val)
+		}
+	}
+}
+
+// writeResult writes a human-readable report of an explain.Result.
+func writeResult(out io.Writer, key string, req explain.Request,
+	res *explain.Result) error {
+
+	fmt.Fprintf(out, "Varnish Service %s\n", key)
+	fmt.Fprintf(out, "Request: %s %s\n", req.Method, req.URL)
+	writeHeader(out, req.Header)
+	fmt.Fprintln(out)
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUB\tKIND\tNAME\tMATCHED\tDETAIL")
+	for _, step := range res.Steps {
+		matched := "no"
+		if step.Matched {
+			matched = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", step.Sub, step.Kind,
+			step.Name, matched, step.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\nResult: %s\n", outcome(res))
+	fmt.Fprintf(out, "Client request: %s\n", res.URL)
+	writeHeader(out, res.Header)
+	if res.BackendURL != "" {
+		fmt.Fprintf(out, "Backend request: %s %s\n", res.BackendMethod,
+			res.BackendURL)
+		writeHeader(out, res.BackendHeader)
+	}
+	if len(res.Notes) > 0 {
+		fmt.Fprintln(out, "\nNotes:")
+		for _, note := range res.Notes {
+			fmt.Fprintf(out, "  - %s\n", note)
+		}
+	}
+	return nil
+}
+
+// explainCmd implements the explain subcommand with the command-line
+// arguments args, writing the report to out. Returns the exit status.
+func explainCmd(args []string, out io.Writer) int {
+	var files, hdrs fileList
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), explainUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Var(&files, "f", "file or directory with manifests, or - for "+
+		"standard input;\nmay be given more than once")
+	class := flags.String("class", "varnish", "value of the Ingress "+
+		"annotation kubernetes.io/ingress.class")
+	svcKey := flags.String("service", "", "namespace/name of the "+
+		"Varnish Service; may be omitted if\nthe manifests define "+
+		"Ingresses for only one Varnish Service")
+	method := flags.String("method", http.MethodGet, "request method")
+	host := flags.String("host", "", "value of the Host header")
+	url := flags.String("url", "/", "request URL")
+	flags.Var(&hdrs, "H", "request header in the form \"Name: value\";\n"+
+		"may be given more than once")
+	clientIP := flags.String("client-ip", explain.DefaultIP,
+		"client IP address")
+	serverIP := flags.String("server-ip", explain.DefaultIP,
+		"server IP address")
+	jsonOut := flags.Bool("json", false, "write the result as JSON")
+	logLvl := flags.String("log-level", "WARN", "log level for messages "+
+		"to standard error")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(files) == 0 || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+	req := explain.Request{
+		Method:   *method,
+		Host:     *host,
+		URL:      *url,
+		Header:   make(http.Header),
+		ClientIP: *clientIP,
+		ServerIP: *serverIP,
+	}
+	for _, hdr := range hdrs {
+		i := strings.IndexByte(hdr, ':')
+		if i <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid header \"%s\"\n", hdr)
+			return 2
+		}
+		req.Header.Add(strings.TrimSpace(hdr[:i]),
+			strings.TrimSpace(hdr[i+1:]))
+	}
+	if *host != "" {
+		req.Header.Set("Host", *host)
+	}
+
+	log, err := stderrLogger(*logLvl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	specs, err := loadSpecs(files, *class, log)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	key := *svcKey
+	if key == "" {
+		if len(specs) != 1 {
+			log.Errorf("Manifests define Ingresses for %d Varnish "+
+				"Services, choose one with -service", len(specs))
+			return 1
+		}
+		for k := range specs {
+			key = k
+		}
+	}
+	spec, ok := specs[key]
+	if !ok {
+		log.Errorf("No Ingresses for Varnish Service %s", key)
+		return 1
+	}
+
+	res, err := explain.Explain(spec, req)
+	if err != nil {
+		log.Errorf("Varnish Service %s: %v", key, err)
+		return 1
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(res)
+	} else {
+		err = writeResult(out, key, req, res)
+	}
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/explain"
+)
+
+func TestExplain(t *testing.T) {
+	var out bytes.Buffer
+	args := []string{"-f", "testdata/cafe.yaml", "-host",
+		"cafe.example.com", "-url", "/coffee/espresso"}
+	if status := explainCmd(args, &out); status != 0 {
+		t.Fatalf("explain(%v) exit status %d", args, status)
+	}
+	want := "backend Service default/coffee-svc"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("explain(%v): output does not name coffee-svc:\n%s",
+			args, out.String())
+	}
+
+	out.Reset()
+	args = []string{"-f", "testdata/cafe.yaml", "-json", "-host",
+		"cafe.example.com", "-url", "/tea", "-method", "POST", "-H",
+		"X-Test: 1"}
+	if status := explainCmd(args, &out); status != 0 {
+		t.Fatalf("explain(%v) exit status %d", args, status)
+	}
+	var res explain.Result
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatalf("explain(%v): cannot decode JSON: %v", args, err)
+	}
+	if res.Recv != "pass" || res.Service != "default/tea-svc" ||
+		res.BackendHeader.Get("X-Test") != "1" {
+		t.Errorf("explain(%v): got recv=%s service=%s X-Test=%s, want "+
+			"recv=pass service=default/tea-svc X-Test=1", args, res.Recv,
+			res.Service, res.BackendHeader.Get("X-Test"))
+	}
+
+	args = []string{"-f", "testdata/cafe.yaml", "-service",
+		"default/other"}
+	if status := explainCmd(args, &out); status != 1 {
+		t.Errorf("explain(%v) exit status want=1 got=%d", args, status)
+	}
+	args = []string{"-f", "testdata/cafe.yaml", "-H", "bogus"}
+	if status := explainCmd(args, &out); status != 2 {
+		t.Errorf("explain(%v) exit status want=2 got=%d", args, status)
+	}
+}
@@ -33,7 +33,7 @@ package main
 import (
 	"flag"
 	"fmt"
-	"math"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"strings"
@@ -49,6 +49,7 @@ import (
 
 	api_v1 "k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -60,7 +61,15 @@ var (
 		"log level: one of PANIC, FATAL, ERROR, WARN, INFO, DEBUG, \n"+
 			"or TRACE")
 	namespaceF = flag.String("namespace", api_v1.NamespaceAll,
-		"namespace in which to listen for resources (default all)")
+		"namespace in which to listen for resources, or a\n"+
+			"comma-separated list of namespaces (default all)")
+	nsSelectorF = flag.String("namespace-selector", "",
+		"label selector for namespaces in which to listen for\n"+
+			"resources, in addition to those given by -namespace")
+	clusterCfgNsF = flag.String("cluster-config-namespace", "",
+		"namespace of the Secrets and ConfigMaps named in\n"+
+			"ClusterVarnishConfigs. ClusterVarnishConfigs are only\n"+
+			"watched if set")
 	tmplDirF = flag.String("templatedir", "",
 		"directory of templates for VCL generation. Defaults to \n"+
 			"the TEMPLATE_DIR env variable, if set, or the \n"+
@@ -77,7 +86,8 @@ var (
 			"instances of Varnish that implement Ingress.\n"+
 			"Monitor deactivated when <= 0s")
 	metricsPortF = flag.Uint("metricsport", 8080,
-		"port at which to listen for the /metrics endpoint")
+		"port at which to listen for the /metrics, /healthz and\n"+
+			"/readyz endpoints")
 	ingressClassF = flag.String("class", "varnish", "value of the Ingress "+
 		"annotation kubernetes.io/ingress.class\nthe controller only "+
 		"considers Ingresses with this value for the\nannotation")
@@ -85,15 +95,124 @@ var (
 		"if non-zero, re-update the controller with the state of\n"+
 			"the cluster this often, even if nothing has changed,\n"+
 			"to synchronize state that may have been missed")
+	runtimeBesF = flag.Bool("runtime-backends", false,
+		"if true, apply the removal of Service endpoints (and\n"+
+			"their return) at runtime by setting backend health,\n"+
+			"without loading a new VCL configuration")
+	updQuietF = flag.Duration("update-quiet-period", 0,
+		"if > 0s, batch updates for a Varnish Service, and load\n"+
+			"the latest configuration when no further updates\n"+
+			"were received during this period")
+	updMaxDelayF = flag.Duration("update-max-delay", 30*time.Second,
+		"maximum time that a batched update may be postponed,\n"+
+			"if -update-quiet-period > 0s. No limit when <= 0s")
+	maxLoadsF = flag.Uint("max-vcl-loads-per-min", 0,
+		"maximum number of VCL loads per minute at each Varnish\n"+
+			"instance; loads are deferred when the limit is\n"+
+			"reached. No limit when 0")
+	canaryF = flag.String("canary", "",
+		"number of Varnish instances, or percentage of instances\n"+
+			"if followed by %, at which a new config is activated\n"+
+			"first for a canary rollout. Canary rollouts are\n"+
+			"disabled if empty or 0")
+	canarySoakF = flag.Duration("canary-soak", time.Minute,
+		"time for which canary instances are checked before a\n"+
+			"new config is activated at all instances")
+	histLenF = flag.Uint("config-history", 3,
+		"number of configurations, including the active one,\n"+
+			"retained for each Varnish Service for rollback")
+	concurrencyF = flag.Uint("update-concurrency", 8,
+		"maximum number of Varnish instances of a Service that\n"+
+			"are updated concurrently. No limit when 0")
+	instDeadlineF = flag.Duration("instance-timeout", 2*time.Minute,
+		"deadline for each operation at a Varnish instance during\n"+
+			"an update, such as a VCL load. No deadline when <= 0s")
+	leaderElectF = flag.Bool("leader-elect", false,
+		"if true, run leader election among replicas of the\n"+
+			"controller; only the leader updates Varnish")
+	leaseNameF = flag.String("leader-elect-lease",
+		"varnish-ingress-controller",
+		"name of the Lease object used for leader election")
+	leaseNsF = flag.String("leader-elect-namespace", "",
+		"namespace of the Lease object used for leader election.\n"+
+			"Defaults to the POD_NAMESPACE env variable")
+	leaseDurationF = flag.Duration("leader-elect-lease-duration",
+		15*time.Second,
+		"time that standby replicas wait before taking over\n"+
+			"after the leader last renewed the Lease")
+	renewDeadlineF = flag.Duration("leader-elect-renew-deadline",
+		10*time.Second,
+		"time in which the leader must renew the Lease, before\n"+
+			"it gives up leadership")
+	retryPeriodF = flag.Duration("leader-elect-retry-period",
+		2*time.Second,
+		"interval between attempts to acquire or renew the Lease")
+	configF = flag.String("config", "",
+		"path of a YAML file with settings for the controller;\n"+
+			"options on the command line override the file")
+	evtVerbosityF = flag.String("event-verbosity", "all",
+		"Events to generate for synced resources: one of all,\n"+
+			"warning or none")
+	defConnectTmoF = flag.Duration("default-connect-timeout", 0,
+		"connect timeout for backends not set by a BackendConfig.\n"+
+			"Varnish default when <= 0s")
+	defFirstByteTmoF = flag.Duration("default-first-byte-timeout", 0,
+		"first byte timeout for backends not set by a\n"+
+			"BackendConfig. Varnish default when <= 0s")
+	defBetweenBytesTmoF = flag.Duration("default-between-bytes-timeout",
+		0, "between bytes timeout for backends not set by a\n"+
+			"BackendConfig. Varnish default when <= 0s")
+	defProbeURLF = flag.String("default-probe-url", "",
+		"URL path of a health probe for backends without a probe\n"+
+			"from a BackendConfig. No default probe if empty")
+	defProbeIntvlF = flag.Duration("default-probe-interval", 0,
+		"interval of the default probe. Varnish default when <= 0s")
+	defProbeTmoF = flag.Duration("default-probe-timeout", 0,
+		"timeout of the default probe. Varnish default when <= 0s")
+	logFmtF = flag.String("log-format", "text",
+		"format of log output: text or json")
+	ctlLogLvlF = flag.String("log-level-controller", "",
+		"log level for the controller that watches the cluster;\n"+
+			"defaults to -log-level")
+	vcLogLvlF = flag.String("log-level-varnish", "",
+		"log level for updates of Varnish instances; defaults\n"+
+			"to -log-level")
+	monLogLvlF = flag.String("log-level-monitor", "",
+		"log level for the monitor of Varnish instances;\n"+
+			"defaults to -log-level")
+	liveTmoF = flag.Duration("liveness-timeout",
+		controller.DefLivenessTimeout,
+		"time after which /healthz reports failure if a worker\n"+
+			"is busy with one item, or if the monitor has not begun\n"+
+			"an iteration after its interval. Not checked when <= 0s")
+	debugAPIF = flag.Bool("debug-api", false,
+		"if true, serve the read-only debug API for Varnish\n"+
+			"Services at /debug/varnish/ on the -metricsport")
+	debugTokenFileF = flag.String("debug-token-file", "",
+		"path of a file containing a bearer token that requests\n"+
+			"to the debug API must present. Required for\n"+
+			"-debug-api")
+	webhookPortF = flag.Uint("webhook-port", 0,
+		"port at which to serve the validating admission webhook\n"+
+			"for VarnishConfigs and ClusterVarnishConfigs via TLS.\n"+
+			"Webhook disabled when 0")
+	webhookCertF = flag.String("webhook-cert-file", "",
+		"path of the TLS certificate for the webhook. Required\n"+
+			"for -webhook-port")
+	webhookKeyF = flag.String("webhook-key-file", "",
+		"path of the TLS private key for the webhook. Required\n"+
+			"for -webhook-port")
+	webhookStrictF = flag.Bool("webhook-reject-warnings", false,
+		"if true, the webhook also rejects configs for which the\n"+
+			"analysis finds warnings")
 	logFormat = logrus.TextFormatter{
 		DisableColors: true,
 		FullTimestamp: true,
 	}
-	log = &logrus.Logger{
-		Out:       os.Stdout,
-		Formatter: &logFormat,
-		Level:     logrus.InfoLevel,
-	}
+	log          = newLogger()
+	ctlLog       = newLogger()
+	varnishLog   = newLogger()
+	monLog       = newLogger()
 	informerStop = make(chan struct{})
 )
 
@@ -103,6 +222,14 @@ var (
 func noop(opts *meta_v1.ListOptions) {}
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render":
+			os.Exit(render(os.Args[2:], os.Stdout))
+		case "explain":
+			os.Exit(explainCmd(os.Args[2:], os.Stdout))
+		}
+	}
 	flag.Parse()
 
 	if *versionF {
@@ -110,55 +237,40 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *readyfileF != "" {
-		if err := os.Remove(*readyfileF); err != nil && !os.IsNotExist(err) {
-			fmt.Printf("Cannot remove ready file %s: %v",
-				*readyfileF, err)
+	var cfgFile *configFile
+	if *configF != "" {
+		var err error
+		if cfgFile, err = loadConfig(*configF); err != nil {
+			fmt.Printf("%v, exiting\n", err)
 			os.Exit(-1)
 		}
 	}
-
-	lvl := strings.ToLower(*loglvlF)
-	switch lvl {
-	case "panic":
-		log.Level = logrus.PanicLevel
-	case "fatal":
-		log.Level = logrus.FatalLevel
-	case "error":
-		log.Level = logrus.ErrorLevel
-	case "warn":
-		log.Level = logrus.WarnLevel
-	case "debug":
-		log.Level = logrus.DebugLevel
-	case "trace":
-		log.Level = logrus.TraceLevel
-	case "info":
-		break
-	default:
-		fmt.Printf("Unknown log level %s, exiting", *loglvlF)
+	if err := checkSettings(); err != nil {
+		fmt.Printf("%v, exiting\n", err)
 		os.Exit(-1)
 	}
+	setLogFormat(*logFmtF)
+	setLogLevels()
 
-	if *ingressClassF == "" {
-		log.Fatalf("class may not be empty")
-		os.Exit(-1)
-	}
-
-	if *metricsPortF > math.MaxUint16 {
-		log.Fatalf("metricsport %d out of range (max %d)",
-			*metricsPortF, math.MaxUint16)
-		os.Exit(-1)
+	if *readyfileF != "" {
+		if err := os.Remove(*readyfileF); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Cannot remove ready file %s: %v",
+				*readyfileF, err)
+			os.Exit(-1)
+		}
 	}
 
 	log.Info("Starting Varnish Ingress controller version:", version)
 	log.Info("Ingress class:", *ingressClassF)
 
-	vController, err := varnish.NewVarnishController(log, *tmplDirF,
-		*monIntvlF)
+	vController, err := varnish.NewVarnishController(varnishLog,
+		*tmplDirF, *monIntvlF)
 	if err != nil {
 		log.Fatal("Cannot initialize Varnish controller: ", err)
 		os.Exit(-1)
 	}
+	vController.SetMonitorLogger(monLog)
+	setRuntimeOpts(vController, nil)
 
 	config, err := clientcmd.BuildConfigFromFlags(*masterURLF, *kubeconfigF)
 	if err != nil {
@@ -173,19 +285,113 @@ func main() {
 		log.Fatal("Failed to create client:", err)
 	}
 
+	var ingController *controller.IngressController
+	nsList := namespaces()
+	if len(nsList) <= 1 && *nsSelectorF == "" {
+		ingController, err = singleNsController(kubeClient,
+			vingClient, vController)
+	} else {
+		watch := controller.Namespaces{Names: nsList}
+		if *nsSelectorF != "" {
+			watch.Selector, err = labels.Parse(*nsSelectorF)
+			if err != nil {
+				log.Fatalf("Invalid namespace-selector %s: %v",
+					*nsSelectorF, err)
+			}
+		}
+		ingController, err = controller.NewNamespacesIngressController(
+			ctlLog, *ingressClassF, kubeClient, vingClient,
+			vController, watch, *resyncPeriodF)
+	}
+	if err != nil {
+		log.Fatalf("Could not initialize controller: %v", err)
+		os.Exit(-1)
+	}
+	vController.EvtGenerator(ingController)
+	if *clusterCfgNsF != "" {
+		ingController.EnableClusterVarnishConfigs(vingClient,
+			*clusterCfgNsF, *resyncPeriodF)
+	}
+	if *leaderElectF {
+		ingController.SetLeaderElection(leaderElection())
+	}
+	if *debugAPIF {
+		token, err := debugToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = ingController.EnableDebugAPI(token); err != nil {
+			log.Fatalf("%v: -debug-api requires -debug-token-file",
+				err)
+		}
+	}
+	if *webhookPortF != 0 {
+		go controller.ServeWebhook(logrus.NewEntry(ctlLog),
+			uint16(*webhookPortF), *webhookCertF, *webhookKeyF,
+			*webhookStrictF)
+	}
+	setRuntimeOpts(vController, ingController)
+	if cfgFile != nil {
+		go cfgFile.watch(vController, ingController)
+	}
+	go handleTermination(log, ingController, vController)
+	ingController.Run(*readyfileF, uint16(*metricsPortF))
+}
+
+// debugToken returns the token for the debug API read from the file
+// given by -debug-token-file, or the empty string if the option is not
+// set.
+func debugToken() (string, error) {
+	if *debugTokenFileF == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(*debugTokenFileF)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read debug token file %s: %v",
+			*debugTokenFileF, err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("Debug token file %s is empty",
+			*debugTokenFileF)
+	}
+	return token, nil
+}
+
+// namespaces returns the namespaces in the comma-separated list given
+// by the -namespace option, or nil for all namespaces.
+func namespaces() []string {
+	var nsList []string
+	for _, ns := range strings.Split(*namespaceF, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			nsList = append(nsList, ns)
+		}
+	}
+	return nsList
+}
+
+// singleNsController returns a controller that watches all
+// namespaces, or the one namespace given by -namespace.
+func singleNsController(
+	kubeClient kubernetes.Interface,
+	vingClient clientset.Interface,
+	vController *varnish.Controller,
+) (*controller.IngressController, error) {
+
 	var informerFactory informers.SharedInformerFactory
 	var vcrInformerFactory vcr_informers.SharedInformerFactory
-	if *namespaceF == api_v1.NamespaceAll {
+	ns := strings.TrimSpace(*namespaceF)
+	if ns == api_v1.NamespaceAll {
 		informerFactory = informers.NewSharedInformerFactory(
 			kubeClient, *resyncPeriodF)
 		vcrInformerFactory = vcr_informers.NewSharedInformerFactory(
 			vingClient, *resyncPeriodF)
 	} else {
 		informerFactory = informers.NewFilteredSharedInformerFactory(
-			kubeClient, *resyncPeriodF, *namespaceF, noop)
+			kubeClient, *resyncPeriodF, ns, noop)
 		vcrInformerFactory =
 			vcr_informers.NewFilteredSharedInformerFactory(
-				vingClient, *resyncPeriodF, *namespaceF, noop)
+				vingClient, *resyncPeriodF, ns, noop)
 
 		// XXX this is prefered, but only available in newer
 		// versions of client-go.
@@ -193,19 +399,44 @@ func main() {
 		// 	kubeClient, *resyncPeriodF,
 		// 	informers.WithNamespace(*namespaceF))
 	}
-
-	ingController, err := controller.NewIngressController(log,
-		*ingressClassF, kubeClient, vController, informerFactory,
-		vcrInformerFactory)
+	ingc, err := controller.NewIngressController(ctlLog, *ingressClassF,
+		kubeClient, vController, informerFactory, vcrInformerFactory)
 	if err != nil {
-		log.Fatalf("Could not initialize controller: %v")
-		os.Exit(-1)
+		return nil, err
 	}
-	vController.EvtGenerator(ingController)
-	go handleTermination(log, ingController, vController)
-	vController.Start()
 	informerFactory.Start(informerStop)
-	ingController.Run(*readyfileF, uint16(*metricsPortF))
+	return ingc, nil
+}
+
+// leaderElection returns the leader election configuration from the
+// command-line options. The identity of the replica is the Pod name
+// from the POD_NAME env variable, or the hostname.
+func leaderElection() *controller.LeaderElection {
+	leaseNs := *leaseNsF
+	if leaseNs == "" {
+		leaseNs = os.Getenv("POD_NAMESPACE")
+	}
+	if leaseNs == "" {
+		log.Fatal("leader-elect-namespace not set, and POD_NAMESPACE " +
+			"not found in the environment")
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Cannot determine identity for leader "+
+				"election: %v", err)
+		}
+		identity = hostname
+	}
+	return &controller.LeaderElection{
+		Namespace:     leaseNs,
+		Name:          *leaseNameF,
+		Identity:      identity,
+		LeaseDuration: *leaseDurationF,
+		RenewDeadline: *renewDeadlineF,
+		RetryPeriod:   *retryPeriodF,
+	}
 }
 
 func handleTermination(
@@ -223,7 +454,7 @@ func handleTermination(
 	ingc.Stop()
 
 	log.Info("Shutting down informers")
-	informerStop <- struct{}{}
+	close(informerStop)
 
 	log.Info("Shutting down the Varnish controller")
 	vc.Quit()
@@ -0,0 +1,306 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	vcr_scheme "code.uplex.de/uplex-varnish/k8s-ingress/pkg/client/clientset/versioned/scheme"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/controller"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	api_v1 "k8s.io/api/core/v1"
+)
+
+const renderUsage = `Usage: %s render [options] -f FILE|DIR|- [-f ...]
+
+Generate the VCL configurations for the Varnish Services that
+implement Ingresses defined in YAML or JSON manifests, as the
+controller would for a cluster with those resources, without
+connecting to a cluster. Manifests may contain Ingresses, Services,
+Endpoints, Pods, Secrets, VarnishConfigs and BackendConfigs, and
+other resources, which are ignored.
+
+Options:
+`
+
+// fileList is a flag.Value for an option that may be given more than
+// once.
+type fileList []string
+
+func (files *fileList) String() string {
+	return strings.Join(*files, ",")
+}
+
+func (files *fileList) Set(file string) error {
+	*files = append(*files, file)
+	return nil
+}
+
+// decoder returns a decoder for the resource types handled by the
+// controller, including the custom resources.
+func decoder() (runtime.Decoder, error) {
+	s := runtime.NewScheme()
+	if err := scheme.AddToScheme(s); err != nil {
+		return nil, err
+	}
+	if err := vcr_scheme.AddToScheme(s); err != nil {
+		return nil, err
+	}
+	return serializer.NewCodecFactory(s).UniversalDeserializer(), nil
+}
+
+// decodeObjs returns the resources in the YAML or JSON documents read
+// from r. Items in a List are returned individually. Documents with a
+// kind that is not known to the decoder are skipped.
+func decodeObjs(dec runtime.Decoder, r io.Reader, name string,
+	log *logrus.Logger) ([]runtime.Object, error) {
+
+	var objs []runtime.Object
+	reader := yaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		docs := [][]byte{doc}
+		for len(docs) > 0 {
+			doc, docs = docs[0], docs[1:]
+			obj, gvk, err := dec.Decode(doc, nil, nil)
+			if runtime.IsNotRegisteredError(err) {
+				log.Debugf("%s: ignoring %v", name, gvk)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			if list, ok := obj.(*api_v1.List); ok {
+				for _, item := range list.Items {
+					docs = append(docs, item.Raw)
+				}
+				continue
+			}
+			objs = append(objs, obj)
+		}
+	}
+}
+
+// readObjs returns the resources in the manifests at path, which may
+// be a file, a directory in which all files with the extensions .yaml,
+// .yml and .json are read, or "-" for standard input.
+func readObjs(dec runtime.Decoder, path string,
+	log *logrus.Logger) ([]runtime.Object, error) {
+
+	if path == "-" {
+		return decodeObjs(dec, os.Stdin, "stdin", log)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".yaml", ".yml", ".json":
+				if !entry.IsDir() {
+					files = append(files,
+						filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+	}
+	var objs []runtime.Object
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		fileObjs, err := decodeObjs(dec, f, file, log)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, fileObjs...)
+	}
+	return objs, nil
+}
+
+// stderrLogger returns a Logger for the subcommands, which logs to
+// standard error at the given level.
+func stderrLogger(level string) (*logrus.Logger, error) {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	return &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableTimestamp: true},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     lvl,
+	}, nil
+}
+
+// loadSpecs returns the VCL specs for the Varnish Services that
+// implement the Ingresses in the manifests, indexed by namespace/name
+// of the Varnish Service.
+func loadSpecs(files []string, class string,
+	log *logrus.Logger) (map[string]vcl.Spec, error) {
+
+	dec, err := decoder()
+	if err != nil {
+		return nil, err
+	}
+	var objs []runtime.Object
+	for _, file := range files {
+		fileObjs, err := readObjs(dec, file, log)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, fileObjs...)
+	}
+	return controller.RenderSpecs(logrus.NewEntry(log), class, objs)
+}
+
+// render implements the render subcommand with the command-line
+// arguments args, writing the VCL to out. Returns the exit status.
+func render(args []string, out io.Writer) int {
+	var files fileList
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), renderUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Var(&files, "f", "file or directory with manifests, or - for "+
+		"standard input;\nmay be given more than once")
+	class := flags.String("class", "varnish", "value of the Ingress "+
+		"annotation kubernetes.io/ingress.class")
+	tmplDir := flags.String("templatedir", "", "directory of templates "+
+		"for VCL generation. Defaults to\nthe TEMPLATE_DIR env "+
+		"variable, if set, or the current\nworking directory")
+	svcKey := flags.String("service", "", "namespace/name of a Varnish "+
+		"Service; if set, only generate\nthe VCL for this Service")
+	logLvl := flags.String("log-level", "WARN", "log level for messages "+
+		"to standard error")
+	verStr := flags.String("varnish-version", "", "MAJOR.MINOR version "+
+		"of Varnish for which the VCL is\ngenerated; if not set, use "+
+		"the default templates")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(files) == 0 || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	log, err := stderrLogger(*logLvl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var ver vcl.Version
+	if *verStr != "" {
+		var ok bool
+		if ver, ok = vcl.ParseBanner("varnish-" + *verStr); !ok {
+			fmt.Fprintf(os.Stderr, "Invalid Varnish version %q\n",
+				*verStr)
+			return 2
+		}
+	}
+
+	if *tmplDir == "" {
+		*tmplDir = os.Getenv("TEMPLATE_DIR")
+	}
+	if err := vcl.InitTemplates(*tmplDir); err != nil {
+		log.Error(err)
+		return 1
+	}
+	specs, err := loadSpecs(files, *class, log)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	keys := make([]string, 0, len(specs))
+	for key := range specs {
+		if *svcKey == "" || key == *svcKey {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		if *svcKey != "" {
+			log.Errorf("No Ingresses for Varnish Service %s",
+				*svcKey)
+		} else {
+			log.Error("No Ingresses for any Varnish Service")
+		}
+		return 1
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		src, _, err := specs[key].GetSrcMapFor(ver)
+		if err != nil {
+			log.Errorf("Varnish Service %s: %v", key, err)
+			return 1
+		}
+		if len(keys) > 1 {
+			if i > 0 {
+				fmt.Fprintln(out)
+			}
+			fmt.Fprintf(out, "# Varnish Service %s\n", key)
+		}
+		fmt.Fprint(out, src)
+	}
+	return 0
+}
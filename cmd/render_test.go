@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const tmplDir = "../pkg/varnish/vcl"
+
+func TestRender(t *testing.T) {
+	var out bytes.Buffer
+	args := []string{"-templatedir", tmplDir, "-f", "testdata/cafe.yaml"}
+	if status := render(args, &out); status != 0 {
+		t.Fatalf("render(%v) exit status %d", args, status)
+	}
+	src := out.String()
+	for _, want := range []string{
+		"cafe.example.com",
+		"192.0.2.1",
+		"192.0.2.5",
+		`.connect_timeout = 1s;`,
+		"directors.random()",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("render(%v): output does not contain %q",
+				args, want)
+		}
+	}
+
+	out.Reset()
+	args = []string{"-templatedir", tmplDir, "-f", "testdata/cafe.yaml",
+		"-service", "default/varnish-ingress"}
+	if status := render(args, &out); status != 0 {
+		t.Errorf("render(%v) exit status %d", args, status)
+	}
+	if out.String() != src {
+		t.Errorf("render(%v): output differs from the output "+
+			"without -service", args)
+	}
+
+	args = []string{"-templatedir", tmplDir, "-f", "testdata/cafe.yaml",
+		"-service", "default/other"}
+	if status := render(args, &out); status != 1 {
+		t.Errorf("render(%v) exit status want=1 got=%d", args, status)
+	}
+	args = []string{"-templatedir", tmplDir, "-class", "other", "-f",
+		"testdata/cafe.yaml"}
+	if status := render(args, &out); status != 1 {
+		t.Errorf("render(%v) exit status want=1 got=%d", args, status)
+	}
+	if status := render(nil, &out); status != 2 {
+		t.Errorf("render() without -f exit status want=2 got=%d",
+			status)
+	}
+}
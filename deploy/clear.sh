@@ -2,6 +2,8 @@
 
 kubectl delete -f controller.yaml
 
+kubectl delete -f clustervarnishcfg-crd.yaml
+
 kubectl delete -f backendcfg-crd.yaml
 
 kubectl delete -f varnishcfg-crd.yaml
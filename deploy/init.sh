@@ -8,4 +8,6 @@ kubectl apply -f varnishcfg-crd.yaml
 
 kubectl apply -f backendcfg-crd.yaml
 
+kubectl apply -f clustervarnishcfg-crd.yaml
+
 kubectl apply -f controller.yaml
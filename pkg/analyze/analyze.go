@@ -0,0 +1,453 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package analyze
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/explain"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+)
+
+// Severity classifies a Finding.
+type Severity uint8
+
+const (
+	// Warning for a configuration that is likely a mistake, but
+	// can be loaded.
+	Warning Severity = iota
+	// Error for a configuration that cannot be loaded, or that
+	// silently disables an access restriction.
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	default:
+		return "__INVALID_SEVERITY__"
+	}
+}
+
+// Kinds of configuration elements to which a Finding refers.
+const (
+	// ACL in spec.acl of a VarnishConfig
+	ACL = "acl"
+	// Auth in spec.auth of a VarnishConfig
+	Auth = "auth"
+	// Disposition in spec.req-disposition of a VarnishConfig
+	Disposition = "req-disposition"
+	// Rewrite in spec.rewrites of a VarnishConfig
+	Rewrite = "rewrite"
+	// Path in the rules of an Ingress
+	Path = "path"
+)
+
+// Finding is the result of the analysis for one element of the
+// configuration.
+//
+//    Severity: Warning or Error
+//    Kind: one of the constants ACL, Auth, Disposition, Rewrite or
+//          Path
+//    Name: identifies the element: the name of an ACL, the realm of
+//          an Auth, the index of a request disposition or rewrite, or
+//          the host of an Ingress rule
+//    Msg: description of the finding
+type Finding struct {
+	Severity Severity
+	Kind     string
+	Name     string
+	Msg      string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s %s: %s", f.Kind, f.Name, f.Msg)
+}
+
+// Spec analyzes a VCL spec, and returns the findings.
+func Spec(spec vcl.Spec) []Finding {
+	var findings []Finding
+	findings = append(findings, acls(spec.ACLs)...)
+	findings = append(findings, auths(spec.Auths)...)
+	findings = append(findings, dispositions(spec.Dispositions)...)
+	findings = append(findings, rewrites(spec.Rewrites)...)
+	findings = append(findings, paths(spec.Rules)...)
+	return findings
+}
+
+// Errors returns the findings with severity Error.
+func Errors(findings []Finding) []Finding {
+	var errs []Finding
+	for _, f := range findings {
+		if f.Severity == Error {
+			errs = append(errs, f)
+		}
+	}
+	return errs
+}
+
+type aclEntry struct {
+	net    *net.IPNet
+	bits   int
+	negate bool
+	str    string
+}
+
+func aclEntries(addrs []vcl.ACLAddress) []aclEntry {
+	var entries []aclEntry
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr.Addr)
+		if ip == nil {
+			// Host names are resolved when the VCL is loaded.
+			continue
+		}
+		bits, max := int(addr.MaskBits), 128
+		if v4 := ip.To4(); v4 != nil {
+			ip, max = v4, 32
+		}
+		str := addr.Addr
+		if addr.MaskBits == vcl.NoMaskBits || bits > max {
+			bits = max
+		} else {
+			str = fmt.Sprintf("%s/%d", addr.Addr, bits)
+		}
+		if addr.Negate {
+			str = "!" + str
+		}
+		mask := net.CIDRMask(bits, max)
+		entries = append(entries, aclEntry{
+			net:    &net.IPNet{IP: ip.Mask(mask), Mask: mask},
+			bits:   bits,
+			negate: addr.Negate,
+			str:    str,
+		})
+	}
+	return entries
+}
+
+func acls(acls []vcl.ACL) []Finding {
+	var findings []Finding
+	for _, acl := range acls {
+		entries := aclEntries(acl.Addresses)
+	ENTRIES:
+		for i, e := range entries {
+			for j, f := range entries {
+				if i == j || len(e.net.IP) != len(f.net.IP) {
+					continue
+				}
+				if e.bits == f.bits && e.net.IP.Equal(f.net.IP) {
+					if j > i {
+						continue
+					}
+					if e.negate != f.negate {
+						findings = append(findings, Finding{
+							Severity: Error,
+							Kind:     ACL,
+							Name:     acl.Name,
+							Msg: fmt.Sprintf("entries %s and "+
+								"%s conflict", f.str, e.str),
+						})
+					} else {
+						findings = append(findings, Finding{
+							Severity: Warning,
+							Kind:     ACL,
+							Name:     acl.Name,
+							Msg: fmt.Sprintf("entries %s and "+
+								"%s are duplicates", f.str,
+								e.str),
+						})
+					}
+					continue ENTRIES
+				}
+				if f.bits < e.bits && f.negate == e.negate &&
+					f.net.Contains(e.net.IP) {
+
+					findings = append(findings, Finding{
+						Severity: Warning,
+						Kind:     ACL,
+						Name:     acl.Name,
+						Msg: fmt.Sprintf("entry %s is covered "+
+							"by entry %s", e.str, f.str),
+					})
+					continue ENTRIES
+				}
+			}
+		}
+		if why := termsContradict(acl.Conditions); why != "" {
+			findings = append(findings, Finding{
+				Severity: Error,
+				Kind:     ACL,
+				Name:     acl.Name,
+				Msg: fmt.Sprintf("conditions can never hold (%s), "+
+					"so the ACL is never applied", why),
+			})
+		}
+	}
+	return findings
+}
+
+func auths(auths []vcl.Auth) []Finding {
+	var findings []Finding
+	for _, auth := range auths {
+		if why := termsContradict(auth.Conditions); why != "" {
+			findings = append(findings, Finding{
+				Severity: Error,
+				Kind:     Auth,
+				Name:     auth.Realm,
+				Msg: fmt.Sprintf("conditions can never hold (%s), "+
+					"so authentication is never required",
+					why),
+			})
+		}
+	}
+	return findings
+}
+
+func dispositions(disps []vcl.DispositionSpec) []Finding {
+	var findings []Finding
+	sems := make([][]condSem, len(disps))
+	for i, disp := range disps {
+		sems[i] = make([]condSem, len(disp.Conditions))
+		for j, cond := range disp.Conditions {
+			sems[i][j] = reqCondSem(cond)
+		}
+	}
+DISPS:
+	for i := range disps {
+		name := fmt.Sprintf("%d", i)
+		if why := contradiction(sems[i]); why != "" {
+			findings = append(findings, Finding{
+				Severity: Warning,
+				Kind:     Disposition,
+				Name:     name,
+				Msg: fmt.Sprintf("conditions can never hold (%s)",
+					why),
+			})
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if shadows(sems[j], sems[i]) {
+				findings = append(findings, Finding{
+					Severity: Warning,
+					Kind:     Disposition,
+					Name:     name,
+					Msg: fmt.Sprintf("unreachable: every "+
+						"request that meets its conditions "+
+						"meets the conditions of request "+
+						"disposition %d, which is evaluated "+
+						"first", j),
+				})
+				continue DISPS
+			}
+		}
+	}
+	return findings
+}
+
+// shadows returns true if every request that meets the conditions
+// in later also meets the conditions in earlier.
+func shadows(earlier, later []condSem) bool {
+	for _, a := range earlier {
+		implied := false
+		for _, b := range later {
+			if a.impliedBy(b) {
+				implied = true
+				break
+			}
+		}
+		if !implied {
+			return false
+		}
+	}
+	return true
+}
+
+// uniqueCheck returns true if the generated VCL invokes VCL failure
+// when more than one rule of the rewrite matches (cf. the
+// needsUniqueCheck template function).
+func uniqueCheck(rw vcl.Rewrite) bool {
+	if rw.Compare == vcl.Equal || rw.Select != vcl.Unique ||
+		len(rw.Rules) < 2 {
+		return false
+	}
+	switch rw.Method {
+	case vcl.Delete:
+		return false
+	case vcl.Sub, vcl.Suball, vcl.RewriteMethod:
+		return true
+	default:
+		return rw.Rules[0].Value != ""
+	}
+}
+
+func rewrites(rws []vcl.Rewrite) []Finding {
+	var findings []Finding
+	for i, rw := range rws {
+		if !uniqueCheck(rw) {
+			continue
+		}
+		var regexes []*regexp.Regexp
+		if rw.Compare == vcl.Match {
+			regexes = make([]*regexp.Regexp, len(rw.Rules))
+			for j, rule := range rw.Rules {
+				regex, err := explain.Regexp(rule.Value,
+					rw.MatchFlags)
+				if err != nil {
+					findings = append(findings, Finding{
+						Severity: Warning,
+						Kind:     Rewrite,
+						Name:     fmt.Sprintf("%d", i),
+						Msg: fmt.Sprintf("cannot analyze "+
+							"pattern %q: %v", rule.Value,
+							err),
+					})
+					regexes = nil
+					break
+				}
+				regexes[j] = regex
+			}
+			if regexes == nil {
+				continue
+			}
+		}
+		for j := range rw.Rules {
+			for k := j + 1; k < len(rw.Rules); k++ {
+				a, b := rw.Rules[j].Value, rw.Rules[k].Value
+				var witness string
+				var ok bool
+				if regexes == nil {
+					witness, ok = prefixOverlap(a, b,
+						rw.MatchFlags.CaseSensitive)
+				} else {
+					witness, ok = overlap(a, b,
+						rw.MatchFlags, regexes[j],
+						regexes[k])
+				}
+				if !ok {
+					continue
+				}
+				findings = append(findings, Finding{
+					Severity: Warning,
+					Kind:     Rewrite,
+					Name:     fmt.Sprintf("%d", i),
+					Msg: fmt.Sprintf("rules %q and %q both "+
+						"match %q; with select=UNIQUE, VCL "+
+						"failure is invoked for such "+
+						"requests", a, b, witness),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+func prefixOverlap(a, b string, caseSensitive bool) (string, bool) {
+	if !caseSensitive {
+		if strings.HasPrefix(strings.ToLower(b), strings.ToLower(a)) {
+			return b, true
+		}
+		if strings.HasPrefix(strings.ToLower(a), strings.ToLower(b)) {
+			return a, true
+		}
+		return "", false
+	}
+	if strings.HasPrefix(b, a) {
+		return b, true
+	}
+	if strings.HasPrefix(a, b) {
+		return a, true
+	}
+	return "", false
+}
+
+// literal returns the string matched by a path pattern, if the
+// pattern matches a fixed string (with POSIX syntax, as used for
+// Ingress paths).
+func literal(path string) (string, bool) {
+	re, err := syntax.Parse(path, syntax.ClassNL|syntax.OneLine)
+	if err != nil {
+		return "", false
+	}
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return "", false
+		}
+		return string(re.Rune), true
+	case syntax.OpEmptyMatch:
+		return "", true
+	}
+	return "", false
+}
+
+func paths(rules []vcl.Rule) []Finding {
+	var findings []Finding
+	for _, rule := range rules {
+		paths := make([]string, 0, len(rule.PathMap))
+		for path := range rule.PathMap {
+			paths = append(paths, path)
+		}
+		// The order in which the paths are added to the URL
+		// matcher, from which the first match is selected.
+		sort.Strings(paths)
+	PATHS:
+		for i, q := range paths {
+			regex, err := regexp.Compile(q)
+			if err != nil {
+				continue
+			}
+			prefix, _ := regex.LiteralPrefix()
+			for _, p := range paths[:i] {
+				lit, ok := literal(p)
+				if !ok || !strings.HasPrefix(prefix, lit) {
+					continue
+				}
+				findings = append(findings, Finding{
+					Severity: Warning,
+					Kind:     Path,
+					Name:     rule.Host,
+					Msg: fmt.Sprintf("path %s is unreachable: "+
+						"every URL that matches it also "+
+						"matches path %s, which is matched "+
+						"first", q, p),
+				})
+				continue PATHS
+			}
+		}
+	}
+	return findings
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package analyze
+
+import (
+	"strings"
+	"testing"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/explain"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+)
+
+func expectFindings(t *testing.T, findings []Finding, sev Severity,
+	kind string, msgs ...string) {
+
+	t.Helper()
+	if len(findings) != len(msgs) {
+		t.Fatalf("got %d findings, want %d: %v", len(findings),
+			len(msgs), findings)
+	}
+	for i, f := range findings {
+		if f.Severity != sev || f.Kind != kind ||
+			!strings.Contains(f.Msg, msgs[i]) {
+			t.Errorf("finding %d: got %s %v, want %s %s containing "+
+				"%q", i, f.Severity, f, sev, kind, msgs[i])
+		}
+	}
+}
+
+func TestACLs(t *testing.T) {
+	acl := vcl.ACL{
+		Name: "local",
+		Addresses: []vcl.ACLAddress{
+			{Addr: "192.0.2.0", MaskBits: 24},
+			{Addr: "192.0.2.1", MaskBits: vcl.NoMaskBits},
+			{Addr: "198.51.100.0", MaskBits: 24, Negate: true},
+			{Addr: "203.0.113.0", MaskBits: 24},
+			{Addr: "203.0.113.0", MaskBits: 24},
+			{Addr: "::1", MaskBits: vcl.NoMaskBits},
+			{Addr: "localhost", MaskBits: vcl.NoMaskBits},
+		},
+	}
+	expectFindings(t, acls([]vcl.ACL{acl}), Warning, ACL,
+		"entry 192.0.2.1 is covered by entry 192.0.2.0/24",
+		"are duplicates")
+
+	acl.Addresses = append(acl.Addresses,
+		vcl.ACLAddress{Addr: "198.51.100.0", MaskBits: 24})
+	findings := acls([]vcl.ACL{acl})
+	expectFindings(t, Errors(findings), Error, ACL,
+		"entries !198.51.100.0/24 and 198.51.100.0/24 conflict")
+
+	acl.Addresses = nil
+	acl.Conditions = []vcl.MatchTerm{
+		{Comparand: "req.http.Host", Compare: vcl.Equal,
+			Value: "cafe.example.com"},
+		{Comparand: "req.http.Host", Compare: vcl.Equal,
+			Value: "cafe.example.com", Negate: true},
+	}
+	expectFindings(t, acls([]vcl.ACL{acl}), Error, ACL,
+		"so the ACL is never applied")
+
+	acl.Conditions[1].Value = "tea.example.com"
+	acl.Conditions[1].Negate = false
+	expectFindings(t, acls([]vcl.ACL{acl}), Error, ACL,
+		"no value of req.http.Host")
+
+	acl.Conditions[1].Compare = vcl.Match
+	acl.Conditions[1].Value = `^cafe\.`
+	expectFindings(t, acls([]vcl.ACL{acl}), Error, ACL)
+}
+
+func TestAuths(t *testing.T) {
+	auth := vcl.Auth{
+		Realm: "cafe",
+		Conditions: []vcl.MatchTerm{
+			{Comparand: "req.url", Compare: vcl.Match,
+				Value: "^/coffee"},
+			{Comparand: "req.url", Compare: vcl.Equal,
+				Value: "/tea"},
+		},
+	}
+	expectFindings(t, auths([]vcl.Auth{auth}), Error, Auth,
+		"authentication is never required")
+
+	auth.Conditions[1].Value = "/coffee/espresso"
+	expectFindings(t, auths([]vcl.Auth{auth}), Error, Auth)
+}
+
+func TestDispositions(t *testing.T) {
+	two := uint(2)
+	five := uint(5)
+	disps := []vcl.DispositionSpec{
+		{
+			Conditions: []vcl.Condition{{
+				Comparand: "req.url",
+				Compare:   vcl.Prefix,
+				Values:    []string{"/static/"},
+				MatchFlags: vcl.MatchFlagsType{
+					CaseSensitive: true,
+				},
+			}},
+			Disposition: vcl.DispositionType{Action: vcl.RecvHash},
+		},
+		{
+			Conditions: []vcl.Condition{
+				{
+					Comparand: "req.url",
+					Compare:   vcl.Equal,
+					Values:    []string{"/static/logo.png"},
+				},
+				{
+					Comparand: "req.method",
+					Compare:   vcl.Equal,
+					Values:    []string{"GET"},
+				},
+			},
+			Disposition: vcl.DispositionType{Action: vcl.RecvPass},
+		},
+		{
+			Conditions: []vcl.Condition{
+				{
+					Comparand: "req.esi_level",
+					Compare:   vcl.Greater,
+					Count:     &five,
+				},
+				{
+					Comparand: "req.esi_level",
+					Compare:   vcl.Less,
+					Count:     &two,
+				},
+			},
+			Disposition: vcl.DispositionType{Action: vcl.RecvPass},
+		},
+		{
+			Conditions: []vcl.Condition{{
+				Comparand: "req.url",
+				Compare:   vcl.Prefix,
+				Values:    []string{"/api/"},
+				MatchFlags: vcl.MatchFlagsType{
+					CaseSensitive: true,
+				},
+			}},
+			Disposition: vcl.DispositionType{Action: vcl.RecvPass},
+		},
+		{
+			Conditions: []vcl.Condition{{
+				Comparand: "req.url",
+				Compare:   vcl.Prefix,
+				Values:    []string{"/API/v1/"},
+			}},
+			Disposition: vcl.DispositionType{Action: vcl.RecvPipe},
+		},
+	}
+	findings := dispositions(disps)
+	if len(findings) != 2 {
+		t.Fatalf("got %d findings, want 2: %v", len(findings),
+			findings)
+	}
+	if findings[0].Name != "1" ||
+		!strings.Contains(findings[0].Msg, "request disposition 0") {
+		t.Errorf("got %v, want disposition 1 shadowed by 0",
+			findings[0])
+	}
+	if findings[1].Name != "2" ||
+		!strings.Contains(findings[1].Msg, "disjoint ranges") {
+		t.Errorf("got %v, want disposition 2 with disjoint ranges",
+			findings[1])
+	}
+	for _, f := range findings {
+		if f.Severity != Warning {
+			t.Errorf("got severity %s, want %s: %v", f.Severity,
+				Warning, f)
+		}
+	}
+}
+
+func TestRewrites(t *testing.T) {
+	rw := vcl.Rewrite{
+		Target:  "req.url",
+		Source:  "req.url",
+		Method:  vcl.Sub,
+		Compare: vcl.Match,
+		Select:  vcl.Unique,
+		MatchFlags: vcl.MatchFlagsType{
+			Anchor: vcl.Start,
+		},
+		Rules: []vcl.RewriteRule{
+			{Value: "/foo/(.*)", Rewrite: "/bar/\\1"},
+			{Value: "/baz[0-9]+/", Rewrite: "/quux/"},
+			{Value: "/foo/b", Rewrite: "/foob/"},
+		},
+	}
+	findings := rewrites([]vcl.Rewrite{rw})
+	expectFindings(t, findings, Warning, Rewrite,
+		`rules "/foo/(.*)" and "/foo/b" both match`)
+
+	rw.Select = vcl.First
+	if findings = rewrites([]vcl.Rewrite{rw}); len(findings) != 0 {
+		t.Errorf("got findings for select=FIRST: %v", findings)
+	}
+
+	rw.Select = vcl.Unique
+	rw.Rules = []vcl.RewriteRule{
+		{Value: "/foo/", Rewrite: "/bar/"},
+		{Value: "/foo/(", Rewrite: "/baz/"},
+	}
+	expectFindings(t, rewrites([]vcl.Rewrite{rw}), Warning, Rewrite,
+		"cannot analyze pattern")
+
+	rw.Method = vcl.Replace
+	rw.Compare = vcl.Prefix
+	rw.Rules = []vcl.RewriteRule{
+		{Value: "/coffee", Rewrite: "/c"},
+		{Value: "/tea", Rewrite: "/t"},
+		{Value: "/Coffee/espresso", Rewrite: "/e"},
+	}
+	expectFindings(t, rewrites([]vcl.Rewrite{rw}), Warning, Rewrite,
+		`both match "/Coffee/espresso"`)
+
+	rw.MatchFlags.CaseSensitive = true
+	if findings = rewrites([]vcl.Rewrite{rw}); len(findings) != 0 {
+		t.Errorf("got findings for case-sensitive prefixes: %v",
+			findings)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	svc := vcl.Service{Name: "svc"}
+	rules := []vcl.Rule{{
+		Host: "cafe.example.com",
+		PathMap: map[string]vcl.Service{
+			"/tea":       svc,
+			"/tea/green": svc,
+			"/coffee.*":  svc,
+			"/coffees":   svc,
+		},
+	}}
+	expectFindings(t, paths(rules), Warning, Path,
+		"path /tea/green is unreachable")
+
+	rules[0].PathMap["/"] = svc
+	expectFindings(t, paths(rules), Warning, Path,
+		"path /coffee.* is unreachable",
+		"path /coffees is unreachable",
+		"path /tea is unreachable",
+		"path /tea/green is unreachable")
+}
+
+func TestOverlap(t *testing.T) {
+	for _, tc := range []struct {
+		a, b    string
+		flags   vcl.MatchFlagsType
+		overlap bool
+	}{
+		{"^/a", "^/b", vcl.MatchFlagsType{}, false},
+		{"^/a.*", "^/ab$", vcl.MatchFlagsType{}, true},
+		{"(foo|bar)", "baz|bar", vcl.MatchFlagsType{}, true},
+		{"x{2,}", "xx", vcl.MatchFlagsType{}, true},
+		{"a.c", "a.c", vcl.MatchFlagsType{Literal: true}, true},
+		{"a.c", "abc", vcl.MatchFlagsType{Literal: true}, true},
+		{"a.c", "abc", vcl.MatchFlagsType{
+			Literal: true,
+			Anchor:  vcl.Both,
+		}, false},
+		{"foo", "bar", vcl.MatchFlagsType{}, true},
+	} {
+		ra, err := explain.Regexp(tc.a, tc.flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rb, err := explain.Regexp(tc.b, tc.flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		witness, ok := overlap(tc.a, tc.b, tc.flags, ra, rb)
+		if ok != tc.overlap {
+			t.Errorf("overlap(%q, %q): got %v, want %v", tc.a, tc.b,
+				ok, tc.overlap)
+			continue
+		}
+		if ok && (!ra.MatchString(witness) ||
+			!rb.MatchString(witness)) {
+			t.Errorf("overlap(%q, %q): witness %q does not match "+
+				"both", tc.a, tc.b, witness)
+		}
+	}
+}
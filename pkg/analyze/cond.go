@@ -0,0 +1,349 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package analyze
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/explain"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+)
+
+type semKind uint8
+
+const (
+	semEqual semKind = iota
+	semPrefix
+	semRegex
+	semExists
+	semNumeric
+)
+
+// condSem is the meaning of a condition in the generated VCL: the
+// comparand is equal to, has a prefix in, or matches one of the
+// values, is set, or is a number in the interval [lo, hi]; negated
+// if neg is true.
+type condSem struct {
+	comparand string
+	kind      semKind
+	neg       bool
+	values    []string
+	fold      bool
+	flags     vcl.MatchFlagsType
+	regexes   []*regexp.Regexp
+	lo, hi    int64
+}
+
+// numSem returns the interval for a numeric comparison.
+func numSem(cmp vcl.CompareType, n int64) (int64, int64) {
+	switch cmp {
+	case vcl.Greater:
+		return n + 1, math.MaxInt64
+	case vcl.GreaterEqual:
+		return n, math.MaxInt64
+	case vcl.Less:
+		return math.MinInt64, n - 1
+	case vcl.LessEqual:
+		return math.MinInt64, n
+	default:
+		return n, n
+	}
+}
+
+// reqCondSem returns the meaning of a request disposition condition,
+// as generated by the recv_disposition template. Conditions that are
+// not understood get an empty kind, so that they are only identical
+// to themselves.
+func reqCondSem(cond vcl.Condition) condSem {
+	sem := condSem{
+		comparand: cond.Comparand,
+		neg:       cond.Negate,
+		values:    cond.Values,
+	}
+	switch {
+	case cond.Compare == vcl.Exists:
+		sem.kind = semExists
+	case cond.Compare == vcl.Match:
+		sem.kind = semRegex
+		sem.fold = !cond.MatchFlags.CaseSensitive
+		sem.flags = cond.MatchFlags
+		for _, val := range cond.Values {
+			regex, err := explain.Regexp(val, cond.MatchFlags)
+			if err != nil {
+				return condSem{comparand: fmt.Sprintf("%+v", cond)}
+			}
+			sem.regexes = append(sem.regexes, regex)
+		}
+	case cond.Compare == vcl.Prefix:
+		sem.kind = semPrefix
+		sem.fold = !cond.MatchFlags.CaseSensitive
+	case cond.Count != nil:
+		sem.kind = semNumeric
+		sem.values = nil
+		sem.lo, sem.hi = numSem(cond.Compare, int64(*cond.Count))
+		if cond.Compare == vcl.Equal {
+			// The template negates both the operator and the
+			// expression, so negations cancel.
+			sem.neg = false
+		}
+	case cond.Compare == vcl.Equal && len(cond.Values) == 1:
+		// Compared with ==, case-sensitive, and negations cancel
+		// as above.
+		sem.kind = semEqual
+		sem.neg = false
+	case cond.Compare == vcl.Equal:
+		sem.kind = semEqual
+		sem.fold = !cond.MatchFlags.CaseSensitive
+	default:
+		return condSem{comparand: fmt.Sprintf("%+v", cond)}
+	}
+	return sem
+}
+
+// termSem returns the meaning of a condition for an ACL or Auth. Match
+// uses the VCL ~ operator (PCRE), approximated by Go regexps.
+func termSem(term vcl.MatchTerm) condSem {
+	sem := condSem{
+		comparand: term.Comparand,
+		neg:       term.Negate,
+		values:    []string{term.Value},
+	}
+	switch term.Compare {
+	case vcl.Equal:
+		sem.kind = semEqual
+	case vcl.Match:
+		regex, err := regexp.Compile(term.Value)
+		if err != nil {
+			return condSem{comparand: fmt.Sprintf("%+v", term)}
+		}
+		sem.kind = semRegex
+		sem.regexes = []*regexp.Regexp{regex}
+	case vcl.Greater, vcl.GreaterEqual, vcl.Less, vcl.LessEqual:
+		n, err := strconv.ParseInt(term.Value, 10, 64)
+		if err != nil {
+			return condSem{comparand: fmt.Sprintf("%+v", term)}
+		}
+		sem.kind = semNumeric
+		sem.neg = false
+		sem.values = nil
+		sem.lo, sem.hi = numSem(term.Compare, n)
+	default:
+		return condSem{comparand: fmt.Sprintf("%+v", term)}
+	}
+	return sem
+}
+
+func (sem condSem) known() bool {
+	return sem.kind != semEqual || len(sem.values) > 0
+}
+
+func eq(a, b string, fold bool) bool {
+	if fold {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func hasPrefix(s, prefix string, fold bool) bool {
+	return len(s) >= len(prefix) && eq(s[:len(prefix)], prefix, fold)
+}
+
+// accepts returns true if the string s meets the non-negated
+// condition (ignoring neg).
+func (sem condSem) accepts(s string) bool {
+	switch sem.kind {
+	case semEqual:
+		for _, val := range sem.values {
+			if eq(s, val, sem.fold) {
+				return true
+			}
+		}
+	case semPrefix:
+		for _, val := range sem.values {
+			if hasPrefix(s, val, sem.fold) {
+				return true
+			}
+		}
+	case semRegex:
+		for _, regex := range sem.regexes {
+			if regex.MatchString(s) {
+				return true
+			}
+		}
+	case semExists:
+		return true
+	}
+	return false
+}
+
+// identical returns true if the conditions have the same meaning,
+// possibly except for negation.
+func identical(a, b condSem) bool {
+	return a.comparand == b.comparand && a.kind == b.kind &&
+		a.fold == b.fold && a.flags == b.flags && a.lo == b.lo &&
+		a.hi == b.hi &&
+		reflect.DeepEqual(a.values, b.values)
+}
+
+// impliedBy returns true if every request that meets b also meets
+// a. Only negated conditions that are identical are compared.
+func (a condSem) impliedBy(b condSem) bool {
+	if a.comparand != b.comparand || !a.known() || !b.known() {
+		return false
+	}
+	if a.neg || b.neg {
+		return a.neg == b.neg && identical(a, b)
+	}
+	if b.fold && !a.fold && (b.kind == semEqual || b.kind == semPrefix ||
+		b.kind == semRegex) {
+		// b matches case variants of its values.
+		return identical(a, b)
+	}
+	switch a.kind {
+	case semExists:
+		if b.kind == semExists {
+			return true
+		}
+		if b.kind != semEqual && b.kind != semPrefix {
+			return false
+		}
+		for _, val := range b.values {
+			if val == "" {
+				return false
+			}
+		}
+		return true
+	case semEqual, semRegex:
+		if b.kind == semRegex {
+			return identical(a, b)
+		}
+		if b.kind != semEqual {
+			return false
+		}
+		for _, val := range b.values {
+			if !a.accepts(val) {
+				return false
+			}
+		}
+		return true
+	case semPrefix:
+		if b.kind != semEqual && b.kind != semPrefix {
+			return false
+		}
+		for _, val := range b.values {
+			if !a.accepts(val) {
+				return false
+			}
+		}
+		return true
+	case semNumeric:
+		return b.kind == semNumeric && b.lo >= a.lo && b.hi <= a.hi
+	}
+	return false
+}
+
+// disjoint returns a description if no request can meet both a and
+// b, otherwise the empty string.
+func disjoint(a, b condSem) string {
+	if a.comparand != b.comparand || !a.known() || !b.known() {
+		return ""
+	}
+	if a.neg != b.neg && identical(a, b) && a.kind != semNumeric {
+		return fmt.Sprintf("%s is required both to meet and not to "+
+			"meet the same condition", a.comparand)
+	}
+	if b.kind == semEqual && !b.neg {
+		a, b = b, a
+	}
+	if a.kind != semEqual || a.neg {
+		if a.kind == semNumeric && b.kind == semNumeric &&
+			!a.neg && !b.neg && (a.hi < b.lo || b.hi < a.lo) {
+			return fmt.Sprintf("%s is compared with disjoint "+
+				"ranges", a.comparand)
+		}
+		return ""
+	}
+	// a is a non-negated equality; some value must meet b.
+	if b.kind == semNumeric {
+		return ""
+	}
+	if b.kind == semExists {
+		if b.neg {
+			return fmt.Sprintf("%s is required both to be set and "+
+				"to be unset", a.comparand)
+		}
+		return ""
+	}
+	for _, val := range a.values {
+		if a.fold && !b.fold {
+			// Case variants of val are not enumerated, except
+			// for comparison with another equality.
+			if b.kind != semEqual || b.neg {
+				return ""
+			}
+			for _, bval := range b.values {
+				if strings.EqualFold(val, bval) {
+					return ""
+				}
+			}
+			continue
+		}
+		if b.accepts(val) != b.neg {
+			return ""
+		}
+	}
+	return fmt.Sprintf("no value of %s can meet all of its conditions",
+		a.comparand)
+}
+
+// contradiction returns a description if no request can meet all of
+// the conditions, otherwise the empty string.
+func contradiction(sems []condSem) string {
+	for i := range sems {
+		for j := i + 1; j < len(sems); j++ {
+			if why := disjoint(sems[i], sems[j]); why != "" {
+				return why
+			}
+		}
+	}
+	return ""
+}
+
+func termsContradict(terms []vcl.MatchTerm) string {
+	sems := make([]condSem, len(terms))
+	for i, term := range terms {
+		sems[i] = termSem(term)
+	}
+	return contradiction(sems)
+}
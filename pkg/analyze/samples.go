@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package analyze
+
+import (
+	"regexp"
+	"regexp/syntax"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+)
+
+// Maximum number of sample strings generated for a pattern.
+const maxSamples = 64
+
+func product(a, b []string) []string {
+	var prod []string
+	for _, x := range a {
+		for _, y := range b {
+			if len(prod) == maxSamples {
+				return prod
+			}
+			prod = append(prod, x+y)
+		}
+	}
+	return prod
+}
+
+func union(a, b []string) []string {
+	u := append([]string(nil), a...)
+	for _, y := range b {
+		if len(u) == maxSamples {
+			break
+		}
+		u = append(u, y)
+	}
+	return u
+}
+
+// samples returns strings matched by the parsed regular expression,
+// at most maxSamples of them: each alternative, and zero or one
+// repetitions, are tried in turn.
+func samples(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return nil
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return nil
+		}
+		s := []string{string(re.Rune[0])}
+		if len(re.Rune) > 2 {
+			s = append(s, string(re.Rune[len(re.Rune)-2]))
+		}
+		return s
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return []string{"a"}
+	case syntax.OpCapture, syntax.OpPlus:
+		return samples(re.Sub[0])
+	case syntax.OpStar, syntax.OpQuest:
+		return union([]string{""}, samples(re.Sub[0]))
+	case syntax.OpRepeat:
+		sub := samples(re.Sub[0])
+		s := []string{""}
+		for i := 0; i < re.Min; i++ {
+			s = product(s, sub)
+		}
+		if re.Min == 0 {
+			s = union(s, sub)
+		}
+		return s
+	case syntax.OpConcat:
+		s := []string{""}
+		for _, sub := range re.Sub {
+			s = product(s, samples(sub))
+		}
+		return s
+	case syntax.OpAlternate:
+		var s []string
+		for _, sub := range re.Sub {
+			s = union(s, samples(sub))
+		}
+		return s
+	default:
+		// Empty matches and assertions
+		return []string{""}
+	}
+}
+
+func patternSamples(pattern string, flags vcl.MatchFlagsType) []string {
+	if flags.Literal {
+		return []string{pattern}
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	return samples(re.Simplify())
+}
+
+// overlap searches for a string that is matched by both of the
+// patterns a and b, compiled as regexA and regexB. Sample strings for
+// each pattern, and their concatenations, are tried.
+func overlap(a, b string, flags vcl.MatchFlagsType, regexA,
+	regexB *regexp.Regexp) (string, bool) {
+
+	sa, sb := patternSamples(a, flags), patternSamples(b, flags)
+	candidates := union(sa, sb)
+	candidates = append(candidates, product(sa, sb)...)
+	candidates = append(candidates, product(sb, sa)...)
+	for _, s := range candidates {
+		if regexA.MatchString(s) && regexB.MatchString(s) {
+			return s, true
+		}
+	}
+	return "", false
+}
@@ -67,6 +67,8 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 		&VarnishConfigList{},
 		&BackendConfig{},
 		&BackendConfigList{},
+		&ClusterVarnishConfig{},
+		&ClusterVarnishConfigList{},
 	)
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
 	return nil
@@ -47,15 +47,20 @@ type VarnishConfig struct {
 }
 
 // VarnishConfigSpec corresponds to the spec section of a
-// VarnishConfig Custom Resource.
+// VarnishConfig Custom Resource. If more than one VarnishConfig
+// applies to a Varnish Service, they are merged in ascending order
+// of Priority, and then by name.
 type VarnishConfigSpec struct {
 	Services        []string          `json:"services,omitempty"`
+	Priority        int32             `json:"priority,omitempty"`
 	SelfSharding    *SelfShardSpec    `json:"self-sharding,omitempty"`
 	VCL             string            `json:"vcl,omitempty"`
 	Auth            []AuthSpec        `json:"auth,omitempty"`
 	ACLs            []ACLSpec         `json:"acl,omitempty"`
 	Rewrites        []RewriteSpec     `json:"rewrites,omitempty"`
 	ReqDispositions []RequestDispSpec `json:"req-disposition,omitempty"`
+	Snippets        []SnippetSpec     `json:"snippets,omitempty"`
+	Templates       *TemplatesSpec    `json:"templates,omitempty"`
 }
 
 // SelfShardSpec specifies self-sharding in a Varnish cluster.
@@ -293,8 +298,49 @@ const (
 	BackendResponse = "backend_response"
 	// BackendError for vcl_backend_error
 	BackendError = "backend_error"
+	// Init for vcl_init (only for VCL snippets)
+	Init = "init"
+	// Fini for vcl_fini (only for VCL snippets)
+	Fini = "fini"
 )
 
+// SnippetPosition classifies the position of a VCL snippet, relative
+// to the code generated by the controller for the same subroutine.
+type SnippetPosition string
+
+const (
+	// After means that the snippet is executed after the
+	// generated code (default).
+	After SnippetPosition = "after"
+	// Before means that the snippet is executed before the
+	// generated code.
+	Before = "before"
+)
+
+// TemplatesSpec names a ConfigMap in the same namespace whose keys
+// with the suffix ".tmpl" are Go templates for VCL generation. A key
+// with the name of one of the controller's templates, such as
+// vcl.tmpl, replaces that template; other templates are executed in
+// addition to the controller's templates, in the order of their
+// names.
+type TemplatesSpec struct {
+	ConfigMapName string `json:"configMapName"`
+}
+
+// SnippetSpec specifies custom VCL code for a subroutine. The code
+// is either given inline in VCL, or in the Key of the ConfigMap
+// ConfigMapName in the same namespace. Snippets in the same Position
+// are included in ascending order of Priority, and then by Name.
+type SnippetSpec struct {
+	Name          string          `json:"name"`
+	Sub           VCLSubType      `json:"sub"`
+	Position      SnippetPosition `json:"position,omitempty"`
+	Priority      int32           `json:"priority,omitempty"`
+	VCL           string          `json:"vcl,omitempty"`
+	ConfigMapName string          `json:"configMapName,omitempty"`
+	Key           string          `json:"key,omitempty"`
+}
+
 // SelectType classifies the determination of the rewrite rule to
 // apply if more than one of them in the Rules array compares
 // successfully. This is only possible when the Method specifies a
@@ -472,3 +518,40 @@ type BackendConfigList struct {
 
 	Items []BackendConfig `json:"items"`
 }
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClusterVarnishConfig is the client API for the cluster-scoped
+// ClusterVarnishConfig Custom Resource, which specifies configuration
+// for all of the Varnish Services selected by labels, across
+// namespaces. It is merged ahead of the VarnishConfigs for a Service.
+type ClusterVarnishConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ClusterVarnishConfigSpec `json:"spec"`
+}
+
+// ClusterVarnishConfigSpec corresponds to the spec section of a
+// ClusterVarnishConfig Custom Resource. Selector selects the Varnish
+// Services to which the config applies by their labels; the other
+// fields are as in VarnishConfigSpec, except that Services is not
+// used. Secrets and ConfigMaps named in the config are retrieved
+// from the namespace of the Varnish Service.
+type ClusterVarnishConfigSpec struct {
+	Selector          metav1.LabelSelector `json:"selector"`
+	VarnishConfigSpec `json:",inline"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClusterVarnishConfigList is a list of ClusterVarnishConfig Custom
+// Resources.
+type ClusterVarnishConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []ClusterVarnishConfig `json:"items"`
+}
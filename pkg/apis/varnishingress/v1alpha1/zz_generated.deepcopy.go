@@ -215,6 +215,84 @@ func (in *BackendConfigSpec) DeepCopy() *BackendConfigSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterVarnishConfig) DeepCopyInto(out *ClusterVarnishConfig) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterVarnishConfig.
+func (in *ClusterVarnishConfig) DeepCopy() *ClusterVarnishConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterVarnishConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterVarnishConfig) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterVarnishConfigList) DeepCopyInto(out *ClusterVarnishConfigList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterVarnishConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterVarnishConfigList.
+func (in *ClusterVarnishConfigList) DeepCopy() *ClusterVarnishConfigList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterVarnishConfigList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterVarnishConfigList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterVarnishConfigSpec) DeepCopyInto(out *ClusterVarnishConfigSpec) {
+	*out = *in
+	in.Selector.DeepCopyInto(&out.Selector)
+	in.VarnishConfigSpec.DeepCopyInto(&out.VarnishConfigSpec)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterVarnishConfigSpec.
+func (in *ClusterVarnishConfigSpec) DeepCopy() *ClusterVarnishConfigSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterVarnishConfigSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Condition) DeepCopyInto(out *Condition) {
 	*out = *in
@@ -470,6 +548,38 @@ func (in *SelfShardSpec) DeepCopy() *SelfShardSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnippetSpec) DeepCopyInto(out *SnippetSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnippetSpec.
+func (in *SnippetSpec) DeepCopy() *SnippetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SnippetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TemplatesSpec) DeepCopyInto(out *TemplatesSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TemplatesSpec.
+func (in *TemplatesSpec) DeepCopy() *TemplatesSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TemplatesSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VarnishConfig) DeepCopyInto(out *VarnishConfig) {
 	*out = *in
@@ -571,6 +681,16 @@ func (in *VarnishConfigSpec) DeepCopyInto(out *VarnishConfigSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Snippets != nil {
+		in, out := &in.Snippets, &out.Snippets
+		*out = make([]SnippetSpec, len(*in))
+		copy(*out, *in)
+	}
+	if in.Templates != nil {
+		in, out := &in.Templates, &out.Templates
+		*out = new(TemplatesSpec)
+		**out = **in
+	}
 	return
 }
 
@@ -42,6 +42,10 @@ func (c *FakeIngressV1alpha1) BackendConfigs(namespace string) v1alpha1.BackendC
 	return &FakeBackendConfigs{c, namespace}
 }
 
+func (c *FakeIngressV1alpha1) ClusterVarnishConfigs() v1alpha1.ClusterVarnishConfigInterface {
+	return &FakeClusterVarnishConfigs{c}
+}
+
 func (c *FakeIngressV1alpha1) VarnishConfigs(namespace string) v1alpha1.VarnishConfigInterface {
 	return &FakeVarnishConfigs{c, namespace}
 }
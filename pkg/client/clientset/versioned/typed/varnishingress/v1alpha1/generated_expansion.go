@@ -30,4 +30,6 @@ package v1alpha1
 
 type BackendConfigExpansion interface{}
 
+type ClusterVarnishConfigExpansion interface{}
+
 type VarnishConfigExpansion interface{}
@@ -37,6 +37,7 @@ import (
 type IngressV1alpha1Interface interface {
 	RESTClient() rest.Interface
 	BackendConfigsGetter
+	ClusterVarnishConfigsGetter
 	VarnishConfigsGetter
 }
 
@@ -49,6 +50,10 @@ func (c *IngressV1alpha1Client) BackendConfigs(namespace string) BackendConfigIn
 	return newBackendConfigs(c, namespace)
 }
 
+func (c *IngressV1alpha1Client) ClusterVarnishConfigs() ClusterVarnishConfigInterface {
+	return newClusterVarnishConfigs(c)
+}
+
 func (c *IngressV1alpha1Client) VarnishConfigs(namespace string) VarnishConfigInterface {
 	return newVarnishConfigs(c, namespace)
 }
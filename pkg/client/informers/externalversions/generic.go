@@ -65,6 +65,8 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 	// Group=ingress.varnish-cache.org, Version=v1alpha1
 	case v1alpha1.SchemeGroupVersion.WithResource("backendconfigs"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Ingress().V1alpha1().BackendConfigs().Informer()}, nil
+	case v1alpha1.SchemeGroupVersion.WithResource("clustervarnishconfigs"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Ingress().V1alpha1().ClusterVarnishConfigs().Informer()}, nil
 	case v1alpha1.SchemeGroupVersion.WithResource("varnishconfigs"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Ingress().V1alpha1().VarnishConfigs().Informer()}, nil
 
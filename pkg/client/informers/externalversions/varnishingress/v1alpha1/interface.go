@@ -36,6 +36,8 @@ import (
 type Interface interface {
 	// BackendConfigs returns a BackendConfigInformer.
 	BackendConfigs() BackendConfigInformer
+	// ClusterVarnishConfigs returns a ClusterVarnishConfigInformer.
+	ClusterVarnishConfigs() ClusterVarnishConfigInformer
 	// VarnishConfigs returns a VarnishConfigInformer.
 	VarnishConfigs() VarnishConfigInformer
 }
@@ -56,6 +58,11 @@ func (v *version) BackendConfigs() BackendConfigInformer {
 	return &backendConfigInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
 
+// ClusterVarnishConfigs returns a ClusterVarnishConfigInformer.
+func (v *version) ClusterVarnishConfigs() ClusterVarnishConfigInformer {
+	return &clusterVarnishConfigInformer{factory: v.factory, tweakListOptions: v.tweakListOptions}
+}
+
 // VarnishConfigs returns a VarnishConfigInformer.
 func (v *version) VarnishConfigs() VarnishConfigInformer {
 	return &varnishConfigInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
@@ -36,6 +36,10 @@ type BackendConfigListerExpansion interface{}
 // BackendConfigNamespaceLister.
 type BackendConfigNamespaceListerExpansion interface{}
 
+// ClusterVarnishConfigListerExpansion allows custom methods to be added to
+// ClusterVarnishConfigLister.
+type ClusterVarnishConfigListerExpansion interface{}
+
 // VarnishConfigListerExpansion allows custom methods to be added to
 // VarnishConfigLister.
 type VarnishConfigListerExpansion interface{}
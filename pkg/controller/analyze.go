@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+// Static analysis of the VCL spec for a Varnish Service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/analyze"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	api_v1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	configWarning = "ConfigWarning"
+	configError   = "ConfigError"
+)
+
+// findingField returns the path of the field in the merged spec to
+// which the finding f for a VarnishConfig refers, in the form used
+// for VcfgMeta.Fields.
+func findingField(spec vcl.Spec, f analyze.Finding) string {
+	switch f.Kind {
+	case analyze.ACL:
+		for i, acl := range spec.ACLs {
+			if acl.Name == f.Name {
+				return fmt.Sprintf(aclField, i)
+			}
+		}
+	case analyze.Auth:
+		return fmt.Sprintf(authField, f.Name)
+	case analyze.Disposition:
+		if i, err := strconv.Atoi(f.Name); err == nil {
+			return fmt.Sprintf(reqDispField, i)
+		}
+	case analyze.Rewrite:
+		if i, err := strconv.Atoi(f.Name); err == nil {
+			return fmt.Sprintf(rewriteField, i)
+		}
+	}
+	return ""
+}
+
+// analyzeSpec runs the static analysis on the VCL spec generated
+// for the Ingresses in ings, and the VarnishConfigs in vcfgMeta.
+// Findings are logged, and reported as Warning Events for the
+// Ingress or VarnishConfig to which they refer. Returns an error if
+// there are findings with severity Error, so that the config is not
+// loaded.
+func (worker *NamespaceWorker) analyzeSpec(spec vcl.Spec,
+	ings []*extensions.Ingress, vcfgMeta varnish.VcfgMeta) error {
+
+	findings := analyze.Spec(spec)
+	if len(findings) == 0 {
+		return nil
+	}
+
+	vcfgs := make(map[string]runtime.Object)
+	if worker.recorder != nil {
+		for _, meta := range vcfgMeta.Configs {
+			if v, err := worker.vcfgObj(meta.Key); err == nil {
+				vcfgs[meta.Key] = v
+			}
+		}
+	}
+	for _, f := range findings {
+		reason := configWarning
+		if f.Severity == analyze.Error {
+			reason = configError
+		}
+		worker.log.Warnf("Config analysis: %s: %s", f.Severity, f)
+		if worker.recorder == nil {
+			continue
+		}
+		if f.Kind != analyze.Path {
+			src, ok := vcfgMeta.Src(findingField(spec, f))
+			if !ok {
+				continue
+			}
+			vcfg, ok := vcfgs[src.Key]
+			if !ok {
+				continue
+			}
+			if len(vcfgMeta.Configs) > 1 {
+				worker.recorder.Eventf(vcfg,
+					api_v1.EventTypeWarning, reason,
+					"%s (%s)", f, src.Field)
+			} else {
+				worker.recorder.Eventf(vcfg,
+					api_v1.EventTypeWarning, reason, "%s",
+					f)
+			}
+			continue
+		}
+		for _, ing := range ings {
+			for _, rule := range ing.Spec.Rules {
+				if rule.Host == f.Name {
+					worker.recorder.Eventf(ing,
+						api_v1.EventTypeWarning,
+						reason, "%s", f)
+					break
+				}
+			}
+		}
+	}
+
+	errs := analyze.Errors(findings)
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, f := range errs {
+		msgs[i] = f.String()
+	}
+	return fmt.Errorf("Config analysis found errors: %s",
+		strings.Join(msgs, "; "))
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	api_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ClusterVarnishConfigs are cluster-scoped, so they are synced by the
+// worker for the empty namespace, whose listers read from all
+// namespaces. The Varnish Services that they select are added to the
+// main queue, so that they are synced by the workers for their
+// namespaces, which in turn requeue the Ingresses for the Services.
+//
+// ClusterVarnishConfigs are only watched if they are enabled by
+// IngressController.EnableClusterVarnishConfigs; otherwise
+// listers.cvcfg is nil. The Secrets and ConfigMaps named in them are
+// read from the namespace configured there, not from the namespaces
+// of the Varnish Services, so that tenants cannot change the policy
+// that the configs enforce.
+
+// Don't return error (requeuing the ClusterVarnishConfig) if no
+// Varnish Services are selected -- they will sync as needed when and
+// if they are discovered.
+func (worker *NamespaceWorker) enqueueSvcsForCvcfg(
+	cvcfg *vcr_v1alpha1.ClusterVarnishConfig) error {
+
+	selector, err := meta_v1.LabelSelectorAsSelector(&cvcfg.Spec.Selector)
+	if err != nil {
+		return fmt.Errorf("ClusterVarnishConfig %s: invalid selector: "+
+			"%v", cvcfg.Name, err)
+	}
+	svcs, err := worker.listers.svc.List(selector)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, svc := range svcs {
+		if !worker.isVarnishIngSvc(svc) {
+			continue
+		}
+		worker.log.Infof("ClusterVarnishConfig %s: enqueuing Varnish "+
+			"Service %s/%s for update", cvcfg.Name, svc.Namespace,
+			svc.Name)
+		worker.mainQueue.Add(&SyncObj{Type: Update, Obj: svc})
+		n++
+	}
+	if n == 0 {
+		worker.log.Infof("ClusterVarnishConfig %s: no Varnish Services "+
+			"selected", cvcfg.Name)
+	}
+	return nil
+}
+
+func (worker *NamespaceWorker) syncCvcfg(key string) error {
+	worker.log.Infof("Syncing ClusterVarnishConfig: %s", key)
+	cvcfg, err := worker.listers.cvcfg.Get(key)
+	if err != nil {
+		return err
+	}
+	worker.log.Tracef("ClusterVarnishConfig %s: %+v", cvcfg.Name, cvcfg)
+
+	// Templates, and the Secrets and ConfigMaps named in the config,
+	// are validated when the config is merged for a Varnish Service.
+	spec := &cvcfg.Spec.VarnishConfigSpec
+	if spec.SelfSharding != nil {
+		if err = validateProbe(&spec.SelfSharding.Probe); err != nil {
+			return fmt.Errorf("ClusterVarnishConfig %s invalid "+
+				"sharding spec: %v", cvcfg.Name, err)
+		}
+	}
+	if err = validateRewrites(spec.Rewrites); err != nil {
+		return err
+	}
+	if err = validateReqDisps(spec.ReqDispositions); err != nil {
+		return err
+	}
+	if err = validateSnippets(spec.Snippets); err != nil {
+		return err
+	}
+
+	return worker.enqueueSvcsForCvcfg(cvcfg)
+}
+
+func (worker *NamespaceWorker) addCvcfg(key string) error {
+	return worker.syncCvcfg(key)
+}
+
+func (worker *NamespaceWorker) updateCvcfg(key string) error {
+	return worker.syncCvcfg(key)
+}
+
+func (worker *NamespaceWorker) deleteCvcfg(obj interface{}) error {
+	cvcfg, ok := obj.(*vcr_v1alpha1.ClusterVarnishConfig)
+	if !ok || cvcfg == nil {
+		worker.log.Warnf("Delete ClusterVarnishConfig: not found: %v",
+			obj)
+		return nil
+	}
+	worker.log.Infof("Deleting ClusterVarnishConfig: %s", cvcfg.Name)
+	return worker.enqueueSvcsForCvcfg(cvcfg)
+}
+
+// requeueCvcfgs adds the ClusterVarnishConfigs that name the Secret
+// or ConfigMap obj to the main queue, after it was changed in the
+// namespace for ClusterVarnishConfigs.
+func (ingc *IngressController) requeueCvcfgs(obj interface{}) {
+	if deleted, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = deleted.Obj
+	}
+	var refers func(*vcr_v1alpha1.VarnishConfigSpec) bool
+	var what string
+	switch o := obj.(type) {
+	case *api_v1.Secret:
+		refers = refersSecret(o.Name)
+		what = "Secret " + o.Namespace + "/" + o.Name
+	case *api_v1.ConfigMap:
+		refers = refersCfgMap(o.Name)
+		what = "ConfigMap " + o.Namespace + "/" + o.Name
+	default:
+		return
+	}
+	cvcfgs, err := ingc.listers.cvcfg.List(labels.Everything())
+	if err != nil {
+		ingc.log.Errorf("Cannot list ClusterVarnishConfigs: %v", err)
+		return
+	}
+	for _, cvcfg := range cvcfgs {
+		if !refers(&cvcfg.Spec.VarnishConfigSpec) {
+			continue
+		}
+		ingc.log.Infof("Requeuing ClusterVarnishConfig %s after "+
+			"update for %s", cvcfg.Name, what)
+		ingc.enqueue(&SyncObj{Type: Update, Obj: cvcfg})
+	}
+}
+
+// refersSecret returns a function that determines if a VarnishConfig
+// spec names the Secret secrName.
+func refersSecret(
+	secrName string) func(*vcr_v1alpha1.VarnishConfigSpec) bool {
+
+	return func(spec *vcr_v1alpha1.VarnishConfigSpec) bool {
+		for _, auth := range spec.Auth {
+			if auth.SecretName == secrName {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// refersCfgMap returns a function that determines if a VarnishConfig
+// spec names the ConfigMap cmName, for templates or snippets.
+func refersCfgMap(
+	cmName string) func(*vcr_v1alpha1.VarnishConfigSpec) bool {
+
+	return func(spec *vcr_v1alpha1.VarnishConfigSpec) bool {
+		if spec.Templates != nil &&
+			spec.Templates.ConfigMapName == cmName {
+			return true
+		}
+		for _, snip := range spec.Snippets {
+			if snip.ConfigMapName == cmName {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// svcCvcfgs returns the ClusterVarnishConfigs whose selectors match
+// the labels of the Varnish Service svc, in the order in which they
+// are merged.
+func (worker *NamespaceWorker) svcCvcfgs(svc *api_v1.Service) (
+	[]*vcr_v1alpha1.ClusterVarnishConfig, error) {
+
+	var svcCvcfgs []*vcr_v1alpha1.ClusterVarnishConfig
+	if worker.listers.cvcfg == nil {
+		return nil, nil
+	}
+	cvcfgs, err := worker.listers.cvcfg.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cvcfgs {
+		selector, err := meta_v1.LabelSelectorAsSelector(
+			&c.Spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("ClusterVarnishConfig %s: "+
+				"invalid selector: %v", c.Name, err)
+		}
+		if selector.Matches(labels.Set(svc.Labels)) {
+			svcCvcfgs = append(svcCvcfgs, c)
+		}
+	}
+	sort.Sort(byClusterPrecedence(svcCvcfgs))
+	return svcCvcfgs, nil
+}
+
+// cvcfgSpec generates the part of the VCL spec that is configured by
+// the ClusterVarnishConfig cvcfg for the Varnish Service svc. Secrets
+// and ConfigMaps named in the config are retrieved from the
+// namespace for ClusterVarnishConfigs.
+func (worker *NamespaceWorker) cvcfgSpec(
+	cvcfg *vcr_v1alpha1.ClusterVarnishConfig,
+	svc *api_v1.Service) (vcl.Spec, error) {
+
+	svcWorker := *worker.nsWorker(svc.Namespace)
+	svcWorker.secr = worker.listers.csecr
+	svcWorker.cmap = worker.listers.ccmap
+	part, err := svcWorker.vcfgSpec(clusterVcfg(cvcfg), svc)
+	if err != nil {
+		return part, err
+	}
+	if len(part.Templates) == 0 {
+		return part, nil
+	}
+	if err = vcl.ValidateTemplates(part.Templates); err != nil {
+		return part, fmt.Errorf("ClusterVarnishConfig %s invalid "+
+			"templates: %v", cvcfg.Name, err)
+	}
+	return part, nil
+}
+
+// vcfgObj returns the VarnishConfig or ClusterVarnishConfig
+// identified by key, in the form used for VcfgMeta, for Events that
+// refer to it.
+func (worker *NamespaceWorker) vcfgObj(key string) (runtime.Object, error) {
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if ns == "" {
+		if worker.listers.cvcfg == nil {
+			return nil, fmt.Errorf("ClusterVarnishConfig %s not "+
+				"found", name)
+		}
+		return worker.listers.cvcfg.Get(name)
+	}
+	return worker.listers.vcfg.VarnishConfigs(ns).Get(name)
+}
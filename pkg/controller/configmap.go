@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2018 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
+	api_v1 "k8s.io/api/core/v1"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Suffix of the keys in a ConfigMap named in VarnishConfig
+// spec.templates that contain VCL templates.
+const tmplSuffix = ".tmpl"
+
+// vcfgTemplates returns the VCL templates from the ConfigMap named
+// in the templates spec of vcfg, indexed by template name; nil if
+// vcfg does not specify templates.
+func (worker *NamespaceWorker) vcfgTemplates(
+	vcfg *vcr_v1alpha1.VarnishConfig) (map[string]string, error) {
+
+	if vcfg.Spec.Templates == nil {
+		return nil, nil
+	}
+	cmName := vcfg.Spec.Templates.ConfigMapName
+	cm, err := worker.cmap.Get(cmName)
+	if err != nil {
+		return nil, fmt.Errorf("VarnishConfig %s/%s: cannot get "+
+			"ConfigMap %s for templates: %v", vcfg.Namespace,
+			vcfg.Name, cmName, err)
+	}
+	tmpls := make(map[string]string)
+	for key, src := range cm.Data {
+		if !strings.HasSuffix(key, tmplSuffix) {
+			worker.log.Debugf("ConfigMap %s/%s: ignoring key %s "+
+				"for templates", cm.Namespace, cm.Name, key)
+			continue
+		}
+		tmpls[key] = src
+	}
+	if len(tmpls) == 0 {
+		worker.log.Warnf("VarnishConfig %s/%s: ConfigMap %s/%s has "+
+			"no keys with suffix %s for templates", vcfg.Namespace,
+			vcfg.Name, cm.Namespace, cm.Name, tmplSuffix)
+		return nil, nil
+	}
+	return tmpls, nil
+}
+
+// ConfigMaps are only relevant to the controller if they contain VCL
+// snippets or templates referenced by a VarnishConfig. Since most
+// ConfigMaps in a cluster are not, the absence of a reference is
+// logged at debug level.
+func (worker *NamespaceWorker) updateVcfgsForCfgMap(cmName string) error {
+	var vcfgs []*vcr_v1alpha1.VarnishConfig
+	vs, err := worker.vcfg.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, v := range vs {
+		if v.Spec.Templates != nil &&
+			v.Spec.Templates.ConfigMapName == cmName {
+			vcfgs = append(vcfgs, v)
+			continue
+		}
+		for _, snip := range v.Spec.Snippets {
+			if snip.ConfigMapName == cmName {
+				vcfgs = append(vcfgs, v)
+				break
+			}
+		}
+	}
+	if len(vcfgs) == 0 {
+		worker.log.Debugf("No VarnishConfigs found for ConfigMap: "+
+			"%s/%s", worker.namespace, cmName)
+		syncCounters.WithLabelValues(worker.namespace, "ConfigMap",
+			"Ignore").Inc()
+		return nil
+	}
+	for _, vcfg := range vcfgs {
+		worker.log.Infof("Requeuing VarnishConfig %s/%s "+
+			"after update for ConfigMap %s/%s",
+			vcfg.Namespace, vcfg.Name, worker.namespace, cmName)
+		worker.queue.Add(&SyncObj{Type: Update, Obj: vcfg})
+	}
+	return nil
+}
+
+func (worker *NamespaceWorker) syncCfgMap(key string) error {
+	worker.log.Debugf("Syncing ConfigMap: %s/%s", worker.namespace, key)
+	return worker.updateVcfgsForCfgMap(key)
+}
+
+func (worker *NamespaceWorker) addCfgMap(key string) error {
+	return worker.syncCfgMap(key)
+}
+
+func (worker *NamespaceWorker) updateCfgMap(key string) error {
+	return worker.syncCfgMap(key)
+}
+
+func (worker *NamespaceWorker) deleteCfgMap(obj interface{}) error {
+	cm, ok := obj.(*api_v1.ConfigMap)
+	if !ok || cm == nil {
+		worker.log.Warnf("Delete ConfigMap: not found: %v", obj)
+		return nil
+	}
+	worker.log.Debugf("Deleting ConfigMap: %s/%s", cm.Namespace, cm.Name)
+	return worker.updateVcfgsForCfgMap(cm.Name)
+}
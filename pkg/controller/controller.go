@@ -30,10 +30,11 @@ package controller
 
 import (
 	"fmt"
-	"os"
+	"sync/atomic"
 	"time"
 
 	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
+	vcr_clientset "code.uplex.de/uplex-varnish/k8s-ingress/pkg/client/clientset/versioned"
 	vcr_informers "code.uplex.de/uplex-varnish/k8s-ingress/pkg/client/informers/externalversions"
 	vcr_listers "code.uplex.de/uplex-varnish/k8s-ingress/pkg/client/listers/varnishingress/v1alpha1"
 	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
@@ -41,9 +42,9 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -62,6 +63,7 @@ type infrmrs struct {
 	svc  cache.SharedIndexInformer
 	endp cache.SharedIndexInformer
 	secr cache.SharedIndexInformer
+	cmap cache.SharedIndexInformer
 	vcfg cache.SharedIndexInformer
 	bcfg cache.SharedIndexInformer
 }
@@ -91,25 +93,49 @@ type SyncObj struct {
 // IngressController, and handed off to NamespaceWorker workers to
 // read data from the client-go cache.
 type Listers struct {
-	ing  ext_listers.IngressLister
-	svc  core_v1_listers.ServiceLister
-	endp core_v1_listers.EndpointsLister
-	secr core_v1_listers.SecretLister
-	vcfg vcr_listers.VarnishConfigLister
-	bcfg vcr_listers.BackendConfigLister
+	ing   ext_listers.IngressLister
+	svc   core_v1_listers.ServiceLister
+	endp  core_v1_listers.EndpointsLister
+	secr  core_v1_listers.SecretLister
+	cmap  core_v1_listers.ConfigMapLister
+	vcfg  vcr_listers.VarnishConfigLister
+	bcfg  vcr_listers.BackendConfigLister
+	cvcfg vcr_listers.ClusterVarnishConfigLister
+	// Secrets and ConfigMaps named in ClusterVarnishConfigs, in the
+	// namespace set by EnableClusterVarnishConfigs.
+	csecr core_v1_listers.SecretNamespaceLister
+	ccmap core_v1_listers.ConfigMapNamespaceLister
 }
 
 // IngressController watches Kubernetes API and reconfigures Varnish
 // via varnish.Controller when needed.
 type IngressController struct {
-	log         *logrus.Logger
+	log         *logrus.Entry
 	client      kubernetes.Interface
 	vController *varnish.Controller
 	informers   *infrmrs
+	cvcfg       cache.SharedIndexInformer
+	cvcfgRefs   []cache.SharedIndexInformer
+	nsWatch     *nsWatcher
 	listers     *Listers
 	nsQs        *NamespaceQueues
 	stopCh      chan struct{}
-	recorder    record.EventRecorder
+	recorder    *verbosityRecorder
+	election    *LeaderElection
+	electDone   chan struct{}
+	leading     int32
+	synced      int32
+	liveTimeout int64
+}
+
+// Namespaces restricts the namespaces watched by the controller to
+// the namespaces in Names, and to the namespaces whose labels match
+// Selector, if it is not nil. Informers for namespaces that match
+// Selector are started and stopped as namespaces are created,
+// deleted or labeled.
+type Namespaces struct {
+	Names    []string
+	Selector labels.Selector
 }
 
 // NewIngressController creates a controller.
@@ -130,62 +156,35 @@ func NewIngressController(
 	vcrInfFactory vcr_informers.SharedInformerFactory,
 ) (*IngressController, error) {
 
-	ingc := IngressController{
-		log:         log,
-		client:      kubeClient,
-		stopCh:      make(chan struct{}),
-		vController: vc,
-	}
-
-	InitMetrics()
-
-	eventBroadcaster := record.NewBroadcaster()
-	eventBroadcaster.StartLogging(ingc.log.Printf)
-	eventBroadcaster.StartRecordingToSink(&core_v1.EventSinkImpl{
-		Interface: ingc.client.CoreV1().Events(""),
-	})
-	evtScheme := runtime.NewScheme()
-	if err := api_v1.AddToScheme(evtScheme); err != nil {
+	ingc, err := newIngressController(log, kubeClient, vc)
+	if err != nil {
 		return nil, err
 	}
-	if err := extensions.AddToScheme(evtScheme); err != nil {
-		return nil, err
-	}
-	if err := vcr_v1alpha1.AddToScheme(evtScheme); err != nil {
-		return nil, err
-	}
-	ingc.recorder = eventBroadcaster.NewRecorder(evtScheme,
-		api_v1.EventSource{Component: "varnish-ingress-controller"})
 
+	// All Secrets and ConfigMaps in the watched namespaces are
+	// cached, since any of them may be named in a VarnishConfig.
 	ingc.informers = &infrmrs{
 		ing:  infFactory.Extensions().V1beta1().Ingresses().Informer(),
 		svc:  infFactory.Core().V1().Services().Informer(),
 		endp: infFactory.Core().V1().Endpoints().Informer(),
 		secr: infFactory.Core().V1().Secrets().Informer(),
+		cmap: infFactory.Core().V1().ConfigMaps().Informer(),
 		vcfg: vcrInfFactory.Ingress().V1alpha1().VarnishConfigs().
 			Informer(),
 		bcfg: vcrInfFactory.Ingress().V1alpha1().BackendConfigs().
 			Informer(),
 	}
 
-	evtFuncs := cache.ResourceEventHandlerFuncs{
-		AddFunc:    ingc.addObj,
-		DeleteFunc: ingc.deleteObj,
-		UpdateFunc: ingc.updateObj,
+	for _, informer := range ingc.informers.all() {
+		informer.AddEventHandler(ingc.evtFuncs())
 	}
 
-	ingc.informers.ing.AddEventHandler(evtFuncs)
-	ingc.informers.svc.AddEventHandler(evtFuncs)
-	ingc.informers.endp.AddEventHandler(evtFuncs)
-	ingc.informers.secr.AddEventHandler(evtFuncs)
-	ingc.informers.vcfg.AddEventHandler(evtFuncs)
-	ingc.informers.bcfg.AddEventHandler(evtFuncs)
-
 	ingc.listers = &Listers{
 		ing:  infFactory.Extensions().V1beta1().Ingresses().Lister(),
 		svc:  infFactory.Core().V1().Services().Lister(),
 		endp: infFactory.Core().V1().Endpoints().Lister(),
 		secr: infFactory.Core().V1().Secrets().Lister(),
+		cmap: infFactory.Core().V1().ConfigMaps().Lister(),
 		vcfg: vcrInfFactory.Ingress().V1alpha1().VarnishConfigs().
 			Lister(),
 		bcfg: vcrInfFactory.Ingress().V1alpha1().BackendConfigs().
@@ -195,9 +194,167 @@ func NewIngressController(
 	ingc.nsQs = NewNamespaceQueues(ingc.log, ingClass, ingc.vController,
 		ingc.listers, ingc.client, ingc.recorder)
 
+	return ingc, nil
+}
+
+// NewNamespacesIngressController creates a controller that only
+// watches the namespaces specified by watch. Informers are created
+// for each of the namespaces, so that the controller does not
+// require permissions for the resources in all namespaces.
+//
+//    log: logger initialized at startup
+//    ingClass: value of the ingress.class Ingress annotation
+//    kubeClient: k8s client initialized at startup
+//    vcrClient: client for the project's own APIs
+//    vc: Varnish controller
+//    watch: namespaces to be watched
+//    resync: resync period for informers
+func NewNamespacesIngressController(
+	log *logrus.Logger,
+	ingClass string,
+	kubeClient kubernetes.Interface,
+	vcrClient vcr_clientset.Interface,
+	vc *varnish.Controller,
+	watch Namespaces,
+	resync time.Duration,
+) (*IngressController, error) {
+
+	ingc, err := newIngressController(log, kubeClient, vc)
+	if err != nil {
+		return nil, err
+	}
+
+	ingc.nsWatch = newNsWatcher(ingc.log, kubeClient, vcrClient, watch,
+		resync, ingc.evtFuncs(), func(ns string) {
+			ingc.nsQs.RemoveWorker(ns)
+		})
+	ingc.listers = ingc.nsWatch.listers()
+	ingc.nsQs = NewNamespaceQueues(ingc.log, ingClass, ingc.vController,
+		ingc.listers, ingc.client, ingc.recorder)
+
+	return ingc, nil
+}
+
+// EnableClusterVarnishConfigs configures the controller to watch the
+// cluster-scoped ClusterVarnishConfigs, which requires that their
+// CustomResourceDefinition is installed, and that the controller is
+// permitted to read them in a ClusterRole. The Secrets and ConfigMaps
+// named in ClusterVarnishConfigs are read from namespace ns, and are
+// watched so that the configs that name them are synced when they
+// change. Must be called before Run.
+//
+// If this method is not called, then ClusterVarnishConfigs are not
+// watched, and the controller does not wait for their cache to sync.
+//
+//    vcrClient: client for the project's own APIs
+//    ns: namespace of Secrets and ConfigMaps in ClusterVarnishConfigs
+//    resync: resync period for informers
+func (ingc *IngressController) EnableClusterVarnishConfigs(
+	vcrClient vcr_clientset.Interface,
+	ns string,
+	resync time.Duration,
+) {
+	ingc.log.Infof("Watching ClusterVarnishConfigs, with Secrets and "+
+		"ConfigMaps in namespace %s", ns)
+	cvcfgs := vcr_informers.NewSharedInformerFactory(vcrClient, resync).
+		Ingress().V1alpha1().ClusterVarnishConfigs()
+	infFactory := informers.NewFilteredSharedInformerFactory(ingc.client,
+		resync, ns, nil)
+	secrs := infFactory.Core().V1().Secrets()
+	cmaps := infFactory.Core().V1().ConfigMaps()
+
+	ingc.cvcfg = cvcfgs.Informer()
+	ingc.cvcfg.AddEventHandler(ingc.evtFuncs())
+	ingc.cvcfgRefs = []cache.SharedIndexInformer{
+		secrs.Informer(),
+		cmaps.Informer(),
+	}
+	for _, informer := range ingc.cvcfgRefs {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    ingc.requeueCvcfgs,
+			DeleteFunc: ingc.requeueCvcfgs,
+			UpdateFunc: func(old, new interface{}) {
+				oldMeta, oldErr := meta.Accessor(old)
+				newMeta, newErr := meta.Accessor(new)
+				if oldErr == nil && newErr == nil &&
+					oldMeta.GetResourceVersion() ==
+						newMeta.GetResourceVersion() {
+					return
+				}
+				ingc.requeueCvcfgs(new)
+			},
+		})
+	}
+	ingc.listers.cvcfg = cvcfgs.Lister()
+	ingc.listers.csecr = secrs.Lister().Secrets(ns)
+	ingc.listers.ccmap = cmaps.Lister().ConfigMaps(ns)
+}
+
+func newIngressController(
+	log *logrus.Logger,
+	kubeClient kubernetes.Interface,
+	vc *varnish.Controller,
+) (*IngressController, error) {
+
+	ingc := IngressController{
+		log:         log.WithField(logComponent, "controller"),
+		client:      kubeClient,
+		stopCh:      make(chan struct{}),
+		vController: vc,
+		liveTimeout: int64(DefLivenessTimeout),
+	}
+
+	InitMetrics()
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(ingc.log.Printf)
+	eventBroadcaster.StartRecordingToSink(&core_v1.EventSinkImpl{
+		Interface: ingc.client.CoreV1().Events(""),
+	})
+	evtScheme := runtime.NewScheme()
+	if err := api_v1.AddToScheme(evtScheme); err != nil {
+		return nil, err
+	}
+	if err := extensions.AddToScheme(evtScheme); err != nil {
+		return nil, err
+	}
+	if err := vcr_v1alpha1.AddToScheme(evtScheme); err != nil {
+		return nil, err
+	}
+	ingc.recorder = &verbosityRecorder{
+		EventRecorder: eventBroadcaster.NewRecorder(evtScheme,
+			api_v1.EventSource{
+				Component: "varnish-ingress-controller",
+			}),
+	}
+
 	return &ingc, nil
 }
 
+func (ingc *IngressController) evtFuncs() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    ingc.addObj,
+		DeleteFunc: ingc.deleteObj,
+		UpdateFunc: ingc.updateObj,
+	}
+}
+
+// allInformers returns the informers for all resources watched by
+// the controller, except for the Secrets and ConfigMaps named in
+// ClusterVarnishConfigs, which are not synced by the workers.
+func (ingc *IngressController) allInformers() []cache.SharedIndexInformer {
+	var all []cache.SharedIndexInformer
+	if ingc.nsWatch != nil {
+		all = ingc.nsWatch.informers()
+	} else {
+		all = ingc.informers.all()
+	}
+	if ingc.cvcfg != nil {
+		all = append(all, ingc.cvcfg)
+	}
+	return all
+}
+
 func (ingc *IngressController) logObj(action string, obj interface{}) {
 	ingc.log.Debug(action, ":", obj)
 	m, mErr := meta.Accessor(obj)
@@ -223,10 +380,14 @@ func incWatchCounter(obj interface{}, sync string) {
 		watchCounters.WithLabelValues("Endpoints", sync).Inc()
 	case *api_v1.Secret:
 		watchCounters.WithLabelValues("Secret", sync).Inc()
+	case *api_v1.ConfigMap:
+		watchCounters.WithLabelValues("ConfigMap", sync).Inc()
 	case *vcr_v1alpha1.VarnishConfig:
 		watchCounters.WithLabelValues("VarnishConfig", sync).Inc()
 	case *vcr_v1alpha1.BackendConfig:
 		watchCounters.WithLabelValues("BackendConfig", sync).Inc()
+	case *vcr_v1alpha1.ClusterVarnishConfig:
+		watchCounters.WithLabelValues("ClusterVarnishConfig", sync).Inc()
 	default:
 		watchCounters.WithLabelValues("Unknown", sync).Inc()
 	}
@@ -235,13 +396,13 @@ func incWatchCounter(obj interface{}, sync string) {
 func (ingc *IngressController) addObj(obj interface{}) {
 	ingc.logObj("Add", obj)
 	incWatchCounter(obj, "Add")
-	ingc.nsQs.Queue.Add(&SyncObj{Type: Add, Obj: obj})
+	ingc.enqueue(&SyncObj{Type: Add, Obj: obj})
 }
 
 func (ingc *IngressController) deleteObj(obj interface{}) {
 	ingc.logObj("Delete", obj)
 	incWatchCounter(obj, "Delete")
-	ingc.nsQs.Queue.Add(&SyncObj{Type: Delete, Obj: obj})
+	ingc.enqueue(&SyncObj{Type: Delete, Obj: obj})
 }
 
 func (ingc *IngressController) updateObj(old, new interface{}) {
@@ -269,10 +430,14 @@ func (ingc *IngressController) updateObj(old, new interface{}) {
 				kind = "Endpoints"
 			case *api_v1.Secret:
 				kind = "Secret"
+			case *api_v1.ConfigMap:
+				kind = "ConfigMap"
 			case *vcr_v1alpha1.VarnishConfig:
 				kind = "VarnishConfig"
 			case *vcr_v1alpha1.BackendConfig:
 				kind = "BackendConfig"
+			case *vcr_v1alpha1.ClusterVarnishConfig:
+				kind = "ClusterVarnishConfig"
 			}
 			ingc.log.Debugf("Update %s %s/%s: unchanged", kind,
 				oldMeta.GetNamespace(), oldMeta.GetName())
@@ -311,64 +476,73 @@ func (ingc *IngressController) updateObj(old, new interface{}) {
 				(*metaObj).GetNamespace(), (*metaObj).GetName())
 		}
 	}
-	ingc.nsQs.Queue.Add(&SyncObj{Type: Update, Obj: new})
+	ingc.enqueue(&SyncObj{Type: Update, Obj: new})
 }
 
 // Run the Ingress controller -- start the informers in goroutines,
 // wait for the caches to sync, and call Run() for the
-// NamespaceQueues. Then block until Stop() is invoked.
+// NamespaceQueues. If leader election is configured, the
+// NamespaceQueues run after this replica has been elected leader.
+// Then block until Stop() is invoked.
 //
 // If readyFile is non-empty, it is the path of a file to touch when
-// the controller is ready (after informers have launched).
+// the controller is ready, as reported by the /readyz endpoint (after
+// the caches have synced, and if this replica is the leader, when the
+// workers are running).
 func (ingc *IngressController) Run(readyFile string, metricsPort uint16) {
 	defer utilruntime.HandleCrash()
 	defer ingc.nsQs.Stop()
+	electing := false
+	defer func() {
+		if ingc.election != nil && !electing {
+			close(ingc.electDone)
+		}
+	}()
 
 	ingc.log.Info("Launching informers")
-	go ingc.informers.ing.Run(ingc.stopCh)
-	go ingc.informers.svc.Run(ingc.stopCh)
-	go ingc.informers.endp.Run(ingc.stopCh)
-	go ingc.informers.secr.Run(ingc.stopCh)
-	go ingc.informers.vcfg.Run(ingc.stopCh)
-	go ingc.informers.bcfg.Run(ingc.stopCh)
-
-	ingc.log.Infof("Starting metrics listener at port %d", metricsPort)
-	go ServeMetrics(ingc.log, metricsPort)
-
-	ingc.log.Info("Controller ready")
-	if readyFile != "" {
-		f, err := os.Create(readyFile)
-		if err != nil {
-			e := fmt.Errorf("Cannot create ready file %s: %v",
-				readyFile, err)
-			utilruntime.HandleError(e)
-			return
+	var synced []cache.InformerSynced
+	if ingc.nsWatch != nil {
+		ingc.nsWatch.run(ingc.stopCh)
+		synced = append(synced, ingc.nsWatch.hasSynced)
+	} else {
+		for _, informer := range ingc.informers.all() {
+			go informer.Run(ingc.stopCh)
+			synced = append(synced, informer.HasSynced)
 		}
-		if err = f.Close(); err != nil {
-			e := fmt.Errorf("Cannot close ready file %s: %v",
-				readyFile, err)
-			utilruntime.HandleError(e)
-			defer f.Close()
+	}
+	if ingc.cvcfg != nil {
+		for _, informer := range append(ingc.cvcfgRefs, ingc.cvcfg) {
+			go informer.Run(ingc.stopCh)
+			synced = append(synced, informer.HasSynced)
 		}
-		ingc.log.Infof("Created ready file %s", readyFile)
 	}
 
+	ingc.log.Infof("Starting metrics listener at port %d", metricsPort)
+	go ServeMetrics(ingc.log, metricsPort, ingc.ready, ingc.alive)
+
 	ingc.log.Info("Waiting for caches to sync")
-	if ok := cache.WaitForCacheSync(ingc.stopCh,
-		ingc.informers.ing.HasSynced,
-		ingc.informers.svc.HasSynced,
-		ingc.informers.endp.HasSynced,
-		ingc.informers.secr.HasSynced,
-		ingc.informers.vcfg.HasSynced,
-		ingc.informers.bcfg.HasSynced); !ok {
+	if ok := cache.WaitForCacheSync(ingc.stopCh, synced...); !ok {
 
 		err := fmt.Errorf("Failed waiting for caches to sync")
 		utilruntime.HandleError(err)
 		return
 	}
 
-	ingc.log.Info("Caches synced, running workers")
-	go wait.Until(ingc.nsQs.Run, time.Second, ingc.stopCh)
+	ingc.log.Info("Caches synced")
+	atomic.StoreInt32(&ingc.synced, 1)
+	if ingc.election == nil {
+		ingc.lead()
+	} else {
+		electing = true
+		go ingc.runLeaderElection()
+	}
+	if readyFile != "" {
+		go func() {
+			if err := ingc.createReadyFile(readyFile); err != nil {
+				utilruntime.HandleError(err)
+			}
+		}()
+	}
 
 	<-ingc.stopCh
 }
@@ -379,5 +553,8 @@ func (ingc *IngressController) Stop() {
 	ingc.log.Info("Shutting down workers")
 	close(ingc.stopCh)
 	<-ingc.nsQs.DoneChan
+	if ingc.election != nil {
+		<-ingc.electDone
+	}
 	ingc.log.Info("Controller exiting")
 }
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+package controller
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/explain"
+)
+
+// Path prefix of the debug API.
+const debugPrefix = "/debug/varnish/"
+
+// EnableDebugAPI registers the handlers for the read-only debug API
+// at the HTTP listener for the /metrics endpoint (see ServeMetrics).
+// It must be called before Run. Requests must present token as a
+// bearer token in the Authorization header. Since the listener is
+// reachable from the cluster network, an error is returned, and the
+// API is not enabled, if token is empty.
+//
+// The debug API has the following endpoints:
+//
+//    GET /debug/varnish/services: JSON array of the names
+//        (namespace/name) of the known Varnish Services
+//    GET /debug/varnish/services/{namespace}/{name}: JSON object
+//        describing the Varnish Service: its current VCL spec, the
+//        name of its config, the resources from which the spec was
+//        derived, and the state of each instance, including its
+//        address, banner, the result of the most recent update, and
+//        the list of loaded VCLs. Add the query parameter vcls=false
+//        to omit the VCL lists, which are retrieved from the admin
+//        interface of each instance.
+//    GET /debug/varnish/services/{namespace}/{name}/vcl: the VCL
+//        source generated from the spec
+//    GET /debug/varnish/services/{namespace}/{name}/explain: JSON
+//        object reporting what the current VCL would do with a
+//        sample request (see pkg/explain), described by the query
+//        parameters method, host, url, client and server (IP
+//        addresses), and header ("Name: value", may be repeated)
+func (ingc *IngressController) EnableDebugAPI(token string) error {
+	if token == "" {
+		return fmt.Errorf("No token configured for the debug API, " +
+			"not enabled")
+	}
+	ingc.log.Info("Enabling debug API at ", debugPrefix)
+	http.Handle(debugPrefix, debugAuth(token, ingc.debugHandler()))
+	return nil
+}
+
+// debugAuth wraps handler to require the bearer token, and to only
+// permit GET and HEAD requests. All requests are rejected if token is
+// empty.
+func debugAuth(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		presented := strings.TrimPrefix(auth, "Bearer ")
+		if token == "" || presented == auth ||
+			subtle.ConstantTimeCompare([]byte(presented),
+				[]byte(token)) != 1 {
+
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(append(body, '\n'))
+}
+
+func (ingc *IngressController) debugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, debugPrefix)
+		path = strings.TrimSuffix(path, "/")
+		parts := strings.Split(path, "/")
+		if parts[0] != "services" || len(parts) > 4 {
+			http.NotFound(w, r)
+			return
+		}
+		switch len(parts) {
+		case 1:
+			writeJSON(w, ingc.vController.ServiceNames())
+			return
+		case 2:
+			http.NotFound(w, r)
+			return
+		}
+
+		svcKey := parts[1] + "/" + parts[2]
+		if len(parts) == 4 && parts[3] == "explain" {
+			ingc.explainHandler(w, r, svcKey)
+			return
+		}
+		if len(parts) == 4 {
+			if parts[3] != "vcl" {
+				http.NotFound(w, r)
+				return
+			}
+			src, err := ingc.vController.ServiceVCL(svcKey)
+			if err != nil {
+				http.Error(w, err.Error(),
+					http.StatusInternalServerError)
+				return
+			}
+			if src == "" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type",
+				"text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write([]byte(src))
+			return
+		}
+
+		listVCLs := r.URL.Query().Get("vcls") != "false"
+		state := ingc.vController.ServiceState(svcKey, listVCLs)
+		if state == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, state)
+	})
+}
+
+// explainHandler serves the explain endpoint of the debug API.
+func (ingc *IngressController) explainHandler(w http.ResponseWriter,
+	r *http.Request, svcKey string) {
+
+	query := r.URL.Query()
+	req := explain.Request{
+		Method:   query.Get("method"),
+		Host:     query.Get("host"),
+		URL:      query.Get("url"),
+		Header:   make(http.Header),
+		ClientIP: query.Get("client"),
+		ServerIP: query.Get("server"),
+	}
+	for _, hdr := range query["header"] {
+		i := strings.IndexByte(hdr, ':')
+		if i <= 0 {
+			http.Error(w, "Invalid header: "+hdr,
+				http.StatusBadRequest)
+			return
+		}
+		req.Header.Add(strings.TrimSpace(hdr[:i]),
+			strings.TrimSpace(hdr[i+1:]))
+	}
+	for _, addr := range []string{req.ClientIP, req.ServerIP} {
+		if addr != "" && net.ParseIP(addr) == nil {
+			http.Error(w, "Invalid IP address: "+addr,
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	spec := ingc.vController.ServiceSpec(svcKey)
+	if spec == nil {
+		http.NotFound(w, r)
+		return
+	}
+	res, err := explain.Explain(*spec, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
+)
+
+func TestDebugAuth(t *testing.T) {
+	handler := debugAuth("s3cr3t", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range []struct {
+		method string
+		auth   string
+		status int
+	}{
+		{"GET", "", http.StatusUnauthorized},
+		{"GET", "s3cr3t", http.StatusUnauthorized},
+		{"GET", "Bearer wrong", http.StatusUnauthorized},
+		{"GET", "Bearer s3cr3t", http.StatusOK},
+		{"HEAD", "Bearer s3cr3t", http.StatusOK},
+		{"POST", "Bearer s3cr3t", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(tc.method, debugPrefix+"services",
+			nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("debugAuth() %s Authorization=%q status "+
+				"want=%d got=%d", tc.method, tc.auth, tc.status,
+				rec.Code)
+		}
+	}
+
+	handler = debugAuth("", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("GET", debugPrefix, nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("debugAuth() without token status want=%d got=%d",
+			http.StatusUnauthorized, rec.Code)
+	}
+
+	ingc := &IngressController{vController: &varnish.Controller{}}
+	if err := ingc.EnableDebugAPI(""); err == nil {
+		t.Error("EnableDebugAPI() without token: expected error")
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	ingc := &IngressController{vController: &varnish.Controller{}}
+	handler := ingc.debugHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET",
+		debugPrefix+"services", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET services status want=%d got=%d", http.StatusOK,
+			rec.Code)
+	}
+	var names []string
+	if err := json.Unmarshal(rec.Body.Bytes(), &names); err != nil {
+		t.Fatalf("GET services: %v", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("GET services want=[] got=%v", names)
+	}
+
+	for _, path := range []string{
+		"foo",
+		"services/ns",
+		"services/ns/varnish",
+		"services/ns/varnish/vcl",
+		"services/ns/varnish/explain?url=/foo",
+		"services/ns/varnish/foo",
+	} {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET",
+			debugPrefix+path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s status want=%d got=%d", path,
+				http.StatusNotFound, rec.Code)
+		}
+	}
+
+	for _, query := range []string{"header=foo", "client=foo"} {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET",
+			debugPrefix+"services/ns/varnish/explain?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET explain?%s status want=%d got=%d", query,
+				http.StatusBadRequest, rec.Code)
+		}
+	}
+}
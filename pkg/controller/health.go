@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Default for the liveness timeout, see SetLivenessTimeout.
+const DefLivenessTimeout = 10 * time.Minute
+
+// SetLivenessTimeout sets the time after which the controller is
+// considered to be stuck, if a NamespaceWorker has been busy with a
+// single work item for longer than d, or if the Varnish monitor has
+// not begun an iteration within its interval plus d. Then the
+// /healthz endpoint reports failure. If d <= 0, liveness is not
+// checked.
+func (ingc *IngressController) SetLivenessTimeout(d time.Duration) {
+	atomic.StoreInt64(&ingc.liveTimeout, int64(d))
+}
+
+func (ingc *IngressController) livenessTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&ingc.liveTimeout))
+}
+
+// ready returns nil if the informer caches have synced, and if this
+// replica is the leader, if the queue workers are running. A standby
+// replica is ready when its caches are synced, so that it can take
+// over as leader.
+func (ingc *IngressController) ready() error {
+	if atomic.LoadInt32(&ingc.synced) == 0 {
+		return fmt.Errorf("Informer caches not synced")
+	}
+	if ingc.isLeader() && !ingc.nsQs.isRunning() {
+		return fmt.Errorf("Queue workers not running")
+	}
+	return nil
+}
+
+// Interval at which readiness is checked before the ready file is
+// created.
+var readyFileIntvl = time.Second
+
+// createReadyFile touches readyFile when ready() first returns nil,
+// so that the file and the /readyz endpoint signal readiness under
+// the same condition. Returns without creating the file if stopCh is
+// closed first.
+func (ingc *IngressController) createReadyFile(readyFile string) error {
+	ticker := time.NewTicker(readyFileIntvl)
+	defer ticker.Stop()
+	for ingc.ready() != nil {
+		select {
+		case <-ingc.stopCh:
+			return nil
+		case <-ticker.C:
+		}
+	}
+	f, err := os.Create(readyFile)
+	if err != nil {
+		return fmt.Errorf("Cannot create ready file %s: %v",
+			readyFile, err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("Cannot close ready file %s: %v",
+			readyFile, err)
+	}
+	ingc.log.Infof("Created ready file %s", readyFile)
+	return nil
+}
+
+// alive returns an error if a NamespaceWorker is stuck, or if this
+// replica is the leader and the Varnish monitor has stopped
+// iterating.
+func (ingc *IngressController) alive() error {
+	timeout := ingc.livenessTimeout()
+	if timeout <= 0 {
+		return nil
+	}
+	if err := ingc.nsQs.stuckWorker(timeout); err != nil {
+		return err
+	}
+	if ingc.isLeader() {
+		return ingc.vController.CheckMonitor(timeout)
+	}
+	return nil
+}
+
+func (qs *NamespaceQueues) isRunning() bool {
+	return atomic.LoadInt32(&qs.running) != 0
+}
+
+// stuckWorker returns an error for the first NamespaceWorker found
+// that has been busy with a work item for longer than timeout.
+func (qs *NamespaceQueues) stuckWorker(timeout time.Duration) error {
+	qs.workersMtx.Lock()
+	defer qs.workersMtx.Unlock()
+	for ns, worker := range qs.workers {
+		busy := atomic.LoadInt64(&worker.busySince)
+		if busy == 0 {
+			continue
+		}
+		since := time.Since(time.Unix(0, busy))
+		if since > timeout {
+			return fmt.Errorf("Worker for namespace %s busy with "+
+				"one item for %v", ns, since.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// healthHandler returns a Handler that responds with status 200 and
+// body "ok" if check returns nil, otherwise with status 503 and the
+// error message.
+func healthHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		if check != nil {
+			if err := check(); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, err)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
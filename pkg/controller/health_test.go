@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errTest = fmt.Errorf("Test failure")
+
+func TestReady(t *testing.T) {
+	ingc := &IngressController{nsQs: &NamespaceQueues{}}
+	if err := ingc.ready(); err == nil {
+		t.Error("ready() before cache sync: expected error")
+	}
+	ingc.synced = 1
+	if err := ingc.ready(); err != nil {
+		t.Errorf("ready() as standby after cache sync: %v", err)
+	}
+	ingc.leading = 1
+	if err := ingc.ready(); err == nil {
+		t.Error("ready() as leader without workers: expected error")
+	}
+	ingc.nsQs.running = 1
+	if err := ingc.ready(); err != nil {
+		t.Errorf("ready() as leader with workers running: %v", err)
+	}
+}
+
+func TestAlive(t *testing.T) {
+	worker := &NamespaceWorker{namespace: "ns"}
+	ingc := &IngressController{
+		vController: &varnish.Controller{},
+		nsQs: &NamespaceQueues{
+			workers: map[string]*NamespaceWorker{"ns": worker},
+		},
+		leading:     1,
+		liveTimeout: int64(time.Minute),
+	}
+	if err := ingc.alive(); err != nil {
+		t.Errorf("alive() with idle worker: %v", err)
+	}
+
+	worker.busySince = time.Now().UnixNano()
+	if err := ingc.alive(); err != nil {
+		t.Errorf("alive() with busy worker: %v", err)
+	}
+
+	worker.busySince = time.Now().Add(-2 * time.Minute).UnixNano()
+	if err := ingc.alive(); err == nil {
+		t.Error("alive() with stuck worker: expected error")
+	}
+
+	ingc.SetLivenessTimeout(0)
+	if err := ingc.alive(); err != nil {
+		t.Errorf("alive() with liveness timeout 0: %v", err)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	var err error
+	check := func() error { return err }
+	handler := healthHandler(check)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("healthHandler() status want=%d got=%d",
+			http.StatusOK, rec.Code)
+	}
+
+	err = errTest
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("healthHandler() status want=%d got=%d",
+			http.StatusServiceUnavailable, rec.Code)
+	}
+	if body := rec.Body.String(); body != errTest.Error()+"\n" {
+		t.Errorf("healthHandler() body want=%q got=%q",
+			errTest.Error()+"\n", body)
+	}
+}
+
+func TestCreateReadyFile(t *testing.T) {
+	defer func(intvl time.Duration) { readyFileIntvl = intvl }(
+		readyFileIntvl)
+	readyFileIntvl = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "readyfile")
+	if err != nil {
+		t.Fatal("TempDir():", err)
+	}
+	defer os.RemoveAll(dir)
+	readyFile := filepath.Join(dir, "ready")
+	ingc := &IngressController{
+		log:    logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard}),
+		nsQs:   &NamespaceQueues{},
+		stopCh: make(chan struct{}),
+	}
+	done := make(chan error)
+	go func() { done <- ingc.createReadyFile(readyFile) }()
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := os.Stat(readyFile); !os.IsNotExist(err) {
+		t.Fatalf("ready file created before cache sync: %v", err)
+	}
+	atomic.StoreInt32(&ingc.leading, 1)
+	atomic.StoreInt32(&ingc.synced, 1)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := os.Stat(readyFile); !os.IsNotExist(err) {
+		t.Fatalf("ready file created as leader without workers: %v",
+			err)
+	}
+	atomic.StoreInt32(&ingc.nsQs.running, 1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("createReadyFile():", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("createReadyFile() did not return when ready")
+	}
+	if _, err := os.Stat(readyFile); err != nil {
+		t.Errorf("ready file not created when ready: %v", err)
+	}
+
+	readyFile = filepath.Join(dir, "stopped")
+	ingc.synced = 0
+	close(ingc.stopCh)
+	if err := ingc.createReadyFile(readyFile); err != nil {
+		t.Error("createReadyFile() after stop:", err)
+	}
+	if _, err := os.Stat(readyFile); !os.IsNotExist(err) {
+		t.Errorf("ready file created after stop: %v", err)
+	}
+}
@@ -33,7 +33,9 @@ package controller
 import (
 	"encoding/base64"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
 	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
@@ -255,10 +257,12 @@ func (worker *NamespaceWorker) getVCLSvc(svcNamespace string, svcName string,
 		Name:      svcNamespace + "/" + svcName,
 		Addresses: addrs,
 	}
+	defaults := worker.beDefaults.get()
 	nsLister := worker.listers.bcfg.BackendConfigs(svcNamespace)
 	bcfgs, err := nsLister.List(labels.Everything())
 	if err != nil {
 		if errors.IsNotFound(err) {
+			defaults.apply(&vclSvc)
 			return vclSvc, nil, nil
 		}
 		return vclSvc, nil, err
@@ -275,6 +279,7 @@ BCfgs:
 		}
 	}
 	if bcfg == nil {
+		defaults.apply(&vclSvc)
 		return vclSvc, nil, nil
 	}
 	if bcfg.Spec.Director != nil {
@@ -301,6 +306,7 @@ BCfgs:
 	if bcfg.Spec.ProxyHeader != nil {
 		vclSvc.ProxyHeader = uint8(*bcfg.Spec.ProxyHeader)
 	}
+	defaults.apply(&vclSvc)
 	return vclSvc, bcfg, nil
 }
 
@@ -544,14 +550,13 @@ func (worker *NamespaceWorker) configAuth(spec *vcl.Spec,
 		for user, pass := range secret.Data {
 			str := user + ":" + string(pass)
 			cred := base64.StdEncoding.EncodeToString([]byte(str))
-			worker.log.Tracef("VarnishConfig %s/%s: add cred %s "+
-				"for realm %s to VCL config", vcfg.Namespace,
-				vcfg.Name, cred, vclAuth.Realm)
 			vclAuth.Credentials = append(vclAuth.Credentials, cred)
 		}
 		configConditions(vclAuth.Conditions, auth.Conditions)
 		worker.log.Tracef("VarnishConfig %s/%s add VCL auth config: "+
-			"%+v", vcfg.Namespace, vcfg.Name, vclAuth)
+			"realm=%s status=%d credentials=%d conditions=%+v",
+			vcfg.Namespace, vcfg.Name, vclAuth.Realm, vclAuth.Status,
+			len(vclAuth.Credentials), vclAuth.Conditions)
 		spec.Auths = append(spec.Auths, vclAuth)
 	}
 	return nil
@@ -819,111 +824,220 @@ func (worker *NamespaceWorker) configReqDisps(spec *vcl.Spec,
 	}
 }
 
-func (worker *NamespaceWorker) addOrUpdateIng(ing *extensions.Ingress) error {
-	ingKey := ing.ObjectMeta.Namespace + "/" + ing.ObjectMeta.Name
-	worker.log.Infof("Adding or Updating Ingress: %s", ingKey)
-
-	// Get the Varnish Service and its Pods
-	svc, err := worker.getVarnishSvcForIng(ing)
-	if err != nil {
-		return err
-	}
-	if svc == nil {
-		return fmt.Errorf("No Varnish Service found for Ingress %s/%s",
-			ing.Namespace, ing.Name)
-	}
-	svcKey := svc.Namespace + "/" + svc.Name
-	worker.log.Infof("Ingress %s configured for Varnish Service %s", ingKey,
-		svcKey)
+func (worker *NamespaceWorker) configSnippets(spec *vcl.Spec,
+	vcfg *vcr_v1alpha1.VarnishConfig) error {
 
-	ings, err := worker.getIngsForVarnishSvc(svc)
-	if err != nil {
+	if len(vcfg.Spec.Snippets) == 0 {
+		worker.log.Infof("No VCL snippets found for VarnishConfig "+
+			"%s/%s", vcfg.Namespace, vcfg.Name)
 		return nil
 	}
-	if len(ings) == 0 {
-		worker.log.Infof("No Ingresses to be implemented by Varnish "+
-			"Service %s, setting to not ready", svcKey)
-		return worker.vController.SetNotReady(svcKey)
+	worker.log.Infof("VarnishConfig %s/%s: configure %d VCL snippets",
+		vcfg.Namespace, vcfg.Name, len(vcfg.Spec.Snippets))
+	spec.Snippets = make([]vcl.Snippet, len(vcfg.Spec.Snippets))
+	for i, snip := range vcfg.Spec.Snippets {
+		worker.log.Tracef("VarnishConfig %s/%s configuring VCL "+
+			"snippet from: %+v", vcfg.Namespace, vcfg.Name, snip)
+		src := snip.VCL
+		if snip.ConfigMapName != "" {
+			cm, err := worker.cmap.Get(snip.ConfigMapName)
+			if err != nil {
+				return fmt.Errorf("VarnishConfig %s/%s snippet "+
+					"%s: cannot get ConfigMap %s: %v",
+					vcfg.Namespace, vcfg.Name, snip.Name,
+					snip.ConfigMapName, err)
+			}
+			var exists bool
+			if src, exists = cm.Data[snip.Key]; !exists {
+				return fmt.Errorf("VarnishConfig %s/%s snippet "+
+					"%s: ConfigMap %s/%s does not have key "+
+					"%s", vcfg.Namespace, vcfg.Name,
+					snip.Name, cm.Namespace, cm.Name,
+					snip.Key)
+			}
+		}
+		spec.Snippets[i] = vcl.Snippet{
+			Name:     snip.Name,
+			Sub:      string(snip.Sub),
+			Before:   snip.Position == vcr_v1alpha1.Before,
+			Priority: snip.Priority,
+			VCL:      strings.TrimRight(src, "\n"),
+		}
 	}
+	sort.Stable(vcl.BySnippetOrder(spec.Snippets))
+	return nil
+}
 
-	ingNames := make([]string, len(ings))
-	for i, ingress := range ings {
-		ingNames[i] = ingress.Namespace + "/" + ingress.Name
-	}
-	worker.log.Infof("Ingresses implemented by Varnish Service %s: %v",
-		svcKey, ingNames)
-	vclSpec, bcfgs, err := worker.ings2VCLSpec(ings)
-	if err != nil {
-		return err
-	}
-	worker.log.Tracef("VCL spec generated from the Ingresses: %v", vclSpec)
+// specMeta identifies the resources from which the VCL spec for a
+// Varnish Service was generated.
+type specMeta struct {
+	ings map[string]varnish.Meta
+	vcfg varnish.VcfgMeta
+	bcfg map[string]varnish.Meta
+}
 
-	var vcfg *vcr_v1alpha1.VarnishConfig
+// svcVcfgs returns the VarnishConfigs in the worker's namespace that
+// apply to the Varnish Service svc, in the order in which they are
+// merged.
+func (worker *NamespaceWorker) svcVcfgs(
+	svc *api_v1.Service) ([]*vcr_v1alpha1.VarnishConfig, error) {
+
+	var svcVcfgs []*vcr_v1alpha1.VarnishConfig
 	worker.log.Tracef("Listing VarnishConfigs in namespace %s",
 		worker.namespace)
 	vcfgs, err := worker.vcfg.List(labels.Everything())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, v := range vcfgs {
 		worker.log.Tracef("VarnishConfig: %s/%s: %+v", v.Namespace,
 			v.Name, v)
 		for _, svcName := range v.Spec.Services {
 			if svcName == svc.Name {
-				vcfg = v
+				svcVcfgs = append(svcVcfgs, v)
 				break
 			}
 		}
 	}
-	if vcfg != nil {
+	sort.Sort(byPrecedence(svcVcfgs))
+	return svcVcfgs, nil
+}
+
+// svcSpec generates the VCL spec for the Varnish Service svc, to
+// implement the Ingresses in ings, together with the
+// ClusterVarnishConfigs that select svc and the VarnishConfigs for
+// svc in the worker's namespace, each merged in order of precedence,
+// and the BackendConfigs for the backend Services, if any.
+func (worker *NamespaceWorker) svcSpec(svc *api_v1.Service,
+	ings []*extensions.Ingress) (vcl.Spec, specMeta, error) {
+
+	var meta specMeta
+	vclSpec, bcfgs, err := worker.ings2VCLSpec(ings)
+	if err != nil {
+		return vclSpec, meta, err
+	}
+	worker.log.Tracef("VCL spec generated from the Ingresses: %d rules, "+
+		"%d services, hash=%s", len(vclSpec.Rules),
+		len(vclSpec.AllServices), vclSpec.DeepHash())
+
+	merge := newVcfgMerge()
+	cvcfgs, err := worker.svcCvcfgs(svc)
+	if err != nil {
+		return vclSpec, meta, err
+	}
+	for _, cvcfg := range cvcfgs {
+		worker.log.Infof("Found ClusterVarnishConfig %s for Varnish "+
+			"Service %s/%s", cvcfg.Name, svc.Namespace, svc.Name)
+		part, err := worker.cvcfgSpec(cvcfg, svc)
+		if err != nil {
+			return vclSpec, meta, err
+		}
+		_, err = merge.merge(&vclSpec, part, clusterVcfg(cvcfg))
+		if err != nil {
+			return vclSpec, meta, fmt.Errorf("Varnish Service "+
+				"%s/%s: %v", svc.Namespace, svc.Name, err)
+		}
+	}
+
+	vcfgs, err := worker.svcVcfgs(svc)
+	if err != nil {
+		return vclSpec, meta, err
+	}
+	for _, vcfg := range vcfgs {
 		worker.log.Infof("Found VarnishConfig %s/%s for Varnish "+
 			"Service %s/%s", vcfg.Namespace, vcfg.Name,
 			svc.Namespace, svc.Name)
-		if err = worker.configSharding(&vclSpec, vcfg, svc); err != nil {
-			return err
-		}
-		if err = worker.configAuth(&vclSpec, vcfg); err != nil {
-			return err
+		part, err := worker.vcfgSpec(vcfg, svc)
+		if err != nil {
+			return vclSpec, meta, err
 		}
-		if err = worker.configACL(&vclSpec, vcfg); err != nil {
-			return err
+		dropped, err := merge.merge(&vclSpec, part, vcfg)
+		if err != nil {
+			return vclSpec, meta, fmt.Errorf("Varnish Service "+
+				"%s/%s: %v", svc.Namespace, svc.Name, err)
 		}
-		if err = worker.configRewrites(&vclSpec, vcfg); err != nil {
-			return err
+		for _, msg := range dropped {
+			worker.log.Warnf("VarnishConfig %s/%s: ignored for "+
+				"Varnish Service %s/%s: %s", vcfg.Namespace,
+				vcfg.Name, svc.Namespace, svc.Name, msg)
+			if worker.recorder != nil {
+				worker.warnEvent(vcfg, clusterEnforced,
+					"Ignored for Varnish Service %s/%s: %s",
+					svc.Namespace, svc.Name, msg)
+			}
 		}
-		worker.configReqDisps(&vclSpec, vcfg.Spec.ReqDispositions,
-			vcfg.Kind, vcfg.Namespace, vcfg.Name)
-		vclSpec.VCL = vcfg.Spec.VCL
-	} else {
+	}
+	if len(vcfgs) == 0 {
 		worker.log.Infof("Found no VarnishConfigs for Varnish Service "+
 			"%s/%s", svc.Namespace, svc.Name)
 	}
+	meta.vcfg = merge.meta
 
-	ingsMeta := make(map[string]varnish.Meta)
+	meta.ings = make(map[string]varnish.Meta)
 	for _, ing := range ings {
 		metaDatum := varnish.Meta{
 			Key: ing.Namespace + "/" + ing.Name,
 			UID: string(ing.UID),
 			Ver: ing.ResourceVersion,
 		}
-		ingsMeta[metaDatum.Key] = metaDatum
+		meta.ings[metaDatum.Key] = metaDatum
 	}
-	var vcfgMeta varnish.Meta
-	if vcfg != nil {
-		vcfgMeta = varnish.Meta{
-			Key: vcfg.Namespace + "/" + vcfg.Name,
-			UID: string(vcfg.UID),
-			Ver: vcfg.ResourceVersion,
-		}
-	}
-	bcfgMeta := make(map[string]varnish.Meta)
+	meta.bcfg = make(map[string]varnish.Meta)
 	for name, bcfg := range bcfgs {
-		bcfgMeta[name] = varnish.Meta{
+		meta.bcfg[name] = varnish.Meta{
 			Key: bcfg.Namespace + "/" + bcfg.Name,
 			UID: string(bcfg.UID),
 			Ver: bcfg.ResourceVersion,
 		}
 	}
+	return vclSpec, meta, nil
+}
+
+func (worker *NamespaceWorker) addOrUpdateIng(ing *extensions.Ingress) error {
+	ingKey := ing.ObjectMeta.Namespace + "/" + ing.ObjectMeta.Name
+	worker.log.Infof("Adding or Updating Ingress: %s", ingKey)
+
+	// Get the Varnish Service and its Pods
+	svc, err := worker.getVarnishSvcForIng(ing)
+	if err != nil {
+		return err
+	}
+	if svc == nil {
+		return fmt.Errorf("No Varnish Service found for Ingress %s/%s",
+			ing.Namespace, ing.Name)
+	}
+	svcKey := svc.Namespace + "/" + svc.Name
+	worker.log.Infof("Ingress %s configured for Varnish Service %s", ingKey,
+		svcKey)
+
+	ings, err := worker.getIngsForVarnishSvc(svc)
+	if err != nil {
+		return nil
+	}
+	if len(ings) == 0 {
+		worker.log.Infof("No Ingresses to be implemented by Varnish "+
+			"Service %s, setting to not ready", svcKey)
+		return worker.vController.SetNotReady(svcKey)
+	}
+
+	ingNames := make([]string, len(ings))
+	for i, ingress := range ings {
+		ingNames[i] = ingress.Namespace + "/" + ingress.Name
+	}
+	worker.log.Infof("Ingresses implemented by Varnish Service %s: %v",
+		svcKey, ingNames)
+	mode, err := isolation(svc)
+	if err != nil {
+		return err
+	}
+	if mode != "" {
+		return worker.updateTenants(svc, mode, ings, ing)
+	}
+	vclSpec, meta, err := worker.svcSpec(svc, ings)
+	if err != nil {
+		return err
+	}
+	ingsMeta, vcfgMeta, bcfgMeta := meta.ings, meta.vcfg, meta.bcfg
 	worker.log.Tracef("Check if config is loaded: hash=%s "+
 		"ingressMetaData=%+v vcfgMetaData=%+v bcfgMetaData=%+v",
 		vclSpec.Canonical().DeepHash(), ingsMeta, vcfgMeta, bcfgMeta)
@@ -934,20 +1048,35 @@ func (worker *NamespaceWorker) addOrUpdateIng(ing *extensions.Ingress) error {
 			vclSpec.Canonical().DeepHash())
 		return nil
 	}
+	if err = worker.analyzeSpec(vclSpec, ings, vcfgMeta); err != nil {
+		return err
+	}
 	worker.log.Tracef("Update config svc=%s ingressMetaData=%+v "+
-		"vcfgMetaData=%+v bcfgMetaData=%+v: %+v", svcKey, ingsMeta,
-		vcfgMeta, bcfgMeta, vclSpec)
+		"vcfgMetaData=%+v bcfgMetaData=%+v: %s", svcKey, ingsMeta,
+		vcfgMeta, bcfgMeta, specSummary(vclSpec))
 	err = worker.vController.Update(svcKey, vclSpec, ingsMeta, vcfgMeta,
 		bcfgMeta)
 	if err != nil {
 		return err
 	}
 	worker.log.Tracef("Updated config svc=%s ingressMetaData=%+v "+
-		"vcfgMetaData=%+v bcfgMetaData=%+v: %+v", svcKey, ingsMeta,
-		vcfgMeta, bcfgMeta, vclSpec)
+		"vcfgMetaData=%+v bcfgMetaData=%+v: %s", svcKey, ingsMeta,
+		vcfgMeta, bcfgMeta, specSummary(vclSpec))
 	return nil
 }
 
+// specSummary describes the VCL spec for trace logs by its hash and
+// the number of its elements, since the full spec includes the
+// credentials for basic and proxy authentication.
+func specSummary(spec vcl.Spec) string {
+	return fmt.Sprintf("hash=%s rules=%d services=%d auths=%d acls=%d "+
+		"rewrites=%d dispositions=%d snippets=%d templates=%d",
+		spec.Canonical().DeepHash(), len(spec.Rules),
+		len(spec.AllServices), len(spec.Auths), len(spec.ACLs),
+		len(spec.Rewrites), len(spec.Dispositions), len(spec.Snippets),
+		len(spec.Templates))
+}
+
 // We only handle Ingresses with the class annotation with the value
 // given as the "class" flag (default "varnish").
 func (worker *NamespaceWorker) isVarnishIngress(ing *extensions.Ingress) bool {
@@ -30,6 +30,7 @@ package controller
 
 import (
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
@@ -37,6 +38,7 @@ import (
 	extensions "k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
 	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
 	"github.com/google/go-cmp/cmp"
 	"github.com/sirupsen/logrus"
@@ -103,6 +105,34 @@ func TestIngressMergeError(t *testing.T) {
 	}
 }
 
+func TestAnalyzeSpec(t *testing.T) {
+	worker := &NamespaceWorker{
+		log: logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard}),
+	}
+	spec := vcl.Spec{
+		ACLs: []vcl.ACL{{
+			Name: "acl",
+			Addresses: []vcl.ACLAddress{
+				{Addr: "192.0.2.0", MaskBits: 24},
+				{Addr: "192.0.2.0", MaskBits: 24, Negate: true},
+			},
+		}},
+	}
+	ings := []*extensions.Ingress{ing1}
+	if err := worker.analyzeSpec(spec, ings, varnish.VcfgMeta{}); err == nil {
+		t.Errorf("analyzeSpec(): no error reported for conflicting " +
+			"ACL entries")
+	} else if testing.Verbose() {
+		t.Logf("analyzeSpec() returned as expected: %v", err)
+	}
+
+	spec.ACLs[0].Addresses[1].Negate = false
+	if err := worker.analyzeSpec(spec, ings, varnish.VcfgMeta{}); err != nil {
+		t.Errorf("analyzeSpec(): error reported for a warning: %v",
+			err)
+	}
+}
+
 func TestConfigMatchFlags(t *testing.T) {
 	zero := uint64(0)
 	mb80 := uint64(1024 * 1024 * 80)
@@ -669,7 +699,9 @@ var reqDispHarness = []struct {
 }
 
 func TestConfigReqDisps(t *testing.T) {
-	worker := &NamespaceWorker{log: &logrus.Logger{Out: ioutil.Discard}}
+	worker := &NamespaceWorker{
+		log: logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard}),
+	}
 	for _, h := range reqDispHarness {
 		vclSpec := &vcl.Spec{}
 		worker.configReqDisps(vclSpec, h.spec, "VarnishConfig",
@@ -682,3 +714,21 @@ func TestConfigReqDisps(t *testing.T) {
 		}
 	}
 }
+
+func TestSpecSummary(t *testing.T) {
+	spec := vcl.Spec{
+		Auths: []vcl.Auth{{
+			Realm:       "cafe",
+			Credentials: []string{"Zm9vOmJhcg=="},
+			Status:      vcl.Basic,
+		}},
+	}
+	summary := specSummary(spec)
+	if strings.Contains(summary, "Zm9vOmJhcg==") {
+		t.Errorf("specSummary() contains credentials: %s", summary)
+	}
+	if !strings.Contains(summary, "auths=1") ||
+		!strings.Contains(summary, spec.Canonical().DeepHash()) {
+		t.Errorf("specSummary() want hash and counts: %s", summary)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LeaderElection configures leader election among replicas of the
+// controller, using a Lease object identified by Namespace and Name.
+// Only the leader syncs Varnish Services; standby replicas keep their
+// informer caches up to date, so that they can take over quickly.
+//
+//    Identity: unique name of this replica, usually the Pod name
+//    LeaseDuration: time that standbys wait before acquiring the
+//                   Lease after the last renewal by the leader
+//    RenewDeadline: time in which the leader must renew the Lease,
+//                   otherwise it gives up leadership
+//    RetryPeriod: interval between attempts to acquire or renew
+type LeaderElection struct {
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// SetLeaderElection configures leader election for Run. If le is
+// nil, leader election is not run, and the controller syncs Varnish
+// Services as soon as its caches are synced.
+func (ingc *IngressController) SetLeaderElection(le *LeaderElection) {
+	ingc.election = le
+	ingc.electDone = make(chan struct{})
+}
+
+func (ingc *IngressController) isLeader() bool {
+	return atomic.LoadInt32(&ingc.leading) != 0
+}
+
+// enqueue adds syncObj to the work queue, if this replica is the
+// leader. A new leader enqueues all objects in the caches when it
+// takes over.
+func (ingc *IngressController) enqueue(syncObj *SyncObj) {
+	if !ingc.isLeader() {
+		return
+	}
+	ingc.nsQs.Queue.Add(syncObj)
+}
+
+// enqueueAll adds every object in the informer caches to the queue,
+// so that all resources are synced.
+func (ingc *IngressController) enqueueAll() {
+	for _, informer := range ingc.allInformers() {
+		for _, obj := range informer.GetStore().List() {
+			ingc.nsQs.Queue.Add(&SyncObj{Type: Add, Obj: obj})
+		}
+	}
+}
+
+// lead starts syncing Varnish Services, after this replica has become
+// the leader (or immediately, if leader election is not configured).
+func (ingc *IngressController) lead() {
+	atomic.StoreInt32(&ingc.leading, 1)
+	isLeaderGauge.Set(1)
+
+	ingc.enqueueAll()
+
+	ingc.log.Info("Running workers")
+	ingc.vController.Start()
+	go wait.Until(ingc.nsQs.Run, time.Second, ingc.stopCh)
+}
+
+// runLeaderElection runs leader election until Stop() is invoked,
+// and then releases the Lease if this replica is the leader. If
+// leadership is lost otherwise, the process exits, so that it can be
+// restarted as a standby.
+func (ingc *IngressController) runLeaderElection() {
+	defer close(ingc.electDone)
+	le := ingc.election
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-ingc.stopCh
+		cancel()
+	}()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: meta_v1.ObjectMeta{
+			Namespace: le.Namespace,
+			Name:      le.Name,
+		},
+		Client: ingc.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: le.Identity,
+		},
+	}
+	ingc.log.Infof("Starting leader election for Lease %s/%s as %s",
+		le.Namespace, le.Name, le.Identity)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            le.Name,
+		LeaseDuration:   le.LeaseDuration,
+		RenewDeadline:   le.RenewDeadline,
+		RetryPeriod:     le.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				ingc.log.Infof("Elected leader: %s",
+					le.Identity)
+				ingc.lead()
+			},
+			OnStoppedLeading: func() {
+				isLeaderGauge.Set(0)
+				select {
+				case <-ctx.Done():
+					ingc.log.Info("Leader election stopped")
+				default:
+					ingc.log.Fatalf("Leadership lost by %s, "+
+						"exiting", le.Identity)
+				}
+			},
+			OnNewLeader: func(identity string) {
+				ingc.log.Infof("Current leader: %s", identity)
+				leaderGauge.Reset()
+				leaderGauge.WithLabelValues(identity).Set(1)
+			},
+		},
+	})
+}
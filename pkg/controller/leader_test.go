@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"testing"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestEnqueueLeader(t *testing.T) {
+	ingc := &IngressController{
+		nsQs: &NamespaceQueues{
+			Queue: workqueue.NewRateLimitingQueue(
+				workqueue.DefaultControllerRateLimiter()),
+		},
+	}
+	defer ingc.nsQs.Queue.ShutDown()
+
+	ingc.enqueue(&SyncObj{Type: Add})
+	if n := ingc.nsQs.Queue.Len(); n != 0 {
+		t.Errorf("enqueue() as standby: queue length want=0 got=%d",
+			n)
+	}
+	ingc.leading = 1
+	ingc.enqueue(&SyncObj{Type: Add})
+	if n := ingc.nsQs.Queue.Len(); n != 1 {
+		t.Errorf("enqueue() as leader: queue length want=1 got=%d", n)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+
+	api_v1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+)
+
+// Field names for structured logging, used consistently in log
+// messages about the resources that the controller syncs.
+const (
+	logComponent = "component"
+	logNamespace = "namespace"
+	logKind      = "kind"
+	logName      = "name"
+)
+
+// objKind returns the kind of a resource watched by the controller.
+func objKind(obj interface{}) string {
+	switch obj.(type) {
+	case *extensions.Ingress:
+		return "Ingress"
+	case *api_v1.Service:
+		return "Service"
+	case *api_v1.Endpoints:
+		return "Endpoints"
+	case *api_v1.Secret:
+		return "Secret"
+	case *api_v1.ConfigMap:
+		return "ConfigMap"
+	case *vcr_v1alpha1.VarnishConfig:
+		return "VarnishConfig"
+	case *vcr_v1alpha1.BackendConfig:
+		return "BackendConfig"
+	case *vcr_v1alpha1.ClusterVarnishConfig:
+		return "ClusterVarnishConfig"
+	default:
+		return "Unknown"
+	}
+}
+
+// objLogger returns an Entry for log messages about the object that
+// the worker syncs, with the kind and name of the resource.
+func (worker *NamespaceWorker) objLogger(obj interface{}) *logrus.Entry {
+	if syncObj, ok := obj.(*SyncObj); ok {
+		obj = syncObj.Obj
+	}
+	if deleted, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = deleted.Obj
+	}
+	fields := logrus.Fields{logKind: objKind(obj)}
+	if m, err := meta.Accessor(obj); err == nil {
+		fields[logName] = m.GetName()
+	}
+	return worker.nsLog.WithFields(fields)
+}
@@ -0,0 +1,415 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+// Merging the ClusterVarnishConfigs and VarnishConfigs for a Varnish
+// Service
+
+import (
+	"fmt"
+	"sort"
+
+	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	api_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Paths of fields in the VarnishConfig spec, as identified in the
+// SrcMap for the generated VCL.
+const (
+	aclField      = "spec.acl[%d]"
+	authField     = "spec.auth[realm=%s]"
+	rewriteField  = "spec.rewrites[%d]"
+	reqDispField  = "spec.req-disposition[%d]"
+	snippetField  = "spec.snippets[name=%s]"
+	tmplField     = "spec.templates[%s]"
+	customVCL     = "spec.vcl"
+	selfSharding  = "spec.self-sharding"
+	templatesSpec = "spec.templates"
+)
+
+// Reason for Warning Events for VarnishConfigs whose fields are not
+// merged, because they would override the fields enforced by a
+// ClusterVarnishConfig.
+const clusterEnforced = "ClusterEnforced"
+
+// Key in vcfgMerge.enforced for the snippets of VarnishConfigs with
+// position before, which would be executed ahead of the code generated
+// for the ClusterVarnishConfigs.
+const snippetsBefore = "snippets before"
+
+// byPrecedence sorts VarnishConfigs in the order in which they are
+// merged: ascending order of priority, and then by name.
+type byPrecedence []*vcr_v1alpha1.VarnishConfig
+
+func (a byPrecedence) Len() int      { return len(a) }
+func (a byPrecedence) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byPrecedence) Less(i, j int) bool {
+	if a[i].Spec.Priority != a[j].Spec.Priority {
+		return a[i].Spec.Priority < a[j].Spec.Priority
+	}
+	if a[i].Namespace != a[j].Namespace {
+		return a[i].Namespace < a[j].Namespace
+	}
+	return a[i].Name < a[j].Name
+}
+
+// byClusterPrecedence sorts ClusterVarnishConfigs in the order in
+// which they are merged: ascending order of priority, and then by
+// name.
+type byClusterPrecedence []*vcr_v1alpha1.ClusterVarnishConfig
+
+func (a byClusterPrecedence) Len() int      { return len(a) }
+func (a byClusterPrecedence) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byClusterPrecedence) Less(i, j int) bool {
+	if a[i].Spec.Priority != a[j].Spec.Priority {
+		return a[i].Spec.Priority < a[j].Spec.Priority
+	}
+	return a[i].Name < a[j].Name
+}
+
+// vcfgMerge accumulates the VarnishConfigs that are merged into the
+// VCL spec for a Varnish Service. owners records the VarnishConfig
+// (namespace/name) that defines each ACL, auth realm and snippet by
+// name, and each of the fields that may be set by only one of the
+// merged VarnishConfigs. enforced records the same for the
+// ClusterVarnishConfigs (by name), and the targets of their
+// rewrites, which may not be overridden by VarnishConfigs. Once a
+// ClusterVarnishConfig is merged, custom VCL, templates and snippets
+// with position before are enforced as well, whether or not it sets
+// them, since they could circumvent the code that it generates.
+type vcfgMerge struct {
+	meta     varnish.VcfgMeta
+	owners   map[string]string
+	enforced map[string]string
+}
+
+func newVcfgMerge() *vcfgMerge {
+	return &vcfgMerge{
+		meta:     varnish.VcfgMeta{Fields: make(map[string]varnish.FieldSrc)},
+		owners:   make(map[string]string),
+		enforced: make(map[string]string),
+	}
+}
+
+// vcfgKey returns the key by which the VarnishConfig vcfg is
+// identified in VcfgMeta: namespace/name, or just the name for a
+// ClusterVarnishConfig, which has no namespace.
+func vcfgKey(vcfg *vcr_v1alpha1.VarnishConfig) string {
+	if vcfg.Namespace == "" {
+		return vcfg.Name
+	}
+	return vcfg.Namespace + "/" + vcfg.Name
+}
+
+// clusterVcfg returns a VarnishConfig with the meta-data and spec of
+// the ClusterVarnishConfig cvcfg, and without a namespace, so that
+// its part of the VCL spec is generated and merged as for a
+// VarnishConfig.
+func clusterVcfg(
+	cvcfg *vcr_v1alpha1.ClusterVarnishConfig) *vcr_v1alpha1.VarnishConfig {
+
+	return &vcr_v1alpha1.VarnishConfig{
+		TypeMeta:   meta_v1.TypeMeta{Kind: "ClusterVarnishConfig"},
+		ObjectMeta: cvcfg.ObjectMeta,
+		Spec:       cvcfg.Spec.VarnishConfigSpec,
+	}
+}
+
+// seq returns the indices 0 to n-1.
+func seq(n int) []int {
+	idxs := make([]int, n)
+	for i := range idxs {
+		idxs[i] = i
+	}
+	return idxs
+}
+
+// enforce removes the elements of part, the spec generated from a
+// VarnishConfig, that would override the fields enforced by the
+// ClusterVarnishConfigs merged previously, and returns descriptions
+// of the elements removed. sharding is cleared if self-sharding is
+// enforced, and acls and rewrites are left with the indices in the
+// VarnishConfig of the ACLs and rewrites that remain.
+func (m *vcfgMerge) enforce(part *vcl.Spec, sharding *bool,
+	acls, rewrites *[]int) []string {
+
+	var dropped []string
+	drop := func(field, what string) bool {
+		owner, exists := m.enforced[field]
+		if exists {
+			dropped = append(dropped, fmt.Sprintf("%s is enforced "+
+				"by ClusterVarnishConfig %s", what, owner))
+		}
+		return exists
+	}
+
+	// custom VCL, templates and snippets before are enforced as
+	// soon as any ClusterVarnishConfig has been merged.
+	if *sharding && drop(selfSharding, "self-sharding") {
+		*sharding = false
+		part.ShardCluster = vcl.ShardCluster{}
+	}
+	if part.VCL != "" && drop(customVCL, "custom VCL") {
+		part.VCL = ""
+	}
+	if len(part.Templates) > 0 && drop(templatesSpec, "templates") {
+		part.Templates = nil
+	}
+
+	var keptACLs []vcl.ACL
+	var aclIdxs []int
+	for i, acl := range part.ACLs {
+		if drop("acl "+acl.Name, "ACL "+acl.Name) {
+			continue
+		}
+		keptACLs = append(keptACLs, acl)
+		aclIdxs = append(aclIdxs, (*acls)[i])
+	}
+	part.ACLs, *acls = keptACLs, aclIdxs
+
+	var keptAuths []vcl.Auth
+	for _, auth := range part.Auths {
+		if !drop("auth "+auth.Realm, "auth realm "+auth.Realm) {
+			keptAuths = append(keptAuths, auth)
+		}
+	}
+	part.Auths = keptAuths
+
+	var keptRewrites []vcl.Rewrite
+	var rwIdxs []int
+	for i, rw := range part.Rewrites {
+		if drop("rewrite "+rw.Target, "rewrite of "+rw.Target) {
+			continue
+		}
+		keptRewrites = append(keptRewrites, rw)
+		rwIdxs = append(rwIdxs, (*rewrites)[i])
+	}
+	part.Rewrites, *rewrites = keptRewrites, rwIdxs
+
+	var keptSnippets []vcl.Snippet
+	for _, snip := range part.Snippets {
+		if drop("snippet "+snip.Name, "snippet "+snip.Name) {
+			continue
+		}
+		if snip.Before && drop(snippetsBefore, "snippet "+snip.Name+
+			" with position before") {
+			continue
+		}
+		keptSnippets = append(keptSnippets, snip)
+	}
+	part.Snippets = keptSnippets
+	return dropped
+}
+
+// claim records field in claims for the VarnishConfig identified by
+// key, or returns an error if a VarnishConfig that was merged
+// previously already owns it.
+func (m *vcfgMerge) claim(claims map[string]string, field, what,
+	key string) error {
+
+	if owner, exists := m.owners[field]; exists {
+		return fmt.Errorf("VarnishConfigs %s and %s both define %s",
+			owner, key, what)
+	}
+	claims[field] = key
+	return nil
+}
+
+// merge merges part, the spec generated from the VarnishConfig vcfg,
+// into spec. The ACLs, auths, rewrites, request dispositions and
+// snippets of part are appended to those of spec. Returns an error,
+// and leaves spec unchanged, if part defines an ACL name, auth realm
+// or snippet name that is already defined, or if both spec and part
+// set custom VCL, self-sharding or templates.
+//
+// ClusterVarnishConfigs, which have no namespace, are merged before
+// any VarnishConfig. The elements of a VarnishConfig that would
+// override the fields that they set, or that could circumvent them
+// (custom VCL, templates and snippets with position before), are not
+// merged, and descriptions of them are returned.
+func (m *vcfgMerge) merge(spec *vcl.Spec, part vcl.Spec,
+	vcfg *vcr_v1alpha1.VarnishConfig) ([]string, error) {
+
+	key := vcfgKey(vcfg)
+	sharding := vcfg.Spec.SelfSharding != nil
+	acls := seq(len(part.ACLs))
+	rewrites := seq(len(part.Rewrites))
+	var dropped []string
+	if vcfg.Namespace != "" {
+		dropped = m.enforce(&part, &sharding, &acls, &rewrites)
+	}
+
+	claims := make(map[string]string)
+	if sharding {
+		if err := m.claim(claims, selfSharding, "self-sharding",
+			key); err != nil {
+			return nil, err
+		}
+	}
+	if part.VCL != "" {
+		if err := m.claim(claims, customVCL, "custom VCL",
+			key); err != nil {
+			return nil, err
+		}
+	}
+	if len(part.Templates) > 0 {
+		if err := m.claim(claims, templatesSpec, "templates",
+			key); err != nil {
+			return nil, err
+		}
+	}
+	for _, acl := range part.ACLs {
+		if err := m.claim(claims, "acl "+acl.Name, "ACL "+acl.Name,
+			key); err != nil {
+			return nil, err
+		}
+	}
+	for _, auth := range part.Auths {
+		if err := m.claim(claims, "auth "+auth.Realm,
+			"auth realm "+auth.Realm, key); err != nil {
+			return nil, err
+		}
+	}
+	for _, snip := range part.Snippets {
+		if err := m.claim(claims, "snippet "+snip.Name,
+			"snippet "+snip.Name, key); err != nil {
+			return nil, err
+		}
+	}
+	for field, owner := range claims {
+		m.owners[field] = owner
+		if vcfg.Namespace == "" {
+			m.enforced[field] = owner
+		}
+	}
+	if vcfg.Namespace == "" {
+		for _, rw := range part.Rewrites {
+			m.enforced["rewrite "+rw.Target] = key
+		}
+		for _, field := range []string{customVCL, templatesSpec,
+			snippetsBefore} {
+			if _, exists := m.enforced[field]; !exists {
+				m.enforced[field] = key
+			}
+		}
+	}
+
+	meta := varnish.Meta{
+		Key: key,
+		UID: string(vcfg.UID),
+		Ver: vcfg.ResourceVersion,
+	}
+	m.meta.Configs = append(m.meta.Configs, meta)
+	m.index(aclField, len(spec.ACLs), acls, key)
+	m.index(rewriteField, len(spec.Rewrites), rewrites, key)
+	m.index(reqDispField, len(spec.Dispositions),
+		seq(len(part.Dispositions)), key)
+	for _, auth := range part.Auths {
+		m.field(fmt.Sprintf(authField, auth.Realm), key)
+	}
+	for _, snip := range part.Snippets {
+		m.field(fmt.Sprintf(snippetField, snip.Name), key)
+	}
+	for name := range part.Templates {
+		m.field(fmt.Sprintf(tmplField, name), key)
+	}
+
+	if sharding {
+		spec.ShardCluster = part.ShardCluster
+	}
+	if part.VCL != "" {
+		m.field(customVCL, key)
+		spec.VCL = part.VCL
+	}
+	if len(part.Templates) > 0 {
+		spec.Templates = part.Templates
+	}
+	spec.ACLs = append(spec.ACLs, part.ACLs...)
+	spec.Auths = append(spec.Auths, part.Auths...)
+	spec.Rewrites = append(spec.Rewrites, part.Rewrites...)
+	spec.Dispositions = append(spec.Dispositions, part.Dispositions...)
+	spec.Snippets = append(spec.Snippets, part.Snippets...)
+	sort.Stable(vcl.BySnippetOrder(spec.Snippets))
+	return dropped, nil
+}
+
+// index maps the fields of the merged spec with the path format and
+// indices beginning at offset to the fields with the indices in idxs
+// in the VarnishConfig identified by key.
+func (m *vcfgMerge) index(format string, offset int, idxs []int,
+	key string) {
+
+	for i, idx := range idxs {
+		m.meta.Fields[fmt.Sprintf(format, offset+i)] = varnish.FieldSrc{
+			Key:   key,
+			Field: fmt.Sprintf(format, idx),
+		}
+	}
+}
+
+// field maps field, which is identified by name, to the same field
+// in the VarnishConfig identified by key.
+func (m *vcfgMerge) field(field, key string) {
+	m.meta.Fields[field] = varnish.FieldSrc{Key: key, Field: field}
+}
+
+// vcfgSpec generates the part of the VCL spec that is configured by
+// the VarnishConfig vcfg for the Varnish Service svc.
+func (worker *NamespaceWorker) vcfgSpec(vcfg *vcr_v1alpha1.VarnishConfig,
+	svc *api_v1.Service) (vcl.Spec, error) {
+
+	var part vcl.Spec
+	var err error
+	if err = worker.configSharding(&part, vcfg, svc); err != nil {
+		return part, err
+	}
+	if err = worker.configAuth(&part, vcfg); err != nil {
+		return part, err
+	}
+	if err = worker.configACL(&part, vcfg); err != nil {
+		return part, err
+	}
+	if err = worker.configRewrites(&part, vcfg); err != nil {
+		return part, err
+	}
+	worker.configReqDisps(&part, vcfg.Spec.ReqDispositions,
+		vcfg.Kind, vcfg.Namespace, vcfg.Name)
+	if err = worker.configSnippets(&part, vcfg); err != nil {
+		return part, err
+	}
+	if part.Templates, err = worker.vcfgTemplates(vcfg); err != nil {
+		return part, err
+	}
+	part.VCL = vcfg.Spec.VCL
+	return part, nil
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"sort"
+	"testing"
+
+	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func mergeVcfg(name string, prio int32) *vcr_v1alpha1.VarnishConfig {
+	return &vcr_v1alpha1.VarnishConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            name,
+			UID:             types.UID("uid-" + name),
+			ResourceVersion: "1",
+		},
+		Spec: vcr_v1alpha1.VarnishConfigSpec{Priority: prio},
+	}
+}
+
+func TestByPrecedence(t *testing.T) {
+	vcfgs := []*vcr_v1alpha1.VarnishConfig{
+		mergeVcfg("team-b", 0),
+		mergeVcfg("platform", -10),
+		mergeVcfg("team-a", 0),
+		mergeVcfg("late", 5),
+	}
+	sort.Sort(byPrecedence(vcfgs))
+	want := []string{"platform", "team-a", "team-b", "late"}
+	for i, vcfg := range vcfgs {
+		if vcfg.Name != want[i] {
+			t.Errorf("byPrecedence[%d]: want %s got %s", i, want[i],
+				vcfg.Name)
+		}
+	}
+}
+
+func TestVcfgMerge(t *testing.T) {
+	var spec vcl.Spec
+	merge := newVcfgMerge()
+
+	platform := mergeVcfg("platform", -10)
+	part := vcl.Spec{
+		ACLs:  []vcl.ACL{{Name: "admin"}},
+		Auths: []vcl.Auth{{Realm: "ops"}},
+		Snippets: []vcl.Snippet{
+			{Name: "hdrs", Sub: "deliver", Priority: 10},
+		},
+	}
+	if _, err := merge.merge(&spec, part, platform); err != nil {
+		t.Fatal("merge(platform):", err)
+	}
+
+	team := mergeVcfg("team", 0)
+	part = vcl.Spec{
+		ACLs:     []vcl.ACL{{Name: "office"}, {Name: "vpn"}},
+		Rewrites: []vcl.Rewrite{{Target: "req.url"}},
+		Snippets: []vcl.Snippet{{Name: "log", Sub: "deliver"}},
+		VCL:      "sub vcl_recv {}",
+	}
+	if _, err := merge.merge(&spec, part, team); err != nil {
+		t.Fatal("merge(team):", err)
+	}
+
+	if len(spec.ACLs) != 3 || spec.ACLs[0].Name != "admin" ||
+		spec.ACLs[2].Name != "vpn" {
+		t.Errorf("merge() ACLs: %+v", spec.ACLs)
+	}
+	if len(spec.Snippets) != 2 || spec.Snippets[0].Name != "log" {
+		t.Errorf("merge() snippets not in priority order: %+v",
+			spec.Snippets)
+	}
+	if spec.VCL != part.VCL {
+		t.Errorf("merge() VCL: %s", spec.VCL)
+	}
+	if len(merge.meta.Configs) != 2 ||
+		merge.meta.Configs[0].Key != "default/platform" ||
+		merge.meta.Configs[1].Key != "default/team" {
+		t.Errorf("merge() meta: %+v", merge.meta.Configs)
+	}
+	for field, want := range map[string]varnish.FieldSrc{
+		"spec.acl[0]": {Key: "default/platform", Field: "spec.acl[0]"},
+		"spec.acl[2]": {Key: "default/team", Field: "spec.acl[1]"},
+		"spec.rewrites[0]": {
+			Key:   "default/team",
+			Field: "spec.rewrites[0]",
+		},
+		"spec.auth[realm=ops]": {
+			Key:   "default/platform",
+			Field: "spec.auth[realm=ops]",
+		},
+		"spec.snippets[name=log]": {
+			Key:   "default/team",
+			Field: "spec.snippets[name=log]",
+		},
+		"spec.vcl": {Key: "default/team", Field: "spec.vcl"},
+	} {
+		if got := merge.meta.Fields[field]; got != want {
+			t.Errorf("merge() field %s: want %+v got %+v", field,
+				want, got)
+		}
+	}
+
+	for _, h := range []struct {
+		name string
+		part vcl.Spec
+	}{
+		{"acl", vcl.Spec{ACLs: []vcl.ACL{{Name: "vpn"}}}},
+		{"auth", vcl.Spec{Auths: []vcl.Auth{{Realm: "ops"}}}},
+		{"snippet", vcl.Spec{Snippets: []vcl.Snippet{{Name: "hdrs"}}}},
+		{"vcl", vcl.Spec{VCL: "sub vcl_deliver {}"}},
+	} {
+		before := len(spec.ACLs)
+		_, err := merge.merge(&spec, h.part, mergeVcfg("conflict", 1))
+		if err == nil {
+			t.Errorf("merge(%s conflict): expected error", h.name)
+			continue
+		}
+		t.Logf("merge(%s conflict) returned as expected: %v", h.name,
+			err)
+		if len(spec.ACLs) != before || len(merge.meta.Configs) != 2 {
+			t.Errorf("merge(%s conflict) changed the spec", h.name)
+		}
+	}
+}
+
+func TestByClusterPrecedence(t *testing.T) {
+	cvcfgs := []*vcr_v1alpha1.ClusterVarnishConfig{
+		{ObjectMeta: metav1.ObjectMeta{Name: "headers"}},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "security"},
+			Spec: vcr_v1alpha1.ClusterVarnishConfigSpec{
+				VarnishConfigSpec: vcr_v1alpha1.VarnishConfigSpec{
+					Priority: -1,
+				},
+			},
+		},
+		{ObjectMeta: metav1.ObjectMeta{Name: "acls"}},
+	}
+	sort.Sort(byClusterPrecedence(cvcfgs))
+	want := []string{"security", "acls", "headers"}
+	for i, cvcfg := range cvcfgs {
+		if cvcfg.Name != want[i] {
+			t.Errorf("byClusterPrecedence[%d]: want %s got %s", i,
+				want[i], cvcfg.Name)
+		}
+	}
+}
+
+func TestClusterVcfgMerge(t *testing.T) {
+	var spec vcl.Spec
+	merge := newVcfgMerge()
+
+	cvcfg := clusterVcfg(&vcr_v1alpha1.ClusterVarnishConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "baseline"},
+	})
+	if key := vcfgKey(cvcfg); key != "baseline" {
+		t.Errorf("vcfgKey(ClusterVarnishConfig): want baseline got %s",
+			key)
+	}
+	part := vcl.Spec{
+		ACLs: []vcl.ACL{{Name: "admin"}},
+		Rewrites: []vcl.Rewrite{
+			{Target: "resp.http.X-Frame-Options"},
+		},
+		Dispositions: []vcl.DispositionSpec{{}},
+	}
+	dropped, err := merge.merge(&spec, part, cvcfg)
+	if err != nil {
+		t.Fatal("merge(baseline):", err)
+	}
+	if len(dropped) != 0 {
+		t.Errorf("merge(baseline) dropped: %v", dropped)
+	}
+
+	part = vcl.Spec{
+		ACLs: []vcl.ACL{{Name: "admin"}, {Name: "office"}},
+		Rewrites: []vcl.Rewrite{
+			{Target: "resp.http.X-Frame-Options"},
+			{Target: "req.url"},
+		},
+		Dispositions: []vcl.DispositionSpec{{}},
+		Snippets: []vcl.Snippet{
+			{Name: "early", Sub: "recv", Before: true, Priority: -1},
+			{Name: "late", Sub: "recv"},
+		},
+		Templates: map[string]string{"vcl.tmpl": "vcl 4.1;"},
+		VCL:       "sub vcl_recv {}",
+	}
+	dropped, err = merge.merge(&spec, part, mergeVcfg("tenant", -10))
+	if err != nil {
+		t.Fatal("merge(tenant):", err)
+	}
+	if len(dropped) != 5 {
+		t.Errorf("merge(tenant) dropped: want 5 got %v", dropped)
+	}
+	for _, msg := range dropped {
+		t.Log("merge(tenant) dropped as expected:", msg)
+	}
+	if len(spec.ACLs) != 2 || spec.ACLs[0].Name != "admin" ||
+		spec.ACLs[1].Name != "office" {
+		t.Errorf("merge() ACLs: %+v", spec.ACLs)
+	}
+	if len(spec.Rewrites) != 2 || spec.Rewrites[1].Target != "req.url" {
+		t.Errorf("merge() rewrites: %+v", spec.Rewrites)
+	}
+	if len(spec.Dispositions) != 2 || spec.VCL != "" ||
+		spec.Templates != nil {
+		t.Errorf("merge() dispositions, VCL or templates: %+v", spec)
+	}
+	if len(spec.Snippets) != 1 || spec.Snippets[0].Name != "late" {
+		t.Errorf("merge() snippets: %+v", spec.Snippets)
+	}
+	if len(merge.meta.Configs) != 2 ||
+		merge.meta.Configs[0].Key != "baseline" {
+		t.Errorf("merge() meta: %+v", merge.meta.Configs)
+	}
+	for field, want := range map[string]varnish.FieldSrc{
+		"spec.acl[0]": {Key: "baseline", Field: "spec.acl[0]"},
+		"spec.acl[1]": {Key: "default/tenant", Field: "spec.acl[1]"},
+		"spec.rewrites[1]": {
+			Key:   "default/tenant",
+			Field: "spec.rewrites[1]",
+		},
+		"spec.req-disposition[1]": {
+			Key:   "default/tenant",
+			Field: "spec.req-disposition[0]",
+		},
+	} {
+		if got := merge.meta.Fields[field]; got != want {
+			t.Errorf("merge() field %s: want %+v got %+v", field,
+				want, got)
+		}
+	}
+}
@@ -169,6 +169,24 @@ var (
 		Name:      "result_total",
 		Help:      "Total number of synchronization results",
 	}, []string{"namespace", "kind", "result"})
+
+	isLeaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "is_leader",
+		Help:      "Whether this controller replica is the leader",
+	})
+
+	leaderGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Identity of the current leader (value 1)",
+	}, []string{"identity"})
+
+	watchedNsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "watched_namespaces",
+		Help:      "Number of namespaces watched by the controller",
+	})
 )
 
 // InitMetrics sets the prometheus provider for the workqueue metrics,
@@ -177,11 +195,19 @@ func InitMetrics() {
 	workqueue.SetProvider(promProvider{})
 	prometheus.Register(watchCounters)
 	prometheus.Register(syncCounters)
+	prometheus.Register(isLeaderGauge)
+	prometheus.Register(leaderGauge)
+	prometheus.Register(watchedNsGauge)
 }
 
-// ServeMetrics executes the HTTP Handler for the /metrics endpoint.
-func ServeMetrics(log *logrus.Logger, port uint16) {
+// ServeMetrics executes the HTTP Handlers for the /metrics endpoint,
+// and for the /readyz and /healthz endpoints, which respond with
+// status 200 if ready and alive (respectively) return nil, and with
+// status 503 otherwise.
+func ServeMetrics(log *logrus.Entry, port uint16, ready, alive func() error) {
 	addr := fmt.Sprintf(":%d", port)
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/readyz", healthHandler(ready))
+	http.Handle("/healthz", healthHandler(alive))
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
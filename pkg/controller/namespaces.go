@@ -0,0 +1,430 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	vcr_clientset "code.uplex.de/uplex-varnish/k8s-ingress/pkg/client/clientset/versioned"
+	vcr_informers "code.uplex.de/uplex-varnish/k8s-ingress/pkg/client/informers/externalversions"
+	vcr_listers "code.uplex.de/uplex-varnish/k8s-ingress/pkg/client/listers/varnishingress/v1alpha1"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	core_v1_listers "k8s.io/client-go/listers/core/v1"
+	ext_listers "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+
+	api_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Satisifes type TweakListOptionsFunc in
+// k8s.io/client-go/informers/internalinterfaces, for informers that
+// only filter by namespace.
+func noop(opts *meta_v1.ListOptions) {}
+
+// nsIndexer is a cache.Indexer that combines the indexers of the
+// informers for one resource type in each watched namespace, so that
+// listers created from it work like listers for all namespaces.
+//
+// Only the read methods used by listers are implemented; the embedded
+// Indexer is always empty.
+type nsIndexer struct {
+	cache.Indexer
+	mtx  sync.RWMutex
+	idxs map[string]cache.Indexer
+}
+
+func newNsIndexer() *nsIndexer {
+	return &nsIndexer{
+		Indexer: cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+			cache.Indexers{}),
+		idxs: make(map[string]cache.Indexer),
+	}
+}
+
+// set adds the indexer for a namespace, or removes it if idx is nil.
+func (nsIdx *nsIndexer) set(ns string, idx cache.Indexer) {
+	nsIdx.mtx.Lock()
+	defer nsIdx.mtx.Unlock()
+	if idx == nil {
+		delete(nsIdx.idxs, ns)
+		return
+	}
+	nsIdx.idxs[ns] = idx
+}
+
+func (nsIdx *nsIndexer) get(ns string) cache.Indexer {
+	nsIdx.mtx.RLock()
+	defer nsIdx.mtx.RUnlock()
+	return nsIdx.idxs[ns]
+}
+
+func (nsIdx *nsIndexer) List() []interface{} {
+	nsIdx.mtx.RLock()
+	defer nsIdx.mtx.RUnlock()
+	var objs []interface{}
+	for _, idx := range nsIdx.idxs {
+		objs = append(objs, idx.List()...)
+	}
+	return objs
+}
+
+func (nsIdx *nsIndexer) ListKeys() []string {
+	nsIdx.mtx.RLock()
+	defer nsIdx.mtx.RUnlock()
+	var keys []string
+	for _, idx := range nsIdx.idxs {
+		keys = append(keys, idx.ListKeys()...)
+	}
+	return keys
+}
+
+func (nsIdx *nsIndexer) Get(obj interface{}) (interface{}, bool, error) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return nil, false, err
+	}
+	return nsIdx.GetByKey(key)
+}
+
+func (nsIdx *nsIndexer) GetByKey(key string) (interface{}, bool, error) {
+	ns, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if idx := nsIdx.get(ns); idx != nil {
+		return idx.GetByKey(key)
+	}
+	return nil, false, nil
+}
+
+func (nsIdx *nsIndexer) Index(
+	name string,
+	obj interface{},
+) ([]interface{}, error) {
+	if name != cache.NamespaceIndex {
+		return nsIdx.Indexer.Index(name, obj)
+	}
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	if idx := nsIdx.get(m.GetNamespace()); idx != nil {
+		return idx.Index(name, obj)
+	}
+	return []interface{}{}, nil
+}
+
+func (nsIdx *nsIndexer) ByIndex(name, val string) ([]interface{}, error) {
+	if name != cache.NamespaceIndex {
+		return nsIdx.Indexer.ByIndex(name, val)
+	}
+	if idx := nsIdx.get(val); idx != nil {
+		return idx.ByIndex(name, val)
+	}
+	return []interface{}{}, nil
+}
+
+// nsIndexers are the combined indexers for each resource type.
+type nsIndexers struct {
+	ing  *nsIndexer
+	svc  *nsIndexer
+	endp *nsIndexer
+	secr *nsIndexer
+	cmap *nsIndexer
+	vcfg *nsIndexer
+	bcfg *nsIndexer
+}
+
+func (idxs *nsIndexers) set(ns string, infs *infrmrs) {
+	if infs == nil {
+		for _, idx := range []*nsIndexer{idxs.ing, idxs.svc,
+			idxs.endp, idxs.secr, idxs.cmap, idxs.vcfg, idxs.bcfg} {
+			idx.set(ns, nil)
+		}
+		return
+	}
+	idxs.ing.set(ns, infs.ing.GetIndexer())
+	idxs.svc.set(ns, infs.svc.GetIndexer())
+	idxs.endp.set(ns, infs.endp.GetIndexer())
+	idxs.secr.set(ns, infs.secr.GetIndexer())
+	idxs.cmap.set(ns, infs.cmap.GetIndexer())
+	idxs.vcfg.set(ns, infs.vcfg.GetIndexer())
+	idxs.bcfg.set(ns, infs.bcfg.GetIndexer())
+}
+
+func (infs *infrmrs) all() []cache.SharedIndexInformer {
+	return []cache.SharedIndexInformer{
+		infs.ing, infs.svc, infs.endp, infs.secr, infs.cmap, infs.vcfg,
+		infs.bcfg,
+	}
+}
+
+// nsInformers are the informers for one watched namespace, and the
+// channel that stops them when the namespace is no longer watched.
+type nsInformers struct {
+	infrmrs
+	stopCh chan struct{}
+}
+
+// nsWatcher maintains informers for each namespace that the
+// controller watches, when it is restricted to a list of namespaces,
+// and/or to namespaces whose labels match a selector.
+type nsWatcher struct {
+	log        *logrus.Entry
+	client     kubernetes.Interface
+	vcrClient  vcr_clientset.Interface
+	resync     time.Duration
+	handler    cache.ResourceEventHandler
+	removed    func(ns string)
+	names      map[string]struct{}
+	selector   labels.Selector
+	nsInformer cache.SharedIndexInformer
+	idxs       nsIndexers
+	mtx        sync.Mutex
+	nsInfs     map[string]*nsInformers
+	started    bool
+}
+
+func newNsWatcher(
+	log *logrus.Entry,
+	client kubernetes.Interface,
+	vcrClient vcr_clientset.Interface,
+	watch Namespaces,
+	resync time.Duration,
+	handler cache.ResourceEventHandler,
+	removed func(ns string),
+) *nsWatcher {
+
+	nsw := &nsWatcher{
+		log:       log,
+		client:    client,
+		vcrClient: vcrClient,
+		resync:    resync,
+		handler:   handler,
+		removed:   removed,
+		names:     make(map[string]struct{}),
+		selector:  watch.Selector,
+		idxs: nsIndexers{
+			ing:  newNsIndexer(),
+			svc:  newNsIndexer(),
+			endp: newNsIndexer(),
+			secr: newNsIndexer(),
+			cmap: newNsIndexer(),
+			vcfg: newNsIndexer(),
+			bcfg: newNsIndexer(),
+		},
+		nsInfs: make(map[string]*nsInformers),
+	}
+	for _, ns := range watch.Names {
+		nsw.names[ns] = struct{}{}
+		nsw.add(ns)
+	}
+	if nsw.selector == nil {
+		return nsw
+	}
+
+	tweak := func(opts *meta_v1.ListOptions) {
+		opts.LabelSelector = nsw.selector.String()
+	}
+	nsw.nsInformer = informers.NewFilteredSharedInformerFactory(client,
+		resync, api_v1.NamespaceAll, tweak).Core().V1().Namespaces().
+		Informer()
+	nsw.nsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    nsw.nsUpdate,
+		UpdateFunc: func(_, obj interface{}) { nsw.nsUpdate(obj) },
+		DeleteFunc: nsw.nsDelete,
+	})
+	return nsw
+}
+
+func (nsw *nsWatcher) nsUpdate(obj interface{}) {
+	ns, ok := obj.(*api_v1.Namespace)
+	if !ok {
+		return
+	}
+	if nsw.selector.Matches(labels.Set(ns.Labels)) {
+		nsw.add(ns.Name)
+		return
+	}
+	nsw.remove(ns.Name)
+}
+
+func (nsw *nsWatcher) nsDelete(obj interface{}) {
+	if tomb, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tomb.Obj
+	}
+	if ns, ok := obj.(*api_v1.Namespace); ok {
+		nsw.remove(ns.Name)
+	}
+}
+
+// add creates informers for a namespace, if they don't already exist,
+// and runs them if the watcher has been started.
+func (nsw *nsWatcher) add(ns string) {
+	nsw.mtx.Lock()
+	defer nsw.mtx.Unlock()
+
+	if _, exists := nsw.nsInfs[ns]; exists {
+		return
+	}
+	nsw.log.Infof("Watching namespace %s", ns)
+	infFactory := informers.NewFilteredSharedInformerFactory(nsw.client,
+		nsw.resync, ns, noop)
+	vcrInfFactory := vcr_informers.NewFilteredSharedInformerFactory(
+		nsw.vcrClient, nsw.resync, ns, noop)
+	nsInfs := &nsInformers{
+		infrmrs: infrmrs{
+			ing: infFactory.Extensions().V1beta1().Ingresses().
+				Informer(),
+			svc:  infFactory.Core().V1().Services().Informer(),
+			endp: infFactory.Core().V1().Endpoints().Informer(),
+			secr: infFactory.Core().V1().Secrets().Informer(),
+			cmap: infFactory.Core().V1().ConfigMaps().Informer(),
+			vcfg: vcrInfFactory.Ingress().V1alpha1().
+				VarnishConfigs().Informer(),
+			bcfg: vcrInfFactory.Ingress().V1alpha1().
+				BackendConfigs().Informer(),
+		},
+		stopCh: make(chan struct{}),
+	}
+	for _, informer := range nsInfs.all() {
+		informer.AddEventHandler(nsw.handler)
+	}
+	nsw.idxs.set(ns, &nsInfs.infrmrs)
+	nsw.nsInfs[ns] = nsInfs
+	watchedNsGauge.Set(float64(len(nsw.nsInfs)))
+	if nsw.started {
+		nsInfs.run()
+	}
+}
+
+// remove stops the informers for a namespace that no longer matches
+// the selector. Namespaces named explicitly are always watched.
+func (nsw *nsWatcher) remove(ns string) {
+	if _, named := nsw.names[ns]; named {
+		return
+	}
+
+	nsw.mtx.Lock()
+	nsInfs, exists := nsw.nsInfs[ns]
+	if !exists {
+		nsw.mtx.Unlock()
+		return
+	}
+	nsw.log.Infof("No longer watching namespace %s", ns)
+	delete(nsw.nsInfs, ns)
+	nsw.idxs.set(ns, nil)
+	watchedNsGauge.Set(float64(len(nsw.nsInfs)))
+	if nsw.started {
+		close(nsInfs.stopCh)
+	}
+	nsw.mtx.Unlock()
+
+	nsw.removed(ns)
+}
+
+func (nsInfs *nsInformers) run() {
+	for _, informer := range nsInfs.all() {
+		go informer.Run(nsInfs.stopCh)
+	}
+}
+
+// run starts the informers, and stops them when stopCh is closed.
+// Informers for namespaces that are added afterward are started
+// immediately.
+func (nsw *nsWatcher) run(stopCh <-chan struct{}) {
+	nsw.mtx.Lock()
+	nsw.started = true
+	for _, nsInfs := range nsw.nsInfs {
+		nsInfs.run()
+	}
+	nsw.mtx.Unlock()
+
+	if nsw.nsInformer != nil {
+		go nsw.nsInformer.Run(stopCh)
+	}
+
+	go func() {
+		<-stopCh
+		nsw.mtx.Lock()
+		defer nsw.mtx.Unlock()
+		nsw.started = false
+		for ns, nsInfs := range nsw.nsInfs {
+			close(nsInfs.stopCh)
+			delete(nsw.nsInfs, ns)
+		}
+	}()
+}
+
+// hasSynced returns true if the namespace informer and the informers
+// for all currently watched namespaces have synced.
+func (nsw *nsWatcher) hasSynced() bool {
+	if nsw.nsInformer != nil && !nsw.nsInformer.HasSynced() {
+		return false
+	}
+	for _, informer := range nsw.informers() {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// informers returns the informers for all watched namespaces.
+func (nsw *nsWatcher) informers() []cache.SharedIndexInformer {
+	nsw.mtx.Lock()
+	defer nsw.mtx.Unlock()
+	var infs []cache.SharedIndexInformer
+	for _, nsInfs := range nsw.nsInfs {
+		infs = append(infs, nsInfs.all()...)
+	}
+	return infs
+}
+
+// listers returns listers that read from the informers for all
+// watched namespaces.
+func (nsw *nsWatcher) listers() *Listers {
+	return &Listers{
+		ing:  ext_listers.NewIngressLister(nsw.idxs.ing),
+		svc:  core_v1_listers.NewServiceLister(nsw.idxs.svc),
+		endp: core_v1_listers.NewEndpointsLister(nsw.idxs.endp),
+		secr: core_v1_listers.NewSecretLister(nsw.idxs.secr),
+		cmap: core_v1_listers.NewConfigMapLister(nsw.idxs.cmap),
+		vcfg: vcr_listers.NewVarnishConfigLister(nsw.idxs.vcfg),
+		bcfg: vcr_listers.NewBackendConfigLister(nsw.idxs.bcfg),
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+	core_v1_listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	api_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNsIndexer(t *testing.T) {
+	nsIdx := newNsIndexer()
+	for _, ns := range []string{"tenant-a", "tenant-b"} {
+		idx := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+			cache.Indexers{
+				cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+			})
+		svc := &api_v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Namespace: ns,
+				Name:      "varnish",
+			},
+		}
+		if err := idx.Add(svc); err != nil {
+			t.Fatalf("Add(): %v", err)
+		}
+		nsIdx.set(ns, idx)
+	}
+	lister := core_v1_listers.NewServiceLister(nsIdx)
+
+	svcs, err := lister.List(labels.Everything())
+	if err != nil {
+		t.Fatalf("List(): %v", err)
+	}
+	if len(svcs) != 2 {
+		t.Errorf("List(): want 2 Services, got %d", len(svcs))
+	}
+	svc, err := lister.Services("tenant-a").Get("varnish")
+	if err != nil {
+		t.Fatalf("Services(tenant-a).Get(): %v", err)
+	}
+	if svc.Namespace != "tenant-a" {
+		t.Errorf("Services(tenant-a).Get(): namespace want=tenant-a "+
+			"got=%s", svc.Namespace)
+	}
+	svcs, err = lister.Services("tenant-b").List(labels.Everything())
+	if err != nil {
+		t.Fatalf("Services(tenant-b).List(): %v", err)
+	}
+	if len(svcs) != 1 || svcs[0].Namespace != "tenant-b" {
+		t.Errorf("Services(tenant-b).List(): want 1 Service in "+
+			"tenant-b, got %+v", svcs)
+	}
+	if _, err = lister.Services("other").Get("varnish"); err == nil {
+		t.Error("Services(other).Get(): expected not found error")
+	}
+
+	nsIdx.set("tenant-b", nil)
+	svcs, err = lister.List(labels.Everything())
+	if err != nil {
+		t.Fatalf("List(): %v", err)
+	}
+	if len(svcs) != 1 {
+		t.Errorf("List() after removing namespace: want 1 Service, "+
+			"got %d", len(svcs))
+	}
+	svcs, err = lister.Services("tenant-b").List(labels.Everything())
+	if err != nil {
+		t.Fatalf("Services(tenant-b).List(): %v", err)
+	}
+	if len(svcs) != 0 {
+		t.Errorf("Services(tenant-b).List() after removing namespace: "+
+			"want 0 Services, got %d", len(svcs))
+	}
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+package controller
+
+// Offline generation of VCL specs from resources read from files
+
+import (
+	"fmt"
+	"sort"
+
+	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
+	vcr_listers "code.uplex.de/uplex-varnish/k8s-ingress/pkg/client/listers/varnishingress/v1alpha1"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	core_v1_listers "k8s.io/client-go/listers/core/v1"
+	ext_listers "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+
+	api_v1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+)
+
+// RenderSpecs generates the VCL spec for each Varnish Service that
+// implements Ingresses among the resources in objs, as the controller
+// would if objs were the resources in the cluster. The specs are
+// returned in a map indexed by the namespace/name of the Varnish
+// Service.
+//
+//    log: logger for messages about the generation of the specs
+//    ingClass: value of the ingress.class Ingress annotation
+//    objs: Ingresses, Services, Endpoints, Pods, Secrets,
+//          ConfigMaps, VarnishConfigs, BackendConfigs and
+//          ClusterVarnishConfigs; resources of other types are
+//          ignored
+//
+// Resources without a namespace are placed in the default namespace,
+// except for ClusterVarnishConfigs, which are cluster-scoped. The
+// Secrets and ConfigMaps named in ClusterVarnishConfigs are read from
+// the default namespace.
+// Pods are only needed if Services have named target ports, and for
+// the Varnish Pods of a self-sharding cluster.
+func RenderSpecs(log *logrus.Entry, ingClass string,
+	objs []runtime.Object) (map[string]vcl.Spec, error) {
+
+	indexers := make(map[string]cache.Indexer)
+	for _, kind := range []string{"Ingress", "Service", "Endpoints",
+		"Secret", "ConfigMap", "VarnishConfig", "BackendConfig",
+		"ClusterVarnishConfig"} {
+
+		indexers[kind] = cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+			cache.Indexers{
+				cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+			})
+	}
+	var pods []runtime.Object
+	for _, obj := range objs {
+		objMeta, err := meta.Accessor(obj)
+		if err != nil {
+			return nil, err
+		}
+		_, cluster := obj.(*vcr_v1alpha1.ClusterVarnishConfig)
+		if objMeta.GetNamespace() == "" && !cluster {
+			objMeta.SetNamespace("default")
+		}
+		var kind string
+		switch obj.(type) {
+		case *extensions.Ingress:
+			kind = "Ingress"
+		case *api_v1.Service:
+			kind = "Service"
+		case *api_v1.Endpoints:
+			kind = "Endpoints"
+		case *api_v1.Secret:
+			kind = "Secret"
+		case *api_v1.ConfigMap:
+			kind = "ConfigMap"
+		case *vcr_v1alpha1.VarnishConfig:
+			kind = "VarnishConfig"
+		case *vcr_v1alpha1.BackendConfig:
+			kind = "BackendConfig"
+		case *vcr_v1alpha1.ClusterVarnishConfig:
+			kind = "ClusterVarnishConfig"
+		case *api_v1.Pod:
+			pods = append(pods, obj)
+			continue
+		default:
+			log.Debugf("Ignoring %T %s/%s", obj,
+				objMeta.GetNamespace(), objMeta.GetName())
+			continue
+		}
+		if err = indexers[kind].Add(obj); err != nil {
+			return nil, err
+		}
+	}
+
+	listers := &Listers{
+		ing:  ext_listers.NewIngressLister(indexers["Ingress"]),
+		svc:  core_v1_listers.NewServiceLister(indexers["Service"]),
+		endp: core_v1_listers.NewEndpointsLister(indexers["Endpoints"]),
+		secr: core_v1_listers.NewSecretLister(indexers["Secret"]),
+		cmap: core_v1_listers.NewConfigMapLister(indexers["ConfigMap"]),
+		vcfg: vcr_listers.NewVarnishConfigLister(
+			indexers["VarnishConfig"]),
+		bcfg: vcr_listers.NewBackendConfigLister(
+			indexers["BackendConfig"]),
+		cvcfg: vcr_listers.NewClusterVarnishConfigLister(
+			indexers["ClusterVarnishConfig"]),
+	}
+	listers.csecr = listers.secr.Secrets("default")
+	listers.ccmap = listers.cmap.ConfigMaps("default")
+	client := fake.NewSimpleClientset(pods...)
+	workers := make(map[string]*NamespaceWorker)
+	worker := func(ns string) *NamespaceWorker {
+		if w, exists := workers[ns]; exists {
+			return w
+		}
+		nsLog := log.WithField(logNamespace, ns)
+		w := &NamespaceWorker{
+			namespace: ns,
+			ingClass:  ingClass,
+			log:       nsLog,
+			nsLog:     nsLog,
+			listers:   listers,
+			ing:       listers.ing.Ingresses(ns),
+			svc:       listers.svc.Services(ns),
+			endp:      listers.endp.Endpoints(ns),
+			secr:      listers.secr.Secrets(ns),
+			cmap:      listers.cmap.ConfigMaps(ns),
+			vcfg:      listers.vcfg.VarnishConfigs(ns),
+			bcfg:      listers.bcfg.BackendConfigs(ns),
+			client:    client,
+		}
+		workers[ns] = w
+		return w
+	}
+
+	// As in the controller, the spec for a Varnish Service is
+	// generated by the worker for the namespace of an Ingress that
+	// it implements; here, the first one in sort order.
+	ingKeys := indexers["Ingress"].ListKeys()
+	sort.Strings(ingKeys)
+	svcs := make(map[string]*api_v1.Service)
+	svcWorkers := make(map[string]*NamespaceWorker)
+	for _, key := range ingKeys {
+		obj, _, err := indexers["Ingress"].GetByKey(key)
+		if err != nil {
+			return nil, err
+		}
+		ing := obj.(*extensions.Ingress)
+		w := worker(ing.Namespace)
+		if !w.isVarnishIngress(ing) {
+			log.Debugf("Ignoring Ingress %s: not Varnish Ingress "+
+				"class %s", key, ingClass)
+			continue
+		}
+		svc, err := w.getVarnishSvcForIng(ing)
+		if err != nil {
+			return nil, err
+		}
+		if svc == nil {
+			return nil, fmt.Errorf("No Varnish Service found for "+
+				"Ingress %s", key)
+		}
+		svcKey := svc.Namespace + "/" + svc.Name
+		if _, exists := svcs[svcKey]; !exists {
+			svcs[svcKey] = svc
+			svcWorkers[svcKey] = w
+		}
+	}
+
+	specs := make(map[string]vcl.Spec, len(svcs))
+	for svcKey, svc := range svcs {
+		w := svcWorkers[svcKey]
+		ings, err := w.getIngsForVarnishSvc(svc)
+		if err != nil {
+			return nil, err
+		}
+		spec, svcMeta, err := w.svcSpec(svc, ings)
+		if err != nil {
+			return nil, fmt.Errorf("Varnish Service %s: %v", svcKey,
+				err)
+		}
+		err = w.analyzeSpec(spec, ings, svcMeta.vcfg)
+		if err != nil {
+			return nil, fmt.Errorf("Varnish Service %s: %v", svcKey,
+				err)
+		}
+		specs[svcKey] = spec
+	}
+	return specs, nil
+}
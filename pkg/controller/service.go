@@ -41,6 +41,10 @@ import (
 // XXX make this configurable
 const admPortName = "varnishadm"
 
+// Annotation for a Varnish Service to pin it to a config in its
+// history.
+const pinConfigKey = annotationPrefix + "pin-config"
+
 // isVarnishIngSvc determines if a Service represents a Varnish that
 // can implement Ingress, for which this controller is responsible.
 // Currently the app label must point to a hardwired name.
@@ -137,8 +141,15 @@ func (worker *NamespaceWorker) syncSvc(key string) error {
 		svc.Namespace, svc.Name)
 
 	// Check if there are Ingresses for which the VCL spec may
-	// change due to changes in Varnish services.
+	// change due to changes in Varnish services, or if the
+	// isolation of tenants changes.
 	updateVCL := false
+	svcKey := svc.Namespace + "/" + svc.Name
+	mode, err := isolation(svc)
+	if err != nil {
+		worker.syncFailure(svc, "%v", err)
+	}
+	isolate := mode != "" || worker.vController.Isolated(svcKey)
 	ings, err := worker.ing.List(labels.Everything())
 	if err != nil {
 		return err
@@ -158,7 +169,7 @@ func (worker *NamespaceWorker) syncSvc(key string) error {
 			ingSvc.Name != svc.Name {
 			continue
 		}
-		if !worker.isVarnishInVCLSpec(ing) {
+		if !isolate && !worker.isVarnishInVCLSpec(ing) {
 			continue
 		}
 		updateVCL = true
@@ -243,6 +254,11 @@ func (worker *NamespaceWorker) syncSvc(key string) error {
 	}
 	worker.log.Tracef("Varnish service %s/%s addresses: %+v", svc.Namespace,
 		svc.Name, addrs)
+	pin := svc.Annotations[pinConfigKey]
+	if err = worker.vController.PinConfig(svc.Namespace+"/"+svc.Name,
+		pin); err != nil {
+		return err
+	}
 	return worker.vController.AddOrUpdateVarnishSvc(
 		svc.Namespace+"/"+svc.Name, addrs,
 		worker.namespace+"/"+secrName, !updateVCL)
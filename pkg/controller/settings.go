@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	api_v1 "k8s.io/api/core/v1"
+)
+
+// EventVerbosity classifies the Events that the controller generates
+// for resources that it syncs.
+type EventVerbosity int32
+
+const (
+	// EventsAll generates all Events.
+	EventsAll EventVerbosity = iota
+	// EventsWarning only generates Events with type "Warning".
+	EventsWarning
+	// EventsNone generates no Events.
+	EventsNone
+)
+
+func (v EventVerbosity) String() string {
+	switch v {
+	case EventsAll:
+		return "all"
+	case EventsWarning:
+		return "warning"
+	case EventsNone:
+		return "none"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseEventVerbosity returns the EventVerbosity named by s, one of
+// "all", "warning" or "none" (case-insensitive).
+func ParseEventVerbosity(s string) (EventVerbosity, error) {
+	switch strings.ToLower(s) {
+	case "all":
+		return EventsAll, nil
+	case "warning":
+		return EventsWarning, nil
+	case "none":
+		return EventsNone, nil
+	default:
+		return EventsAll, fmt.Errorf("Unknown event verbosity %s, "+
+			"must be one of all, warning or none", s)
+	}
+}
+
+// verbosityRecorder is an EventRecorder that discards Events as
+// required by its current EventVerbosity.
+type verbosityRecorder struct {
+	record.EventRecorder
+	verbosity int32
+}
+
+func (r *verbosityRecorder) record(evtType string) bool {
+	switch EventVerbosity(atomic.LoadInt32(&r.verbosity)) {
+	case EventsNone:
+		return false
+	case EventsWarning:
+		return evtType == api_v1.EventTypeWarning
+	default:
+		return true
+	}
+}
+
+func (r *verbosityRecorder) Event(obj runtime.Object, evtType, reason,
+	msg string) {
+
+	if r.record(evtType) {
+		r.EventRecorder.Event(obj, evtType, reason, msg)
+	}
+}
+
+func (r *verbosityRecorder) Eventf(obj runtime.Object, evtType, reason,
+	msgFmt string, args ...interface{}) {
+
+	if r.record(evtType) {
+		r.EventRecorder.Eventf(obj, evtType, reason, msgFmt, args...)
+	}
+}
+
+func (r *verbosityRecorder) AnnotatedEventf(obj runtime.Object,
+	annotations map[string]string, evtType, reason, msgFmt string,
+	args ...interface{}) {
+
+	if r.record(evtType) {
+		r.EventRecorder.AnnotatedEventf(obj, annotations, evtType,
+			reason, msgFmt, args...)
+	}
+}
+
+// SetEventVerbosity determines which Events the controller generates.
+func (ingc *IngressController) SetEventVerbosity(v EventVerbosity) {
+	atomic.StoreInt32(&ingc.recorder.verbosity, int32(v))
+}
+
+// BackendDefaults are applied to the backends for Services that are
+// not configured by a BackendConfig, or whose BackendConfig does not
+// set the corresponding field. Zero values leave the defaults of
+// Varnish in effect. A default probe is only configured if ProbeURL
+// is non-empty.
+type BackendDefaults struct {
+	ConnectTimeout      time.Duration
+	FirstByteTimeout    time.Duration
+	BetweenBytesTimeout time.Duration
+	ProbeURL            string
+	ProbeInterval       time.Duration
+	ProbeTimeout        time.Duration
+}
+
+// vclDur formats d as a VCL duration, or returns the empty string if
+// d <= 0s.
+func vclDur(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+func (d BackendDefaults) apply(svc *vcl.Service) {
+	if svc.ConnectTimeout == "" {
+		svc.ConnectTimeout = vclDur(d.ConnectTimeout)
+	}
+	if svc.FirstByteTimeout == "" {
+		svc.FirstByteTimeout = vclDur(d.FirstByteTimeout)
+	}
+	if svc.BetweenBytesTimeout == "" {
+		svc.BetweenBytesTimeout = vclDur(d.BetweenBytesTimeout)
+	}
+	if svc.Probe == nil && d.ProbeURL != "" {
+		svc.Probe = &vcl.Probe{
+			URL:      d.ProbeURL,
+			Interval: vclDur(d.ProbeInterval),
+			Timeout:  vclDur(d.ProbeTimeout),
+		}
+	}
+}
+
+// beDefaults holds the BackendDefaults shared by all workers.
+type beDefaults struct {
+	mtx      sync.RWMutex
+	defaults BackendDefaults
+}
+
+func (d *beDefaults) get() BackendDefaults {
+	if d == nil {
+		return BackendDefaults{}
+	}
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.defaults
+}
+
+func (d *beDefaults) set(defaults BackendDefaults) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.defaults == defaults {
+		return false
+	}
+	d.defaults = defaults
+	return true
+}
+
+// SetBackendDefaults sets the defaults for backend timeouts and
+// probes. If they have changed, and this replica is the leader, all
+// resources are synced again, so that the new defaults take effect
+// immediately.
+func (ingc *IngressController) SetBackendDefaults(defaults BackendDefaults) {
+	if !ingc.nsQs.beDefaults.set(defaults) || !ingc.isLeader() {
+		return
+	}
+	ingc.log.Info("Backend defaults changed, syncing all resources")
+	ingc.enqueueAll()
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	"k8s.io/client-go/tools/record"
+
+	api_v1 "k8s.io/api/core/v1"
+)
+
+func TestEventVerbosity(t *testing.T) {
+	fake := record.NewFakeRecorder(10)
+	recorder := &verbosityRecorder{EventRecorder: fake}
+	svc := &api_v1.Service{}
+	for _, test := range []struct {
+		verbosity EventVerbosity
+		want      int
+	}{
+		{EventsAll, 2},
+		{EventsWarning, 1},
+		{EventsNone, 0},
+	} {
+		recorder.verbosity = int32(test.verbosity)
+		recorder.Eventf(svc, api_v1.EventTypeNormal, "Test", "normal")
+		recorder.Eventf(svc, api_v1.EventTypeWarning, "Test", "warn")
+		if n := len(fake.Events); n != test.want {
+			t.Errorf("verbosity=%s: want %d events got %d",
+				test.verbosity, test.want, n)
+		}
+		for len(fake.Events) > 0 {
+			<-fake.Events
+		}
+	}
+
+	if _, err := ParseEventVerbosity("loud"); err == nil {
+		t.Error("ParseEventVerbosity(loud): expected error")
+	}
+}
+
+func TestBackendDefaults(t *testing.T) {
+	defaults := BackendDefaults{
+		ConnectTimeout:   1500 * time.Millisecond,
+		FirstByteTimeout: time.Minute,
+		ProbeURL:         "/healthz",
+		ProbeInterval:    5 * time.Second,
+	}
+	svc := vcl.Service{FirstByteTimeout: "10s"}
+	defaults.apply(&svc)
+	if svc.ConnectTimeout != "1.5s" {
+		t.Errorf("ConnectTimeout want=1.5s got=%s", svc.ConnectTimeout)
+	}
+	if svc.FirstByteTimeout != "10s" {
+		t.Errorf("FirstByteTimeout from BackendConfig overridden: %s",
+			svc.FirstByteTimeout)
+	}
+	if svc.BetweenBytesTimeout != "" {
+		t.Errorf("BetweenBytesTimeout want empty got=%s",
+			svc.BetweenBytesTimeout)
+	}
+	if svc.Probe == nil || svc.Probe.URL != "/healthz" ||
+		svc.Probe.Interval != "5s" || svc.Probe.Timeout != "" {
+		t.Errorf("default probe: got %+v", svc.Probe)
+	}
+
+	for d, want := range map[time.Duration]string{
+		10 * time.Microsecond: "0.00001s",
+		time.Millisecond:      "0.001s",
+		1000000 * time.Second: "1000000s",
+		0:                     "",
+	} {
+		if got := vclDur(d); got != want {
+			t.Errorf("vclDur(%v) want=%s got=%s", d, want, got)
+		}
+	}
+
+	probe := &vcl.Probe{URL: "/ready"}
+	svc = vcl.Service{Probe: probe}
+	defaults.apply(&svc)
+	if svc.Probe != probe {
+		t.Errorf("probe from BackendConfig overridden: %+v", svc.Probe)
+	}
+}
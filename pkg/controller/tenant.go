@@ -0,0 +1,252 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+// Isolation of the tenants of a Varnish Service in separate VCL
+// configs
+
+import (
+	"fmt"
+	"sort"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish"
+
+	api_v1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+)
+
+// Annotation for a Varnish Service to isolate its tenants, with the
+// values "namespace" (the Ingresses in a namespace form a tenant) or
+// "ingress" (each Ingress is a tenant).
+const (
+	isolationKey     = annotationPrefix + "isolation"
+	isolateNamespace = "namespace"
+	isolateIngress   = "ingress"
+)
+
+// isolation returns the isolation mode set by annotation for the
+// Varnish Service svc, or "" if its tenants are not isolated.
+func isolation(svc *api_v1.Service) (string, error) {
+	mode, exists := svc.Annotations[isolationKey]
+	if !exists || mode == "" {
+		return "", nil
+	}
+	if mode != isolateNamespace && mode != isolateIngress {
+		return "", fmt.Errorf("Varnish Service %s/%s: illegal value "+
+			"'%s' for annotation %s, must be '%s' or '%s'",
+			svc.Namespace, svc.Name, mode, isolationKey,
+			isolateNamespace, isolateIngress)
+	}
+	return mode, nil
+}
+
+// tenantName returns the name of the tenant to which the Ingress ing
+// belongs, in isolation mode: the namespace, or namespace/name.
+func tenantName(ing *extensions.Ingress, mode string) string {
+	if mode == isolateIngress {
+		return ing.Namespace + "/" + ing.Name
+	}
+	return ing.Namespace
+}
+
+// groupTenants groups the Ingresses in ings by tenant, and returns
+// the groups and the tenant names in sorted order.
+func groupTenants(ings []*extensions.Ingress,
+	mode string) (map[string][]*extensions.Ingress, []string) {
+
+	groups := make(map[string][]*extensions.Ingress)
+	names := make([]string, 0)
+	for _, ing := range ings {
+		name := tenantName(ing, mode)
+		if _, exists := groups[name]; !exists {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], ing)
+	}
+	sort.Strings(names)
+	return groups, names
+}
+
+// nsWorker returns a worker for the namespace ns that shares the
+// listers, client, recorder and settings of worker, so that the spec
+// for a tenant is generated from the VarnishConfigs and Services in
+// the tenant's namespace. The returned worker is not started.
+func (worker *NamespaceWorker) nsWorker(ns string) *NamespaceWorker {
+	if ns == worker.namespace {
+		return worker
+	}
+	nsLog := worker.log.WithField(logNamespace, ns)
+	return &NamespaceWorker{
+		namespace:   ns,
+		ingClass:    worker.ingClass,
+		log:         nsLog,
+		nsLog:       nsLog,
+		vController: worker.vController,
+		mainQueue:   worker.mainQueue,
+		listers:     worker.listers,
+		ing:         worker.listers.ing.Ingresses(ns),
+		svc:         worker.listers.svc.Services(ns),
+		endp:        worker.listers.endp.Endpoints(ns),
+		secr:        worker.listers.secr.Secrets(ns),
+		cmap:        worker.listers.cmap.ConfigMaps(ns),
+		vcfg:        worker.listers.vcfg.VarnishConfigs(ns),
+		bcfg:        worker.listers.bcfg.BackendConfigs(ns),
+		client:      worker.client,
+		recorder:    worker.recorder,
+		beDefaults:  worker.beDefaults,
+	}
+}
+
+// tenantConflict returns an error if a host in the Ingresses of the
+// tenant identified by name, or the default backend, is already
+// claimed by another tenant, as recorded in hosts and dflt;
+// otherwise its hosts and default backend are recorded as claimed.
+func tenantConflict(name string, ings []*extensions.Ingress,
+	hosts map[string]string, dflt *string) error {
+
+	for _, ing := range ings {
+		if ing.Spec.Backend != nil && *dflt != "" && *dflt != name {
+			return fmt.Errorf("Default backend is also defined by "+
+				"tenant %s", *dflt)
+		}
+		for _, rule := range ing.Spec.Rules {
+			other, exists := hosts[rule.Host]
+			if exists && other != name {
+				return fmt.Errorf("Host '%s' is also named in "+
+					"rules for tenant %s", rule.Host, other)
+			}
+		}
+	}
+	for _, ing := range ings {
+		if ing.Spec.Backend != nil {
+			*dflt = name
+		}
+		for _, rule := range ing.Spec.Rules {
+			hosts[rule.Host] = name
+		}
+	}
+	return nil
+}
+
+// updateTenants updates the Varnish Service svc, whose tenants are
+// isolated by mode, to implement the Ingresses in ings. The spec for
+// each tenant is generated by a worker for the tenant's namespace.
+// ing is the Ingress currently synced; an error is returned if the
+// config for its tenant could not be updated. Failures for the other
+// tenants are reported as Events for their Ingresses and
+// VarnishConfig, so that the sync of ing is not retried for errors
+// in configs for which it is not responsible.
+func (worker *NamespaceWorker) updateTenants(svc *api_v1.Service,
+	mode string, ings []*extensions.Ingress,
+	ing *extensions.Ingress) error {
+
+	svcKey := svc.Namespace + "/" + svc.Name
+	groups, names := groupTenants(ings, mode)
+	worker.log.Infof("Varnish Service %s: tenants isolated by %s: %v",
+		svcKey, mode, names)
+
+	tenants := make([]varnish.Tenant, 0, len(names))
+	failed := make(map[string]error)
+	vcfgs := make(map[string]varnish.VcfgMeta)
+	hosts := make(map[string]string)
+	dflt := ""
+	for _, name := range names {
+		tIngs := groups[name]
+		w := worker.nsWorker(tIngs[0].Namespace)
+		tenant := varnish.Tenant{Name: name}
+		spec, meta, err := w.svcSpec(svc, tIngs)
+		if err == nil {
+			vcfgs[name] = meta.vcfg
+			err = w.analyzeSpec(spec, tIngs, meta.vcfg)
+		}
+		if err == nil {
+			err = tenantConflict(name, tIngs, hosts, &dflt)
+		}
+		if err != nil {
+			tenant.Err = err
+			failed[name] = err
+		} else {
+			tenant.Spec = spec
+			tenant.Ings = meta.ings
+			tenant.Vcfg = meta.vcfg
+			tenant.Bcfg = meta.bcfg
+		}
+		tenants = append(tenants, tenant)
+	}
+
+	err := worker.vController.UpdateTenants(svcKey, tenants)
+	switch errs := err.(type) {
+	case nil:
+	case varnish.TenantErrors:
+		for name, tErr := range errs {
+			failed[name] = tErr
+		}
+	default:
+		return err
+	}
+
+	current := tenantName(ing, mode)
+	for _, name := range names {
+		tErr, exists := failed[name]
+		if !exists || name == current {
+			continue
+		}
+		worker.tenantFailure(svcKey, name, groups[name],
+			vcfgs[name], tErr)
+	}
+	if tErr, exists := failed[current]; exists {
+		return fmt.Errorf("Varnish Service %s tenant %s: %v", svcKey,
+			current, tErr)
+	}
+	return nil
+}
+
+// tenantFailure reports the error err for the tenant identified by
+// name as Warning Events for the tenant's Ingresses, and for the
+// VarnishConfigs in vcfgMeta.
+func (worker *NamespaceWorker) tenantFailure(svcKey, name string,
+	ings []*extensions.Ingress, vcfgMeta varnish.VcfgMeta, err error) {
+
+	worker.log.Errorf("Varnish Service %s tenant %s: %v", svcKey, name,
+		err)
+	for _, ing := range ings {
+		worker.warnEvent(ing, syncFailure,
+			"Varnish Service %s tenant %s: %v", svcKey, name, err)
+	}
+	for _, meta := range vcfgMeta.Configs {
+		vcfg, getErr := worker.vcfgObj(meta.Key)
+		if getErr != nil {
+			worker.log.Warnf("Cannot get VarnishConfig %s: %v",
+				meta.Key, getErr)
+			continue
+		}
+		worker.warnEvent(vcfg, syncFailure,
+			"Varnish Service %s tenant %s: %v", svcKey, name, err)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsolation(t *testing.T) {
+	svc := &api_v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "varnish",
+			Name:        "varnish-ingress",
+			Annotations: map[string]string{},
+		},
+	}
+	for val, exp := range map[string]string{
+		"":               "",
+		isolateNamespace: isolateNamespace,
+		isolateIngress:   isolateIngress,
+	} {
+		svc.Annotations[isolationKey] = val
+		if mode, err := isolation(svc); err != nil || mode != exp {
+			t.Errorf("isolation(%s): want %s got %s, err=%v", val,
+				exp, mode, err)
+		}
+	}
+	svc.Annotations[isolationKey] = "pod"
+	if _, err := isolation(svc); err == nil {
+		t.Error("isolation(pod): expected error")
+	}
+}
+
+func tenantIng(ns, name string, dflt bool,
+	hosts ...string) *extensions.Ingress {
+
+	ing := &extensions.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+	}
+	if dflt {
+		ing.Spec.Backend = &extensions.IngressBackend{
+			ServiceName: "svc",
+		}
+	}
+	for _, host := range hosts {
+		ing.Spec.Rules = append(ing.Spec.Rules,
+			extensions.IngressRule{Host: host})
+	}
+	return ing
+}
+
+func TestGroupTenants(t *testing.T) {
+	ings := []*extensions.Ingress{
+		tenantIng("tea", "ing1", false, "tea.example.com"),
+		tenantIng("cafe", "ing2", false, "cafe.example.com"),
+		tenantIng("tea", "ing3", false, "green.example.com"),
+	}
+	groups, names := groupTenants(ings, isolateNamespace)
+	if len(names) != 2 || names[0] != "cafe" || names[1] != "tea" {
+		t.Errorf("groupTenants(namespace) names: %v", names)
+	}
+	if len(groups["tea"]) != 2 || len(groups["cafe"]) != 1 {
+		t.Errorf("groupTenants(namespace): %+v", groups)
+	}
+
+	groups, names = groupTenants(ings, isolateIngress)
+	if len(names) != 3 || names[0] != "cafe/ing2" ||
+		names[1] != "tea/ing1" || names[2] != "tea/ing3" {
+		t.Errorf("groupTenants(ingress) names: %v", names)
+	}
+	if len(groups["tea/ing1"]) != 1 {
+		t.Errorf("groupTenants(ingress): %+v", groups)
+	}
+}
+
+func TestTenantConflict(t *testing.T) {
+	hosts := make(map[string]string)
+	dflt := ""
+	cafe := []*extensions.Ingress{
+		tenantIng("cafe", "ing1", true, "cafe.example.com"),
+		tenantIng("cafe", "ing2", false, "cafe.example.com"),
+	}
+	if err := tenantConflict("cafe", cafe, hosts, &dflt); err != nil {
+		t.Errorf("tenantConflict(cafe): %v", err)
+	}
+	if dflt != "cafe" || hosts["cafe.example.com"] != "cafe" {
+		t.Errorf("tenantConflict(cafe): dflt=%s hosts=%v", dflt, hosts)
+	}
+
+	tea := []*extensions.Ingress{
+		tenantIng("tea", "ing1", false, "tea.example.com",
+			"cafe.example.com"),
+	}
+	if err := tenantConflict("tea", tea, hosts, &dflt); err == nil {
+		t.Error("tenantConflict(tea) host: expected error")
+	} else {
+		t.Logf("tenantConflict() returned as expected: %v", err)
+	}
+	if _, exists := hosts["tea.example.com"]; exists {
+		t.Error("tenantConflict() claimed hosts for a failed tenant")
+	}
+
+	tea = []*extensions.Ingress{
+		tenantIng("tea", "ing1", true, "tea.example.com"),
+	}
+	if err := tenantConflict("tea", tea, hosts, &dflt); err == nil {
+		t.Error("tenantConflict(tea) default: expected error")
+	}
+	tea[0].Spec.Backend = nil
+	if err := tenantConflict("tea", tea, hosts, &dflt); err != nil {
+		t.Errorf("tenantConflict(tea): %v", err)
+	}
+}
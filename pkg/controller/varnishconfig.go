@@ -36,6 +36,7 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 
 	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
 
 	api_v1 "k8s.io/api/core/v1"
 	extensions "k8s.io/api/extensions/v1beta1"
@@ -263,6 +264,17 @@ func (worker *NamespaceWorker) syncVcfg(key string) error {
 	if err = validateReqDisps(vcfg.Spec.ReqDispositions); err != nil {
 		return err
 	}
+	if err = validateSnippets(vcfg.Spec.Snippets); err != nil {
+		return err
+	}
+	tmpls, err := worker.vcfgTemplates(vcfg)
+	if err != nil {
+		return err
+	}
+	if err = vcl.ValidateTemplates(tmpls); err != nil {
+		return fmt.Errorf("VarnishConfig %s/%s invalid templates: %v",
+			vcfg.Namespace, vcfg.Name, err)
+	}
 
 	return worker.enqueueIngsForVcfg(vcfg)
 }
@@ -285,3 +297,23 @@ func (worker *NamespaceWorker) deleteVcfg(obj interface{}) error {
 		vcfg.Name)
 	return worker.enqueueIngsForVcfg(vcfg)
 }
+
+func validateSnippets(snippets []vcr_v1alpha1.SnippetSpec) error {
+	names := make(map[string]struct{}, len(snippets))
+	for _, snip := range snippets {
+		if _, exists := names[snip.Name]; exists {
+			return fmt.Errorf("snippet name %s is not unique",
+				snip.Name)
+		}
+		names[snip.Name] = struct{}{}
+		if (snip.VCL == "") == (snip.ConfigMapName == "") {
+			return fmt.Errorf("snippet %s: exactly one of vcl or "+
+				"configMapName must be set", snip.Name)
+		}
+		if (snip.ConfigMapName == "") != (snip.Key == "") {
+			return fmt.Errorf("snippet %s: key must be set if and "+
+				"only if configMapName is set", snip.Name)
+		}
+	}
+	return nil
+}
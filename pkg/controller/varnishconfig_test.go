@@ -152,3 +152,54 @@ func TestValidateReqDisps(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateSnippets(t *testing.T) {
+	badSnippetSlice := [][]vcr_v1alpha1.SnippetSpec{
+		{
+			{Name: "foo", Sub: vcr_v1alpha1.Recv, VCL: "return(pass);"},
+			{Name: "foo", Sub: vcr_v1alpha1.Hash, VCL: "return(lookup);"},
+		},
+		{{Name: "foo", Sub: vcr_v1alpha1.Recv}},
+		{{
+			Name:          "foo",
+			Sub:           vcr_v1alpha1.Recv,
+			VCL:           "return(pass);",
+			ConfigMapName: "snippets",
+			Key:           "foo",
+		}},
+		{{Name: "foo", Sub: vcr_v1alpha1.Recv, ConfigMapName: "snippets"}},
+		{{
+			Name: "foo",
+			Sub:  vcr_v1alpha1.Recv,
+			VCL:  "return(pass);",
+			Key:  "foo",
+		}},
+	}
+
+	goodSnippetSlice := [][]vcr_v1alpha1.SnippetSpec{
+		{},
+		{
+			{Name: "foo", Sub: vcr_v1alpha1.Recv, VCL: "return(pass);"},
+			{
+				Name:          "bar",
+				Sub:           vcr_v1alpha1.Init,
+				Position:      vcr_v1alpha1.Before,
+				ConfigMapName: "snippets",
+				Key:           "bar",
+			},
+		},
+	}
+
+	for _, snips := range badSnippetSlice {
+		if err := validateSnippets(snips); err == nil {
+			t.Errorf("validateSnippets(%+v) expected error got=nil",
+				snips)
+		}
+	}
+	for _, snips := range goodSnippetSlice {
+		if err := validateSnippets(snips); err != nil {
+			t.Errorf("validateSnippets(%+v) expected no error got=%v",
+				snips, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+// Validating admission webhook for VarnishConfig and
+// ClusterVarnishConfig resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/analyze"
+	vcr_v1alpha1 "code.uplex.de/uplex-varnish/k8s-ingress/pkg/apis/varnishingress/v1alpha1"
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	"github.com/sirupsen/logrus"
+
+	admission "k8s.io/api/admission/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WebhookPath is the path at which the validating admission webhook
+// is served.
+const WebhookPath = "/validate"
+
+// Upper bound for the size of an AdmissionReview in a request body.
+const maxReviewBytes = 3 * 1024 * 1024
+
+// ServeWebhook serves the validating admission webhook for
+// VarnishConfig and ClusterVarnishConfig resources at WebhookPath, via
+// TLS at port, with the certificate and private key in certFile and
+// keyFile. As with ServeMetrics, the process exits if the listener
+// fails, so it should be run in a goroutine.
+//
+// The webhook rejects configs that fail the checks applied when they
+// are synced, or for which the static analysis (see pkg/analyze)
+// finds errors. Findings with severity Warning are logged, and the
+// config is admitted, unless rejectWarnings is true.
+func ServeWebhook(log *logrus.Entry, port uint16, certFile, keyFile string,
+	rejectWarnings bool) {
+
+	mux := http.NewServeMux()
+	mux.Handle(WebhookPath, webhookHandler(log, rejectWarnings))
+	addr := fmt.Sprintf(":%d", port)
+	log.Infof("Serving validating webhook at %s%s", addr, WebhookPath)
+	log.Fatal(http.ListenAndServeTLS(addr, certFile, keyFile, mux))
+}
+
+func webhookHandler(log *logrus.Entry, rejectWarnings bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body,
+			maxReviewBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var review admission.AdmissionReview
+		if err = json.Unmarshal(body, &review); err != nil ||
+			review.Request == nil {
+
+			http.Error(w, "Invalid AdmissionReview",
+				http.StatusBadRequest)
+			return
+		}
+		review.Response = admitVcfg(log, review.Request,
+			rejectWarnings)
+		review.Response.UID = review.Request.UID
+		review.Request = nil
+		writeJSON(w, review)
+	})
+}
+
+// admitVcfg returns the response to the admission request req for a
+// VarnishConfig or ClusterVarnishConfig. Requests for other kinds of
+// resources, and DELETE requests, are admitted.
+func admitVcfg(log *logrus.Entry, req *admission.AdmissionRequest,
+	rejectWarnings bool) *admission.AdmissionResponse {
+
+	resp := &admission.AdmissionResponse{Allowed: true}
+	if req.Operation == admission.Delete {
+		return resp
+	}
+	var vcfg *vcr_v1alpha1.VarnishConfig
+	var err error
+	switch req.Kind.Kind {
+	case "VarnishConfig":
+		vcfg = &vcr_v1alpha1.VarnishConfig{}
+		err = json.Unmarshal(req.Object.Raw, vcfg)
+	case "ClusterVarnishConfig":
+		cvcfg := &vcr_v1alpha1.ClusterVarnishConfig{}
+		if err = json.Unmarshal(req.Object.Raw, cvcfg); err == nil {
+			vcfg = clusterVcfg(cvcfg)
+		}
+	default:
+		log.Warnf("Validating webhook: ignoring request for %s %s",
+			req.Kind.Kind, req.Name)
+		return resp
+	}
+	if err != nil {
+		err = fmt.Errorf("Cannot decode %s: %v", req.Kind.Kind, err)
+	} else {
+		var warnings []string
+		warnings, err = validateVcfg(log, vcfg)
+		if err == nil && rejectWarnings && len(warnings) > 0 {
+			err = fmt.Errorf("Config analysis found warnings: %s",
+				strings.Join(warnings, "; "))
+		}
+		for _, warning := range warnings {
+			log.Warnf("Validating webhook: %s %s: %s",
+				req.Kind.Kind, vcfgKey(vcfg), warning)
+		}
+	}
+	if err != nil {
+		log.Infof("Validating webhook: rejecting %s %s: %v",
+			req.Kind.Kind, req.Name, err)
+		resp.Allowed = false
+		resp.Result = &meta_v1.Status{
+			Status:  meta_v1.StatusFailure,
+			Reason:  meta_v1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Message: err.Error(),
+		}
+	}
+	return resp
+}
+
+// validateVcfg applies the checks to the VarnishConfig vcfg that are
+// applied when it is synced, and the static analysis to the part of
+// the VCL spec that it configures, on its own. Secrets and ConfigMaps
+// named in the config are not read, so templates and snippets from
+// ConfigMaps are not checked, and Ingress paths are not analyzed.
+// Returns the findings with severity Warning, and an error if the
+// config is invalid, or if the analysis finds errors.
+func validateVcfg(log *logrus.Entry,
+	vcfg *vcr_v1alpha1.VarnishConfig) ([]string, error) {
+
+	spec := &vcfg.Spec
+	if spec.SelfSharding != nil {
+		if err := validateProbe(&spec.SelfSharding.Probe); err != nil {
+			return nil, fmt.Errorf("Invalid sharding spec: %v", err)
+		}
+	}
+	if err := validateRewrites(spec.Rewrites); err != nil {
+		return nil, err
+	}
+	if err := validateReqDisps(spec.ReqDispositions); err != nil {
+		return nil, err
+	}
+	if err := validateSnippets(spec.Snippets); err != nil {
+		return nil, err
+	}
+
+	// Credentials do not affect the analysis, so the auth spec is
+	// generated without reading the Secrets.
+	worker := &NamespaceWorker{log: log}
+	var part vcl.Spec
+	for _, auth := range spec.Auth {
+		vclAuth := vcl.Auth{
+			Realm:      auth.Realm,
+			Conditions: make([]vcl.MatchTerm, len(auth.Conditions)),
+		}
+		configConditions(vclAuth.Conditions, auth.Conditions)
+		part.Auths = append(part.Auths, vclAuth)
+	}
+	if err := worker.configACL(&part, vcfg); err != nil {
+		return nil, err
+	}
+	if err := worker.configRewrites(&part, vcfg); err != nil {
+		return nil, err
+	}
+	worker.configReqDisps(&part, spec.ReqDispositions, vcfg.Kind,
+		vcfg.Namespace, vcfg.Name)
+
+	var warnings, errs []string
+	for _, f := range analyze.Spec(part) {
+		if f.Severity == analyze.Error {
+			errs = append(errs, f.String())
+		} else {
+			warnings = append(warnings, f.String())
+		}
+	}
+	if len(errs) > 0 {
+		return warnings, fmt.Errorf("Config analysis found errors: %s",
+			strings.Join(errs, "; "))
+	}
+	return warnings, nil
+}
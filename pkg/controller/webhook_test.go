@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	admission "k8s.io/api/admission/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func vcfgReview(kind, acl string) admission.AdmissionReview {
+	obj := `{"apiVersion":"ingress.varnish-cache.org/v1alpha1",` +
+		`"kind":"` + kind + `","metadata":{"name":"cfg"},` +
+		`"spec":{"services":["varnish"],"acl":[{"name":"acl",` +
+		`"addrs":[` + acl + `]}]}}`
+	return admission.AdmissionReview{
+		TypeMeta: meta_v1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Request: &admission.AdmissionRequest{
+			UID:       "4711",
+			Kind:      meta_v1.GroupVersionKind{Kind: kind},
+			Name:      "cfg",
+			Operation: admission.Create,
+			Object:    runtime.RawExtension{Raw: []byte(obj)},
+		},
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	log := logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard})
+	const (
+		valid  = `{"addr":"192.0.2.0","mask-bits":24}`
+		covers = `{"addr":"192.0.2.1"}`
+		negate = `{"addr":"192.0.2.0","mask-bits":24,"negate":true}`
+	)
+	for _, tc := range []struct {
+		kind    string
+		acl     string
+		strict  bool
+		allowed bool
+	}{
+		{"VarnishConfig", valid, false, true},
+		{"VarnishConfig", valid + "," + covers, false, true},
+		{"VarnishConfig", valid + "," + covers, true, false},
+		{"VarnishConfig", valid + "," + negate, false, false},
+		{"ClusterVarnishConfig", valid, false, true},
+		{"ClusterVarnishConfig", valid + "," + negate, false, false},
+	} {
+		body, err := json.Marshal(vcfgReview(tc.kind, tc.acl))
+		if err != nil {
+			t.Fatal("Marshal():", err)
+		}
+		req := httptest.NewRequest("POST", WebhookPath,
+			bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		webhookHandler(log, tc.strict).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("webhook %s [%s] status want=200 got=%d",
+				tc.kind, tc.acl, rec.Code)
+		}
+		var review admission.AdmissionReview
+		if err = json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+			t.Fatal("Unmarshal():", err)
+		}
+		resp := review.Response
+		if resp == nil || resp.UID != "4711" ||
+			review.Kind != "AdmissionReview" {
+			t.Fatalf("webhook %s [%s] invalid review: %+v",
+				tc.kind, tc.acl, review)
+		}
+		if resp.Allowed != tc.allowed {
+			t.Errorf("webhook %s [%s] strict=%v allowed want=%v "+
+				"got=%v", tc.kind, tc.acl, tc.strict,
+				tc.allowed, resp.Allowed)
+		}
+		if !resp.Allowed && (resp.Result == nil ||
+			!strings.Contains(resp.Result.Message, "acl acl")) {
+			t.Errorf("webhook %s [%s] result: %+v", tc.kind,
+				tc.acl, resp.Result)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	webhookHandler(log, false).ServeHTTP(rec,
+		httptest.NewRequest("GET", WebhookPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("webhook GET status want=405 got=%d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	webhookHandler(log, false).ServeHTTP(rec,
+		httptest.NewRequest("POST", WebhookPath,
+			strings.NewReader("{}")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("webhook empty review status want=400 got=%d",
+			rec.Code)
+	}
+}
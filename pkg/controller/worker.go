@@ -31,6 +31,8 @@ package controller
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api_v1 "k8s.io/api/core/v1"
 	extensions "k8s.io/api/extensions/v1beta1"
@@ -65,19 +67,24 @@ const (
 type NamespaceWorker struct {
 	namespace   string
 	ingClass    string
-	log         *logrus.Logger
+	log         *logrus.Entry
+	nsLog       *logrus.Entry
 	vController *varnish.Controller
 	queue       workqueue.RateLimitingInterface
+	mainQueue   workqueue.RateLimitingInterface
 	listers     *Listers
 	ing         ext_listers.IngressNamespaceLister
 	svc         core_v1_listers.ServiceNamespaceLister
 	endp        core_v1_listers.EndpointsNamespaceLister
 	secr        core_v1_listers.SecretNamespaceLister
+	cmap        core_v1_listers.ConfigMapNamespaceLister
 	vcfg        vcr_listers.VarnishConfigNamespaceLister
 	bcfg        vcr_listers.BackendConfigNamespaceLister
 	client      kubernetes.Interface
 	recorder    record.EventRecorder
+	beDefaults  *beDefaults
 	wg          *sync.WaitGroup
+	busySince   int64
 }
 
 func (worker *NamespaceWorker) event(obj interface{}, evtType, reason,
@@ -105,6 +112,10 @@ func (worker *NamespaceWorker) event(obj interface{}, evtType, reason,
 		secr, _ := eventObj.(*api_v1.Secret)
 		worker.recorder.Eventf(secr, evtType, reason, msgFmt, args...)
 		kind = "Secret"
+	case *api_v1.ConfigMap:
+		cm, _ := eventObj.(*api_v1.ConfigMap)
+		worker.recorder.Eventf(cm, evtType, reason, msgFmt, args...)
+		kind = "ConfigMap"
 	case *ving_v1alpha1.VarnishConfig:
 		vcfg, _ := eventObj.(*ving_v1alpha1.VarnishConfig)
 		worker.recorder.Eventf(vcfg, evtType, reason, msgFmt, args...)
@@ -113,6 +124,10 @@ func (worker *NamespaceWorker) event(obj interface{}, evtType, reason,
 		bcfg, _ := eventObj.(*ving_v1alpha1.BackendConfig)
 		worker.recorder.Eventf(bcfg, evtType, reason, msgFmt, args...)
 		kind = "BackendConfig"
+	case *ving_v1alpha1.ClusterVarnishConfig:
+		cvcfg, _ := eventObj.(*ving_v1alpha1.ClusterVarnishConfig)
+		worker.recorder.Eventf(cvcfg, evtType, reason, msgFmt, args...)
+		kind = "ClusterVarnishConfig"
 	default:
 		worker.log.Warnf("Unhandled type %T, no event generated",
 			eventObj)
@@ -169,10 +184,14 @@ func (worker *NamespaceWorker) dispatch(obj interface{}) error {
 			return worker.addEndp(key)
 		case *api_v1.Secret:
 			return worker.addSecret(key)
+		case *api_v1.ConfigMap:
+			return worker.addCfgMap(key)
 		case *ving_v1alpha1.VarnishConfig:
 			return worker.addVcfg(key)
 		case *ving_v1alpha1.BackendConfig:
 			return worker.addBcfg(key)
+		case *ving_v1alpha1.ClusterVarnishConfig:
+			return worker.addCvcfg(key)
 		default:
 			worker.syncFailure(syncObj.Obj,
 				"Unhandled object type: %T", syncObj.Obj)
@@ -188,10 +207,14 @@ func (worker *NamespaceWorker) dispatch(obj interface{}) error {
 			return worker.updateEndp(key)
 		case *api_v1.Secret:
 			return worker.updateSecret(key)
+		case *api_v1.ConfigMap:
+			return worker.updateCfgMap(key)
 		case *ving_v1alpha1.VarnishConfig:
 			return worker.updateVcfg(key)
 		case *ving_v1alpha1.BackendConfig:
 			return worker.updateBcfg(key)
+		case *ving_v1alpha1.ClusterVarnishConfig:
+			return worker.updateCvcfg(key)
 		default:
 			worker.syncFailure(syncObj.Obj,
 				"Unhandled object type: %T", syncObj.Obj)
@@ -212,10 +235,14 @@ func (worker *NamespaceWorker) dispatch(obj interface{}) error {
 			return worker.deleteEndp(deletedObj)
 		case *api_v1.Secret:
 			return worker.deleteSecret(deletedObj)
+		case *api_v1.ConfigMap:
+			return worker.deleteCfgMap(deletedObj)
 		case *ving_v1alpha1.VarnishConfig:
 			return worker.deleteVcfg(deletedObj)
 		case *ving_v1alpha1.BackendConfig:
 			return worker.deleteBcfg(deletedObj)
+		case *ving_v1alpha1.ClusterVarnishConfig:
+			return worker.deleteCvcfg(deletedObj)
 		default:
 			worker.syncFailure(deletedObj,
 				"Unhandled object type: %T", deletedObj)
@@ -235,6 +262,12 @@ func (worker *NamespaceWorker) next() {
 	}
 	defer worker.queue.Done(obj)
 
+	atomic.StoreInt64(&worker.busySince, time.Now().UnixNano())
+	defer atomic.StoreInt64(&worker.busySince, 0)
+
+	worker.log = worker.objLogger(obj)
+	defer func() { worker.log = worker.nsLog }()
+
 	if err := worker.dispatch(obj); err == nil {
 		if ns, name, err := getNameSpace(obj); err == nil {
 			worker.syncSuccess(obj, "Successfully synced: %s/%s",
@@ -269,13 +302,16 @@ type NamespaceQueues struct {
 	Queue       workqueue.RateLimitingInterface
 	DoneChan    chan struct{}
 	ingClass    string
-	log         *logrus.Logger
+	log         *logrus.Entry
 	vController *varnish.Controller
+	workersMtx  sync.Mutex
 	workers     map[string]*NamespaceWorker
 	listers     *Listers
 	client      kubernetes.Interface
 	recorder    record.EventRecorder
+	beDefaults  *beDefaults
 	wg          *sync.WaitGroup
+	running     int32
 }
 
 // NewNamespaceQueues creates a NamespaceQueues object.
@@ -287,7 +323,7 @@ type NamespaceQueues struct {
 //    client: k8s API client initialized at startup
 //    recorder: Event broadcaster initialized at startup
 func NewNamespaceQueues(
-	log *logrus.Logger,
+	log *logrus.Entry,
 	ingClass string,
 	vController *varnish.Controller,
 	listers *Listers,
@@ -306,6 +342,7 @@ func NewNamespaceQueues(
 		listers:     listers,
 		client:      client,
 		recorder:    recorder,
+		beDefaults:  new(beDefaults),
 		wg:          new(sync.WaitGroup),
 	}
 }
@@ -336,25 +373,32 @@ func (qs *NamespaceQueues) next() {
 		utilruntime.HandleError(err)
 		return
 	}
+	qs.workersMtx.Lock()
+	defer qs.workersMtx.Unlock()
 	worker, exists := qs.workers[ns]
 	if !exists {
 		q := workqueue.NewNamedRateLimitingQueue(
 			workqueue.DefaultControllerRateLimiter(), ns)
+		nsLog := qs.log.WithField(logNamespace, ns)
 		worker = &NamespaceWorker{
 			namespace:   ns,
 			ingClass:    qs.ingClass,
-			log:         qs.log,
+			log:         nsLog,
+			nsLog:       nsLog,
 			vController: qs.vController,
 			queue:       q,
+			mainQueue:   qs.Queue,
 			listers:     qs.listers,
 			ing:         qs.listers.ing.Ingresses(ns),
 			svc:         qs.listers.svc.Services(ns),
 			endp:        qs.listers.endp.Endpoints(ns),
 			secr:        qs.listers.secr.Secrets(ns),
+			cmap:        qs.listers.cmap.ConfigMaps(ns),
 			vcfg:        qs.listers.vcfg.VarnishConfigs(ns),
 			bcfg:        qs.listers.bcfg.BackendConfigs(ns),
 			client:      qs.client,
 			recorder:    qs.recorder,
+			beDefaults:  qs.beDefaults,
 			wg:          qs.wg,
 		}
 		qs.workers[ns] = worker
@@ -370,21 +414,40 @@ func (qs *NamespaceQueues) next() {
 // namespace.
 func (qs *NamespaceQueues) Run() {
 	qs.log.Info("Starting dispatcher worker")
+	atomic.StoreInt32(&qs.running, 1)
+	defer atomic.StoreInt32(&qs.running, 0)
 	for !qs.Queue.ShuttingDown() {
 		qs.next()
 	}
 }
 
+// RemoveWorker shuts down the NamespaceWorker for a namespace that
+// is no longer watched. A new worker is started if the namespace is
+// watched again.
+func (qs *NamespaceQueues) RemoveWorker(ns string) {
+	qs.workersMtx.Lock()
+	defer qs.workersMtx.Unlock()
+	worker, exists := qs.workers[ns]
+	if !exists {
+		return
+	}
+	qs.log.Infof("Shutting down queue for namespace: %s", ns)
+	worker.queue.ShutDown()
+	delete(qs.workers, ns)
+}
+
 // Stop shuts down the main queue loop initiated by Run(), and in turn
 // shuts down all of the NamespaceWorkers.
 func (qs *NamespaceQueues) Stop() {
 	qs.log.Info("Shutting down dispatcher worker")
 	qs.Queue.ShutDown()
+	qs.workersMtx.Lock()
 	for _, worker := range qs.workers {
 		qs.log.Infof("Shutting down queue for namespace: %s",
 			worker.namespace)
 		worker.queue.ShutDown()
 	}
+	qs.workersMtx.Unlock()
 	qs.log.Info("Waiting for workers to shut down")
 	qs.wg.Wait()
 	close(qs.DoneChan)
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package explain
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+)
+
+// Patterns for the regsub() calls generated for the xff-first and
+// xff-2ndlast ACL comparands.
+var (
+	xffFirst   = regexp.MustCompile(`^([^,\s]+).*`)
+	xff2ndLast = regexp.MustCompile(`^.*?([[:xdigit:]:.]+)\s*,[^,]*$`)
+)
+
+// aclIP returns the address to which an ACL is applied, as generated
+// by the aclCmp template function: std.ip() with the fallback 0.0.0.0
+// is applied to header values.
+func (s *state) aclIP(comparand string) (net.IP, error) {
+	var val string
+	switch {
+	case comparand == "client.ip" || comparand == "remote.ip":
+		return s.clientIP, nil
+	case comparand == "server.ip" || comparand == "local.ip":
+		return s.serverIP, nil
+	case comparand == "xff-first":
+		val = regsub(xffFirst, s.value("req.http.X-Forwarded-For"), `\1`)
+	case comparand == "xff-2ndlast":
+		val = regsub(xff2ndLast, s.value("req.http.X-Forwarded-For"),
+			`\1`)
+	case strings.HasPrefix(comparand, "req.http."):
+		val = s.value(comparand)
+	default:
+		return nil, fmt.Errorf("Unknown ACL comparand %s", comparand)
+	}
+	if ip := net.ParseIP(val); ip != nil {
+		return ip, nil
+	}
+	return net.IPv4zero, nil
+}
+
+// aclMatch returns true if the address matches the ACL, and the entry
+// that determined the result. As in Varnish, the most specific
+// matching entry decides, and the ACL does not match if that entry is
+// negated. Entries that are host names are resolved by Varnish when
+// the VCL is loaded; they are skipped here, and returned in
+// unresolved.
+func aclMatch(ip net.IP, addrs []vcl.ACLAddress) (match bool,
+	entry string, unresolved []string) {
+
+	best := -1
+	for _, addr := range addrs {
+		aclIP := net.ParseIP(addr.Addr)
+		if aclIP == nil {
+			unresolved = append(unresolved, addr.Addr)
+			continue
+		}
+		bits, max := int(addr.MaskBits), 128
+		if v4 := aclIP.To4(); v4 != nil {
+			aclIP, max = v4, 32
+		}
+		if addr.MaskBits == vcl.NoMaskBits || bits > max {
+			bits = max
+		}
+		mask := net.CIDRMask(bits, max)
+		ipNet := net.IPNet{IP: aclIP.Mask(mask), Mask: mask}
+		if !ipNet.Contains(ip) || bits <= best {
+			continue
+		}
+		best = bits
+		match = !addr.Negate
+		entry = ipNet.String()
+		if addr.Negate {
+			entry = "!" + entry
+		}
+	}
+	return
+}
+
+func (s *state) acls() error {
+	xffs := s.req.header["X-Forwarded-For"]
+	for _, acl := range s.spec.ACLs {
+		if strings.HasPrefix(acl.Comparand, "xff-") {
+			// std.collect(req.http.X-Forwarded-For)
+			if len(xffs) > 1 {
+				s.req.header.Set("X-Forwarded-For",
+					strings.Join(xffs, ", "))
+			}
+			break
+		}
+	}
+	for _, acl := range s.spec.ACLs {
+		failed, err := s.terms(acl.Conditions)
+		if err != nil {
+			return fmt.Errorf("ACL %s: %v", acl.Name, err)
+		}
+		var matched bool
+		var detail string
+		if failed != "" {
+			detail = failed
+		} else {
+			ip, err := s.aclIP(acl.Comparand)
+			if err != nil {
+				return fmt.Errorf("ACL %s: %v", acl.Name, err)
+			}
+			in, entry, unresolved := aclMatch(ip, acl.Addresses)
+			for _, host := range unresolved {
+				s.note("ACL %s: host name %s is not resolved",
+					acl.Name, host)
+			}
+			if in {
+				detail = fmt.Sprintf("%s %s matches entry %s",
+					acl.Comparand, ip, entry)
+			} else if entry != "" {
+				detail = fmt.Sprintf("%s %s is excluded by entry %s",
+					acl.Comparand, ip, entry)
+			} else {
+				detail = fmt.Sprintf("%s %s matches no entry",
+					acl.Comparand, ip)
+			}
+			// A whitelist fails if the address does not match, a
+			// blacklist if it does.
+			matched = in != acl.Whitelist
+		}
+		hdr := acl.ResultHdr
+		if !matched {
+			if hdr.Header != "" {
+				if err := s.set(hdr.Header, hdr.Success); err != nil {
+					s.note("ACL %s: %v", acl.Name, err)
+				}
+			}
+			s.step("recv", "acl", acl.Name, false, "%s", detail)
+			continue
+		}
+		if hdr.Header != "" {
+			if err := s.set(hdr.Header, hdr.Failure); err != nil {
+				s.note("ACL %s: %v", acl.Name, err)
+			}
+			detail += fmt.Sprintf(", set %s = %q", hdr.Header,
+				hdr.Failure)
+		}
+		if acl.FailStatus < 100 {
+			s.step("recv", "acl", acl.Name, true, "%s", detail)
+			continue
+		}
+		s.step("recv", "acl", acl.Name, true, "%s: return(synth(%d))",
+			detail, acl.FailStatus)
+		s.res.Recv = vcl.RecvSynth
+		s.synth(acl.FailStatus, http.StatusText(int(acl.FailStatus)))
+		return nil
+	}
+	return nil
+}
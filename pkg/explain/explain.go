@@ -0,0 +1,822 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package explain
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+)
+
+// DefaultIP is assumed for the client and server addresses of a
+// Request if they are not specified.
+const DefaultIP = "127.0.0.1"
+
+// Request is a sample client request to be evaluated by Explain.
+//
+//    Method: the request method, GET if empty
+//    Host: the Host header, overrides Host in Header if non-empty
+//    URL: the request URL, / if empty
+//    Header: request headers
+//    ClientIP: the client address (client.ip and remote.ip in VCL)
+//    ServerIP: the server address (server.ip and local.ip in VCL)
+type Request struct {
+	Method   string
+	Host     string
+	URL      string
+	Header   http.Header
+	ClientIP string
+	ServerIP string
+}
+
+// Step reports the evaluation of one element of the configuration
+// while the request is processed, in the order of execution.
+//
+//    Sub: the VCL subroutine (without the vcl_ prefix)
+//    Kind: one of shard, acl, auth, rewrite, disposition, builtin
+//          or routing
+//    Name: identifies the element, such as an ACL name or Auth realm
+//    Matched: whether the element applied to the request
+//    Detail: a description of the evaluation
+type Step struct {
+	Sub     string `json:"sub"`
+	Kind    string `json:"kind"`
+	Name    string `json:"name,omitempty"`
+	Matched bool   `json:"matched"`
+	Detail  string `json:"detail"`
+}
+
+// Result is the outcome of Explain.
+//
+// Recv is the return action of vcl_recv. If a synthetic response is
+// generated, Status and Reason are set; Failed is true if VCL
+// failure was invoked, which results in a 503 response. If the
+// request is sent to a backend, Service and Director identify the
+// Service and its director type, and Default is true if it is the
+// default Service. URL and Header are the client request after
+// rewrites, and the Backend fields describe the backend request.
+//
+// Notes lists the parts of the configuration that could not be
+// evaluated, or were only approximated.
+type Result struct {
+	Steps         []Step         `json:"steps"`
+	Recv          vcl.RecvReturn `json:"recv"`
+	Status        uint16         `json:"status,omitempty"`
+	Reason        string         `json:"reason,omitempty"`
+	Failed        bool           `json:"failed,omitempty"`
+	Service       string         `json:"service,omitempty"`
+	Director      string         `json:"director,omitempty"`
+	Default       bool           `json:"default,omitempty"`
+	URL           string         `json:"url"`
+	Header        http.Header    `json:"header"`
+	BackendMethod string         `json:"backendMethod,omitempty"`
+	BackendURL    string         `json:"backendURL,omitempty"`
+	BackendHeader http.Header    `json:"backendHeader,omitempty"`
+	Notes         []string       `json:"notes,omitempty"`
+}
+
+// httpObj holds the variables of req or bereq.
+type httpObj struct {
+	method string
+	url    string
+	header http.Header
+}
+
+func (obj *httpObj) copy() *httpObj {
+	cp := &httpObj{
+		method: obj.method,
+		url:    obj.url,
+		header: make(http.Header, len(obj.header)),
+	}
+	for k, v := range obj.header {
+		cp.header[k] = append([]string(nil), v...)
+	}
+	return cp
+}
+
+type state struct {
+	spec     vcl.Spec
+	req      *httpObj
+	bereq    *httpObj
+	clientIP net.IP
+	serverIP net.IP
+	res      *Result
+	done     bool
+}
+
+// Explain evaluates the VCL generated from spec for the client
+// request, and reports the result.
+//
+// An error is returned if the request is invalid, or if the Spec
+// contains patterns that cannot be compiled (in which case the VCL
+// would fail to load).
+func Explain(spec vcl.Spec, req Request) (*Result, error) {
+	s, err := newState(spec, req)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.recv(); err != nil {
+		return nil, err
+	}
+	if !s.done {
+		if err = s.backend(); err != nil {
+			return nil, err
+		}
+	}
+	s.finish()
+	return s.res, nil
+}
+
+func parseIP(addr, which string) (net.IP, error) {
+	if addr == "" {
+		addr = DefaultIP
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid %s address: %s", which, addr)
+	}
+	return ip, nil
+}
+
+func newState(spec vcl.Spec, req Request) (*state, error) {
+	var err error
+	s := &state{
+		spec: spec,
+		req: &httpObj{
+			method: req.Method,
+			url:    req.URL,
+			header: make(http.Header),
+		},
+		res: &Result{},
+	}
+	if s.clientIP, err = parseIP(req.ClientIP, "client"); err != nil {
+		return nil, err
+	}
+	if s.serverIP, err = parseIP(req.ServerIP, "server"); err != nil {
+		return nil, err
+	}
+	if s.req.method == "" {
+		s.req.method = http.MethodGet
+	}
+	if s.req.url == "" {
+		s.req.url = "/"
+	}
+	for k, v := range req.Header {
+		for _, val := range v {
+			s.req.header.Add(k, val)
+		}
+	}
+	if req.Host != "" {
+		s.req.header.Set("Host", req.Host)
+	}
+	return s, nil
+}
+
+func (s *state) step(sub, kind, name string, matched bool, format string,
+	args ...interface{}) {
+
+	s.res.Steps = append(s.res.Steps, Step{
+		Sub:     sub,
+		Kind:    kind,
+		Name:    name,
+		Matched: matched,
+		Detail:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (s *state) note(format string, args ...interface{}) {
+	s.res.Notes = append(s.res.Notes, fmt.Sprintf(format, args...))
+}
+
+func (s *state) synth(status uint16, reason string) {
+	s.res.Status = status
+	s.res.Reason = reason
+	s.done = true
+}
+
+func (s *state) fail() {
+	s.res.Failed = true
+	s.synth(503, "VCL failed")
+}
+
+func (s *state) obj(variable string) (*httpObj, string) {
+	i := strings.IndexByte(variable, '.')
+	if i < 0 {
+		return nil, ""
+	}
+	switch variable[:i] {
+	case "req":
+		return s.req, variable[i+1:]
+	case "bereq":
+		return s.bereq, variable[i+1:]
+	}
+	return nil, ""
+}
+
+// get returns the value of a VCL variable, and whether it is set. An
+// error is returned if the variable cannot be evaluated.
+func (s *state) get(variable string) (string, bool, error) {
+	switch variable {
+	case "client.ip", "remote.ip":
+		return s.clientIP.String(), true, nil
+	case "server.ip", "local.ip":
+		return s.serverIP.String(), true, nil
+	case "req.restarts", "req.esi_level", "bereq.retries":
+		return "0", true, nil
+	case "req.proto", "bereq.proto":
+		return "HTTP/1.1", true, nil
+	}
+	obj, field := s.obj(variable)
+	if obj == nil {
+		return "", false, fmt.Errorf("%s is not evaluated", variable)
+	}
+	switch {
+	case field == "url":
+		return obj.url, true, nil
+	case field == "method":
+		return obj.method, true, nil
+	case strings.HasPrefix(field, "http."):
+		vals, ok := obj.header[http.CanonicalHeaderKey(field[5:])]
+		if !ok || len(vals) == 0 {
+			return "", false, nil
+		}
+		return vals[0], true, nil
+	}
+	return "", false, fmt.Errorf("%s is not evaluated", variable)
+}
+
+func (s *state) set(variable, val string) error {
+	obj, field := s.obj(variable)
+	switch {
+	case obj == nil:
+	case field == "url":
+		obj.url = val
+		return nil
+	case field == "method":
+		obj.method = val
+		return nil
+	case strings.HasPrefix(field, "http."):
+		obj.header.Set(field[5:], val)
+		return nil
+	}
+	return fmt.Errorf("set %s is not evaluated", variable)
+}
+
+func (s *state) unset(variable string) error {
+	obj, field := s.obj(variable)
+	if obj == nil || !strings.HasPrefix(field, "http.") {
+		return fmt.Errorf("unset %s is not evaluated", variable)
+	}
+	obj.header.Del(field[5:])
+	return nil
+}
+
+// value returns the value of a variable as used in a VCL expression,
+// in which an unset string is empty. If the variable cannot be
+// evaluated, a note is added, and it is treated as unset.
+func (s *state) value(variable string) string {
+	val, _, err := s.get(variable)
+	if err != nil {
+		s.note("%v, treated as unset", err)
+	}
+	return val
+}
+
+func (s *state) recv() error {
+	if len(s.spec.ShardCluster.Nodes) > 0 {
+		if s.shardRecv() {
+			return nil
+		}
+	}
+	if err := s.acls(); err != nil || s.done {
+		return err
+	}
+	if err := s.auths(); err != nil || s.done {
+		return err
+	}
+	if err := s.rewrites("recv"); err != nil || s.done {
+		if s.done {
+			s.res.Recv = vcl.RecvFail
+		}
+		return err
+	}
+	if s.spec.VCL != "" {
+		s.note("Custom VCL is not evaluated; it may change the " +
+			"request or its disposition")
+	}
+	if len(s.spec.Templates) > 0 {
+		s.note("VCL is generated by custom templates, which are not " +
+			"evaluated; the explanation assumes the standard " +
+			"templates")
+	}
+	for _, snip := range s.spec.Snippets {
+		if snip.Sub == "recv" {
+			s.note("VCL snippet %s is not evaluated; it may change "+
+				"the request or its disposition", snip.Name)
+		}
+	}
+	return s.dispositions()
+}
+
+// shardRecv evaluates vcl_recv for self-sharding, and returns true
+// if it returned.
+func (s *state) shardRecv() bool {
+	for _, node := range s.spec.ShardCluster.Nodes {
+		if len(node.Addresses) == 0 {
+			continue
+		}
+		ip := net.ParseIP(node.Addresses[0].IP)
+		if ip == nil || !ip.Equal(s.clientIP) {
+			continue
+		}
+		host, _, _ := s.get("req.http.Host")
+		if host == "vk8s_cluster" {
+			s.res.Recv = vcl.RecvSynth
+			if s.req.url == "/vk8s_cluster_health" {
+				s.step("recv", "shard", node.Name, true,
+					"cluster health check from %s", node.Name)
+				s.synth(200, "OK")
+			} else {
+				s.step("recv", "shard", node.Name, true,
+					"cluster request from %s for an unknown URL",
+					node.Name)
+				s.synth(404, "Not Found")
+			}
+			return true
+		}
+		s.step("recv", "shard", node.Name, true,
+			"request from cluster node %s: return(hash)", node.Name)
+		s.res.Recv = vcl.RecvHash
+		return true
+	}
+	s.step("recv", "shard", "", false,
+		"client %s is not a cluster node", s.clientIP)
+	return false
+}
+
+// relation evaluates a comparison as generated by the cmpRelation
+// template function, in which negation only applies to the equality
+// and match operators.
+func relation(lhs, rhs string, cmp vcl.CompareType, negate,
+	numeric bool) (bool, error) {
+
+	switch cmp {
+	case vcl.Equal:
+		if numeric {
+			l, r, err := numbers(lhs, rhs)
+			if err != nil {
+				return false, err
+			}
+			return (l == r) != negate, nil
+		}
+		return (lhs == rhs) != negate, nil
+	case vcl.Match:
+		// VCL ~ uses PCRE, approximated with Go regexps.
+		regex, err := compile(rhs,
+			vcl.MatchFlagsType{CaseSensitive: true})
+		if err != nil {
+			return false, fmt.Errorf("Cannot compile pattern \"%s\": %v",
+				rhs, err)
+		}
+		return regex.MatchString(lhs) != negate, nil
+	case vcl.Greater, vcl.GreaterEqual, vcl.Less, vcl.LessEqual:
+		l, r, err := numbers(lhs, rhs)
+		if err != nil {
+			return false, err
+		}
+		switch cmp {
+		case vcl.Greater:
+			return l > r, nil
+		case vcl.GreaterEqual:
+			return l >= r, nil
+		case vcl.Less:
+			return l < r, nil
+		default:
+			return l <= r, nil
+		}
+	}
+	return false, fmt.Errorf("Invalid comparison type %v", cmp)
+}
+
+func numbers(lhs, rhs string) (float64, float64, error) {
+	l, err := strconv.ParseFloat(lhs, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Not a number: \"%s\"", lhs)
+	}
+	r, err := strconv.ParseFloat(rhs, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Not a number: \"%s\"", rhs)
+	}
+	return l, r, nil
+}
+
+// terms evaluates the conditions for an ACL or Auth, which are all
+// required (the VCL && short-circuits). It returns a description of
+// the first condition that does not hold, or the empty string if all
+// of them hold.
+func (s *state) terms(terms []vcl.MatchTerm) (string, error) {
+	for _, term := range terms {
+		val := s.value(term.Comparand)
+		ok, err := relation(val, term.Value, term.Compare, term.Negate,
+			false)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return fmt.Sprintf("condition on %s does not hold",
+				term.Comparand), nil
+		}
+	}
+	return "", nil
+}
+
+func (s *state) auths() error {
+	for _, auth := range s.spec.Auths {
+		failed, err := s.terms(auth.Conditions)
+		if err != nil {
+			return fmt.Errorf("Auth realm %s: %v", auth.Realm, err)
+		}
+		if failed != "" {
+			s.step("recv", "auth", auth.Realm, false, "%s", failed)
+			continue
+		}
+		hdr := "req.http.Authorization"
+		if auth.Status != vcl.Basic {
+			hdr = "req.http.Proxy-Authorization"
+		}
+		patterns := make([]string, len(auth.Credentials))
+		for i, cred := range auth.Credentials {
+			patterns[i] = `Basic\s+\Q` + cred + `\E\s*`
+		}
+		creds, err := newRegexSet(patterns, vcl.MatchFlagsType{
+			Anchor:        vcl.Both,
+			CaseSensitive: true,
+		})
+		if err != nil {
+			return fmt.Errorf("Auth realm %s: %v", auth.Realm, err)
+		}
+		if len(creds.match(s.value(hdr))) > 0 {
+			s.step("recv", "auth", auth.Realm, false,
+				"%s matches valid credentials", hdr)
+			continue
+		}
+		s.step("recv", "auth", auth.Realm, true,
+			"%s does not match valid credentials: return(synth(%d))",
+			hdr, 60000+int(auth.Status))
+		s.res.Recv = vcl.RecvSynth
+		reason := "Unauthorized"
+		if auth.Status != vcl.Basic {
+			reason = "Proxy Authentication Required"
+		}
+		s.synth(uint16(auth.Status), reason)
+		return nil
+	}
+	return nil
+}
+
+func reqNeedsMatcher(cond vcl.Condition) bool {
+	switch cond.Compare {
+	case vcl.Match, vcl.Prefix:
+		return true
+	case vcl.Exists, vcl.Greater, vcl.GreaterEqual, vcl.Less,
+		vcl.LessEqual:
+		return false
+	}
+	if cond.Count != nil || len(cond.Values) == 1 {
+		return false
+	}
+	return true
+}
+
+// condition evaluates a condition for a request disposition exactly
+// as generated by the recv_disposition template. In particular, if
+// Negate is set, the entire expression is negated, which for the
+// relational case applies in addition to the negated operator.
+func condition(val string, isSet bool, cond vcl.Condition) (bool, error) {
+	var ok bool
+	switch {
+	case reqNeedsMatcher(cond):
+		var m *set
+		if cond.Compare == vcl.Match {
+			var err error
+			m, err = newRegexSet(cond.Values, cond.MatchFlags)
+			if err != nil {
+				return false, err
+			}
+		} else {
+			m = newSelectorSet(cond.Values, cond.Compare == vcl.Prefix,
+				cond.MatchFlags.CaseSensitive)
+		}
+		ok = len(m.match(val)) > 0
+	case cond.Compare == vcl.Exists:
+		ok = isSet
+	default:
+		var rhs string
+		if cond.Count != nil {
+			rhs = strconv.FormatUint(uint64(*cond.Count), 10)
+		} else if len(cond.Values) > 0 {
+			rhs = cond.Values[0]
+		}
+		var err error
+		ok, err = relation(val, rhs, cond.Compare, cond.Negate,
+			cond.Count != nil)
+		if err != nil {
+			return false, err
+		}
+	}
+	if cond.Negate {
+		ok = !ok
+	}
+	return ok, nil
+}
+
+func (s *state) dispositions() error {
+	if len(s.spec.Dispositions) == 0 {
+		s.builtinRecv()
+		return nil
+	}
+DISPS:
+	for d, disp := range s.spec.Dispositions {
+		name := strconv.Itoa(d)
+		for c, cond := range disp.Conditions {
+			val, isSet, err := s.get(cond.Comparand)
+			if err != nil {
+				s.note("%v, treated as unset", err)
+			}
+			ok, err := condition(val, isSet, cond)
+			if err != nil {
+				return fmt.Errorf("Request disposition %d, "+
+					"condition %d: %v", d, c, err)
+			}
+			if !ok {
+				s.step("recv", "disposition", name, false,
+					"condition on %s does not hold",
+					cond.Comparand)
+				continue DISPS
+			}
+		}
+		s.recvReturn(name, disp.Disposition)
+		return nil
+	}
+	s.step("recv", "disposition", "", true,
+		"no disposition applies: return(hash)")
+	s.res.Recv = vcl.RecvHash
+	return nil
+}
+
+func (s *state) recvReturn(name string, disp vcl.DispositionType) {
+	s.res.Recv = disp.Action
+	switch disp.Action {
+	case vcl.RecvSynth:
+		s.step("recv", "disposition", name, true,
+			"return(synth(%d))", disp.Status)
+		reason := disp.Reason
+		if reason == "" {
+			reason = http.StatusText(int(disp.Status))
+		}
+		s.synth(disp.Status, reason)
+	case vcl.RecvFail:
+		s.step("recv", "disposition", name, true, "return(fail)")
+		s.fail()
+	case vcl.RecvRestart:
+		s.step("recv", "disposition", name, true, "return(restart)")
+		s.note("The restarted request is not evaluated")
+		s.done = true
+	default:
+		s.step("recv", "disposition", name, true, "return(%s)",
+			disp.Action)
+	}
+}
+
+var stdMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"PUT":     true,
+	"POST":    true,
+	"TRACE":   true,
+	"OPTIONS": true,
+	"DELETE":  true,
+}
+
+// builtinRecv evaluates vcl_recv in the builtin VCL, which applies
+// if no request dispositions are specified.
+func (s *state) builtinRecv() {
+	var action vcl.RecvReturn
+	var why string
+	switch {
+	case s.req.method == "PRI":
+		s.step("recv", "builtin", "", true,
+			"method PRI: return(synth(405))")
+		s.res.Recv = vcl.RecvSynth
+		s.synth(405, "Method Not Allowed")
+		return
+	case s.req.header.Get("Host") == "":
+		s.step("recv", "builtin", "", true,
+			"no Host header in an HTTP/1.1 request: "+
+				"return(synth(400))")
+		s.res.Recv = vcl.RecvSynth
+		s.synth(400, "Bad Request")
+		return
+	case !stdMethods[s.req.method]:
+		action, why = vcl.RecvPipe, "non-standard method "+s.req.method
+	case s.req.method != "GET" && s.req.method != "HEAD":
+		action, why = vcl.RecvPass, "method "+s.req.method
+	case s.req.header.Get("Authorization") != "":
+		action, why = vcl.RecvPass, "Authorization header is set"
+	case s.req.header.Get("Cookie") != "":
+		action, why = vcl.RecvPass, "Cookie header is set"
+	default:
+		action, why = vcl.RecvHash, "cacheable request"
+	}
+	s.step("recv", "builtin", "", true, "%s: return(%s)", why, action)
+	s.res.Recv = action
+}
+
+func (s *state) backend() error {
+	switch s.res.Recv {
+	case vcl.RecvHash:
+		if err := s.rewrites("hash"); err != nil || s.done {
+			return err
+		}
+		s.note("A cache miss is assumed; on a cache hit, the " +
+			"response is delivered from cache")
+		s.route("miss")
+		if s.done {
+			return nil
+		}
+		if err := s.rewrites("miss"); err != nil || s.done {
+			return err
+		}
+		return s.fetch(http.MethodGet)
+	case vcl.RecvPass:
+		s.route("pass")
+		if s.done {
+			return nil
+		}
+		if err := s.rewrites("pass"); err != nil || s.done {
+			return err
+		}
+		return s.fetch(s.req.method)
+	case vcl.RecvPipe:
+		s.bereq = s.req.copy()
+		s.route("pipe")
+		if s.done {
+			return nil
+		}
+		return s.rewrites("pipe")
+	case vcl.RecvPurge:
+		if err := s.rewrites("purge"); err != nil || s.done {
+			return err
+		}
+		s.synth(200, "Purged")
+	}
+	return nil
+}
+
+func (s *state) fetch(method string) error {
+	s.bereq = s.req.copy()
+	s.bereq.method = method
+	if len(s.spec.ShardCluster.Nodes) > 0 {
+		s.note("With self-sharding, the backend request may be " +
+			"sent to the cluster node that is primary for the " +
+			"object, in which case rewrites in vcl_backend_fetch " +
+			"are not executed")
+	}
+	return s.rewrites("backend_fetch")
+}
+
+func dirType(svc vcl.Service) string {
+	if svc.Director == nil {
+		return vcl.RoundRobin.String()
+	}
+	return svc.Director.Type.String()
+}
+
+// route emulates vk8s_set_backend, which is called at the start of
+// vcl_miss, vcl_pass and vcl_pipe.
+func (s *state) route(sub string) {
+	host, _, _ := s.get("req.http.Host")
+	if len(s.spec.Rules) > 0 {
+		patterns := make([]string, len(s.spec.Rules))
+		for i, rule := range s.spec.Rules {
+			patterns[i] = `\Q` + rule.Host + `\E(:\d+)?`
+		}
+		hosts, err := newRegexSet(patterns, vcl.MatchFlagsType{
+			Anchor:        vcl.Both,
+			CaseSensitive: true,
+		})
+		if err != nil {
+			s.note("Host matching is not evaluated: %v", err)
+		} else if matches := hosts.match(host); len(matches) > 1 {
+			s.step(sub, "routing", host, true,
+				"Host %q matches %d rules: return(fail)",
+				host, len(matches))
+			s.fail()
+			return
+		} else if len(matches) == 1 {
+			rule := s.spec.Rules[matches[0]]
+			if s.routePath(sub, rule) {
+				return
+			}
+		}
+	}
+	if s.spec.DefaultService.Name == "" {
+		s.step(sub, "routing", host, true, "no rule matches Host %q "+
+			"and URL %q, and there is no default backend: "+
+			"return(synth(404))", host, s.req.url)
+		s.synth(404, "Not Found")
+		return
+	}
+	svc := s.spec.DefaultService
+	s.step(sub, "routing", host, true, "no rule matches Host %q and "+
+		"URL %q: default Service %s (%s)", host, s.req.url, svc.Name,
+		dirType(svc))
+	s.res.Service = svc.Name
+	s.res.Director = dirType(svc)
+	s.res.Default = true
+}
+
+// routePath evaluates the URL matcher for a rule, to which paths are
+// added in the order of template map iteration (sorted by key), and
+// from which the backend is selected with select=FIRST.
+func (s *state) routePath(sub string, rule vcl.Rule) bool {
+	paths := make([]string, 0, len(rule.PathMap))
+	for path := range rule.PathMap {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	urls, err := newRegexSet(paths, vcl.MatchFlagsType{
+		Anchor:        vcl.Start,
+		PosixSyntax:   true,
+		CaseSensitive: true,
+	})
+	if err != nil {
+		s.note("URL matching for host %s is not evaluated: %v",
+			rule.Host, err)
+		return false
+	}
+	matches := urls.match(s.req.url)
+	if len(matches) == 0 {
+		s.step(sub, "routing", rule.Host, false,
+			"URL %q matches no path for host %s", s.req.url,
+			rule.Host)
+		return false
+	}
+	path := paths[matches[0]]
+	svc := rule.PathMap[path]
+	s.step(sub, "routing", rule.Host, true, "URL %q matches path %q "+
+		"for host %s: Service %s (%s)", s.req.url, path, rule.Host,
+		svc.Name, dirType(svc))
+	s.res.Service = svc.Name
+	s.res.Director = dirType(svc)
+	return true
+}
+
+func (s *state) finish() {
+	for i, rw := range s.spec.Rewrites {
+		switch sub := rewrSub(rw); sub {
+		case "hit", "deliver", "synth", "backend_response",
+			"backend_error":
+			s.note("Rewrite %d of %s in vcl_%s is not evaluated",
+				i, rw.Target, sub)
+		}
+	}
+	s.res.URL = s.req.url
+	s.res.Header = s.req.header
+	if s.bereq != nil && !s.done {
+		s.res.BackendMethod = s.bereq.method
+		s.res.BackendURL = s.bereq.url
+		s.res.BackendHeader = s.bereq.header
+	}
+}
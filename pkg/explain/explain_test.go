@@ -0,0 +1,454 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package explain
+
+import (
+	"net/http"
+	"testing"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+)
+
+var (
+	teaSvc = vcl.Service{
+		Name:      "tea-svc",
+		Addresses: []vcl.Address{{IP: "192.0.2.1", Port: 80}},
+	}
+	coffeeSvc = vcl.Service{
+		Name:      "coffee-svc",
+		Addresses: []vcl.Address{{IP: "192.0.2.2", Port: 80}},
+		Director:  &vcl.Director{Type: vcl.Random},
+	}
+	defSvc = vcl.Service{
+		Name:      "default-svc",
+		Addresses: []vcl.Address{{IP: "192.0.2.3", Port: 80}},
+	}
+	cafeSpec = vcl.Spec{
+		DefaultService: defSvc,
+		Rules: []vcl.Rule{{
+			Host: "cafe.example.com",
+			PathMap: map[string]vcl.Service{
+				"/tea":    teaSvc,
+				"/coffee": coffeeSvc,
+			},
+		}},
+		AllServices: map[string]vcl.Service{
+			"tea-svc":     teaSvc,
+			"coffee-svc":  coffeeSvc,
+			"default-svc": defSvc,
+		},
+	}
+)
+
+func explain(t *testing.T, spec vcl.Spec, req Request) *Result {
+	t.Helper()
+	res, err := Explain(spec, req)
+	if err != nil {
+		t.Fatalf("Explain(): %v", err)
+	}
+	return res
+}
+
+func TestRouting(t *testing.T) {
+	for _, tc := range []struct {
+		host, url, svc, dir string
+		dflt                bool
+	}{
+		{"cafe.example.com", "/tea/green", "tea-svc", "round_robin",
+			false},
+		{"cafe.example.com:8080", "/coffee", "coffee-svc", "random",
+			false},
+		{"cafe.example.com", "/", "default-svc", "round_robin", true},
+		{"cafe.example.com", "/tea", "tea-svc", "round_robin", false},
+		{"Cafe.example.com", "/tea", "default-svc", "round_robin",
+			true},
+		{"bar.example.com", "/tea", "default-svc", "round_robin", true},
+	} {
+		res := explain(t, cafeSpec, Request{Host: tc.host, URL: tc.url})
+		if res.Recv != vcl.RecvHash {
+			t.Errorf("%s%s: recv got %s want hash", tc.host, tc.url,
+				res.Recv)
+		}
+		if res.Service != tc.svc || res.Director != tc.dir ||
+			res.Default != tc.dflt {
+			t.Errorf("%s%s: got service=%s director=%s default=%v, "+
+				"want service=%s director=%s default=%v", tc.host,
+				tc.url, res.Service, res.Director, res.Default,
+				tc.svc, tc.dir, tc.dflt)
+		}
+		if res.BackendMethod != http.MethodGet ||
+			res.BackendURL != tc.url {
+			t.Errorf("%s%s: got backend request %s %s", tc.host,
+				tc.url, res.BackendMethod, res.BackendURL)
+		}
+	}
+
+	// Paths are added to the URL matcher in sorted order, and the
+	// first match is selected, so "/" shadows the other paths.
+	spec := cafeSpec
+	spec.Rules = []vcl.Rule{{
+		Host: "cafe.example.com",
+		PathMap: map[string]vcl.Service{
+			"/tea": teaSvc,
+			"/":    defSvc,
+		},
+	}}
+	res := explain(t, spec, Request{Host: "cafe.example.com", URL: "/tea"})
+	if res.Service != "default-svc" || res.Default {
+		t.Errorf("path / first in sort order: got service=%s "+
+			"default=%v, want service=default-svc default=false",
+			res.Service, res.Default)
+	}
+
+	spec = cafeSpec
+	spec.DefaultService = vcl.Service{}
+	res = explain(t, spec, Request{Host: "bar.example.com"})
+	if res.Status != 404 || res.Service != "" {
+		t.Errorf("no default service: got status=%d service=%s, want "+
+			"status=404 and no service", res.Status, res.Service)
+	}
+
+	res = explain(t, cafeSpec, Request{
+		Host:   "cafe.example.com",
+		URL:    "/tea",
+		Method: http.MethodPost,
+	})
+	if res.Recv != vcl.RecvPass || res.BackendMethod != http.MethodPost ||
+		res.Service != "tea-svc" {
+		t.Errorf("POST: got recv=%s method=%s service=%s, want "+
+			"recv=pass method=POST service=tea-svc", res.Recv,
+			res.BackendMethod, res.Service)
+	}
+}
+
+func TestACL(t *testing.T) {
+	spec := cafeSpec
+	spec.ACLs = []vcl.ACL{
+		{
+			Name:       "local",
+			Comparand:  "client.ip",
+			FailStatus: 403,
+			Whitelist:  true,
+			Addresses: []vcl.ACLAddress{
+				{Addr: "10.0.0.0", MaskBits: 8},
+				{Addr: "10.1.0.0", MaskBits: 16, Negate: true},
+				{Addr: "10.1.1.1", MaskBits: vcl.NoMaskBits},
+			},
+		},
+		{
+			Name:       "xff",
+			Comparand:  "xff-first",
+			FailStatus: 0,
+			Addresses: []vcl.ACLAddress{
+				{Addr: "192.0.2.0", MaskBits: 24},
+			},
+			ResultHdr: vcl.ResultHdrType{
+				Header:  "req.http.X-Blocked",
+				Success: "false",
+				Failure: "true",
+			},
+		},
+	}
+	for _, tc := range []struct {
+		client, xff, blocked string
+		status               uint16
+	}{
+		{"10.0.0.1", "", "false", 0},
+		{"10.1.0.1", "", "", 403},
+		{"10.1.1.1", "", "false", 0},
+		{"172.16.0.1", "", "", 403},
+		{"10.0.0.1", "192.0.2.7, 10.0.0.1", "true", 0},
+		{"10.0.0.1", "198.51.100.1, 192.0.2.7", "false", 0},
+	} {
+		req := Request{
+			Host:     "cafe.example.com",
+			URL:      "/tea",
+			ClientIP: tc.client,
+			Header:   http.Header{},
+		}
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		res := explain(t, spec, req)
+		if res.Status != tc.status {
+			t.Errorf("client %s: got status %d want %d", tc.client,
+				res.Status, tc.status)
+		}
+		if got := res.Header.Get("X-Blocked"); got != tc.blocked {
+			t.Errorf("client %s xff %s: got X-Blocked=%s want %s",
+				tc.client, tc.xff, got, tc.blocked)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	spec := cafeSpec
+	spec.Auths = []vcl.Auth{{
+		Realm:       "cafe",
+		Status:      vcl.Basic,
+		Credentials: []string{"Zm9vOmJhcg=="},
+		Conditions: []vcl.MatchTerm{{
+			Comparand: "req.url",
+			Compare:   vcl.Match,
+			Value:     "^/coffee",
+		}},
+	}}
+	for _, tc := range []struct {
+		url, auth string
+		status    uint16
+	}{
+		{"/tea", "", 0},
+		{"/coffee", "", 401},
+		{"/coffee", "Basic Zm9vOmJhcg==", 0},
+		{"/coffee", "Basic   Zm9vOmJhcg==  ", 0},
+		{"/coffee", "Basic Zm9vOmJheg==", 401},
+		{"/coffee", "basic Zm9vOmJhcg==", 401},
+	} {
+		req := Request{
+			Host:   "cafe.example.com",
+			URL:    tc.url,
+			Header: http.Header{},
+		}
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		res := explain(t, spec, req)
+		if res.Status != tc.status {
+			t.Errorf("%s %q: got status %d want %d", tc.url, tc.auth,
+				res.Status, tc.status)
+		}
+	}
+}
+
+func TestDispositions(t *testing.T) {
+	spec := cafeSpec
+	spec.Dispositions = []vcl.DispositionSpec{
+		{
+			Conditions: []vcl.Condition{{
+				Comparand: "req.method",
+				Compare:   vcl.Equal,
+				Values:    []string{"GET", "HEAD"},
+				Negate:    true,
+			}},
+			Disposition: vcl.DispositionType{
+				Action: vcl.RecvSynth,
+				Status: 405,
+			},
+		},
+		{
+			Conditions: []vcl.Condition{
+				{
+					Comparand: "req.url",
+					Compare:   vcl.Prefix,
+					Values:    []string{"/coffee", "/tea"},
+					MatchFlags: vcl.MatchFlagsType{
+						CaseSensitive: false,
+					},
+				},
+				{
+					Comparand: "req.http.Cookie",
+					Compare:   vcl.Exists,
+				},
+			},
+			Disposition: vcl.DispositionType{Action: vcl.RecvPass},
+		},
+		{
+			Conditions: []vcl.Condition{{
+				Comparand: "req.url",
+				Compare:   vcl.Match,
+				Values:    []string{`\.php$`},
+				MatchFlags: vcl.MatchFlagsType{
+					CaseSensitive: true,
+				},
+			}},
+			Disposition: vcl.DispositionType{Action: vcl.RecvPipe},
+		},
+	}
+	for _, tc := range []struct {
+		method, url, cookie string
+		recv                vcl.RecvReturn
+		status              uint16
+	}{
+		{"POST", "/tea", "", vcl.RecvSynth, 405},
+		{"GET", "/TEA/green", "x=y", vcl.RecvPass, 0},
+		{"GET", "/tea/green", "", vcl.RecvHash, 0},
+		{"HEAD", "/index.php", "", vcl.RecvPipe, 0},
+		{"GET", "/index.PHP", "x=y", vcl.RecvHash, 0},
+	} {
+		req := Request{
+			Method: tc.method,
+			Host:   "cafe.example.com",
+			URL:    tc.url,
+			Header: http.Header{},
+		}
+		if tc.cookie != "" {
+			req.Header.Set("Cookie", tc.cookie)
+		}
+		res := explain(t, spec, req)
+		if res.Recv != tc.recv || res.Status != tc.status {
+			t.Errorf("%s %s: got recv=%s status=%d want recv=%s "+
+				"status=%d", tc.method, tc.url, res.Recv, res.Status,
+				tc.recv, tc.status)
+		}
+	}
+}
+
+func TestRewrites(t *testing.T) {
+	spec := cafeSpec
+	spec.Rewrites = []vcl.Rewrite{
+		{
+			Target:  "req.url",
+			Source:  "req.url",
+			Method:  vcl.Sub,
+			Compare: vcl.Match,
+			Rules: []vcl.RewriteRule{
+				{Value: `^/old/(.*)`, Rewrite: `/tea/\1`},
+			},
+			MatchFlags: vcl.MatchFlagsType{CaseSensitive: true},
+			VCLSub:     vcl.Recv,
+		},
+		{
+			Target:  "bereq.http.X-Cafe",
+			Source:  "bereq.url",
+			Method:  vcl.Replace,
+			Compare: vcl.Prefix,
+			Rules: []vcl.RewriteRule{
+				{Value: "/tea", Rewrite: "tea"},
+				{Value: "/tea/green", Rewrite: "green tea"},
+			},
+			Select: vcl.Longest,
+			MatchFlags: vcl.MatchFlagsType{
+				CaseSensitive: true,
+			},
+		},
+		{
+			Target: "req.http.Host",
+			Method: vcl.Replace,
+			Rules: []vcl.RewriteRule{
+				{Rewrite: "cafe.example.com"},
+			},
+			VCLSub: vcl.Recv,
+		},
+		{
+			Target: "req.http.X-Debug",
+			Method: vcl.Delete,
+			VCLSub: vcl.Recv,
+		},
+		{
+			Target: "resp.http.X-Cafe",
+			Source: "req.http.X-Cafe",
+			Method: vcl.Replace,
+		},
+	}
+	req := Request{
+		Host:   "www.example.com",
+		URL:    "/old/green/sencha",
+		Header: http.Header{"X-Debug": []string{"on"}},
+	}
+	res := explain(t, spec, req)
+	if res.URL != "/tea/green/sencha" {
+		t.Errorf("req.url got %s want /tea/green/sencha", res.URL)
+	}
+	if res.Service != "tea-svc" || res.Default {
+		t.Errorf("got service %s (default=%v) want tea-svc",
+			res.Service, res.Default)
+	}
+	if got := res.Header.Get("X-Debug"); got != "" {
+		t.Errorf("X-Debug got %s want unset", got)
+	}
+	if got := res.BackendHeader.Get("X-Cafe"); got != "green tea" {
+		t.Errorf("bereq X-Cafe got %q want \"green tea\"", got)
+	}
+	if len(res.Notes) == 0 {
+		t.Error("want a note for the resp rewrite, got none")
+	}
+	var order []string
+	for _, step := range res.Steps {
+		if step.Kind == "rewrite" {
+			order = append(order, step.Sub+"/"+step.Name)
+		}
+	}
+	want := []string{"recv/0", "recv/2", "recv/3", "backend_fetch/1"}
+	if len(order) != len(want) {
+		t.Fatalf("rewrite order got %v want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Errorf("rewrite order got %v want %v", order, want)
+			break
+		}
+	}
+
+	spec.Rewrites = []vcl.Rewrite{{
+		Target:  "req.url",
+		Source:  "req.url",
+		Method:  vcl.Sub,
+		Compare: vcl.Match,
+		Rules: []vcl.RewriteRule{
+			{Value: `^/tea`, Rewrite: "/t"},
+			{Value: `^/tea/green`, Rewrite: "/g"},
+		},
+		MatchFlags: vcl.MatchFlagsType{CaseSensitive: true},
+		VCLSub:     vcl.Recv,
+	}}
+	req = Request{Host: "cafe.example.com", URL: "/tea/green"}
+	if res = explain(t, spec, req); !res.Failed || res.Status != 503 {
+		t.Errorf("non-unique match: got failed=%v status=%d, want "+
+			"VCL failure", res.Failed, res.Status)
+	}
+	spec.Rewrites[0].Select = vcl.Last
+	if res = explain(t, spec, req); res.Failed || res.URL != "/g" {
+		t.Errorf("select=LAST: got failed=%v url=%s, want url=/g",
+			res.Failed, res.URL)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	posix := vcl.MatchFlagsType{PosixSyntax: true, CaseSensitive: true}
+	if _, err := compile(`/\d+`, posix); err == nil {
+		t.Error(`compile(\d) with posix_syntax: want error`)
+	}
+	posix.PerlClasses = true
+	if _, err := compile(`/\d+`, posix); err != nil {
+		t.Errorf(`compile(\d) with perl_classes: %v`, err)
+	}
+	lit, err := compile(`a.b`, vcl.MatchFlagsType{
+		Literal: true,
+		Anchor:  vcl.Both,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lit.MatchString("axb") || !lit.MatchString("A.B") {
+		t.Error("literal, case-insensitive, anchored match failed")
+	}
+	if got := substitute(lit, "a.b", `[\0\\]`, false); got != `[a.b\]` {
+		t.Errorf("substitute() got %s", got)
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package explain
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+)
+
+// The functions in this file emulate the re2 and selector VMODs, as
+// they are used by the generated VCL.
+
+// compile returns a regular expression that matches the same strings
+// as the pattern compiled by the re2 VMOD with the given flags.
+//
+// posix_syntax restricts patterns to POSIX egrep syntax, unless
+// perl_classes or word_boundary are also set; this is checked by
+// parsing the pattern without Perl extensions. Go's regexp package
+// accepts a superset of RE2 syntax otherwise, so a pattern that
+// compiles here may still be rejected by the VMOD.
+func compile(pattern string, flags vcl.MatchFlagsType) (*regexp.Regexp,
+	error) {
+
+	expr := pattern
+	if flags.Literal {
+		expr = regexp.QuoteMeta(pattern)
+	} else if flags.PosixSyntax {
+		parseFlags := syntax.ClassNL | syntax.OneLine
+		if flags.PerlClasses || flags.WordBoundary {
+			parseFlags |= syntax.PerlX
+		}
+		if _, err := syntax.Parse(pattern, parseFlags); err != nil {
+			return nil, err
+		}
+	}
+	switch flags.Anchor {
+	case vcl.Start:
+		expr = "^(?:" + expr + ")"
+	case vcl.Both:
+		expr = "^(?:" + expr + ")$"
+	}
+	if !flags.CaseSensitive {
+		expr = "(?i)" + expr
+	}
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if flags.LongestMatch {
+		regex.Longest()
+	}
+	return regex, nil
+}
+
+// Regexp returns a regular expression that matches the same strings
+// as the pattern compiled by the re2 VMOD with the given flags,
+// within the limits described in the package documentation.
+func Regexp(pattern string, flags vcl.MatchFlagsType) (*regexp.Regexp,
+	error) {
+
+	return compile(pattern, flags)
+}
+
+// set emulates an object created by re2.set() or selector.set().
+type set struct {
+	strings       []string
+	regexes       []*regexp.Regexp
+	prefix        bool
+	caseSensitive bool
+}
+
+// newRegexSet emulates re2.set() with the given flags, and add() for
+// each of the patterns.
+func newRegexSet(patterns []string, flags vcl.MatchFlagsType) (*set,
+	error) {
+
+	s := &set{
+		strings:       patterns,
+		regexes:       make([]*regexp.Regexp, len(patterns)),
+		caseSensitive: flags.CaseSensitive,
+	}
+	for i, pattern := range patterns {
+		regex, err := compile(pattern, flags)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot compile pattern \"%s\": %v",
+				pattern, err)
+		}
+		s.regexes[i] = regex
+	}
+	return s, nil
+}
+
+// newSelectorSet emulates selector.set(), and add() for each of the
+// strings. If prefix is true, the set is used for hasprefix(),
+// otherwise for match().
+func newSelectorSet(strs []string, prefix, caseSensitive bool) *set {
+	return &set{
+		strings:       strs,
+		prefix:        prefix,
+		caseSensitive: caseSensitive,
+	}
+}
+
+func (s *set) equal(a, b string) bool {
+	if s.caseSensitive {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
+
+// match returns the indices of all members of the set that match
+// the subject, in the order in which they were added.
+func (s *set) match(subject string) []int {
+	var matches []int
+	for i, str := range s.strings {
+		switch {
+		case s.regexes != nil:
+			if !s.regexes[i].MatchString(subject) {
+				continue
+			}
+		case s.prefix:
+			if len(subject) < len(str) ||
+				!s.equal(subject[:len(str)], str) {
+				continue
+			}
+		default:
+			if !s.equal(subject, str) {
+				continue
+			}
+		}
+		matches = append(matches, i)
+	}
+	return matches
+}
+
+// choose returns the index of the member selected from matches by
+// the select parameter of the VMOD methods. It returns an error in
+// cases in which the VMOD invokes VCL failure.
+func (s *set) choose(matches []int, subject string,
+	sel vcl.SelectType) (int, error) {
+
+	if len(matches) == 0 {
+		return -1, fmt.Errorf("No match")
+	}
+	switch sel {
+	case vcl.Unique:
+		if len(matches) != 1 {
+			return -1, fmt.Errorf("%d matches with select=UNIQUE",
+				len(matches))
+		}
+		return matches[0], nil
+	case vcl.First:
+		return matches[0], nil
+	case vcl.Last:
+		return matches[len(matches)-1], nil
+	case vcl.Exact:
+		for _, m := range matches {
+			if s.equal(subject, s.strings[m]) {
+				return m, nil
+			}
+		}
+		return -1, fmt.Errorf("No exact match with select=EXACT")
+	case vcl.Longest, vcl.Shortest:
+		chosen := matches[0]
+		for _, m := range matches[1:] {
+			l, c := len(s.strings[m]), len(s.strings[chosen])
+			if (sel == vcl.Longest && l > c) ||
+				(sel == vcl.Shortest && l < c) {
+				chosen = m
+			}
+		}
+		return chosen, nil
+	default:
+		return -1, fmt.Errorf("Unknown select value %v", sel)
+	}
+}
+
+// expand returns the RE2 rewrite string with the backreferences \0
+// to \9 replaced by the corresponding submatches of src, as
+// identified by the index pairs in m, and with \\ replaced by a
+// backslash.
+func expand(rewrite, src string, m []int) string {
+	var b strings.Builder
+	for i := 0; i < len(rewrite); i++ {
+		c := rewrite[i]
+		if c != '\\' || i+1 == len(rewrite) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		d := rewrite[i]
+		switch {
+		case d >= '0' && d <= '9':
+			n := int(d - '0')
+			if 2*n+1 < len(m) && m[2*n] >= 0 {
+				b.WriteString(src[m[2*n]:m[2*n+1]])
+			}
+		case d == '\\':
+			b.WriteByte('\\')
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(d)
+		}
+	}
+	return b.String()
+}
+
+// substitute emulates the sub() and suball() methods of the VMODs:
+// the first match of regex in src (or every match, if all is true) is
+// replaced with the expanded rewrite string.
+func substitute(regex *regexp.Regexp, src, rewrite string, all bool) string {
+	n := 1
+	if all {
+		n = -1
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range regex.FindAllStringSubmatchIndex(src, n) {
+		b.WriteString(src[last:m[0]])
+		b.WriteString(expand(rewrite, src, m))
+		last = m[1]
+	}
+	b.WriteString(src[last:])
+	return b.String()
+}
+
+// extract emulates the extract() method of the re2 VMOD: the
+// expanded rewrite string is returned if regex matches src. The
+// second return value is false if there was no match.
+func extract(regex *regexp.Regexp, src, rewrite string) (string, bool) {
+	m := regex.FindStringSubmatchIndex(src)
+	if m == nil {
+		return "", false
+	}
+	return expand(rewrite, src, m), true
+}
+
+// regsub emulates the VCL function regsub(): if regex matches src,
+// the first match is replaced, otherwise src is returned unchanged.
+func regsub(regex *regexp.Regexp, src, rewrite string) string {
+	return substitute(regex, src, rewrite, false)
+}
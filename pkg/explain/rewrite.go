@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package explain
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+)
+
+// The following functions correspond to the template functions of
+// the same names in pkg/varnish/vcl.
+
+func rewrSub(rewr vcl.Rewrite) string {
+	if rewr.VCLSub == vcl.Unspecified {
+		if strings.HasPrefix(rewr.Target, "resp") {
+			rewr.VCLSub = vcl.Deliver
+		} else if strings.HasPrefix(rewr.Target, "beresp") {
+			rewr.VCLSub = vcl.BackendResponse
+		} else if strings.HasPrefix(rewr.Target, "req") {
+			rewr.VCLSub = vcl.Recv
+		} else {
+			rewr.VCLSub = vcl.BackendFetch
+		}
+	}
+	switch rewr.VCLSub {
+	case vcl.Recv:
+		return "recv"
+	case vcl.Pipe:
+		return "pipe"
+	case vcl.Pass:
+		return "pass"
+	case vcl.Hash:
+		return "hash"
+	case vcl.Purge:
+		return "purge"
+	case vcl.Miss:
+		return "miss"
+	case vcl.Hit:
+		return "hit"
+	case vcl.Deliver:
+		return "deliver"
+	case vcl.Synth:
+		return "synth"
+	case vcl.BackendFetch:
+		return "backend_fetch"
+	case vcl.BackendResponse:
+		return "backend_response"
+	case vcl.BackendError:
+		return "backend_error"
+	default:
+		return "__UNKNOWN_VCL_SUB__"
+	}
+}
+
+func needsMatcher(rewr vcl.Rewrite) bool {
+	switch rewr.Method {
+	case vcl.Append, vcl.Prepend, vcl.Delete, vcl.Replace:
+		if len(rewr.Rules) == 0 ||
+			(len(rewr.Rules) == 1 && rewr.Rules[0].Value == "") {
+			return false
+		}
+		return true
+	default:
+		return true
+	}
+}
+
+func needsUniqueCheck(rewr vcl.Rewrite) bool {
+	if rewr.Compare == vcl.Equal || rewr.Select != vcl.Unique {
+		return false
+	}
+	switch rewr.Method {
+	case vcl.Delete:
+		return false
+	case vcl.Sub, vcl.Suball, vcl.RewriteMethod:
+		return true
+	default:
+		return len(rewr.Rules) > 0 && rewr.Rules[0].Value != ""
+	}
+}
+
+func saveRegex(rewr vcl.Rewrite, rule vcl.RewriteRule) string {
+	regex := `^\Q` + rule.Value + `\E`
+	if rewr.Compare == vcl.Prefix {
+		return regex
+	}
+	return regex + "$"
+}
+
+func rewriteSet(rewr vcl.Rewrite) (*set, error) {
+	values := make([]string, len(rewr.Rules))
+	for i, rule := range rewr.Rules {
+		values[i] = rule.Value
+	}
+	if rewr.Compare == vcl.Match {
+		return newRegexSet(values, rewr.MatchFlags)
+	}
+	return newSelectorSet(values, rewr.Compare == vcl.Prefix,
+		rewr.MatchFlags.CaseSensitive), nil
+}
+
+// rewrites executes the rewrites for a VCL subroutine, in the order
+// in which they are specified.
+func (s *state) rewrites(sub string) error {
+	for i, rw := range s.spec.Rewrites {
+		if rewrSub(rw) != sub {
+			continue
+		}
+		if err := s.rewrite(sub, i, rw); err != nil {
+			return fmt.Errorf("Rewrite %d: %v", i, err)
+		}
+		if s.done {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *state) rewrite(sub string, i int, rw vcl.Rewrite) error {
+	name := strconv.Itoa(i)
+	sel := -1
+	var m *set
+	var src string
+	if needsMatcher(rw) {
+		var err error
+		if m, err = rewriteSet(rw); err != nil {
+			return err
+		}
+		src = s.value(rw.Source)
+		matches := m.match(src)
+		if len(matches) == 0 {
+			s.step(sub, "rewrite", name, false,
+				"%s %q matches no rule", rw.Source, src)
+			return nil
+		}
+		if needsUniqueCheck(rw) && len(matches) != 1 {
+			s.step(sub, "rewrite", name, true,
+				"%s %q had %d matches: return(fail)", rw.Source,
+				src, len(matches))
+			s.fail()
+			return nil
+		}
+		if sel, err = m.choose(matches, src, rw.Select); err != nil {
+			s.step(sub, "rewrite", name, true, "%s %q: %v, "+
+				"return(fail)", rw.Source, src, err)
+			s.fail()
+			return nil
+		}
+	}
+
+	var val string
+	switch rw.Method {
+	case vcl.Delete:
+		if err := s.unset(rw.Target); err != nil {
+			s.note("Rewrite %d: %v", i, err)
+			return nil
+		}
+		s.step(sub, "rewrite", name, true, "unset %s", rw.Target)
+		return nil
+	case vcl.Append:
+		val = s.operand1(rw) + s.operand2(rw, sel)
+	case vcl.Prepend:
+		val = s.operand2(rw, sel) + s.operand1(rw)
+	case vcl.Replace:
+		val = s.operand2(rw, sel)
+	case vcl.Sub, vcl.Suball, vcl.RewriteMethod:
+		var ok bool
+		var err error
+		if val, ok, err = s.substitute(rw, m, sel, src); err != nil {
+			return err
+		} else if !ok {
+			s.note("Rewrite %d: the rewrite method with the "+
+				"selector VMOD is not evaluated", i)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Unknown rewrite method %v", rw.Method)
+	}
+	if err := s.set(rw.Target, val); err != nil {
+		s.note("Rewrite %d: %v", i, err)
+		return nil
+	}
+	detail := fmt.Sprintf("set %s = %q", rw.Target, val)
+	if sel >= 0 {
+		detail = fmt.Sprintf("%s %q matches %q: %s", rw.Source, src,
+			rw.Rules[sel].Value, detail)
+	}
+	s.step(sub, "rewrite", name, true, "%s", detail)
+	return nil
+}
+
+func (s *state) operand1(rw vcl.Rewrite) string {
+	if len(rw.Rules) == 0 {
+		return s.value(rw.Target)
+	}
+	return s.value(rw.Source)
+}
+
+func (s *state) operand2(rw vcl.Rewrite, sel int) string {
+	if len(rw.Rules) == 1 && rw.Rules[0].Value == "" {
+		return rw.Rules[0].Rewrite
+	}
+	if len(rw.Rules) > 0 && rw.Rules[0].Value != "" {
+		return rw.Rules[sel].Rewrite
+	}
+	return s.value(rw.Source)
+}
+
+// substitute evaluates the sub, suball and extract methods. With the
+// selector VMOD, the regex saved for the selected rule is used. The
+// second return value is false if the operation is not evaluated.
+func (s *state) substitute(rw vcl.Rewrite, m *set, sel int,
+	src string) (string, bool, error) {
+
+	rule := rw.Rules[sel]
+	if rw.Compare != vcl.Match {
+		if rw.Method == vcl.RewriteMethod {
+			return "", false, nil
+		}
+		regex, err := compile(saveRegex(rw, rule), vcl.MatchFlagsType{
+			CaseSensitive: rw.MatchFlags.CaseSensitive,
+		})
+		if err != nil {
+			return "", false, err
+		}
+		return substitute(regex, src, rule.Rewrite, false), true, nil
+	}
+	regex := m.regexes[sel]
+	switch rw.Method {
+	case vcl.Sub:
+		return substitute(regex, src, rule.Rewrite, false), true, nil
+	case vcl.Suball:
+		return substitute(regex, src, rule.Rewrite, true), true, nil
+	default:
+		val, _ := extract(regex, src, rule.Rewrite)
+		return val, true, nil
+	}
+}
@@ -0,0 +1,397 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package varnish
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.uplex.de/uplex-varnish/varnishapi/pkg/admin"
+)
+
+const (
+	canaryStarted    = "CanaryStarted"
+	canarySucceeded  = "CanarySucceeded"
+	canaryFailed     = "CanaryFailed"
+	canaryCheckIntvl = 10 * time.Second
+)
+
+// canaryState is the state of a canary rollout in progress for a
+// Varnish Service.
+type canaryState struct {
+	spec     *vclSpec
+	cfg      string
+	prev     string
+	srcs     *vclSources
+	insts    []*varnishInst
+	loadedAt []*varnishInst
+	deadline time.Time
+}
+
+// SetCanary configures staged rollouts of new configurations. A new
+// config is first loaded at all instances of a Varnish Service, but
+// is only activated at a subset of them, the canaries. The canaries
+// are checked for the duration soak, and if all checks succeed, the
+// config is activated at the remaining instances. Otherwise the
+// canaries are rolled back to the previous config.
+//
+// canary is the number of canary instances, or a percentage of the
+// instances if it ends with "%". Canary rollouts are disabled if
+// canary is the empty string or 0, or if soak <= 0.
+func (vc *Controller) SetCanary(canary string, soak time.Duration) error {
+	n, pct, err := ParseCanary(canary)
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	vc.opts.canaryN, vc.opts.canaryPct, vc.opts.canarySoak = n, pct, soak
+	return err
+}
+
+// ParseCanary parses a canary specification as described for
+// SetCanary, returning the number or percentage of canary instances,
+// and true if it is a percentage. Returns 0 for the empty string.
+func ParseCanary(canary string) (uint, bool, error) {
+	if canary == "" {
+		return 0, false, nil
+	}
+	pct := false
+	numStr := canary
+	if strings.HasSuffix(canary, "%") {
+		pct = true
+		numStr = strings.TrimSuffix(canary, "%")
+	}
+	n, err := strconv.ParseUint(numStr, 10, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("Illegal canary specification "+
+			"%s: %v", canary, err)
+	}
+	if pct && n > 100 {
+		return 0, false, fmt.Errorf("Illegal canary specification "+
+			"%s: percentage > 100", canary)
+	}
+	return uint(n), pct, nil
+}
+
+// canaryInsts returns the instances of svc at which a new config is
+// to be activated first, or nil if there is to be no canary rollout.
+func (vc *Controller) canaryInsts(svc *varnishSvc) []*varnishInst {
+	opts := vc.settings()
+	if opts.canaryN == 0 || opts.canarySoak <= 0 {
+		return nil
+	}
+	var insts []*varnishInst
+	for _, inst := range svc.instances {
+		if inst != nil {
+			insts = append(insts, inst)
+		}
+	}
+	n := int(opts.canaryN)
+	if opts.canaryPct {
+		n = int(math.Ceil(float64(len(insts)) *
+			float64(opts.canaryN) / 100))
+	}
+	if n >= len(insts) {
+		return nil
+	}
+	sort.Slice(insts, func(i, j int) bool {
+		return insts[i].addr < insts[j].addr
+	})
+	return insts[:n]
+}
+
+// backendHealth counts the backends of the config cfgName in the
+// output of backend.list, and the number of them that are sick.
+func backendHealth(list, cfgName string) (total, sick int) {
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], cfgName+".") {
+			continue
+		}
+		total++
+		if strings.ToLower(fields[1]) == "sick" ||
+			strings.HasPrefix(fields[2], "Sick") {
+			sick++
+		}
+	}
+	return
+}
+
+// checkCanary runs the monitor's health checks at the canary
+// instance inst. If final is true, then the backends of the config
+// cfgName are checked as well; the check fails if a larger fraction
+// of them is sick than of the backends of the previous config prev.
+func (vc *Controller) checkCanary(inst *varnishInst, cfg, prev string,
+	final bool) error {
+
+	log := inst.logger(vc.log).WithField(logConfig, cfg)
+	metrics := getInstanceMetrics(inst.addr)
+	return vc.withAdmin(inst, metrics, func(adm *admin.Admin) error {
+		if _, err := adm.Ping(); err != nil {
+			metrics.pingFails.Inc()
+			return fmt.Errorf("Ping failed: %v", err)
+		}
+		metrics.pings.Inc()
+		state, err := adm.Status()
+		if err != nil {
+			return fmt.Errorf("Status failed: %v", err)
+		}
+		if state != admin.Running {
+			return fmt.Errorf("Child process not running: %s",
+				state)
+		}
+		panic, err := adm.GetPanic()
+		if err != nil {
+			return fmt.Errorf("Panic check failed: %v", err)
+		}
+		if panic != "" {
+			metrics.panics.Inc()
+			return fmt.Errorf("Panic: %s", panic)
+		}
+		if !final {
+			return nil
+		}
+
+		resp, err := adm.Command("backend.list", cfg+".*")
+		if err != nil {
+			return fmt.Errorf("backend.list failed: %v", err)
+		}
+		total, sick := backendHealth(resp.Msg, cfg)
+		resp, err = adm.Command("backend.list", prev+".*")
+		if err != nil {
+			return fmt.Errorf("backend.list failed: %v", err)
+		}
+		prevTotal, prevSick := backendHealth(resp.Msg, prev)
+		log.Debugf("Canary %s: %d of %d backends sick in config %s, "+
+			"%d of %d in config %s", inst.addr, sick, total, cfg,
+			prevSick, prevTotal, prev)
+		if total == 0 || sick == 0 {
+			return nil
+		}
+		if prevTotal == 0 ||
+			float64(sick)/float64(total) >
+				float64(prevSick)/float64(prevTotal) {
+			return fmt.Errorf("%d of %d backends sick in config %s",
+				sick, total, cfg)
+		}
+		return nil
+	})
+}
+
+// startCanary activates the config at the canary instances, and
+// starts the goroutine that completes the rollout after the soak
+// time. svc.mtx must be held.
+func (vc *Controller) startCanary(name string, svc *varnishSvc,
+	c *canaryState) error {
+
+	results := vc.labelAll(activatePhase, c.insts, c.cfg, nil)
+	if errs := results.errs(); len(errs) > 0 {
+		labelled := results.succeeded()
+		return vc.rollback(name, c, labelled, errs, len(labelled) > 0)
+	}
+
+	var addrs []string
+	for _, inst := range c.insts {
+		addrs = append(addrs, inst.addr)
+	}
+	soak := vc.settings().canarySoak
+	c.deadline = time.Now().Add(soak)
+	svc.canary = c
+	canaryGauge.WithLabelValues(name).Set(1)
+	vc.infoEvt(name, canaryStarted, "Config %s activated at canary "+
+		"instances %s for Varnish Service %s, soak time %v", c.cfg,
+		strings.Join(addrs, ","), name, soak)
+	go vc.soakCanary(name, c)
+	return nil
+}
+
+// rollback sets the instances in labelled back to the previous
+// config after a failed rollout, and discards the new config where it
+// was loaded.
+func (vc *Controller) rollback(name string, c *canaryState,
+	labelled []*varnishInst, errs AdmErrors, partial bool) RolloutError {
+
+	rollbacksCtr.WithLabelValues(name).Inc()
+	rbErr := RolloutError{
+		svc:     name,
+		cfg:     c.cfg,
+		prev:    c.prev,
+		partial: partial,
+		canary:  true,
+		errs:    errs,
+	}
+	rbErr.rbErrs = vc.labelAll(rollbackPhase, labelled, c.prev, nil).errs()
+	if len(rbErr.rbErrs) == 0 {
+		rbErr.rbErrs = vc.discardConfig(c.cfg, c.loadedAt)
+	}
+	return rbErr
+}
+
+// presentInsts returns the instances in insts that are still
+// instances of svc, since instances may be removed by Endpoints
+// updates during the soak time. svc.mtx must be held.
+func presentInsts(svc *varnishSvc, insts []*varnishInst) []*varnishInst {
+	present := make(map[*varnishInst]struct{}, len(svc.instances))
+	for _, inst := range svc.instances {
+		present[inst] = struct{}{}
+	}
+	var remaining []*varnishInst
+	for _, inst := range insts {
+		if _, ok := present[inst]; ok {
+			remaining = append(remaining, inst)
+		}
+	}
+	return remaining
+}
+
+// soakCanary checks the canaries of the rollout c for the Varnish
+// Service identified by name until the soak time has elapsed, and
+// then continues the rollout or rolls it back. Canaries that are
+// removed from the Service are no longer checked; if all of them are
+// removed, the canary rollout is started again with new canaries.
+func (vc *Controller) soakCanary(name string, c *canaryState) {
+	log := vc.svcLog(name)
+	for {
+		wait := time.Until(c.deadline)
+		final := wait <= canaryCheckIntvl
+		if !final {
+			wait = canaryCheckIntvl
+		}
+		time.Sleep(wait)
+
+		svc := vc.lockSvc(name, false)
+		if svc == nil || svc.canary != c {
+			log.Infof("Canary rollout of config %s for Varnish "+
+				"Service %s cancelled", c.cfg, name)
+			if svc != nil {
+				svc.mtx.Unlock()
+			}
+			return
+		}
+		if insts := presentInsts(svc, c.insts); len(insts) <
+			len(c.insts) {
+
+			log.Infof("Varnish Service %s: %d of %d canary "+
+				"instances removed during the canary rollout "+
+				"of config %s", name, len(c.insts)-len(insts),
+				len(c.insts), c.cfg)
+			c.insts = insts
+			c.loadedAt = presentInsts(svc, c.loadedAt)
+		}
+		if len(c.insts) == 0 {
+			log.Infof("Varnish Service %s: restarting the canary "+
+				"rollout of config %s", name, c.cfg)
+			svc.canary = nil
+			canaryGauge.WithLabelValues(name).Set(0)
+			svc.mtx.Unlock()
+			go vc.runUpdate(name)
+			return
+		}
+		results := vc.fanOut("canary", c.insts,
+			func(inst *varnishInst, _ *instanceMetrics) (bool,
+				error) {
+				return false, vc.checkCanary(inst, c.cfg, c.prev,
+					final)
+			})
+		results.record("canary", c.cfg)
+		errs := results.errs()
+		if len(errs) == 0 && !final {
+			svc.mtx.Unlock()
+			continue
+		}
+		vc.finishCanary(name, svc, c, errs)
+		svc.mtx.Unlock()
+		return
+	}
+}
+
+// finishCanary completes the canary rollout c, after errs were
+// encountered in the checks of the canaries, or the soak time has
+// elapsed. svc.mtx must be held.
+func (vc *Controller) finishCanary(name string, svc *varnishSvc,
+	c *canaryState, errs AdmErrors) {
+
+	log := vc.svcLog(name)
+	svc.canary = nil
+	canaryGauge.WithLabelValues(name).Set(0)
+	if len(errs) > 0 {
+		rbErr := vc.rollback(name, c, c.insts, errs, true)
+		svc.canaryFailed = c.cfg
+		canaryFailedGauge.WithLabelValues(name).Set(1)
+		vc.errorEvt(name, canaryFailed, "Canary rollout failed, "+
+			"config %s is not rolled out again until the "+
+			"configuration changes: %v", c.cfg, rbErr)
+		return
+	}
+	vc.infoEvt(name, canarySucceeded, "Canary checks for config %s "+
+		"succeeded for Varnish Service %s, activating at all "+
+		"instances", c.cfg, name)
+
+	canary := make(map[*varnishInst]struct{}, len(c.insts))
+	for _, inst := range c.insts {
+		canary[inst] = struct{}{}
+	}
+	var remaining []*varnishInst
+	for _, inst := range svc.insts() {
+		if _, ok := canary[inst]; !ok {
+			remaining = append(remaining, inst)
+		}
+	}
+	// Instances may have been added during the soak time, so the
+	// config is loaded where necessary before activation.
+	results := vc.loadAll(remaining, c.cfg, c.srcs)
+	c.loadedAt = append(c.loadedAt, results.newlyLoaded()...)
+	errs = results.errs()
+	labelled := append([]*varnishInst(nil), c.insts...)
+	if len(errs) > 0 {
+		errs = c.srcs.srcErrs(errs)
+	} else {
+		results = vc.labelAll(activatePhase, remaining, c.cfg, nil)
+		errs = results.errs()
+		labelled = append(labelled, results.succeeded()...)
+	}
+	if len(errs) > 0 {
+		rbErr := vc.rollback(name, c, labelled, errs, true)
+		vc.errorEvt(name, updateErr, "Errors updating Varnish "+
+			"Service %s: %v", name, rbErr)
+		return
+	}
+	vc.setLoaded(svc, c.spec)
+	if svc.pin == c.cfg ||
+		(svc.pin == "" && svc.spec != nil &&
+			svc.spec.configName() == c.cfg) {
+		svc.cfgLoaded = true
+		return
+	}
+	log.Infof("Varnish Service %s: config changed during canary "+
+		"rollout, updating", name)
+	go vc.runUpdate(name)
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package varnish
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"code.uplex.de/uplex-varnish/varnishapi/pkg/admin"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// A connection that has been idle for longer than pingIdle is
+	// checked with a ping before it is used again.
+	pingIdle = 10 * time.Second
+	// Backoff after failed connection attempts, doubled for each
+	// consecutive failure up to maxBackoff.
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Values of the admin connection state gauge.
+const (
+	connDisconnected = iota
+	connConnected
+	connBackoff
+)
+
+// admConn is a long-lived connection to the admin port of a Varnish
+// instance. The mutex serializes all admin interactions with the
+// instance.
+type admConn struct {
+	mtx      sync.Mutex
+	adm      *admin.Admin
+	lastUsed time.Time
+	failures uint
+	retryAt  time.Time
+}
+
+// admSecret is the shared secret for the admin ports of the instances
+// of a Varnish Service. The data may be updated while it is shared by
+// the instances.
+type admSecret struct {
+	mtx  sync.RWMutex
+	data []byte
+}
+
+func (secr *admSecret) get() []byte {
+	secr.mtx.RLock()
+	defer secr.mtx.RUnlock()
+	return secr.data
+}
+
+func (secr *admSecret) set(data []byte) {
+	secr.mtx.Lock()
+	defer secr.mtx.Unlock()
+	secr.data = append([]byte(nil), data...)
+}
+
+var errNoAdmSecret = errors.New("No known admin secret")
+
+// connectError is returned by withAdmin when a connection to the
+// admin port could not be established.
+type connectError struct {
+	err error
+}
+
+func (err connectError) Error() string {
+	return err.err.Error()
+}
+
+func isConnErr(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// backoff returns the period in which connection attempts are
+// suspended after the given number of consecutive failures.
+func backoff(failures uint) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	if failures > 16 {
+		return maxBackoff
+	}
+	wait := minBackoff << (failures - 1)
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
+
+// close closes the admin connection, if any. conn.mtx must be held.
+func (conn *admConn) close(metrics *instanceMetrics) {
+	if conn.adm == nil {
+		return
+	}
+	conn.adm.Close()
+	conn.adm = nil
+	metrics.connState.Set(connDisconnected)
+}
+
+// connect returns the current admin connection to inst if it is still
+// usable, or establishes a new connection, unless connection attempts
+// are in a backoff period after failures. inst.conn.mtx must be held.
+func (vc *Controller) connect(inst *varnishInst,
+	metrics *instanceMetrics) (*admin.Admin, error) {
+
+	log := inst.logger(vc.log)
+	conn := inst.conn
+	now := time.Now()
+	if conn.adm != nil {
+		if now.Sub(conn.lastUsed) < pingIdle {
+			return conn.adm, nil
+		}
+		_, err := conn.adm.Ping()
+		if err == nil {
+			metrics.pings.Inc()
+			return conn.adm, nil
+		}
+		log.Infof("Admin connection to %s failed ping, "+
+			"reconnecting: %v", inst.addr, err)
+		metrics.pingFails.Inc()
+		conn.close(metrics)
+	}
+	if now.Before(conn.retryAt) {
+		return nil, fmt.Errorf("Connection attempts suspended after "+
+			"%d failures, retry in %v", conn.failures,
+			conn.retryAt.Sub(now).Round(time.Millisecond))
+	}
+
+	log.Tracef("Connect to %s, timeout=%v", inst.addr, admTimeout)
+	timer := prometheus.NewTimer(metrics.connectLatency)
+	adm, err := admin.Dial(inst.addr, inst.admSecret.get(), admTimeout)
+	timer.ObserveDuration()
+	if err != nil {
+		metrics.connectFails.Inc()
+		conn.failures++
+		conn.retryAt = now.Add(backoff(conn.failures))
+		metrics.connState.Set(connBackoff)
+		return nil, err
+	}
+	if conn.failures > 0 || !conn.lastUsed.IsZero() {
+		metrics.reconnects.Inc()
+	}
+	conn.adm = adm
+	conn.failures = 0
+	conn.retryAt = time.Time{}
+	metrics.connState.Set(connConnected)
+	inst.Banner = adm.Banner
+	log.Infof("Connected to Varnish admin endpoint at %s", inst.addr)
+	return adm, nil
+}
+
+// withAdmin invokes f with the admin connection to the Varnish
+// instance inst, establishing a connection if necessary. Admin
+// interactions with the instance are serialized. If f fails with an
+// error indicating that the connection was lost, the connection is
+// closed, and is re-established for the next interaction.
+//
+// If no admin secret is known for the instance, the error is
+// errNoAdmSecret. If a connection cannot be established, the error has
+// type connectError.
+func (vc *Controller) withAdmin(inst *varnishInst, metrics *instanceMetrics,
+	f func(adm *admin.Admin) error) error {
+
+	log := inst.logger(vc.log)
+	inst.conn.mtx.Lock()
+	defer inst.conn.mtx.Unlock()
+	if inst.admSecret == nil {
+		return errNoAdmSecret
+	}
+	vc.wg.Add(1)
+	defer vc.wg.Done()
+
+	adm, err := vc.connect(inst, metrics)
+	if err != nil {
+		return connectError{err: err}
+	}
+	err = f(adm)
+	inst.conn.lastUsed = time.Now()
+	if err != nil && isConnErr(err) {
+		log.Warnf("Admin connection to %s lost: %v", inst.addr, err)
+		inst.conn.close(metrics)
+	}
+	return err
+}
+
+// setSecret sets the admin secret for inst.
+func (inst *varnishInst) setSecret(secr *admSecret) {
+	inst.conn.mtx.Lock()
+	defer inst.conn.mtx.Unlock()
+	inst.admSecret = secr
+}
+
+// closeConn closes the admin connection to inst, for example when
+// the instance is removed.
+func (inst *varnishInst) closeConn() {
+	inst.conn.mtx.Lock()
+	defer inst.conn.mtx.Unlock()
+	inst.conn.close(getInstanceMetrics(inst.addr))
+}
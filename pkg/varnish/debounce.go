@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package varnish
+
+import (
+	"fmt"
+	"time"
+)
+
+// loadLimitError is returned when a VCL load for a Varnish Service is
+// deferred, because an instance has reached the maximum number of
+// loads per minute.
+type loadLimitError struct {
+	addr string
+	wait time.Duration
+}
+
+func (err loadLimitError) Error() string {
+	return fmt.Sprintf("%s: VCL load limit reached, load deferred for %v",
+		err.addr, err.wait)
+}
+
+// SetUpdateDelay configures the batching of updates for Varnish
+// Services. If quiet > 0, then Update does not load a new
+// configuration immediately; rather, the load is scheduled after
+// quiet has elapsed with no further Updates for the same Service, so
+// that only the most recent configuration is rendered and loaded. If
+// maxDelay > 0, then a load is not postponed for longer than maxDelay
+// after the first Update of a batch, even if Updates keep arriving.
+//
+// If quiet <= 0, then Update loads configurations immediately.
+func (vc *Controller) SetUpdateDelay(quiet, maxDelay time.Duration) {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	vc.opts.quiet = quiet
+	vc.opts.maxDelay = maxDelay
+}
+
+// SetMaxLoadsPerMin limits the number of VCL loads at each Varnish
+// instance to max per minute. When the limit is reached, the load is
+// deferred until it is permitted again. There is no limit if max is
+// 0.
+func (vc *Controller) SetMaxLoadsPerMin(max uint) {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	vc.opts.maxLoads = max
+}
+
+// scheduleUpdate (re-)starts the timer for a batched update of the
+// Varnish Service svc, identified by key. The timer is not restarted
+// if the currently pending update is for the same configuration.
+// svc.mtx must be held.
+func (vc *Controller) scheduleUpdate(key string, svc *varnishSvc,
+	prevCfg string) {
+
+	log := vc.svcLog(key)
+	now := time.Now()
+	if svc.pending != nil {
+		if prevCfg == svc.spec.configName() {
+			log.Debugf("Varnish Service %s: update already "+
+				"pending for config %s", key, prevCfg)
+			return
+		}
+		if svc.pending.Stop() {
+			log.Debugf("Varnish Service %s: config %s "+
+				"superseded before load", key, prevCfg)
+			droppedSpecsCtr.WithLabelValues(key).Inc()
+		}
+	} else {
+		svc.pendingSince = now
+	}
+
+	opts := vc.settings()
+	delay := opts.quiet
+	if opts.maxDelay > 0 {
+		deadline := svc.pendingSince.Add(opts.maxDelay)
+		if now.Add(delay).After(deadline) {
+			delay = deadline.Sub(now)
+		}
+	}
+	log.Debugf("Varnish Service %s: update scheduled in %v", key, delay)
+	vc.startTimer(key, svc, delay)
+}
+
+// startTimer sets svc.pending to a timer that runs the batched update
+// for the Varnish Service identified by key after delay. When the
+// timer fires, the update only runs if the timer is still pending;
+// otherwise it was stopped too late, after it was superseded by a
+// newer timer or an immediate update. svc.mtx must be held.
+func (vc *Controller) startTimer(key string, svc *varnishSvc,
+	delay time.Duration) {
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		svc := vc.lockSvc(key, false)
+		if svc == nil {
+			return
+		}
+		defer svc.mtx.Unlock()
+
+		if svc.pending != timer {
+			vc.svcLog(key).Debugf("Varnish Service %s: "+
+				"superseded update timer fired, ignoring", key)
+			return
+		}
+		svc.pending = nil
+		vc.batchUpdate(key, svc)
+	})
+	svc.pending = timer
+}
+
+// runUpdate executes an update for the Varnish Service identified by
+// key, unless a batched update is pending, which loads the most
+// recent configuration when its timer fires.
+func (vc *Controller) runUpdate(key string) {
+	svc := vc.lockSvc(key, false)
+	if svc == nil {
+		return
+	}
+	defer svc.mtx.Unlock()
+
+	if svc.pending != nil {
+		vc.svcLog(key).Debugf("Varnish Service %s: update pending",
+			key)
+		return
+	}
+	vc.batchUpdate(key, svc)
+}
+
+// batchUpdate runs the update for the Varnish Service svc, identified
+// by key, and re-schedules it if a VCL load must be deferred due to the
+// load limit. svc.mtx must be held.
+func (vc *Controller) batchUpdate(key string, svc *varnishSvc) {
+	log := vc.svcLog(key)
+	err := vc.updateVarnishSvc(key, svc)
+	if err == nil {
+		return
+	}
+	if limitErr, ok := err.(loadLimitError); ok {
+		log.Infof("Varnish Service %s: %v", key, limitErr)
+		svc.pendingSince = time.Now()
+		vc.startTimer(key, svc, limitErr.wait)
+		return
+	}
+	vc.errorEvt(key, updateErr, "Errors updating Varnish Service %s: %+v",
+		key, err)
+}
+
+// loadWait returns the time to wait until a VCL load is permitted for
+// all instances of svc, or 0 if the load may proceed. The address of
+// the instance with the longest wait is also returned. svc.mtx must be
+// held.
+func (vc *Controller) loadWait(svc *varnishSvc) (time.Duration, string) {
+	var wait time.Duration
+	var addr string
+	maxLoads := vc.settings().maxLoads
+	if maxLoads == 0 {
+		return 0, ""
+	}
+	now := time.Now()
+	for _, inst := range svc.instances {
+		inst.pruneLoads(now)
+		if uint(len(inst.loadTimes)) < maxLoads {
+			continue
+		}
+		instWait := inst.loadTimes[0].Add(time.Minute).Sub(now)
+		if instWait > wait {
+			wait = instWait
+			addr = inst.addr
+		}
+	}
+	return wait, addr
+}
+
+// pruneLoads removes the times of VCL loads at inst that are older
+// than one minute.
+func (inst *varnishInst) pruneLoads(now time.Time) {
+	i := 0
+	for i < len(inst.loadTimes) &&
+		now.Sub(inst.loadTimes[i]) >= time.Minute {
+		i++
+	}
+	inst.loadTimes = inst.loadTimes[i:]
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+package varnish
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+
+	"code.uplex.de/uplex-varnish/varnishapi/pkg/admin"
+)
+
+// Phase of admin interactions for the debug API, for the per-instance
+// result metrics.
+const debugPhase = "debug"
+
+// redactedCred replaces the credentials for basic and proxy
+// authentication in the specs and VCL sources shown by the debug API.
+const redactedCred = "REDACTED"
+
+// redacted returns a copy of spec in which the credentials of each
+// auth realm are replaced by redactedCred, so that the debug API does
+// not reveal the contents of the Secrets from which they were read.
+func redacted(spec vcl.Spec) vcl.Spec {
+	if len(spec.Auths) == 0 {
+		return spec
+	}
+	auths := make([]vcl.Auth, len(spec.Auths))
+	for i, auth := range spec.Auths {
+		creds := make([]string, len(auth.Credentials))
+		for j := range creds {
+			creds[j] = redactedCred
+		}
+		auth.Credentials = creds
+		auths[i] = auth
+	}
+	spec.Auths = auths
+	return spec
+}
+
+// UpdateResult is the outcome of the most recent update operation at
+// a Varnish instance.
+type UpdateResult struct {
+	Time   time.Time `json:"time"`
+	Phase  string    `json:"phase"`
+	Config string    `json:"config"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// VCLState describes a VCL configuration loaded at a Varnish
+// instance. If Label is non-empty, the configuration is a label for
+// the configuration named by Label.
+type VCLState struct {
+	Name  string `json:"name"`
+	State string `json:"state,omitempty"`
+	Label string `json:"label,omitempty"`
+}
+
+// InstanceState describes a Varnish instance for the debug API.
+// Version is the Varnish version parsed from the Banner, for which
+// VCL is generated. VCLs is the list of configurations loaded at the instance, as
+// reported by its admin interface. If the list could not be
+// retrieved, VCLError describes the failure.
+type InstanceState struct {
+	Addr       string        `json:"addr"`
+	Banner     string        `json:"banner,omitempty"`
+	Version    string        `json:"version,omitempty"`
+	LastUpdate *UpdateResult `json:"lastUpdate,omitempty"`
+	VCLs       []VCLState    `json:"vcls,omitempty"`
+	VCLError   string        `json:"vclError,omitempty"`
+}
+
+// TenantState describes an isolated tenant of a Varnish Service for
+// the debug API.
+//
+//    Name: name of the tenant
+//    Label: VCL label of the tenant's config
+//    Config: name of the config generated for the tenant
+//    Loaded: name of the config currently labelled for the tenant
+//    Error: error from the most recent update for the tenant, if any
+//    Ingresses, VarnishConfigs, BackendConfigs: the resources from
+//             which the tenant's config was derived
+type TenantState struct {
+	Name           string          `json:"name"`
+	Label          string          `json:"label"`
+	Config         string          `json:"config,omitempty"`
+	Loaded         string          `json:"loaded,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	Ingresses      map[string]Meta `json:"ingresses,omitempty"`
+	VarnishConfigs []Meta          `json:"varnishConfigs,omitempty"`
+	BackendConfigs map[string]Meta `json:"backendConfigs,omitempty"`
+}
+
+// ServiceState describes a Varnish Service for the debug API.
+//
+//    Spec: the current specification for VCL generation, with the
+//          credentials for authentication redacted, nil if none
+//          has been received
+//    Config: name of the config generated from Spec
+//    Loaded: name of the config currently loaded, if known
+//    Pinned: name of the config to which the Service is pinned, if any
+//    CanaryFailed: name of the config that failed the canary checks,
+//                  and is not rolled out until the config changes
+//    History: names of the configs retained for rollback, the active
+//             config first
+//    Ingresses, VarnishConfigs, BackendConfigs: the resources from
+//             which Spec was derived
+//    Tenants: the isolated tenants of the Service, if any
+//    Dispatch: name of the dispatcher config that is active while
+//              tenants are isolated
+type ServiceState struct {
+	Name           string          `json:"name"`
+	Spec           *vcl.Spec       `json:"spec,omitempty"`
+	Config         string          `json:"config,omitempty"`
+	Loaded         string          `json:"loaded,omitempty"`
+	Pinned         string          `json:"pinned,omitempty"`
+	CanaryFailed   string          `json:"canaryFailed,omitempty"`
+	History        []string        `json:"history,omitempty"`
+	Ingresses      map[string]Meta `json:"ingresses,omitempty"`
+	VarnishConfigs []Meta          `json:"varnishConfigs,omitempty"`
+	BackendConfigs map[string]Meta `json:"backendConfigs,omitempty"`
+	Tenants        []TenantState   `json:"tenants,omitempty"`
+	Dispatch       string          `json:"dispatch,omitempty"`
+	Instances      []InstanceState `json:"instances"`
+}
+
+// record sets the result of the update operation phase for config
+// cfg at each instance in results. The mutex of the Service to which
+// the instances belong must be held.
+func (results instResults) record(phase, cfg string) {
+	now := time.Now()
+	for _, result := range results {
+		update := &UpdateResult{Time: now, Phase: phase, Config: cfg}
+		if result.err != nil {
+			update.Error = result.err.Error()
+		}
+		result.inst.lastUpdate = update
+	}
+}
+
+// ServiceNames returns the keys (namespace/name) of the Varnish
+// Services known to the controller, in sorted order.
+func (vc *Controller) ServiceNames() []string {
+	return vc.svcKeys()
+}
+
+func vclState(state admin.VCLState) string {
+	switch state {
+	case admin.AutoState:
+		return "auto"
+	case admin.ColdState:
+		return "cold"
+	case admin.WarmState:
+		return "warm"
+	default:
+		return ""
+	}
+}
+
+// listVCLs retrieves the list of loaded configurations at each of
+// the instances in insts, and sets them in the corresponding element
+// of states. The mutex of the Service must be held.
+func (vc *Controller) listVCLs(insts []*varnishInst, states []InstanceState) {
+	var mtx sync.Mutex
+	idx := make(map[*varnishInst]int, len(insts))
+	for i, inst := range insts {
+		idx[inst] = i
+	}
+	results := vc.fanOut(debugPhase, insts,
+		func(inst *varnishInst, metrics *instanceMetrics) (bool, error) {
+			return false, vc.withAdmin(inst, metrics,
+				func(adm *admin.Admin) error {
+					vcls, err := adm.VCLList()
+					if err != nil {
+						return err
+					}
+					mtx.Lock()
+					defer mtx.Unlock()
+					state := &states[idx[inst]]
+					state.Banner = inst.Banner
+					state.Version = vcl.Version{}.String()
+					if ver, ok := vcl.ParseBanner(
+						inst.Banner); ok {
+						state.Version = ver.String()
+					}
+					for _, v := range vcls {
+						state.VCLs = append(state.VCLs,
+							VCLState{
+								Name:  v.Name,
+								State: vclState(v.State),
+								Label: v.LabelVCL,
+							})
+					}
+					return nil
+				})
+		})
+	mtx.Lock()
+	defer mtx.Unlock()
+	for i, result := range results {
+		if result.err != nil {
+			states[i].VCLError = result.err.Error()
+		}
+	}
+}
+
+// ServiceState returns a description of the Varnish Service
+// identified by svcKey (namespace/name), for the debug API. If
+// listVCLs is true, the configurations loaded at each instance are
+// retrieved from their admin interfaces; this waits for an update of
+// the Service in progress to complete. Returns nil if the Service is
+// not known.
+func (vc *Controller) ServiceState(svcKey string,
+	listVCLs bool) *ServiceState {
+
+	svc := vc.lockSvc(svcKey, false)
+	if svc == nil {
+		return nil
+	}
+	state := &ServiceState{
+		Name:         svcKey,
+		Pinned:       svc.pin,
+		CanaryFailed: svc.canaryFailed,
+	}
+	if svc.spec != nil {
+		spec := redacted(svc.spec.spec)
+		state.Spec = &spec
+		state.Config = svc.spec.configName()
+		state.Ingresses = svc.spec.ings
+		state.BackendConfigs = svc.spec.bcfg
+		state.VarnishConfigs = svc.spec.vcfg.Configs
+	}
+	if svc.loaded != nil {
+		state.Loaded = svc.loaded.configName()
+	} else if svc.recovered != "" {
+		state.Loaded = svc.recovered
+	}
+	for _, h := range svc.history {
+		state.History = append(state.History, h.name)
+	}
+	for _, name := range svc.tenantNames() {
+		t := svc.tenants[name]
+		tState := TenantState{Name: name, Label: t.label}
+		if t.spec != nil {
+			tState.Config = t.spec.configName()
+			tState.Ingresses = t.spec.ings
+			tState.BackendConfigs = t.spec.bcfg
+			tState.VarnishConfigs = t.spec.vcfg.Configs
+		}
+		if t.loaded != nil {
+			tState.Loaded = t.loaded.configName()
+		}
+		if t.err != nil {
+			tState.Error = t.err.Error()
+		}
+		state.Tenants = append(state.Tenants, tState)
+	}
+	state.Dispatch = svc.dispatch
+	insts := svc.insts()
+	state.Instances = make([]InstanceState, len(insts))
+	for i, inst := range insts {
+		state.Instances[i].Addr = inst.addr
+		if inst.lastUpdate != nil {
+			update := *inst.lastUpdate
+			state.Instances[i].LastUpdate = &update
+		}
+	}
+	if listVCLs {
+		vc.listVCLs(insts, state.Instances)
+	}
+	svc.mtx.Unlock()
+	return state
+}
+
+// ServiceSpec returns the current VCL spec for the Varnish Service
+// identified by svcKey (namespace/name), or nil if the Service is not
+// known or has no spec. The credentials for authentication are not
+// redacted, so that requests can be evaluated with pkg/explain; the
+// spec is not to be shown as is.
+func (vc *Controller) ServiceSpec(svcKey string) *vcl.Spec {
+	svc := vc.lockSvc(svcKey, false)
+	if svc == nil {
+		return nil
+	}
+	specs := svc.spec
+	svc.mtx.Unlock()
+	if specs == nil {
+		return nil
+	}
+	spec := specs.spec
+	return &spec
+}
+
+// ServiceVCL returns the VCL source generated from the current spec
+// for the Varnish Service identified by svcKey, with the credentials
+// for authentication redacted. Returns the empty string and no error
+// if the Service is not known, or if no spec has been received for
+// it.
+func (vc *Controller) ServiceVCL(svcKey string) (string, error) {
+	svc := vc.lockSvc(svcKey, false)
+	if svc == nil {
+		return "", nil
+	}
+	spec := svc.spec
+	svc.mtx.Unlock()
+	if spec == nil {
+		return "", nil
+	}
+	src, err := redacted(spec.spec).GetSrc()
+	if err != nil {
+		return "", fmt.Errorf("Cannot generate VCL for Varnish "+
+			"Service %s: %v", svcKey, err)
+	}
+	return src, nil
+}
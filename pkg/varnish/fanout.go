@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package varnish
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Phases of a rollout, for the per-instance result metrics.
+const (
+	loadPhase     = "load"
+	activatePhase = "activate"
+	rollbackPhase = "rollback"
+	discardPhase  = "discard"
+)
+
+// instResult is the result of an operation at a Varnish instance,
+// invoked by fanOut.
+type instResult struct {
+	inst        *varnishInst
+	newlyLoaded bool
+	err         error
+}
+
+type instResults []instResult
+
+// errs returns the errors in the results as AdmErrors, or nil if
+// there were no errors.
+func (results instResults) errs() AdmErrors {
+	var errs AdmErrors
+	for _, result := range results {
+		if result.err != nil {
+			errs = append(errs,
+				AdmError{addr: result.inst.addr, err: result.err})
+		}
+	}
+	return errs
+}
+
+// succeeded returns the instances at which the operation succeeded.
+func (results instResults) succeeded() []*varnishInst {
+	var insts []*varnishInst
+	for _, result := range results {
+		if result.err == nil {
+			insts = append(insts, result.inst)
+		}
+	}
+	return insts
+}
+
+// SetUpdateConcurrency sets the maximum number of Varnish instances of
+// a Service at which updates are executed concurrently (no limit if
+// max is 0), and the deadline for an update at a single instance (no
+// deadline if <= 0).
+func (vc *Controller) SetUpdateConcurrency(max uint, deadline time.Duration) {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	vc.opts.concurrency = max
+	vc.opts.instDeadline = deadline
+}
+
+// fanOut invokes f concurrently for each of the instances in insts,
+// with at most the configured concurrency of invocations at a time, and
+// collects the results in the same order as insts. If an invocation
+// does not complete within the instance deadline, the result for the instance is an
+// error. The admin commands issued by f cannot be cancelled, so the
+// invocation continues in the background; further admin interactions
+// with the instance wait until it completes.
+func (vc *Controller) fanOut(phase string, insts []*varnishInst,
+	f func(*varnishInst, *instanceMetrics) (bool, error)) instResults {
+
+	var wg sync.WaitGroup
+	var sem chan struct{}
+	opts := vc.settings()
+	if opts.concurrency > 0 {
+		sem = make(chan struct{}, opts.concurrency)
+	}
+	results := make(instResults, len(insts))
+	for i, inst := range insts {
+		wg.Add(1)
+		go func(i int, inst *varnishInst) {
+			defer wg.Done()
+			if sem != nil {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+			}
+			metrics := getInstanceMetrics(inst.addr)
+			resultCh := make(chan instResult, 1)
+			go func() {
+				newlyLoaded, err := f(inst, metrics)
+				resultCh <- instResult{
+					inst:        inst,
+					newlyLoaded: newlyLoaded,
+					err:         err,
+				}
+			}()
+
+			var timeout <-chan time.Time
+			if opts.instDeadline > 0 {
+				timer := time.NewTimer(opts.instDeadline)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+			outcome := "success"
+			select {
+			case results[i] = <-resultCh:
+				if results[i].err != nil {
+					outcome = "error"
+				}
+			case <-timeout:
+				results[i] = instResult{
+					inst: inst,
+					err: fmt.Errorf("Deadline %v exceeded",
+						opts.instDeadline),
+				}
+				outcome = "timeout"
+			}
+			instResultCtr.WithLabelValues(inst.addr, phase,
+				outcome).Inc()
+		}(i, inst)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package varnish
+
+import (
+	"time"
+)
+
+const configPinned = "ConfigPinned"
+
+// cfgHistory is an entry in the history of configs that were loaded
+// for a Varnish Service. spec is nil for a placeholder entry added by
+// setPinRecovered.
+type cfgHistory struct {
+	spec   *vclSpec
+	name   string
+	hash   string
+	loaded time.Time
+}
+
+// SetHistoryLen sets the number of configs, including the currently
+// active config, that are retained for each Varnish Service. These
+// configs are not discarded by the monitor, and are available for
+// rollback with PinConfig.
+func (vc *Controller) SetHistoryLen(n uint) {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	vc.opts.histLen = n
+}
+
+// setLoaded records spec as the spec from which the VCL config
+// currently active for svc was generated, and adds it to the front of
+// the history. svc.mtx must be held.
+func (vc *Controller) setLoaded(svc *varnishSvc, spec *vclSpec) {
+	svc.loaded = spec
+	vc.addHistory(svc, cfgHistory{
+		spec:   spec,
+		name:   spec.configName(),
+		hash:   spec.spec.Canonical().DeepHash(),
+		loaded: time.Now(),
+	})
+}
+
+// setPinRecovered adds a placeholder entry for the pinned config to
+// the front of the history of svc, when recoverState found it at all
+// instances after a restart, but it is not generated by the
+// current spec, so its spec is unknown. Then the instances are not
+// inspected again for every update, until the instances change.
+// svc.mtx must be held.
+func (vc *Controller) setPinRecovered(svc *varnishSvc) {
+	vc.addHistory(svc, cfgHistory{name: svc.pin, loaded: time.Now()})
+}
+
+// pinRecovered returns true if svc is pinned to a config with a
+// placeholder entry in the history.
+func (svc *varnishSvc) pinRecovered() bool {
+	for _, entry := range svc.history {
+		if entry.name == svc.pin {
+			return entry.spec == nil
+		}
+	}
+	return false
+}
+
+// clearPinRecovered removes placeholder entries from the history of
+// svc, so that the pinned config is recovered again, for example when
+// instances are added. svc.mtx must be held.
+func (svc *varnishSvc) clearPinRecovered() {
+	hist := svc.history[:0]
+	for _, entry := range svc.history {
+		if entry.spec != nil {
+			hist = append(hist, entry)
+		}
+	}
+	svc.history = hist
+}
+
+// addHistory adds entry to the front of the history of svc, removing
+// any previous entry of the same name, and the oldest entries beyond
+// the history length. svc.mtx must be held.
+func (vc *Controller) addHistory(svc *varnishSvc, entry cfgHistory) {
+	max := int(vc.settings().histLen)
+	if max < 1 {
+		max = 1
+	}
+	hist := make([]cfgHistory, 1, max)
+	hist[0] = entry
+	for _, prev := range svc.history {
+		if len(hist) >= max {
+			break
+		}
+		if prev.name != entry.name {
+			hist = append(hist, prev)
+		}
+	}
+	svc.history = hist
+}
+
+// histEntry returns the spec for the config cfgName in the history of
+// svc, or nil if it is not in the history, or if the entry is a
+// placeholder.
+func (svc *varnishSvc) histEntry(cfgName string) *vclSpec {
+	for _, entry := range svc.history {
+		if entry.name == cfgName {
+			return entry.spec
+		}
+	}
+	return nil
+}
+
+// retained returns the set of config names in the history of svc,
+// the pinned config, and the configs loaded for isolated tenants,
+// which are not to be discarded by the monitor.
+func (svc *varnishSvc) retained() map[string]struct{} {
+	names := make(map[string]struct{}, len(svc.history))
+	for _, entry := range svc.history {
+		names[entry.name] = struct{}{}
+	}
+	for _, t := range svc.tenants {
+		if t.loaded != nil {
+			names[t.loaded.configName()] = struct{}{}
+		}
+	}
+	if svc.dispatch != "" {
+		names[svc.dispatch] = struct{}{}
+	}
+	if svc.pin != "" {
+		names[svc.pin] = struct{}{}
+	}
+	return names
+}
+
+// PinConfig pins the Varnish Service identified by svcKey to the
+// config cfgName, which must be in the history of configs for the
+// Service. While the config is pinned, it remains active regardless of
+// changes in Ingresses, VarnishConfigs and so on, for example to roll
+// back from a bad change until it is fixed. If cfgName is the empty
+// string, any pin is removed, and the Service is updated to implement
+// its current configuration.
+func (vc *Controller) PinConfig(svcKey, cfgName string) error {
+	svc := vc.lockSvc(svcKey, cfgName != "")
+	if svc == nil {
+		return nil
+	}
+	defer svc.mtx.Unlock()
+
+	if cfgName != "" && cfgName == svc.pinMissing {
+		// Already reported by pinnedSpec.
+		return nil
+	}
+	svc.pinMissing = ""
+	if svc.pin == cfgName {
+		return nil
+	}
+	svc.pin = cfgName
+	if cfgName == "" {
+		vc.infoEvt(svcKey, configPinned, "Varnish Service %s: "+
+			"config unpinned", svcKey)
+	} else {
+		vc.infoEvt(svcKey, configPinned, "Varnish Service %s: "+
+			"config pinned to %s", svcKey, cfgName)
+	}
+	if len(svc.instances) == 0 {
+		return nil
+	}
+	return vc.updateVarnishSvc(svcKey, svc)
+}
+
+// pinnedSpec returns the spec of the config to which svc is pinned,
+// or nil if it is not pinned. If the pinned config is not in the
+// history, but is generated by the current spec, then the current
+// spec is returned.
+//
+// The history is lost when the controller restarts; then the pinned
+// config is kept if recoverState finds it at the instances. If it
+// cannot be found at all, a Warning Event is generated, and the pin is
+// ignored, so that the Service is updated to its current config,
+// until it is pinned to a different config.
+func (vc *Controller) pinnedSpec(name string, svc *varnishSvc) *vclSpec {
+	log := vc.svcLog(name)
+	if svc.pin == "" {
+		return nil
+	}
+	spec := svc.histEntry(svc.pin)
+	if spec == nil && svc.spec != nil &&
+		svc.spec.configName() == svc.pin {
+		spec = svc.spec
+	}
+	if spec == nil {
+		vc.warnEvt(name, configPinned, "Varnish Service %s: pinned "+
+			"config %s not found in the config history or at the "+
+			"instances, pin ignored", name, svc.pin)
+		svc.pinMissing = svc.pin
+		svc.pin = ""
+		return nil
+	}
+	log.Infof("Varnish Service %s: config pinned to %s", name, svc.pin)
+	return spec
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package varnish
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Field names for structured logging, used consistently in log
+// messages about Varnish Services and instances.
+const (
+	logComponent = "component"
+	logSvc       = "varnishService"
+	logInst      = "instance"
+	logConfig    = "config"
+)
+
+// SetMonitorLogger sets the logger for the monitor, so that it may be
+// set to a different level than the logger for the Varnish
+// controller. By default, the monitor logs to the logger passed to
+// NewVarnishController.
+func (vc *Controller) SetMonitorLogger(log *logrus.Logger) {
+	vc.monLog = log.WithField(logComponent, "monitor")
+}
+
+// svcLog returns an Entry for log messages about the Varnish Service
+// identified by name.
+func (vc *Controller) svcLog(name string) *logrus.Entry {
+	return vc.log.WithField(logSvc, name)
+}
+
+// logger returns an Entry derived from log for messages about the
+// instance.
+func (inst *varnishInst) logger(log *logrus.Entry) *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		logSvc:  inst.svc,
+		logInst: inst.addr,
+	})
+}
@@ -54,6 +54,9 @@ type instanceMetrics struct {
 	childNotRunning prometheus.Counter
 	vclDiscards     prometheus.Counter
 	monitorChecks   prometheus.Counter
+	beHealthSets    prometheus.Counter
+	connState       prometheus.Gauge
+	reconnects      prometheus.Counter
 }
 
 var (
@@ -99,6 +102,61 @@ var (
 		Help:      "Total number of monitor results",
 	}, []string{"service", "status", "result"})
 
+	droppedSpecsCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "dropped_specs_total",
+		Help: "Total number of configurations superseded before " +
+			"they were loaded",
+	}, []string{"service"})
+
+	deferredLoadsCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "deferred_loads_total",
+		Help: "Total number of VCL loads deferred due to the " +
+			"load limit",
+	}, []string{"service"})
+
+	rollbacksCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "rollbacks_total",
+		Help: "Total number of updates that were rolled back " +
+			"after failures",
+	}, []string{"service"})
+
+	canaryGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "canary_in_progress",
+		Help:      "Whether a canary rollout is in progress (0 or 1)",
+	}, []string{"service"})
+
+	canaryFailedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "canary_failed",
+		Help: "Whether the current config failed the canary " +
+			"checks (0 or 1)",
+	}, []string{"service"})
+
+	rolloutLatency = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "rollout_duration_seconds",
+		Help:       "Duration of config rollouts for Varnish Services",
+		Objectives: latencyObjectives,
+	}, []string{"service"})
+
+	instResultCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "rollout_instance_results_total",
+		Help: "Total number of results of rollout operations at " +
+			"Varnish instances",
+	}, []string{"varnish_instance", "phase", "result"})
+
 	addr2instMetrics = make(map[string]*instanceMetrics)
 	instMetricsMtx   = &sync.Mutex{}
 
@@ -118,6 +176,13 @@ func initMetrics() {
 	prometheus.Register(monResultCtr)
 	prometheus.Register(beSvcsGauge)
 	prometheus.Register(beEndpsGauge)
+	prometheus.Register(droppedSpecsCtr)
+	prometheus.Register(deferredLoadsCtr)
+	prometheus.Register(rollbacksCtr)
+	prometheus.Register(canaryGauge)
+	prometheus.Register(canaryFailedGauge)
+	prometheus.Register(rolloutLatency)
+	prometheus.Register(instResultCtr)
 }
 
 func getInstanceMetrics(addr string) *instanceMetrics {
@@ -233,6 +298,30 @@ func getInstanceMetrics(addr string) *instanceMetrics {
 			Help:        "Total number of monitor checks",
 			ConstLabels: labels,
 		}),
+		beHealthSets: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backend_health_sets_total",
+			Help: "Total number of backend health changes " +
+				"applied at runtime",
+			ConstLabels: labels,
+		}),
+		connState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "admin_connection_state",
+			Help: "State of the admin connection (0: disconnected, " +
+				"1: connected, 2: backing off after failures)",
+			ConstLabels: labels,
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "admin_reconnects_total",
+			Help: "Total number of admin connections re-established " +
+				"after the previous connection was lost",
+			ConstLabels: labels,
+		}),
 	}
 	prometheus.Register(metrics.updates)
 	prometheus.Register(metrics.updateErrs)
@@ -248,6 +337,9 @@ func getInstanceMetrics(addr string) *instanceMetrics {
 	prometheus.Register(metrics.childNotRunning)
 	prometheus.Register(metrics.vclDiscards)
 	prometheus.Register(metrics.monitorChecks)
+	prometheus.Register(metrics.beHealthSets)
+	prometheus.Register(metrics.connState)
+	prometheus.Register(metrics.reconnects)
 	addr2instMetrics[addr] = metrics
 	return metrics
 }
@@ -29,11 +29,12 @@
 package varnish
 
 import (
+	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"code.uplex.de/uplex-varnish/varnishapi/pkg/admin"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
@@ -68,35 +69,49 @@ func (vc *Controller) errorEvt(svc, reason, msgFmt string, args ...interface{})
 	monResultCtr.WithLabelValues(svc, "error", reason).Inc()
 }
 
-func (vc *Controller) checkInst(svc string, inst *varnishInst) bool {
+// checkInst runs the monitor checks for the Varnish instance inst.
+// Cold configs with the ingress prefix are discarded, unless they are
+// in the set retain.
+func (vc *Controller) checkInst(svc string, inst *varnishInst,
+	retain map[string]struct{}) bool {
+
+	log := inst.logger(vc.monLog)
 	metrics := getInstanceMetrics(inst.addr)
 	metrics.monitorChecks.Inc()
 
-	vc.log.Infof("Monitoring Varnish instance %s (Service %s)", inst.addr,
+	log.Infof("Monitoring Varnish instance %s (Service %s)", inst.addr,
 		svc)
 
-	if inst.admSecret == nil {
+	ok := false
+	err := vc.withAdmin(inst, metrics, func(adm *admin.Admin) error {
+		var err error
+		ok, err = vc.checkAdmin(svc, inst, adm, metrics, retain)
+		return err
+	})
+	if err == errNoAdmSecret {
 		vc.warnEvt(svc, noAdmSecret,
 			"No admin secret known for endpoint %s", inst.addr)
 		return false
 	}
-	inst.admMtx.Lock()
-	defer inst.admMtx.Unlock()
-	vc.wg.Add(1)
-	defer vc.wg.Done()
-
-	timer := prometheus.NewTimer(metrics.connectLatency)
-	adm, err := admin.Dial(inst.addr, *inst.admSecret, admTimeout)
-	timer.ObserveDuration()
 	if err != nil {
-		metrics.connectFails.Inc()
-		vc.errorEvt(svc, connectErr, "Error connecting to %s: %v",
-			inst.addr, err)
+		if _, isConnErr := err.(connectError); isConnErr {
+			vc.errorEvt(svc, connectErr,
+				"Error connecting to %s: %v", inst.addr, err)
+		}
 		return false
 	}
-	defer adm.Close()
-	inst.Banner = adm.Banner
-	vc.log.Debugf("Connected to Varnish instance %s, banner: %s", inst.addr,
+	return ok
+}
+
+// checkAdmin runs the monitor checks over the admin connection adm
+// to the Varnish instance inst. Errors are reported as events, and are
+// also returned, so that a lost connection can be closed.
+func (vc *Controller) checkAdmin(svc string, inst *varnishInst,
+	adm *admin.Admin, metrics *instanceMetrics,
+	retain map[string]struct{}) (bool, error) {
+
+	log := inst.logger(vc.monLog)
+	log.Debugf("Connected to Varnish instance %s, banner: %s", inst.addr,
 		adm.Banner)
 
 	pong, err := adm.Ping()
@@ -104,20 +119,20 @@ func (vc *Controller) checkInst(svc string, inst *varnishInst) bool {
 		metrics.pingFails.Inc()
 		vc.errorEvt(svc, pingErr, "Error pinging at %s: %v", inst.addr,
 			err)
-		return false
+		return false, err
 	}
 	metrics.pings.Inc()
-	vc.log.Debugf("Succesfully pinged instance %s: %+v", inst.addr, pong)
+	log.Debugf("Succesfully pinged instance %s: %+v", inst.addr, pong)
 
 	state, err := adm.Status()
 	if err != nil {
 		vc.errorEvt(svc, statusErr, "Error getting status at %s: %v",
 			inst.addr, err)
-		return false
+		return false, err
 	}
 	if state == admin.Running {
 		metrics.childRunning.Inc()
-		vc.log.Debugf("Status at %s: %s", inst.addr, state)
+		log.Debugf("Status at %s: %s", inst.addr, state)
 	} else {
 		metrics.childNotRunning.Inc()
 		vc.warnEvt(svc, statusNotRun, "Status at %s: %s", inst.addr,
@@ -128,10 +143,10 @@ func (vc *Controller) checkInst(svc string, inst *varnishInst) bool {
 	if err != nil {
 		vc.errorEvt(svc, panicErr, "Error getting panic at %s: %v",
 			inst.addr, err)
-		return false
+		return false, err
 	}
 	if panic == "" {
-		vc.log.Debugf("No panic at %s", inst.addr)
+		log.Debugf("No panic at %s", inst.addr)
 	} else {
 		metrics.panics.Inc()
 		vc.errorEvt(svc, panic, "Panic at %s: %s", inst.addr, panic)
@@ -142,58 +157,146 @@ func (vc *Controller) checkInst(svc string, inst *varnishInst) bool {
 	if err != nil {
 		vc.errorEvt(svc, vclListErr,
 			"Error getting VCL list at %s: %v", inst.addr, err)
-		return false
+		return false, err
 	}
 	for _, vcl := range vcls {
+		if _, ok := retain[vcl.Name]; ok {
+			log.Debugf("Retaining VCL %s at %s", vcl.Name,
+				inst.addr)
+			continue
+		}
 		if strings.HasPrefix(vcl.Name, ingressPrefix) &&
 			vcl.State == admin.ColdState {
 			if err = adm.VCLDiscard(vcl.Name); err != nil {
 				vc.errorEvt(svc, discardErr,
 					"Error discarding VCL %s at %s: "+
 						"%v", vcl.Name, inst.addr, err)
-				return false
+				return false, err
 			}
 			metrics.vclDiscards.Inc()
-			vc.log.Infof("Discarded VCL %s at %s", vcl.Name,
+			log.Infof("Discarded VCL %s at %s", vcl.Name,
 				inst.addr)
 		}
 	}
-	return true
+	return true, nil
+}
+
+// monitorUpdate updates a Varnish Service from the monitor, unless a
+// batched update is pending, or a VCL load must be deferred due to
+// the load limit. svc.mtx must be held.
+func (vc *Controller) monitorUpdate(svcName string, svc *varnishSvc) error {
+	log := vc.monLog.WithField(logSvc, svcName)
+	if svc.pending != nil {
+		log.Infof("Update pending for Varnish Service %s",
+			svcName)
+		return nil
+	}
+	err := vc.updateVarnishSvc(svcName, svc)
+	if _, ok := err.(loadLimitError); ok {
+		log.Infof("Varnish Service %s: %v", svcName, err)
+		return nil
+	}
+	return err
+}
+
+func (vc *Controller) monitor() {
+	monitorIntvl := vc.settings().monIntvl
+	vc.logMonitorIntvl(monitorIntvl)
+	for {
+		atomic.StoreInt64(&vc.monBeat, time.Now().UnixNano())
+
+		// Receive on a nil channel blocks, so the monitor only
+		// waits for a new interval if it is not running.
+		var tick <-chan time.Time
+		if monitorIntvl > 0 {
+			tick = time.After(monitorIntvl)
+		}
+		select {
+		case <-tick:
+		case <-vc.monWake:
+			monitorIntvl = vc.settings().monIntvl
+			vc.logMonitorIntvl(monitorIntvl)
+			continue
+		}
+
+		for _, svcName := range vc.svcKeys() {
+			vc.monitorSvc(svcName)
+		}
+	}
 }
 
-func (vc *Controller) monitor(monitorIntvl time.Duration) {
+func (vc *Controller) logMonitorIntvl(monitorIntvl time.Duration) {
 	if monitorIntvl <= 0 {
-		vc.log.Infof("Varnish monitor interval=%v, monitor not running",
+		vc.monLog.Infof("Varnish monitor interval=%v, monitor not running",
 			monitorIntvl)
 		return
 	}
-	vc.log.Info("Varnish monitor starting, interval: ", monitorIntvl)
+	vc.monLog.Info("Varnish monitor starting, interval: ", monitorIntvl)
+}
 
-	for {
-		time.Sleep(monitorIntvl)
+// CheckMonitor returns an error if the monitor is running, but has not
+// begun a new iteration within its interval plus timeout, for example
+// because the check of a Varnish instance is hung. Returns nil if the
+// monitor has not been started or is not running, or if timeout <= 0.
+func (vc *Controller) CheckMonitor(timeout time.Duration) error {
+	beat := atomic.LoadInt64(&vc.monBeat)
+	monitorIntvl := vc.settings().monIntvl
+	if beat == 0 || monitorIntvl <= 0 || timeout <= 0 {
+		return nil
+	}
+	since := time.Since(time.Unix(0, beat))
+	if since > monitorIntvl+timeout {
+		return fmt.Errorf("Monitor has not begun an iteration for %v "+
+			"(interval %v)", since.Round(time.Second), monitorIntvl)
+	}
+	return nil
+}
 
-		for svcName, svc := range vc.svcs {
-			vc.log.Infof("Monitoring Varnish instances in %s",
-				svcName)
+// SetMonitorInterval sets the interval at which the monitor checks
+// Varnish instances. The monitor does not run if the interval is <=
+// 0s. The new interval takes effect immediately, if the monitor has
+// been started.
+func (vc *Controller) SetMonitorInterval(monitorIntvl time.Duration) {
+	vc.mtx.Lock()
+	changed := vc.opts.monIntvl != monitorIntvl
+	vc.opts.monIntvl = monitorIntvl
+	vc.mtx.Unlock()
 
-			good := true
-			for _, inst := range svc.instances {
-				if !vc.checkInst(svcName, inst) {
-					good = false
-				}
-			}
+	if !changed {
+		return
+	}
+	select {
+	case vc.monWake <- struct{}{}:
+	default:
+	}
+}
 
-			if err := vc.updateVarnishSvc(svcName); err != nil {
-				vc.errorEvt(svcName, updateErr,
-					"Errors updating Varnish "+
-						"Service %s: %+v", svcName, err)
-				good = false
-			}
-			if good {
-				vc.infoEvt(svcName, monitorGood,
-					"Monitor check good for Service: %s",
-					svcName)
-			}
+// monitorSvc runs the monitor checks for the instances of the Varnish
+// Service identified by svcName, and updates the Service if necessary.
+func (vc *Controller) monitorSvc(svcName string) {
+	log := vc.monLog.WithField(logSvc, svcName)
+	svc := vc.lockSvc(svcName, false)
+	if svc == nil {
+		return
+	}
+	defer svc.mtx.Unlock()
+
+	log.Infof("Monitoring Varnish instances in %s", svcName)
+	good := true
+	retain := svc.retained()
+	for _, inst := range svc.instances {
+		if !vc.checkInst(svcName, inst, retain) {
+			good = false
 		}
 	}
+
+	if err := vc.monitorUpdate(svcName, svc); err != nil {
+		vc.errorEvt(svcName, updateErr,
+			"Errors updating Varnish Service %s: %+v", svcName, err)
+		good = false
+	}
+	if good {
+		vc.infoEvt(svcName, monitorGood,
+			"Monitor check good for Service: %s", svcName)
+	}
 }
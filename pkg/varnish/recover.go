@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package varnish
+
+import (
+	"sync"
+
+	"code.uplex.de/uplex-varnish/varnishapi/pkg/admin"
+)
+
+const (
+	configRecovered = "ConfigRecovered"
+	recoverPhase    = "recover"
+)
+
+// activeConfig returns the name of the config labelled as the regular
+// config in the VCL list vcls, or the empty string if there is none,
+// and whether the readiness label is set to the ready config.
+func activeConfig(vcls []admin.VCLData) (string, bool) {
+	active, ready := "", false
+	for _, vcl := range vcls {
+		switch vcl.Name {
+		case regularLabel:
+			active = vcl.LabelVCL
+		case readinessLabel:
+			ready = vcl.LabelVCL == readyCfg
+		}
+	}
+	return active, ready
+}
+
+// hasConfig returns true if the config cfgName is loaded according to
+// the VCL list vcls.
+func hasConfig(vcls []admin.VCLData, cfgName string) bool {
+	for _, vcl := range vcls {
+		if vcl.Name == cfgName && vcl.LabelVCL == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// commonConfig returns the config that is active and ready at all of
+// the instances, given the results of activeConfig for each instance,
+// or the empty string if the instances do not agree.
+func commonConfig(active map[*varnishInst]string,
+	ready map[*varnishInst]bool, insts []*varnishInst) string {
+
+	cfg := ""
+	for _, inst := range insts {
+		if !ready[inst] || active[inst] == "" {
+			return ""
+		}
+		if cfg == "" {
+			cfg = active[inst]
+		} else if active[inst] != cfg {
+			return ""
+		}
+	}
+	return cfg
+}
+
+// recoverState inspects the VCL lists of the instances of svc when the
+// controller has no record of a loaded config, for example after a
+// restart. If the config that is active and ready at all instances is
+// the config for the current spec, it is recorded as loaded, and true
+// is returned; then the config does not have to be loaded again.
+// Otherwise, if all instances agree on an active config, it is
+// recorded as the config to which a failed rollout may be rolled back.
+// If svc is pinned, the pinned config is recovered by recoverPin.
+// svc.mtx must be held.
+func (vc *Controller) recoverState(name string, svc *varnishSvc) bool {
+	log := vc.svcLog(name)
+	insts := svc.insts()
+	if len(insts) == 0 {
+		return false
+	}
+	var mtx sync.Mutex
+	pin, pinLoaded := svc.pin, 0
+	active := make(map[*varnishInst]string, len(insts))
+	ready := make(map[*varnishInst]bool, len(insts))
+	results := vc.fanOut(recoverPhase, insts,
+		func(inst *varnishInst, metrics *instanceMetrics) (bool, error) {
+			return false, vc.withAdmin(inst, metrics,
+				func(adm *admin.Admin) error {
+					vcls, err := adm.VCLList()
+					if err != nil {
+						return err
+					}
+					cfg, rdy := activeConfig(vcls)
+					mtx.Lock()
+					defer mtx.Unlock()
+					active[inst] = cfg
+					ready[inst] = rdy
+					if pin != "" && hasConfig(vcls, pin) {
+						pinLoaded++
+					}
+					return nil
+				})
+		})
+	if errs := results.errs(); len(errs) > 0 {
+		log.Warnf("Varnish Service %s: cannot determine the "+
+			"active config: %v", name, errs)
+		return false
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	cfg := commonConfig(active, ready, insts)
+	if pin != "" &&
+		vc.recoverPin(name, svc, cfg, pinLoaded == len(insts)) {
+		return true
+	}
+	if cfg == "" {
+		log.Infof("Varnish Service %s: no common active config at "+
+			"the instances", name)
+		return false
+	}
+	if svc.pin == "" && cfg == svc.spec.configName() {
+		vc.setLoaded(svc, svc.spec)
+		vc.infoEvt(name, configRecovered, "Varnish Service %s: "+
+			"config %s already active at all instances", name, cfg)
+		return true
+	}
+	log.Infof("Varnish Service %s: config %s active at all instances",
+		name, cfg)
+	svc.recovered = cfg
+	return false
+}
+
+// recoverPin is called by recoverState when svc is pinned to a config,
+// but no config is known to be loaded. If the pinned config is active
+// at all instances (given by active), it remains active; if it is
+// loaded at all of them, it is activated. In both cases, the current
+// spec is recorded as loaded if it generates the pinned config,
+// otherwise a placeholder is added to the history by setPinRecovered,
+// and true is returned. Otherwise, pinnedSpec looks for the config when the
+// Service is updated. svc.mtx must be held.
+func (vc *Controller) recoverPin(name string, svc *varnishSvc,
+	active string, loaded bool) bool {
+
+	if active != svc.pin {
+		if !loaded {
+			return false
+		}
+		results := vc.labelAll(rollbackPhase, svc.insts(), svc.pin, nil)
+		if errs := results.errs(); len(errs) > 0 {
+			vc.svcLog(name).Warnf("Varnish Service %s: cannot "+
+				"activate pinned config %s: %v", name, svc.pin,
+				errs)
+			return false
+		}
+	}
+	if svc.spec != nil && svc.spec.configName() == svc.pin {
+		vc.setLoaded(svc, svc.spec)
+	} else {
+		vc.setPinRecovered(svc)
+	}
+	if svc.recovered != svc.pin {
+		vc.infoEvt(name, configRecovered, "Varnish Service %s: "+
+			"pinned config %s active at all instances", name,
+			svc.pin)
+	}
+	svc.recovered = svc.pin
+	return true
+}
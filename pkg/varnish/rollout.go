@@ -0,0 +1,558 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package varnish
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+	"code.uplex.de/uplex-varnish/varnishapi/pkg/admin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// RolloutError is returned when an update for a Varnish Service
+// failed at one or more instances. Configurations are rolled out in
+// two phases: the new VCL is first loaded at every instance, and is
+// only activated (labelled as the regular config) when all of the
+// loads succeeded. Otherwise the new config is discarded, and the
+// previous config remains active everywhere. If activation fails at
+// some instances, then the instances at which it succeeded are
+// labelled with the previous config again.
+//
+// The error describes the overall outcome of the rollout, as well as
+// the errors encountered at individual instances.
+type RolloutError struct {
+	svc     string
+	cfg     string
+	prev    string
+	partial bool
+	canary  bool
+	errs    AdmErrors
+	rbErrs  AdmErrors
+}
+
+// Outcome returns a description of the state of the Varnish Service
+// after the failed rollout.
+func (err RolloutError) Outcome() string {
+	if err.canary {
+		if len(err.rbErrs) > 0 {
+			return fmt.Sprintf("canary rollout of config %s "+
+				"failed, rollback to config %s failed",
+				err.cfg, err.prev)
+		}
+		return fmt.Sprintf("canary rollout of config %s failed, "+
+			"rolled back to config %s", err.cfg, err.prev)
+	}
+	if !err.partial {
+		if err.prev == "" {
+			return fmt.Sprintf("config %s not activated", err.cfg)
+		}
+		return fmt.Sprintf("config %s not activated, config %s "+
+			"remains active", err.cfg, err.prev)
+	}
+	if err.prev == "" {
+		return fmt.Sprintf("config %s activated at only some "+
+			"instances, no previous config known for rollback",
+			err.cfg)
+	}
+	if len(err.rbErrs) > 0 {
+		return fmt.Sprintf("config %s activated at only some "+
+			"instances, rollback to config %s failed", err.cfg,
+			err.prev)
+	}
+	return fmt.Sprintf("config %s activated at only some instances, "+
+		"rolled back to config %s", err.cfg, err.prev)
+}
+
+// AdmErrors returns the errors encountered at individual instances,
+// including any errors encountered during rollback.
+func (err RolloutError) AdmErrors() AdmErrors {
+	errs := make(AdmErrors, 0, len(err.errs)+len(err.rbErrs))
+	errs = append(errs, err.errs...)
+	return append(errs, err.rbErrs...)
+}
+
+// Error returns an error message with the outcome of the rollout,
+// and the errors at each instance that failed.
+func (err RolloutError) Error() string {
+	msg := fmt.Sprintf("Varnish Service %s: %s: %s", err.svc,
+		err.Outcome(), err.errs.Error())
+	if len(err.rbErrs) > 0 {
+		msg += " rollback errors: " + err.rbErrs.Error()
+	}
+	return msg
+}
+
+// vclSrcError is an error reported by the VCL compiler, together with
+// the configuration fields from which the VCL source at the reported
+// locations was generated.
+type vclSrcError struct {
+	err     error
+	origins []string
+}
+
+func (err vclSrcError) Error() string {
+	return fmt.Sprintf("%v (generated from: %s)", err.err,
+		strings.Join(err.origins, ", "))
+}
+
+// origin returns a description of the configuration from which a
+// part of the VCL source for spec was generated, naming the
+// VarnishConfig, ClusterVarnishConfig or BackendConfig, if known.
+func (spec *vclSpec) origin(origin vcl.Origin) string {
+	switch origin.Kind {
+	case vcl.VarnishConfigKind:
+		if src, ok := spec.vcfg.Src(origin.Field); ok {
+			return fmt.Sprintf("%s %s %s", src.Kind(), src.Key,
+				src.Field)
+		}
+	case vcl.BackendConfigKind:
+		if meta, ok := spec.bcfg[origin.Name]; ok {
+			return fmt.Sprintf("BackendConfig %s %s", meta.Key,
+				origin.Field)
+		}
+	}
+	return origin.String()
+}
+
+// vclSource provides the VCL source of a config to be loaded at the
+// instance at addr, which runs Varnish version v.
+type vclSource interface {
+	get(addr string, v vcl.Version) (string, error)
+}
+
+// vclSources generates the VCL source for a spec for the versions of
+// Varnish at the instances at which it is loaded, and records the
+// version for which the source was generated at each instance. The
+// methods may be called concurrently by the goroutines of a fanOut.
+type vclSources struct {
+	spec *vclSpec
+	mtx  sync.Mutex
+	srcs map[vcl.Version]string
+	maps map[vcl.Version]vcl.SrcMap
+	vers map[string]vcl.Version
+}
+
+func newVCLSources(spec *vclSpec) *vclSources {
+	return &vclSources{
+		spec: spec,
+		srcs: make(map[vcl.Version]string),
+		maps: make(map[vcl.Version]vcl.SrcMap),
+		vers: make(map[string]vcl.Version),
+	}
+}
+
+// gen returns the source for version v, generating it if necessary.
+// s.mtx must be held.
+func (s *vclSources) gen(v vcl.Version) (string, error) {
+	if src, ok := s.srcs[v]; ok {
+		return src, nil
+	}
+	src, srcMap, err := s.spec.spec.GetSrcMapFor(v)
+	if err != nil {
+		return "", err
+	}
+	s.srcs[v] = src
+	s.maps[v] = srcMap
+	return src, nil
+}
+
+// get returns the VCL source for the instance at addr, which runs
+// Varnish version v.
+func (s *vclSources) get(addr string, v vcl.Version) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.vers[addr] = v
+	return s.gen(v)
+}
+
+// versions returns the Varnish versions for which the source was
+// generated, each with the addresses of the instances that run it.
+func (s *vclSources) versions() map[vcl.Version][]string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	vers := make(map[vcl.Version][]string)
+	for addr, v := range s.vers {
+		vers[v] = append(vers[v], addr)
+	}
+	for _, addrs := range vers {
+		sort.Strings(addrs)
+	}
+	return vers
+}
+
+// srcErrs adds the origins in the configuration to errors from the
+// VCL compiler in errs, using the source generated for the version
+// of Varnish at the instance that reported the error.
+func (s *vclSources) srcErrs(errs AdmErrors) AdmErrors {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, admErr := range errs {
+		v := s.vers[admErr.addr]
+		if _, err := s.gen(v); err != nil {
+			continue
+		}
+		origins := s.maps[v].Origins(admErr.err.Error())
+		if len(origins) == 0 {
+			continue
+		}
+		srcErr := vclSrcError{err: admErr.err}
+		for _, origin := range origins {
+			srcErr.origins = append(srcErr.origins,
+				s.spec.origin(origin))
+		}
+		errs[i].err = srcErr
+	}
+	return errs
+}
+
+// mixedVersions returns a description of the Varnish versions at the
+// instances for which the source was generated, if there is more than
+// one version; otherwise the empty string.
+func (s *vclSources) mixedVersions() string {
+	vers := s.versions()
+	if len(vers) < 2 {
+		return ""
+	}
+	descs := make([]string, 0, len(vers))
+	for v, addrs := range vers {
+		descs = append(descs, fmt.Sprintf("%s at %s", v,
+			strings.Join(addrs, ",")))
+	}
+	sort.Strings(descs)
+	return strings.Join(descs, "; ")
+}
+
+// loadInstance is the first phase of an update at a Varnish instance:
+// the config cfgName is loaded, unless it is already loaded. The VCL
+// source is generated for the version of Varnish at the instance.
+// Returns true if the config was newly loaded.
+func (vc *Controller) loadInstance(inst *varnishInst, cfgName string,
+	srcs vclSource, metrics *instanceMetrics) (bool, error) {
+
+	log := inst.logger(vc.log).WithField(logConfig, cfgName)
+	log.Infof("Update Varnish instance at %s", inst.addr)
+	newlyLoaded := false
+	err := vc.withAdmin(inst, metrics, func(adm *admin.Admin) error {
+		log.Tracef("List VCLs at %s", inst.addr)
+		vcls, err := adm.VCLList()
+		if err != nil {
+			return err
+		}
+		log.Tracef("VCL List at %s: %+v", inst.addr, vcls)
+		for _, vcl := range vcls {
+			if vcl.Name == cfgName {
+				log.Infof("Config %s already loaded at "+
+					"instance %s", cfgName, inst.addr)
+				return nil
+			}
+		}
+
+		ver, ok := vcl.ParseBanner(inst.Banner)
+		if !ok {
+			log.Warnf("Cannot determine the Varnish version at %s, "+
+				"generating VCL with the default templates",
+				inst.addr)
+		}
+		vclSrc, err := srcs.get(inst.addr, ver)
+		if err != nil {
+			return err
+		}
+		log.Tracef("Load config %s for Varnish %s at %s, source: %s",
+			cfgName, ver, inst.addr, vclSrc)
+		timer := prometheus.NewTimer(metrics.vclLoadLatency)
+		err = adm.VCLInline(cfgName, vclSrc)
+		timer.ObserveDuration()
+		if err != nil {
+			log.Tracef("Error loading config %s at %s: %v",
+				cfgName, inst.addr, err)
+			metrics.vclLoadErrs.Inc()
+			return err
+		}
+		metrics.vclLoads.Inc()
+		newlyLoaded = true
+		log.Infof("Loaded config %s at Varnish endpoint %s",
+			cfgName, inst.addr)
+		return nil
+	})
+	return newlyLoaded, err
+}
+
+// labelInstance is the second phase of an update at a Varnish
+// instance: the config cfgName is labelled as the regular config, and
+// the readiness config is labelled, if they are not already labelled.
+//
+// If health is non-nil, it maps the names of backends in the config
+// to true if the backend health is to be set to auto, false if it is
+// to be set to sick.
+func (vc *Controller) labelInstance(inst *varnishInst, cfgName string,
+	health map[string]bool, metrics *instanceMetrics) error {
+
+	log := inst.logger(vc.log).WithField(logConfig, cfgName)
+	return vc.withAdmin(inst, metrics, func(adm *admin.Admin) error {
+		log.Tracef("List VCLs at %s", inst.addr)
+		vcls, err := adm.VCLList()
+		if err != nil {
+			return err
+		}
+		log.Tracef("VCL List at %s: %+v", inst.addr, vcls)
+		if err = labelCfg(adm, inst, vcls, regularLabel, cfgName,
+			log); err != nil {
+			return err
+		}
+		if err = labelCfg(adm, inst, vcls, readinessLabel, readyCfg,
+			log); err != nil {
+			return err
+		}
+
+		for be, healthy := range health {
+			state := "auto"
+			if !healthy {
+				state = "sick"
+			}
+			log.Tracef("Set health of backend %s in config %s "+
+				"to %s at %s", be, cfgName, state, inst.addr)
+			_, err = adm.Command("backend.set_health",
+				cfgName+"."+be, state)
+			if err != nil {
+				return err
+			}
+			metrics.beHealthSets.Inc()
+		}
+		if health != nil {
+			log.Infof("Set backend health for config %s at "+
+				"Varnish endpoint %s", cfgName, inst.addr)
+		}
+		return nil
+	})
+}
+
+// labelCfg labels the config cfgName as lbl at the instance inst,
+// unless the VCL list vcls shows that it is already labelled.
+func labelCfg(adm *admin.Admin, inst *varnishInst, vcls []admin.VCLData,
+	lbl, cfgName string, log *logrus.Entry) error {
+
+	for _, vcl := range vcls {
+		if vcl.Name == lbl && vcl.LabelVCL == cfgName {
+			log.Infof("Config %s already labelled as %s at %s",
+				cfgName, lbl, inst.addr)
+			return nil
+		}
+	}
+	log.Tracef("Label config %s as %s at %s", cfgName, lbl, inst.addr)
+	if err := adm.VCLLabel(lbl, cfgName); err != nil {
+		return err
+	}
+	log.Infof("Labeled config %s as %s at Varnish endpoint %s", cfgName,
+		lbl, inst.addr)
+	return nil
+}
+
+// discardConfig discards cfgName at each of the instances in insts,
+// after a failed rollout.
+func (vc *Controller) discardConfig(cfgName string,
+	insts []*varnishInst) AdmErrors {
+
+	results := vc.fanOut(discardPhase, insts,
+		func(inst *varnishInst, metrics *instanceMetrics) (bool, error) {
+			err := vc.withAdmin(inst, metrics,
+				func(adm *admin.Admin) error {
+					return adm.VCLDiscard(cfgName)
+				})
+			if err != nil {
+				return false, err
+			}
+			metrics.vclDiscards.Inc()
+			vc.log.Infof("Discarded config %s at %s", cfgName,
+				inst.addr)
+			return false, nil
+		})
+	results.record(discardPhase, cfgName)
+	return results.errs()
+}
+
+// loadAll runs the first phase of a rollout, loading cfgName at each
+// of the instances in insts. The load times of instances at which the
+// config was newly loaded are recorded for the load limit.
+func (vc *Controller) loadAll(insts []*varnishInst, cfgName string,
+	srcs vclSource) instResults {
+
+	results := vc.fanOut(loadPhase, insts,
+		func(inst *varnishInst, metrics *instanceMetrics) (bool, error) {
+			metrics.updates.Inc()
+			newlyLoaded, err := vc.loadInstance(inst, cfgName,
+				srcs, metrics)
+			if err != nil {
+				metrics.updateErrs.Inc()
+			}
+			return newlyLoaded, err
+		})
+	results.record(loadPhase, cfgName)
+	now := time.Now()
+	for _, result := range results {
+		if result.err == nil && result.newlyLoaded {
+			result.inst.loadTimes = append(result.inst.loadTimes,
+				now)
+		}
+	}
+	return results
+}
+
+// newlyLoaded returns the instances at which a config was newly
+// loaded, from the results of loadAll.
+func (results instResults) newlyLoaded() []*varnishInst {
+	var insts []*varnishInst
+	for _, result := range results {
+		if result.err == nil && result.newlyLoaded {
+			insts = append(insts, result.inst)
+		}
+	}
+	return insts
+}
+
+// labelAll runs the second phase of a rollout, activating cfgName at
+// each of the instances in insts. phase is activatePhase, or
+// rollbackPhase when a previous config is re-activated.
+func (vc *Controller) labelAll(phase string, insts []*varnishInst,
+	cfgName string, health map[string]bool) instResults {
+
+	results := vc.fanOut(phase, insts,
+		func(inst *varnishInst, metrics *instanceMetrics) (bool, error) {
+			err := vc.labelInstance(inst, cfgName, health, metrics)
+			if err != nil && phase == activatePhase {
+				metrics.updateErrs.Inc()
+			}
+			return false, err
+		})
+	results.record(phase, cfgName)
+	return results
+}
+
+// insts returns the non-nil instances of svc.
+func (svc *varnishSvc) insts() []*varnishInst {
+	insts := make([]*varnishInst, 0, len(svc.instances))
+	for _, inst := range svc.instances {
+		if inst == nil {
+			continue
+		}
+		insts = append(insts, inst)
+	}
+	return insts
+}
+
+// rollout implements the two-phase update of the Varnish Service
+// svc, identified by name, to the config generated from spec. prevCfg
+// is the name of the config that is currently active, or the empty
+// string if it is not known.
+//
+// If canary rollouts are configured, the second phase is started at
+// the canary instances, and completed asynchronously after the soak
+// time.
+func (vc *Controller) rollout(name string, svc *varnishSvc, spec *vclSpec,
+	prevCfg string, health map[string]bool) error {
+
+	log := vc.svcLog(name)
+	timer := prometheus.NewTimer(rolloutLatency.WithLabelValues(name))
+	defer timer.ObserveDuration()
+	cfgName := spec.configName()
+	insts := svc.insts()
+
+	log.Infof("Update Varnish instances: load config %s", cfgName)
+	srcs := newVCLSources(spec)
+	results := vc.loadAll(insts, cfgName, srcs)
+	if mixed := srcs.mixedVersions(); mixed != "" {
+		log.Warnf("Varnish Service %s: instances run different "+
+			"versions of Varnish (%s), config %s generated for "+
+			"each version", name, mixed, cfgName)
+	}
+	loadedAt := results.newlyLoaded()
+	if errs := results.errs(); len(errs) > 0 {
+		log.Errorf("Varnish Service %s: config %s could not be "+
+			"loaded at all instances, discarding", name, cfgName)
+		rollbacksCtr.WithLabelValues(name).Inc()
+		return RolloutError{
+			svc:    name,
+			cfg:    cfgName,
+			prev:   prevCfg,
+			errs:   srcs.srcErrs(errs),
+			rbErrs: vc.discardConfig(cfgName, loadedAt),
+		}
+	}
+
+	if prevCfg != "" && prevCfg != cfgName && health == nil {
+		if canaries := vc.canaryInsts(svc); canaries != nil {
+			return vc.startCanary(name, svc, &canaryState{
+				spec:     spec,
+				cfg:      cfgName,
+				prev:     prevCfg,
+				srcs:     srcs,
+				insts:    canaries,
+				loadedAt: loadedAt,
+			})
+		}
+	}
+
+	log.Infof("Update Varnish instances: activate config %s", cfgName)
+	results = vc.labelAll(activatePhase, insts, cfgName, health)
+	errs := results.errs()
+	if len(errs) == 0 {
+		vc.setLoaded(svc, spec)
+		if svc.dispatch != "" {
+			if errs = vc.endIsolation(name, svc, insts); len(errs) > 0 {
+				return errs
+			}
+		}
+		svc.cfgLoaded = true
+		return nil
+	}
+
+	rollbacksCtr.WithLabelValues(name).Inc()
+	labelled := results.succeeded()
+	rbErr := RolloutError{
+		svc:     name,
+		cfg:     cfgName,
+		prev:    prevCfg,
+		partial: len(labelled) > 0,
+		errs:    errs,
+	}
+	if prevCfg == "" || prevCfg == cfgName {
+		return rbErr
+	}
+	log.Errorf("Varnish Service %s: config %s could not be activated "+
+		"at all instances, rolling back to config %s", name, cfgName,
+		prevCfg)
+	rbErr.rbErrs = vc.labelAll(rollbackPhase, labelled, prevCfg, nil).errs()
+	return rbErr
+}
@@ -0,0 +1,527 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package varnish
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+	"code.uplex.de/uplex-varnish/varnishapi/pkg/admin"
+)
+
+const (
+	// bootCfg is the config that is active when tenants are not
+	// isolated, and sends requests to the regular label.
+	bootCfg        = "boot"
+	dispatchPrefix = ingressPrefix + "dispatch_"
+)
+
+// Tenant is the configuration for a tenant of a Varnish Service
+// whose tenants are isolated, see UpdateTenants.
+//
+//    Name: name of the tenant, such as a namespace
+//    Spec: VCL spec generated for the tenant's Ingresses
+//    Ings: Ingress meta-data
+//    Vcfg: meta-data for the merged VarnishConfigs
+//    Bcfg: BackendConfig meta-data
+//    Err: error encountered when generating Spec, if any; then
+//         Spec is ignored, and the config currently loaded for
+//         the tenant, if any, remains in use
+type Tenant struct {
+	Name string
+	Spec vcl.Spec
+	Ings map[string]Meta
+	Vcfg VcfgMeta
+	Bcfg map[string]Meta
+	Err  error
+}
+
+// TenantErrors are returned by UpdateTenants for the tenants whose
+// configs could not be updated, indexed by tenant name. The configs
+// of the other tenants were updated.
+type TenantErrors map[string]error
+
+// Error returns an error message with the errors for each tenant, in
+// order of the tenant names.
+func (errs TenantErrors) Error() string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("tenant %s: %v", name, errs[name])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// tenant is the state of a tenant of a Varnish Service whose tenants
+// are isolated. spec is the desired config, and loaded is the config
+// currently labelled for the tenant at all instances; either may be
+// nil. err is the outcome of the most recent update.
+type tenant struct {
+	label  string
+	spec   *vclSpec
+	loaded *vclSpec
+	err    error
+}
+
+// dispatchSrc is the source of a dispatcher config, which is the same
+// for every version of Varnish.
+type dispatchSrc string
+
+func (src dispatchSrc) get(addr string, v vcl.Version) (string, error) {
+	return string(src), nil
+}
+
+// setTenants sets the desired configurations for the isolated tenants
+// of svc, and adjusts the gauges for backend Services and endpoints.
+// If tenants is nil, the tenants of svc are no longer isolated.
+// svc.mtx must be held.
+func (svc *varnishSvc) setTenants(tenants []Tenant) {
+	for _, t := range svc.tenants {
+		nBeSvcs, nBeEndps := t.spec.backendCounts()
+		beSvcsGauge.Sub(nBeSvcs)
+		beEndpsGauge.Sub(nBeEndps)
+	}
+	if tenants == nil {
+		svc.tenants = nil
+		return
+	}
+	svc.setSpec(nil)
+	prev := svc.tenants
+	svc.tenants = make(map[string]*tenant, len(tenants))
+	for _, t := range tenants {
+		state := &tenant{label: vcl.TenantLabel(t.Name)}
+		if p, exists := prev[t.Name]; exists {
+			state.loaded = p.loaded
+		}
+		if t.Err != nil {
+			state.spec = state.loaded
+			state.err = t.Err
+		} else {
+			state.spec = &vclSpec{
+				spec: t.Spec,
+				ings: t.Ings,
+				vcfg: t.Vcfg,
+				bcfg: t.Bcfg,
+			}
+		}
+		nBeSvcs, nBeEndps := state.spec.backendCounts()
+		beSvcsGauge.Add(nBeSvcs)
+		beEndpsGauge.Add(nBeEndps)
+		svc.tenants[t.Name] = state
+	}
+}
+
+// tenantNames returns the names of the tenants of svc in sorted
+// order.
+func (svc *varnishSvc) tenantNames() []string {
+	names := make([]string, 0, len(svc.tenants))
+	for name := range svc.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UpdateTenants updates the Varnish Service identified by svcKey to
+// implement the configurations of isolated tenants. The config for
+// each tenant is loaded separately, and labelled with the tenant's
+// label; a dispatcher config is made active, which sends requests
+// to the label of the tenant by the Host header. So an error in the
+// config of one tenant, for example in its custom VCL, does not
+// affect the other tenants. If tenants were not isolated for the
+// Service previously, they are isolated from now on; Update ends the
+// isolation.
+//
+// If the configs of some tenants could not be updated, TenantErrors
+// are returned. A tenant whose config was not updated continues to
+// use the config that was previously loaded for it, if any.
+//
+// Updates for isolated tenants are not batched, and are not subject
+// to the load limit, canary rollouts, runtime backend changes or
+// pinning.
+func (vc *Controller) UpdateTenants(svcKey string, tenants []Tenant) error {
+	svc := vc.lockSvc(svcKey, true)
+	defer svc.mtx.Unlock()
+
+	if tenants == nil {
+		tenants = []Tenant{}
+	}
+	svc.cfgLoaded = false
+	svc.setTenants(tenants)
+
+	if len(svc.instances) == 0 {
+		return fmt.Errorf("Currently no known endpoints for Varnish "+
+			"service %s", svcKey)
+	}
+	return vc.updateVarnishSvc(svcKey, svc)
+}
+
+// Isolated returns true iff the tenants of the Varnish Service
+// identified by svcKey are currently isolated, see UpdateTenants.
+func (vc *Controller) Isolated(svcKey string) bool {
+	svc := vc.lockSvc(svcKey, false)
+	if svc == nil {
+		return false
+	}
+	defer svc.mtx.Unlock()
+	return svc.tenants != nil
+}
+
+// updateTenants updates the Varnish Service svc, identified by name,
+// whose tenants are isolated: the config for each tenant is loaded
+// and labelled, and then the dispatcher for the tenants that have a
+// config is loaded and made active. svc.mtx must be held.
+func (vc *Controller) updateTenants(name string, svc *varnishSvc) error {
+	log := vc.svcLog(name)
+	insts := svc.insts()
+	errs := make(TenantErrors)
+
+	for _, tName := range svc.tenantNames() {
+		t := svc.tenants[tName]
+		if err := vc.rolloutTenant(name, tName, t, insts); err != nil {
+			log.Errorf("Varnish Service %s: %v", name, err)
+			errs[tName] = err
+		}
+	}
+
+	dispatch := vcl.Dispatch{}
+	hosts := make(map[string]string)
+	dflt := ""
+	for _, tName := range svc.tenantNames() {
+		t := svc.tenants[tName]
+		if t.loaded == nil {
+			continue
+		}
+		route := vcl.Route{Label: t.label}
+		for _, rule := range t.loaded.spec.Rules {
+			if other, exists := hosts[rule.Host]; exists {
+				errs[tName] = fmt.Errorf("Host %s is also "+
+					"defined by tenant %s, not routed to "+
+					"tenant %s", rule.Host, other, tName)
+				continue
+			}
+			hosts[rule.Host] = tName
+			route.Hosts = append(route.Hosts, rule.Host)
+		}
+		if t.loaded.spec.DefaultService.Name != "" {
+			if dflt != "" {
+				errs[tName] = fmt.Errorf("Default backend is "+
+					"also defined by tenant %s, not "+
+					"routed to tenant %s", dflt, tName)
+			} else {
+				dflt = tName
+				route.Default = true
+			}
+		}
+		dispatch.Routes = append(dispatch.Routes, route)
+	}
+	if err := vc.rolloutDispatch(name, svc, dispatch, insts); err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	for _, t := range svc.tenants {
+		if t.spec != t.loaded {
+			return nil
+		}
+	}
+	svc.cfgLoaded = true
+	return nil
+}
+
+// rolloutTenant implements the two-phase update of the config for the
+// tenant t, identified by tName, of the Varnish Service identified by
+// name: the config is loaded at each of the instances in insts, and
+// then labelled with the tenant's label, if all of the loads
+// succeeded. Otherwise, the config previously loaded for the tenant
+// remains in use. svc.mtx must be held for the Service.
+func (vc *Controller) rolloutTenant(name, tName string, t *tenant,
+	insts []*varnishInst) error {
+
+	log := vc.svcLog(name)
+	if t.spec == nil {
+		log.Infof("Varnish Service %s: no config for tenant %s", name,
+			tName)
+		return nil
+	}
+	spec := t.spec
+	if _, err := spec.spec.GetSrc(); err != nil {
+		t.err = err
+		return err
+	}
+	cfgName := spec.configName()
+	prevCfg := ""
+	if t.loaded != nil {
+		prevCfg = t.loaded.configName()
+	}
+	tenantSvc := name + " tenant " + tName
+
+	log.Infof("Varnish Service %s: load config %s for tenant %s", name,
+		cfgName, tName)
+	srcs := newVCLSources(spec)
+	results := vc.loadAll(insts, cfgName, srcs)
+	if errs := results.errs(); len(errs) > 0 {
+		log.Errorf("Varnish Service %s: config %s for tenant %s could "+
+			"not be loaded at all instances, discarding", name,
+			cfgName, tName)
+		rollbacksCtr.WithLabelValues(name).Inc()
+		t.err = RolloutError{
+			svc:    tenantSvc,
+			cfg:    cfgName,
+			prev:   prevCfg,
+			errs:   srcs.srcErrs(errs),
+			rbErrs: vc.discardConfig(cfgName, results.newlyLoaded()),
+		}
+		return t.err
+	}
+
+	log.Infof("Varnish Service %s: label config %s as %s for tenant %s",
+		name, cfgName, t.label, tName)
+	results = vc.labelTenantAll(activatePhase, insts, t.label, cfgName)
+	errs := results.errs()
+	if len(errs) == 0 {
+		t.loaded = spec
+		t.err = nil
+		return nil
+	}
+
+	rollbacksCtr.WithLabelValues(name).Inc()
+	labelled := results.succeeded()
+	rbErr := RolloutError{
+		svc:     tenantSvc,
+		cfg:     cfgName,
+		prev:    prevCfg,
+		partial: len(labelled) > 0,
+		errs:    errs,
+	}
+	if prevCfg != "" && prevCfg != cfgName {
+		rbErr.rbErrs = vc.labelTenantAll(rollbackPhase, labelled,
+			t.label, prevCfg).errs()
+	}
+	t.err = rbErr
+	return rbErr
+}
+
+// labelTenantAll labels cfgName with the tenant label lbl at each of
+// the instances in insts. phase is activatePhase, or rollbackPhase
+// when the previous config of the tenant is labelled again.
+func (vc *Controller) labelTenantAll(phase string, insts []*varnishInst,
+	lbl, cfgName string) instResults {
+
+	results := vc.fanOut(phase, insts,
+		func(inst *varnishInst, metrics *instanceMetrics) (bool, error) {
+			log := inst.logger(vc.log).WithField(logConfig,
+				cfgName)
+			err := vc.withAdmin(inst, metrics,
+				func(adm *admin.Admin) error {
+					vcls, err := adm.VCLList()
+					if err != nil {
+						return err
+					}
+					return labelCfg(adm, inst, vcls, lbl,
+						cfgName, log)
+				})
+			if err != nil && phase == activatePhase {
+				metrics.updateErrs.Inc()
+			}
+			return false, err
+		})
+	results.record(phase, cfgName)
+	return results
+}
+
+// rolloutDispatch loads the dispatcher config for dispatch at each of
+// the instances in insts, and makes it the active config, if all of
+// the loads succeeded. Then the previous dispatcher config is
+// discarded, as well as the labels of tenants that are no longer
+// routed. svc.mtx must be held.
+func (vc *Controller) rolloutDispatch(name string, svc *varnishSvc,
+	dispatch vcl.Dispatch, insts []*varnishInst) error {
+
+	log := vc.svcLog(name)
+	src, err := dispatch.GetSrc()
+	if err != nil {
+		return err
+	}
+	cfgName := nonAlNum.ReplaceAllLiteralString(
+		dispatchPrefix+dispatch.DeepHash(), "_")
+	prevCfg := svc.dispatch
+
+	log.Infof("Varnish Service %s: load dispatcher config %s", name,
+		cfgName)
+	results := vc.loadAll(insts, cfgName, dispatchSrc(src))
+	if errs := results.errs(); len(errs) > 0 {
+		log.Errorf("Varnish Service %s: dispatcher config %s could "+
+			"not be loaded at all instances, discarding", name,
+			cfgName)
+		rollbacksCtr.WithLabelValues(name).Inc()
+		return RolloutError{
+			svc:    name,
+			cfg:    cfgName,
+			prev:   prevCfg,
+			errs:   errs,
+			rbErrs: vc.discardConfig(cfgName, results.newlyLoaded()),
+		}
+	}
+
+	log.Infof("Varnish Service %s: activate dispatcher config %s", name,
+		cfgName)
+	results = vc.useAll(activatePhase, insts, cfgName)
+	if errs := results.errs(); len(errs) > 0 {
+		rollbacksCtr.WithLabelValues(name).Inc()
+		used := results.succeeded()
+		rbErr := RolloutError{
+			svc:     name,
+			cfg:     cfgName,
+			prev:    prevCfg,
+			partial: len(used) > 0,
+			errs:    errs,
+		}
+		if prevCfg == cfgName {
+			return rbErr
+		}
+		rbCfg := prevCfg
+		if rbCfg == "" {
+			rbCfg = bootCfg
+		}
+		rbErr.rbErrs = vc.useAll(rollbackPhase, used, rbCfg).errs()
+		return rbErr
+	}
+	svc.dispatch = cfgName
+
+	if prevCfg != "" && prevCfg != cfgName {
+		if errs := vc.discardConfig(prevCfg, insts); len(errs) > 0 {
+			log.Warnf("Varnish Service %s: cannot discard "+
+				"dispatcher config %s: %v", name, prevCfg, errs)
+		}
+	}
+	routed := make(map[string]struct{}, len(dispatch.Routes))
+	for _, route := range dispatch.Routes {
+		routed[route.Label] = struct{}{}
+	}
+	vc.discardLabels(name, svc, routed, insts)
+	if svc.labels == nil {
+		svc.labels = make(map[string]struct{})
+	}
+	for label := range routed {
+		svc.labels[label] = struct{}{}
+	}
+	return nil
+}
+
+// discardLabels discards the tenant labels set for svc at the
+// instances in insts, except for those in keep. Labels that cannot be
+// discarded are retained in svc.labels, so that discarding is tried
+// again after the next update. svc.mtx must be held.
+func (vc *Controller) discardLabels(name string, svc *varnishSvc,
+	keep map[string]struct{}, insts []*varnishInst) {
+
+	log := vc.svcLog(name)
+	for label := range svc.labels {
+		if _, ok := keep[label]; ok {
+			continue
+		}
+		if errs := vc.discardConfig(label, insts); len(errs) > 0 {
+			log.Warnf("Varnish Service %s: cannot discard tenant "+
+				"label %s: %v", name, label, errs)
+			continue
+		}
+		delete(svc.labels, label)
+	}
+}
+
+// useAll makes cfgName the active config at each of the instances in
+// insts, and labels the readiness config. phase is activatePhase, or
+// rollbackPhase when a previous config is made active again.
+func (vc *Controller) useAll(phase string, insts []*varnishInst,
+	cfgName string) instResults {
+
+	results := vc.fanOut(phase, insts,
+		func(inst *varnishInst, metrics *instanceMetrics) (bool, error) {
+			log := inst.logger(vc.log).WithField(logConfig,
+				cfgName)
+			err := vc.withAdmin(inst, metrics,
+				func(adm *admin.Admin) error {
+					log.Tracef("Use config %s at %s",
+						cfgName, inst.addr)
+					_, err := adm.Command("vcl.use",
+						cfgName)
+					if err != nil {
+						return err
+					}
+					log.Infof("Using config %s at Varnish "+
+						"endpoint %s", cfgName,
+						inst.addr)
+					vcls, err := adm.VCLList()
+					if err != nil {
+						return err
+					}
+					return labelCfg(adm, inst, vcls,
+						readinessLabel, readyCfg, log)
+				})
+			if err != nil && phase == activatePhase {
+				metrics.updateErrs.Inc()
+			}
+			return false, err
+		})
+	results.record(phase, cfgName)
+	return results
+}
+
+// endIsolation makes the boot config active again at the instances
+// in insts, after the regular config has been labelled for a Varnish
+// Service whose tenants were previously isolated. Then the dispatcher
+// config and the tenant labels are discarded. svc.mtx must be held.
+func (vc *Controller) endIsolation(name string, svc *varnishSvc,
+	insts []*varnishInst) AdmErrors {
+
+	log := vc.svcLog(name)
+	log.Infof("Varnish Service %s: tenants no longer isolated, "+
+		"activate config %s", name, bootCfg)
+	if errs := vc.useAll(activatePhase, insts, bootCfg).errs(); len(errs) > 0 {
+		log.Errorf("Varnish Service %s: config %s could not be "+
+			"activated at all instances", name, bootCfg)
+		return errs
+	}
+	if errs := vc.discardConfig(svc.dispatch, insts); len(errs) > 0 {
+		log.Warnf("Varnish Service %s: cannot discard dispatcher "+
+			"config %s: %v", name, svc.dispatch, errs)
+	}
+	svc.dispatch = ""
+	vc.discardLabels(name, svc, nil, insts)
+	return nil
+}
@@ -35,10 +35,10 @@ package varnish
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,7 +48,6 @@ import (
 	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
 	"code.uplex.de/uplex-varnish/varnishapi/pkg/admin"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -117,10 +116,80 @@ type Meta struct {
 	Ver string
 }
 
+// FieldSrc identifies a field in the spec of a VarnishConfig or
+// ClusterVarnishConfig.
+//
+//    Key: namespace/name of the VarnishConfig, or the name of the
+//         ClusterVarnishConfig
+//    Field: path of the field, such as spec.acl[1]
+type FieldSrc struct {
+	Key   string
+	Field string
+}
+
+// Kind returns the kind of the config identified by src.Key:
+// ClusterVarnishConfig if the key has no namespace, otherwise
+// VarnishConfig.
+func (src FieldSrc) Kind() string {
+	if strings.IndexByte(src.Key, '/') < 0 {
+		return "ClusterVarnishConfig"
+	}
+	return "VarnishConfig"
+}
+
+// VcfgMeta encapsulates meta-data for the VarnishConfigs that are
+// merged into the configuration for a Varnish Service, including
+// ClusterVarnishConfigs, which are identified by name only.
+//
+//    Configs: meta-data for each VarnishConfig, in the order in
+//             which they were merged
+//    Fields: maps the fields of the merged spec, such as spec.acl[3],
+//            to the fields of the VarnishConfigs from which they
+//            were merged
+type VcfgMeta struct {
+	Configs []Meta
+	Fields  map[string]FieldSrc
+}
+
+// equal returns true iff the same VarnishConfigs, at the same
+// versions, are merged in the same order for meta and other.
+func (meta VcfgMeta) equal(other VcfgMeta) bool {
+	if len(meta.Configs) != len(other.Configs) {
+		return false
+	}
+	for i, cfg := range meta.Configs {
+		if cfg != other.Configs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Src returns the VarnishConfig and the field within it from which
+// field of the merged spec, such as spec.acl[3].addrs[0], was merged.
+// The lookup is by the path up to the first index, or up to a line
+// number, as in spec.vcl line 2.
+func (meta VcfgMeta) Src(field string) (FieldSrc, bool) {
+	prefix := field
+	if i := strings.IndexByte(field, ']'); i >= 0 {
+		prefix = field[:i+1]
+	} else if i := strings.IndexByte(field, ' '); i >= 0 {
+		prefix = field[:i]
+	}
+	if src, ok := meta.Fields[prefix]; ok {
+		src.Field += field[len(prefix):]
+		return src, true
+	}
+	if len(meta.Configs) == 1 {
+		return FieldSrc{Key: meta.Configs[0].Key, Field: field}, true
+	}
+	return FieldSrc{}, false
+}
+
 type vclSpec struct {
 	spec vcl.Spec
 	ings map[string]Meta
-	vcfg Meta
+	vcfg VcfgMeta
 	bcfg map[string]Meta
 }
 
@@ -129,30 +198,106 @@ func (spec vclSpec) configName() string {
 	return nonAlNum.ReplaceAllLiteralString(name, "_")
 }
 
+// The fields of varnishInst are protected by the mutex of the
+// varnishSvc to which the instance belongs, except for admSecret and
+// Banner, which are protected by the mutex of conn (admin interactions
+// may continue in the background after an update deadline has passed).
 type varnishInst struct {
 	addr      string
-	admSecret *[]byte
+	svc       string
+	admSecret *admSecret
 	Banner    string
-	admMtx    *sync.Mutex
+	conn      *admConn
+	loadTimes []time.Time
+	// lastUpdate is the outcome of the most recent update
+	// operation at the instance, for the debug API.
+	lastUpdate *UpdateResult
 }
 
 type varnishSvc struct {
+	// mtx serializes updates and monitor checks for the Service,
+	// and protects its state. deleted is set when the Service is
+	// removed from Controller.svcs; a goroutine that acquires mtx
+	// after that point must not use the Service.
+	mtx       sync.Mutex
+	deleted   bool
 	instances []*varnishInst
 	spec      *vclSpec
+	// loaded is the spec from which the VCL configuration that is
+	// currently loaded was generated. It differs from spec if
+	// endpoint changes were applied by setting backend health at
+	// runtime.
+	loaded    *vclSpec
 	secrName  string
 	cfgLoaded bool
+	// pending is the timer for a batched update, if one is
+	// scheduled, and pendingSince the time at which the first
+	// Update of the batch was received.
+	pending      *time.Timer
+	pendingSince time.Time
+	// canary is the state of a canary rollout in progress, if any.
+	// canaryFailed is the name of a config that failed the canary
+	// checks, which is not rolled out again until the config for
+	// the Service changes.
+	canary       *canaryState
+	canaryFailed string
+	// history is the list of configs most recently loaded, the
+	// currently active config first, and pin is the name of a
+	// config in the history to which the Service is pinned.
+	// pinMissing is a pin that was ignored, because the config
+	// could not be found (after a restart).
+	history    []cfgHistory
+	pin        string
+	pinMissing string
+	// recovered is the config found to be active at all instances
+	// when no config was known to be loaded (after a restart).
+	recovered string
+	// tenants are the isolated tenants of the Service by name, nil
+	// if tenants are not isolated. dispatch is the name of the
+	// dispatcher config that is active while tenants are isolated,
+	// and labels are the tenant labels set at the instances.
+	tenants  map[string]*tenant
+	dispatch string
+	labels   map[string]struct{}
+}
+
+// updateSettings are the settings for updates, configured with the
+// Set* methods of Controller.
+type updateSettings struct {
+	runtimeBes   bool
+	quiet        time.Duration
+	maxDelay     time.Duration
+	maxLoads     uint
+	canaryN      uint
+	canaryPct    bool
+	canarySoak   time.Duration
+	histLen      uint
+	concurrency  uint
+	instDeadline time.Duration
+	monIntvl     time.Duration
 }
 
 // Controller encapsulates information about each Varnish
 // cluster deployed as Ingress implementations in the cluster, and
 // their current states.
+//
+// The methods of Controller may be called concurrently, for example
+// by the workers for different namespaces. mtx protects the maps svcs
+// and secrets, and the update settings; it is only held briefly. Each
+// Varnish Service has its own lock, so that updates for different
+// Services may proceed in parallel. The lock for a Service may be held
+// while acquiring mtx, but not vice versa.
 type Controller struct {
-	log      *logrus.Logger
-	svcEvt   interfaces.SvcEventGenerator
-	svcs     map[string]*varnishSvc
-	secrets  map[string]*[]byte
-	wg       *sync.WaitGroup
-	monIntvl time.Duration
+	log     *logrus.Entry
+	monLog  *logrus.Entry
+	svcEvt  interfaces.SvcEventGenerator
+	svcs    map[string]*varnishSvc
+	secrets map[string]*admSecret
+	wg      *sync.WaitGroup
+	monWake chan struct{}
+	monBeat int64
+	mtx     sync.Mutex
+	opts    updateSettings
 }
 
 // NewVarnishController returns an instance of Controller.
@@ -177,11 +322,13 @@ func NewVarnishController(log *logrus.Logger, tmplDir string,
 	}
 	initMetrics()
 	return &Controller{
-		svcs:     make(map[string]*varnishSvc),
-		secrets:  make(map[string]*[]byte),
-		log:      log,
-		monIntvl: monIntvl,
-		wg:       new(sync.WaitGroup),
+		svcs:    make(map[string]*varnishSvc),
+		secrets: make(map[string]*admSecret),
+		log:     log.WithField(logComponent, "varnish"),
+		monLog:  log.WithField(logComponent, "monitor"),
+		wg:      new(sync.WaitGroup),
+		monWake: make(chan struct{}, 1),
+		opts:    updateSettings{monIntvl: monIntvl},
 	}, nil
 }
 
@@ -192,155 +339,176 @@ func (vc *Controller) EvtGenerator(svcEvt interfaces.SvcEventGenerator) {
 	vc.svcEvt = svcEvt
 }
 
-// Start initiates the Varnish controller and starts the monitor
-// goroutine.
-func (vc *Controller) Start() {
-	fmt.Printf("Varnish controller logging at level: %s\n", vc.log.Level)
-	go vc.monitor(vc.monIntvl)
+// SetRuntimeBackends determines whether changes in the endpoints of
+// backend Services may be applied at runtime, without loading a new
+// VCL configuration. If enabled, and the only difference between a
+// new configuration and the currently loaded one is that endpoints
+// were removed (or were re-added after removal), then the health of
+// the corresponding backends in the loaded VCL is set via
+// backend.set_health. All other changes, including new endpoints,
+// still require a VCL load.
+func (vc *Controller) SetRuntimeBackends(enable bool) {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	vc.opts.runtimeBes = enable
 }
 
-func (vc *Controller) updateVarnishInstance(inst *varnishInst, cfgName string,
-	vclSrc string, metrics *instanceMetrics) error {
-
-	vc.log.Infof("Update Varnish instance at %s", inst.addr)
-	vc.log.Tracef("Varnish instance %s: %+v", inst.addr, *inst)
-	if inst.admSecret == nil {
-		return fmt.Errorf("No known admin secret")
-	}
-	inst.admMtx.Lock()
-	defer inst.admMtx.Unlock()
-	vc.wg.Add(1)
-	defer vc.wg.Done()
-
-	vc.log.Tracef("Connect to %s, timeout=%v", inst.addr, admTimeout)
-	timer := prometheus.NewTimer(metrics.connectLatency)
-	adm, err := admin.Dial(inst.addr, *inst.admSecret, admTimeout)
-	timer.ObserveDuration()
-	if err != nil {
-		metrics.connectFails.Inc()
-		return err
-	}
-	defer adm.Close()
-	inst.Banner = adm.Banner
-	vc.log.Infof("Connected to Varnish admin endpoint at %s", inst.addr)
+// settings returns the current settings for updates.
+func (vc *Controller) settings() updateSettings {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	return vc.opts
+}
 
-	loaded, labelled, ready := false, false, false
-	vc.log.Tracef("List VCLs at %s", inst.addr)
-	vcls, err := adm.VCLList()
-	if err != nil {
-		return err
-	}
-	vc.log.Tracef("VCL List at %s: %+v", inst.addr, vcls)
-	for _, vcl := range vcls {
-		if vcl.Name == cfgName {
-			loaded = true
-		}
-		if vcl.LabelVCL == cfgName &&
-			vcl.Name == regularLabel {
-			labelled = true
-		}
-		if vcl.LabelVCL == readyCfg &&
-			vcl.Name == readinessLabel {
-			ready = true
+// lockSvc returns the Varnish Service identified by key with its lock
+// held, creating it if it does not exist and create is true. Returns
+// nil if the Service does not exist and create is false. The caller
+// must unlock the Service.
+func (vc *Controller) lockSvc(key string, create bool) *varnishSvc {
+	for {
+		vc.mtx.Lock()
+		svc, exists := vc.svcs[key]
+		if !exists {
+			if !create {
+				vc.mtx.Unlock()
+				return nil
+			}
+			svc = &varnishSvc{instances: make([]*varnishInst, 0)}
+			vc.svcs[key] = svc
+			svcsGauge.Inc()
+			vc.svcLog(key).Infof("Added Varnish service "+
+				"definition %s", key)
 		}
-	}
+		vc.mtx.Unlock()
 
-	if loaded {
-		vc.log.Infof("Config %s already loaded at instance %s", cfgName,
-			inst.addr)
-	} else {
-		vc.log.Tracef("Load config %s at %s", cfgName, inst.addr)
-		timer = prometheus.NewTimer(metrics.vclLoadLatency)
-		err = adm.VCLInline(cfgName, vclSrc)
-		timer.ObserveDuration()
-		if err != nil {
-			vc.log.Tracef("Error loading config %s at %s: %v",
-				cfgName, inst.addr, err)
-			metrics.vclLoadErrs.Inc()
-			return err
+		svc.mtx.Lock()
+		if !svc.deleted {
+			return svc
 		}
-		metrics.vclLoads.Inc()
-		vc.log.Infof("Loaded config %s at Varnish endpoint %s", cfgName,
-			inst.addr)
-	}
-
-	if labelled {
-		vc.log.Infof("Config %s already labelled as regular at %s",
-			cfgName, inst.addr)
-	} else {
-		vc.log.Tracef("Label config %s as %s at %s", cfgName,
-			regularLabel, inst.addr)
-		err = adm.VCLLabel(regularLabel, cfgName)
-		if err != nil {
-			return err
-		}
-		vc.log.Infof("Labeled config %s as %s at Varnish endpoint %s",
-			cfgName, regularLabel, inst.addr)
+		// Deleted while waiting for the lock, look it up again.
+		svc.mtx.Unlock()
 	}
+}
 
-	if ready {
-		vc.log.Infof("Config %s already labelled as ready at %s",
-			readyCfg, inst.addr)
-	} else {
-		vc.log.Tracef("Label config %s as %s at %s", readyCfg,
-			readinessLabel, inst.addr)
-		err = adm.VCLLabel(readinessLabel, readyCfg)
-		if err != nil {
-			return err
-		}
-		vc.log.Infof("Labeled config %s as %s at Varnish endpoint %s",
-			readyCfg, readinessLabel, inst.addr)
+// svcKeys returns the keys of all Varnish Services currently known.
+func (vc *Controller) svcKeys() []string {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+
+	keys := make([]string, 0, len(vc.svcs))
+	for key := range vc.svcs {
+		keys = append(keys, key)
 	}
-	return nil
+	sort.Strings(keys)
+	return keys
 }
 
-func (vc *Controller) updateVarnishSvc(name string) error {
-	svc, exists := vc.svcs[name]
-	if !exists || svc == nil {
-		return fmt.Errorf("No known Varnish Service %s", name)
+// Start initiates the Varnish controller and starts the monitor
+// goroutine.
+func (vc *Controller) Start() {
+	fmt.Printf("Varnish controller logging at level: %s\n", vc.log.Logger.Level)
+	go vc.monitor()
+}
+
+// summary describes the state of the Service for trace logs, without
+// the full contents of its configuration.
+func (svc *varnishSvc) summary() string {
+	cfg, loaded := "none", "none"
+	if svc.spec != nil {
+		cfg = svc.spec.configName()
 	}
-	vc.log.Tracef("Update Varnish svc %s: config=%+v", name, *svc)
+	if svc.loaded != nil {
+		loaded = svc.loaded.configName()
+	}
+	return fmt.Sprintf("instances=%d secret=%s config=%s loaded=%s "+
+		"cfgLoaded=%v tenants=%d dispatch=%s", len(svc.instances),
+		svc.secrName, cfg, loaded, svc.cfgLoaded, len(svc.tenants),
+		svc.dispatch)
+}
+
+// updateVarnishSvc updates the Varnish Service svc, identified by
+// name, to implement its current configuration. svc.mtx must be held.
+func (vc *Controller) updateVarnishSvc(name string, svc *varnishSvc) error {
+	log := vc.svcLog(name)
+	log.Tracef("Update Varnish svc %s: %s", name, svc.summary())
 	svc.cfgLoaded = false
 	if svc.secrName == "" {
 		return fmt.Errorf("No known admin secret for Varnish Service "+
 			"%s", name)
 	}
-	if svc.spec == nil {
-		vc.log.Infof("Update Varnish Service %s: Currently no Ingress"+
+	if svc.spec == nil && svc.tenants == nil {
+		log.Infof("Update Varnish Service %s: Currently no Ingress"+
 			" defined", name)
 		return nil
 	}
+	if svc.canary != nil {
+		log.Infof("Update Varnish Service %s: canary rollout of "+
+			"config %s in progress, update deferred", name,
+			svc.canary.cfg)
+		return nil
+	}
+	if svc.tenants != nil {
+		return vc.updateTenants(name, svc)
+	}
+	if svc.loaded == nil && svc.dispatch == "" && svc.pin != "" &&
+		svc.pinRecovered() {
+		log.Debugf("Update Varnish Service %s: pinned config %s "+
+			"recovered at the instances", name, svc.pin)
+		svc.cfgLoaded = true
+		return nil
+	}
+	if svc.loaded == nil && svc.dispatch == "" &&
+		vc.recoverState(name, svc) &&
+		(svc.pin != "" || !vc.settings().runtimeBes) {
+		svc.cfgLoaded = true
+		return nil
+	}
 
-	vclSrc, err := svc.spec.spec.GetSrc()
-	if err != nil {
-		return err
+	spec := vc.pinnedSpec(name, svc)
+	var health map[string]bool
+	if spec == nil {
+		spec = svc.spec
 	}
-	cfgName := svc.spec.configName()
+	if vc.settings().runtimeBes && svc.loaded != nil && svc.pin == "" {
+		if states, ok := svc.spec.spec.RuntimeBackends(
+			svc.loaded.spec); ok {
 
-	vc.log.Infof("Update Varnish instances: load config %s", cfgName)
-	vc.log.Tracef("Config %s source: %s", cfgName, vclSrc)
-	var errs AdmErrors
-	for _, inst := range svc.instances {
-		if inst == nil {
-			vc.log.Errorf("Instance object is nil")
-			continue
+			log.Infof("Update Varnish Service %s: applying "+
+				"endpoint changes at runtime to config %s",
+				name, svc.loaded.configName())
+			spec = svc.loaded
+			health = states
+		}
+	}
+	if _, err := spec.spec.GetSrc(); err != nil {
+		return err
+	}
+	cfgName := spec.configName()
+	if svc.canaryFailed != "" {
+		if cfgName == svc.canaryFailed && svc.pin == "" {
+			log.Infof("Update Varnish Service %s: config %s "+
+				"failed canary checks, not rolled out again "+
+				"until the configuration changes", name,
+				cfgName)
+			return nil
 		}
-		metrics := getInstanceMetrics(inst.addr)
-		metrics.updates.Inc()
-		if e := vc.updateVarnishInstance(inst, cfgName, vclSrc,
-			metrics); e != nil {
+		svc.canaryFailed = ""
+		canaryFailedGauge.WithLabelValues(name).Set(0)
+	}
 
-			admErr := AdmError{addr: inst.addr, err: e}
-			errs = append(errs, admErr)
-			metrics.updateErrs.Inc()
-			continue
+	if health == nil &&
+		(svc.loaded == nil || svc.loaded.configName() != cfgName) {
+		if wait, addr := vc.loadWait(svc); wait > 0 {
+			deferredLoadsCtr.WithLabelValues(name).Inc()
+			return loadLimitError{addr: addr, wait: wait}
 		}
 	}
-	if len(errs) == 0 {
-		svc.cfgLoaded = true
-		return nil
+
+	prevCfg := svc.recovered
+	if svc.loaded != nil {
+		prevCfg = svc.loaded.configName()
 	}
-	return errs
+	return vc.rollout(name, svc, spec, prevCfg, health)
 }
 
 // Label cfg as lbl at Varnish instance inst. If mayClose is true, then
@@ -349,46 +517,27 @@ func (vc *Controller) updateVarnishSvc(name string) error {
 func (vc *Controller) setCfgLabel(inst *varnishInst, cfg, lbl string,
 	mayClose bool) error {
 
-	if inst.admSecret == nil {
-		return AdmError{
-			addr: inst.addr,
-			err:  fmt.Errorf("No known admin secret"),
-		}
-	}
+	log := inst.logger(vc.log).WithField(logConfig, cfg)
 	metrics := getInstanceMetrics(inst.addr)
-	inst.admMtx.Lock()
-	defer inst.admMtx.Unlock()
-	vc.wg.Add(1)
-	defer vc.wg.Done()
-
-	vc.log.Tracef("Connect to %s, timeout=%v", inst.addr, admTimeout)
-	timer := prometheus.NewTimer(metrics.connectLatency)
-	adm, err := admin.Dial(inst.addr, *inst.admSecret, admTimeout)
-	timer.ObserveDuration()
-	if err != nil {
+	err := vc.withAdmin(inst, metrics, func(adm *admin.Admin) error {
+		log.Tracef("Set config %s to label %s at %s", inst.addr,
+			cfg, lbl)
+		return adm.VCLLabel(lbl, cfg)
+	})
+	if err == nil {
+		return nil
+	}
+	if err == errNoAdmSecret {
+		return AdmError{addr: inst.addr, err: err}
+	}
+	if _, ok := err.(connectError); ok || isConnErr(err) {
 		if mayClose {
-			vc.log.Warnf("Could not connect to %s: %v", inst.addr,
-				err)
+			log.Warnf("Admin connection to %s failed: %v",
+				inst.addr, err)
 			return nil
 		}
-		metrics.connectFails.Inc()
 		return AdmError{addr: inst.addr, err: err}
 	}
-	defer adm.Close()
-	inst.Banner = adm.Banner
-	vc.log.Infof("Connected to Varnish admin endpoint at %s", inst.addr)
-
-	vc.log.Tracef("Set config %s to label %s at %s", inst.addr, cfg, lbl)
-	if err := adm.VCLLabel(lbl, cfg); err != nil {
-		if err == io.EOF {
-			if mayClose {
-				vc.log.Warnf("Connection at EOF at %s",
-					inst.addr)
-				return nil
-			}
-			return AdmError{addr: inst.addr, err: err}
-		}
-	}
 	return nil
 }
 
@@ -398,9 +547,9 @@ func (vc *Controller) removeVarnishInstances(insts []*varnishInst) error {
 
 	for _, inst := range insts {
 		// XXX health check for sharding config should fail
-		if err := vc.setCfgLabel(inst, notAvailCfg, readinessLabel,
-			true); err != nil {
-
+		err := vc.setCfgLabel(inst, notAvailCfg, readinessLabel, true)
+		inst.closeConn()
+		if err != nil {
 			admErr := AdmError{addr: inst.addr, err: err}
 			errs = append(errs, admErr)
 			continue
@@ -413,18 +562,16 @@ func (vc *Controller) removeVarnishInstances(insts []*varnishInst) error {
 	return errs
 }
 
-func (vc *Controller) updateVarnishSvcAddrs(key string, addrs []vcl.Address,
-	secrPtr *[]byte, loadVCL bool) error {
+// updateVarnishSvcAddrs sets the instances of the Varnish Service svc
+// to the admin addresses addrs, and sets removed instances to the not
+// ready state. svc.mtx must be held.
+func (vc *Controller) updateVarnishSvcAddrs(key string, svc *varnishSvc,
+	addrs []vcl.Address, secrPtr *admSecret, loadVCL bool) error {
 
+	log := vc.svcLog(key)
 	var errs AdmErrors
 	var newInsts, remInsts, keepInsts []*varnishInst
 
-	svc, exists := vc.svcs[key]
-	if !exists {
-		// Shouldn't be possible
-		return fmt.Errorf("No known Varnish Service %s", key)
-	}
-
 	updateAddrs := make(map[string]struct{})
 	prevAddrs := make(map[string]*varnishInst)
 	for _, addr := range addrs {
@@ -442,8 +589,9 @@ func (vc *Controller) updateVarnishSvcAddrs(key string, addrs []vcl.Address,
 		}
 		newInst := &varnishInst{
 			addr:      addr,
+			svc:       key,
 			admSecret: secrPtr,
-			admMtx:    &sync.Mutex{},
+			conn:      &admConn{},
 		}
 		newInsts = append(newInsts, newInst)
 		instsGauge.Inc()
@@ -454,33 +602,43 @@ func (vc *Controller) updateVarnishSvcAddrs(key string, addrs []vcl.Address,
 			remInsts = append(remInsts, inst)
 		}
 	}
-	vc.log.Tracef("Varnish svc %s: keeping instances=%+v, "+
+	log.Tracef("Varnish svc %s: keeping instances=%+v, "+
 		"new instances=%+v, removing instances=%+v", key, keepInsts,
 		newInsts, remInsts)
 	svc.instances = append(keepInsts, newInsts...)
+	if len(newInsts) > 0 {
+		// The pinned config must be found at the new instances.
+		svc.clearPinRecovered()
+	}
 
 	for _, inst := range remInsts {
-		vc.log.Tracef("Varnish svc %s setting to not ready: %+v", key,
+		log.Tracef("Varnish svc %s setting to not ready: %+v", key,
 			inst)
-		if err := vc.setCfgLabel(inst, notAvailCfg, readinessLabel,
-			true); err != nil {
-
+		err := vc.setCfgLabel(inst, notAvailCfg, readinessLabel, true)
+		inst.closeConn()
+		if err != nil {
 			admErr := AdmError{addr: inst.addr, err: err}
 			errs = append(errs, admErr)
 			continue
 		}
 		instsGauge.Dec()
 	}
-	vc.log.Tracef("Varnish svc %s config: %+v", key, *svc)
+	log.Tracef("Varnish svc %s: %s", key, svc.summary())
 
 	if loadVCL {
-		vc.log.Tracef("Varnish svc %s: load VCL", key)
-		updateErrs := vc.updateVarnishSvc(key)
+		log.Tracef("Varnish svc %s: load VCL", key)
+		updateErrs := vc.updateVarnishSvc(key, svc)
 		if updateErrs != nil {
-			vadmErrs, ok := updateErrs.(AdmErrors)
-			if ok {
+			if len(errs) == 0 {
+				return updateErrs
+			}
+			switch vadmErrs := updateErrs.(type) {
+			case AdmErrors:
 				errs = append(errs, vadmErrs...)
-			} else {
+			case RolloutError:
+				log.Errorf("%v", vadmErrs)
+				errs = append(errs, vadmErrs.AdmErrors()...)
+			default:
 				return updateErrs
 			}
 		}
@@ -503,49 +661,25 @@ func (vc *Controller) updateVarnishSvcAddrs(key string, addrs []vcl.Address,
 func (vc *Controller) AddOrUpdateVarnishSvc(key string, addrs []vcl.Address,
 	secrName string, loadVCL bool) error {
 
-	var secrPtr *[]byte
-	svc, svcExists := vc.svcs[key]
-	if !svcExists {
-		var instances []*varnishInst
-		svc = &varnishSvc{}
-		for _, addr := range addrs {
-			admAddr := addr.IP + ":" + strconv.Itoa(int(addr.Port))
-			instance := &varnishInst{
-				addr:   admAddr,
-				admMtx: &sync.Mutex{},
-			}
-			vc.log.Tracef("Varnish svc %s: creating instance %+v",
-				key, *instance)
-			instances = append(instances, instance)
-			instsGauge.Inc()
-		}
-		svc.instances = instances
-		vc.svcs[key] = svc
-		svcsGauge.Inc()
-		vc.log.Tracef("Varnish svc %s: created config", key)
-	}
-	vc.log.Tracef("Varnish svc %s config: %+v", key, svc)
+	log := vc.svcLog(key)
+	svc := vc.lockSvc(key, true)
+	defer svc.mtx.Unlock()
+	log.Tracef("Varnish svc %s: %s", key, svc.summary())
 
 	svc.secrName = secrName
-	if _, exists := vc.secrets[secrName]; exists {
-		secrPtr = vc.secrets[secrName]
-	} else {
-		secrPtr = nil
-	}
+	secrPtr := vc.getSecret(secrName)
 	for _, inst := range svc.instances {
-		inst.admSecret = secrPtr
+		inst.setSecret(secrPtr)
 	}
-	vc.log.Tracef("Varnish svc %s: updated instance with secret %s", key,
+	log.Tracef("Varnish svc %s: updated instance with secret %s", key,
 		secrName)
 
-	vc.log.Tracef("Update Varnish svc %s: addrs=%+v secret=%s reloadVCL=%v",
+	log.Tracef("Update Varnish svc %s: addrs=%+v secret=%s reloadVCL=%v",
 		key, addrs, secrName, loadVCL)
-	if secrPtr != nil {
-		vc.log.Tracef("secret contents = %v", *secrPtr)
-	} else {
-		vc.log.Trace("secret is nil")
+	if secrPtr == nil {
+		log.Trace("secret is nil")
 	}
-	return vc.updateVarnishSvcAddrs(key, addrs, secrPtr, loadVCL)
+	return vc.updateVarnishSvcAddrs(key, svc, addrs, secrPtr, loadVCL)
 }
 
 // DeleteVarnishSvc is called on the Delete event for the Varnish
@@ -553,32 +687,60 @@ func (vc *Controller) AddOrUpdateVarnishSvc(key string, addrs []vcl.Address,
 // is set to the unready state, and no further action is taken (other
 // resources in the cluster may shut down the Varnish instances).
 func (vc *Controller) DeleteVarnishSvc(key string) error {
-	svc, ok := vc.svcs[key]
-	if !ok {
+	svc := vc.lockSvc(key, false)
+	if svc == nil {
 		return nil
 	}
-	err := vc.removeVarnishInstances(svc.instances)
-	if err != nil {
-		delete(vc.svcs, key)
-		svcsGauge.Dec()
+	defer svc.mtx.Unlock()
+
+	if svc.pending != nil {
+		svc.pending.Stop()
+		svc.pending = nil
+	}
+	if svc.canary != nil {
+		svc.canary = nil
+		canaryGauge.WithLabelValues(key).Set(0)
 	}
+	if svc.canaryFailed != "" {
+		svc.canaryFailed = ""
+		canaryFailedGauge.WithLabelValues(key).Set(0)
+	}
+	svc.setSpec(nil)
+	svc.setTenants(nil)
+	err := vc.removeVarnishInstances(svc.instances)
+	svc.instances = nil
+	svc.deleted = true
+
+	vc.mtx.Lock()
+	delete(vc.svcs, key)
+	vc.mtx.Unlock()
+	svcsGauge.Dec()
 	return err
 }
 
-func (vc *Controller) updateBeGauges() {
-	nBeSvcs := 0
+// backendCounts returns the number of backend Services and endpoints
+// in spec.
+func (spec *vclSpec) backendCounts() (float64, float64) {
+	if spec == nil {
+		return 0, 0
+	}
 	nBeEndps := 0
-	for _, svc := range vc.svcs {
-		if svc == nil || svc.spec == nil {
-			continue
-		}
-		nBeSvcs += len(svc.spec.spec.AllServices)
-		for _, beSvc := range svc.spec.spec.AllServices {
-			nBeEndps += len(beSvc.Addresses)
-		}
+	for _, beSvc := range spec.spec.AllServices {
+		nBeEndps += len(beSvc.Addresses)
 	}
-	beSvcsGauge.Set(float64(nBeSvcs))
-	beEndpsGauge.Set(float64(nBeEndps))
+	return float64(len(spec.spec.AllServices)), float64(nBeEndps)
+}
+
+// setSpec sets the desired configuration for svc, and adjusts the
+// gauges for backend Services and endpoints. svc.mtx must be held.
+func (svc *varnishSvc) setSpec(spec *vclSpec) {
+	nBeSvcs, nBeEndps := svc.spec.backendCounts()
+	beSvcsGauge.Sub(nBeSvcs)
+	beEndpsGauge.Sub(nBeEndps)
+	svc.spec = spec
+	nBeSvcs, nBeEndps = spec.backendCounts()
+	beSvcsGauge.Add(nBeSvcs)
+	beEndpsGauge.Add(nBeEndps)
 }
 
 // Update a Varnish Service to implement an configuration.
@@ -586,34 +748,40 @@ func (vc *Controller) updateBeGauges() {
 //    svcKey: namespace/name key for the Service
 //    spec: VCL spec corresponding to the configuration
 //    ingsMeta: Ingress meta-data
-//    vcfgMeta: VarnishConfig meta-data
+//    vcfgMeta: meta-data for the merged VarnishConfigs
 //    bcfgMeta: BackendConfig meta-data
+//
+// If the tenants of the Service were isolated (see UpdateTenants), the
+// isolation ends when the config has been loaded.
 func (vc *Controller) Update(svcKey string, spec vcl.Spec,
-	ingsMeta map[string]Meta, vcfgMeta Meta,
+	ingsMeta map[string]Meta, vcfgMeta VcfgMeta,
 	bcfgMeta map[string]Meta) error {
 
-	svc, exists := vc.svcs[svcKey]
-	if !exists {
-		svc = &varnishSvc{instances: make([]*varnishInst, 0)}
-		vc.svcs[svcKey] = svc
-		svcsGauge.Inc()
-		vc.log.Infof("Added Varnish service definition %s", svcKey)
+	svc := vc.lockSvc(svcKey, true)
+	defer svc.mtx.Unlock()
+
+	prevCfg := ""
+	if svc.spec != nil {
+		prevCfg = svc.spec.configName()
 	}
 	svc.cfgLoaded = false
-	if svc.spec == nil {
-		svc.spec = &vclSpec{}
-	}
-	svc.spec.spec = spec
-	svc.spec.ings = ingsMeta
-	svc.spec.vcfg = vcfgMeta
-	svc.spec.bcfg = bcfgMeta
-	vc.updateBeGauges()
+	svc.setTenants(nil)
+	svc.setSpec(&vclSpec{
+		spec: spec,
+		ings: ingsMeta,
+		vcfg: vcfgMeta,
+		bcfg: bcfgMeta,
+	})
 
 	if len(svc.instances) == 0 {
 		return fmt.Errorf("Currently no known endpoints for Varnish "+
 			"service %s", svcKey)
 	}
-	return vc.updateVarnishSvc(svcKey)
+	if vc.settings().quiet > 0 {
+		vc.scheduleUpdate(svcKey, svc, prevCfg)
+		return nil
+	}
+	return vc.updateVarnishSvc(svcKey, svc)
 }
 
 // SetNotReady may be called on the Delete event on an Ingress, if no
@@ -621,12 +789,14 @@ func (vc *Controller) Update(svcKey string, spec vcl.Spec,
 // The Service is set to the not ready state, by relabelling VCL so
 // that readiness checks are not answered with status 200.
 func (vc *Controller) SetNotReady(svcKey string) error {
-	svc, ok := vc.svcs[svcKey]
-	if !ok {
+	svc := vc.lockSvc(svcKey, false)
+	if svc == nil {
 		return fmt.Errorf("Set Varnish Service not ready: %s unknown",
 			svcKey)
 	}
-	svc.spec = nil
+	defer svc.mtx.Unlock()
+	svc.setSpec(nil)
+	svc.setTenants(nil)
 
 	var errs AdmErrors
 	for _, inst := range svc.instances {
@@ -653,17 +823,19 @@ func (vc *Controller) SetNotReady(svcKey string) error {
 //    svcKey: namespace/name key for the Varnish Service
 //    spec: VCL specification derived from the configuration
 //    ingsMeta: Ingress meta-data
-//    vcfgMeta: VarnishConfig meta-data
+//    vcfgMeta: meta-data for the merged VarnishConfigs
 //    bcfgMeta: BackendConfig meta-data
 func (vc *Controller) HasConfig(svcKey string, spec vcl.Spec,
-	ingsMeta map[string]Meta, vcfgMeta Meta,
+	ingsMeta map[string]Meta, vcfgMeta VcfgMeta,
 	bcfgMeta map[string]Meta) bool {
 
-	svc, ok := vc.svcs[svcKey]
-	if !ok {
+	svc := vc.lockSvc(svcKey, false)
+	if svc == nil {
 		return false
 	}
-	if !svc.cfgLoaded {
+	defer svc.mtx.Unlock()
+
+	if !svc.cfgLoaded || svc.spec == nil || svc.tenants != nil {
 		return false
 	}
 	if len(ingsMeta) != len(svc.spec.ings) {
@@ -672,9 +844,7 @@ func (vc *Controller) HasConfig(svcKey string, spec vcl.Spec,
 	if len(bcfgMeta) != len(svc.spec.bcfg) {
 		return false
 	}
-	if vcfgMeta.Key != svc.spec.vcfg.Key ||
-		vcfgMeta.UID != svc.spec.vcfg.UID ||
-		vcfgMeta.Ver != svc.spec.vcfg.Ver {
+	if !vcfgMeta.equal(svc.spec.vcfg) {
 		return false
 	}
 	for k, v := range ingsMeta {
@@ -703,53 +873,60 @@ func (vc *Controller) HasConfig(svcKey string, spec vcl.Spec,
 // SetAdmSecret stores the Secret data identified by the
 // namespace/name key.
 func (vc *Controller) SetAdmSecret(key string, secret []byte) {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+
 	secr, exists := vc.secrets[key]
 	if !exists {
-		secretSlice := make([]byte, len(secret))
-		secr = &secretSlice
+		secr = &admSecret{}
 		vc.secrets[key] = secr
 		secretsGauge.Inc()
 	}
-	copy(*vc.secrets[key], secret)
+	secr.set(secret)
+}
+
+// getSecret returns the Secret identified by the namespace/name key,
+// or nil if it is not known.
+func (vc *Controller) getSecret(key string) *admSecret {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+	return vc.secrets[key]
 }
 
 // UpdateSvcForSecret associates the Secret identified by the
 // namespace/name secretKey with the Varnish Service identified by the
 // namespace/name svcKey. The Service is newly synced if necessary.
 func (vc *Controller) UpdateSvcForSecret(svcKey, secretKey string) error {
-	secret, exists := vc.secrets[secretKey]
-	if !exists {
+	log := vc.svcLog(svcKey)
+	secret := vc.getSecret(secretKey)
+	if secret == nil {
 		secretKey = ""
-		secret = nil
 	}
-	svc, exists := vc.svcs[svcKey]
-	if !exists {
-		if secret == nil {
-			vc.log.Infof("Neither Varnish Service %s nor secret "+
-				"%s found", svcKey, secretKey)
-			return nil
-		}
-		vc.log.Infof("Creating Varnish Service %s to set secret %s",
+	svc := vc.lockSvc(svcKey, secret != nil)
+	if svc == nil {
+		log.Infof("Neither Varnish Service %s nor secret %s found",
 			svcKey, secretKey)
-		svc = &varnishSvc{instances: make([]*varnishInst, 0)}
-		vc.svcs[svcKey] = svc
-		svcsGauge.Inc()
+		return nil
 	}
+	defer svc.mtx.Unlock()
 	svc.secrName = secretKey
 
 	for _, inst := range svc.instances {
-		vc.log.Infof("Setting secret for instance %s", inst.addr)
-		inst.admSecret = secret
+		log.Infof("Setting secret for instance %s", inst.addr)
+		inst.setSecret(secret)
 	}
 
-	vc.log.Infof("Updating Service %s after setting secret %s", svcKey,
+	log.Infof("Updating Service %s after setting secret %s", svcKey,
 		secretKey)
-	return vc.updateVarnishSvc(svcKey)
+	return vc.updateVarnishSvc(svcKey, svc)
 }
 
 // DeleteAdmSecret removes the secret identified by the namespace/name
 // key.
 func (vc *Controller) DeleteAdmSecret(name string) {
+	vc.mtx.Lock()
+	defer vc.mtx.Unlock()
+
 	_, exists := vc.secrets[name]
 	if exists {
 		delete(vc.secrets, name)
@@ -762,4 +939,15 @@ func (vc *Controller) Quit() {
 	vc.log.Info("Wait for admin interactions with Varnish instances to " +
 		"finish")
 	vc.wg.Wait()
+
+	for _, key := range vc.svcKeys() {
+		svc := vc.lockSvc(key, false)
+		if svc == nil {
+			continue
+		}
+		for _, inst := range svc.instances {
+			inst.closeConn()
+		}
+		svc.mtx.Unlock()
+	}
 }
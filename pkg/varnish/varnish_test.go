@@ -30,10 +30,20 @@ package varnish
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"code.uplex.de/uplex-varnish/k8s-ingress/pkg/varnish/vcl"
+	"code.uplex.de/uplex-varnish/varnishapi/pkg/admin"
+
+	"github.com/sirupsen/logrus"
 )
 
 func TestAdmError(t *testing.T) {
@@ -193,10 +203,12 @@ var bcfgsMeta = map[string]Meta{
 	},
 }
 
-var vcfgMeta = Meta{
-	Key: "default/varnish-cfg",
-	UID: "6ba7b814-9dad-11d1-80b4-00c04fd430c8",
-	Ver: "37337",
+var vcfgMeta = VcfgMeta{
+	Configs: []Meta{{
+		Key: "default/varnish-cfg",
+		UID: "6ba7b814-9dad-11d1-80b4-00c04fd430c8",
+		Ver: "37337",
+	}},
 }
 
 func TestHasConfig(t *testing.T) {
@@ -233,13 +245,22 @@ func TestHasConfig(t *testing.T) {
 	}
 	vSvc.cfgLoaded = true
 
-	otherVcfg := vcfgMeta
-	otherVcfg.Ver = "37338"
+	otherVcfg := VcfgMeta{Configs: []Meta{vcfgMeta.Configs[0]}}
+	otherVcfg.Configs[0].Ver = "37338"
 	if vc.HasConfig(svcKey, cafeSpecShuf, ingsMeta, otherVcfg, bcfgsMeta) {
 
 		t.Errorf("HasConfig(changed VarnishConfig) got:true want:false")
 	}
 
+	otherVcfg = VcfgMeta{Configs: []Meta{
+		{Key: "default/platform-cfg", UID: "1", Ver: "1"},
+		vcfgMeta.Configs[0],
+	}}
+	if vc.HasConfig(svcKey, cafeSpecShuf, ingsMeta, otherVcfg, bcfgsMeta) {
+
+		t.Errorf("HasConfig(added VarnishConfig) got:true want:false")
+	}
+
 	otherIngs := make(map[string]Meta)
 	for k, v := range ingsMeta {
 		otherIngs[k] = v
@@ -315,3 +336,1191 @@ func TestConfigName(t *testing.T) {
 			"'%s' '%s'", name1, name2)
 	}
 }
+
+func TestUpdateDelay(t *testing.T) {
+	svcKey := "default/varnish-ingress"
+	vSvc := &varnishSvc{
+		instances: []*varnishInst{{
+			addr: "192.0.2.1:6081",
+			conn: &admConn{},
+		}},
+	}
+	vc := Controller{
+		log:  logrus.NewEntry(logrus.New()),
+		svcs: map[string]*varnishSvc{svcKey: vSvc},
+	}
+	vc.SetUpdateDelay(time.Hour, 2*time.Hour)
+
+	if err := vc.Update(svcKey, cafeSpec, ingsMeta, vcfgMeta,
+		bcfgsMeta); err != nil {
+		t.Fatalf("Update() with update delay: %v", err)
+	}
+	timer := vSvc.pending
+	if timer == nil {
+		t.Fatal("Update() with update delay: no update scheduled")
+	}
+	defer func() { vSvc.pending.Stop() }()
+
+	if err := vc.Update(svcKey, cafeSpecShuf, ingsMeta, vcfgMeta,
+		bcfgsMeta); err != nil {
+		t.Fatalf("Update() with update delay: %v", err)
+	}
+	if vSvc.pending != timer {
+		t.Error("Update() for the same config restarted the timer")
+	}
+
+	if err := vc.Update(svcKey, vcl.Spec{}, ingsMeta, vcfgMeta,
+		bcfgsMeta); err != nil {
+		t.Fatalf("Update() with update delay: %v", err)
+	}
+	if vSvc.pending == timer {
+		t.Error("Update() for a new config did not restart the timer")
+	}
+	if vSvc.spec.spec.DeepHash() != (vcl.Spec{}).DeepHash() {
+		t.Error("Update() did not set the latest spec")
+	}
+}
+
+func TestSupersededTimer(t *testing.T) {
+	svcKey := "default/varnish-ingress"
+	vSvc := &varnishSvc{}
+	vc := Controller{
+		log:  logrus.NewEntry(logrus.New()),
+		svcs: map[string]*varnishSvc{svcKey: vSvc},
+	}
+
+	// The timer fires while the lock is held, and is superseded
+	// before the lock is released.
+	vSvc.mtx.Lock()
+	vc.startTimer(svcKey, vSvc, 0)
+	time.Sleep(10 * time.Millisecond)
+	newer := time.NewTimer(time.Hour)
+	defer newer.Stop()
+	vSvc.pending = newer
+	vSvc.mtx.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	vSvc.mtx.Lock()
+	defer vSvc.mtx.Unlock()
+	if vSvc.pending != newer {
+		t.Error("superseded timer cleared the pending update")
+	}
+}
+
+func TestLoadWait(t *testing.T) {
+	now := time.Now()
+	inst := &varnishInst{
+		addr: "192.0.2.1:6081",
+		loadTimes: []time.Time{
+			now.Add(-2 * time.Minute),
+			now.Add(-30 * time.Second),
+			now.Add(-10 * time.Second),
+		},
+	}
+	vSvc := &varnishSvc{instances: []*varnishInst{inst}}
+	vc := Controller{}
+
+	if wait, _ := vc.loadWait(vSvc); wait != 0 {
+		t.Errorf("loadWait() with no limit: got %v want 0", wait)
+	}
+
+	vc.opts.maxLoads = 3
+	if wait, _ := vc.loadWait(vSvc); wait != 0 {
+		t.Errorf("loadWait() below the limit: got %v want 0", wait)
+	}
+	if len(inst.loadTimes) != 2 {
+		t.Errorf("loadWait(): got %d load times, want 2",
+			len(inst.loadTimes))
+	}
+
+	vc.opts.maxLoads = 2
+	wait, addr := vc.loadWait(vSvc)
+	if wait <= 0 || wait > 30*time.Second {
+		t.Errorf("loadWait() at the limit: got %v want 0s < wait <= "+
+			"30s", wait)
+	}
+	if addr != inst.addr {
+		t.Errorf("loadWait() at the limit: got addr %s want %s", addr,
+			inst.addr)
+	}
+}
+
+func TestRolloutError(t *testing.T) {
+	errs := AdmErrors{
+		AdmError{
+			addr: "192.0.2.1:6081",
+			err:  fmt.Errorf("VCL compilation failed"),
+		},
+	}
+	rbErr := RolloutError{
+		svc:  "default/varnish-ingress",
+		cfg:  "vk8s_ing_new",
+		prev: "vk8s_ing_old",
+		errs: errs,
+	}
+	want := "Varnish Service default/varnish-ingress: config " +
+		"vk8s_ing_new not activated, config vk8s_ing_old remains " +
+		"active: [{192.0.2.1:6081: VCL compilation failed}]"
+	if err := rbErr.Error(); err != want {
+		t.Errorf("RolloutError.Error() want=%s got=%s", want, err)
+	}
+
+	rbErr.partial = true
+	want = "config vk8s_ing_new activated at only some instances, " +
+		"rolled back to config vk8s_ing_old"
+	if outcome := rbErr.Outcome(); outcome != want {
+		t.Errorf("RolloutError.Outcome() want=%s got=%s", want,
+			outcome)
+	}
+
+	rbErr.rbErrs = AdmErrors{
+		AdmError{
+			addr: "192.0.2.2:6081",
+			err:  fmt.Errorf("EOF"),
+		},
+	}
+	want = "config vk8s_ing_new activated at only some instances, " +
+		"rollback to config vk8s_ing_old failed"
+	if outcome := rbErr.Outcome(); outcome != want {
+		t.Errorf("RolloutError.Outcome() want=%s got=%s", want,
+			outcome)
+	}
+	if len(rbErr.AdmErrors()) != 2 {
+		t.Errorf("RolloutError.AdmErrors() want 2 errors got %d",
+			len(rbErr.AdmErrors()))
+	}
+}
+
+func TestSrcErrs(t *testing.T) {
+	if err := vcl.InitTemplates("vcl"); err != nil {
+		t.Fatal("InitTemplates():", err)
+	}
+	spec := &vclSpec{
+		spec: vcl.Spec{VCL: "sub vcl_recv {\n\tbogus;\n}\n"},
+		vcfg: VcfgMeta{Configs: []Meta{{Key: "default/varnish-cfg"}}},
+	}
+	src, err := spec.spec.GetSrc()
+	if err != nil {
+		t.Fatal("GetSrc():", err)
+	}
+	line := strings.Count(src[:strings.Index(src, "bogus")], "\n") + 1
+	errs := newVCLSources(spec).srcErrs(AdmErrors{
+		AdmError{
+			addr: "192.0.2.1:6081",
+			err: fmt.Errorf("Message from VCC-compiler:\n"+
+				"Expected an action, 'if', '{' or '}'\n"+
+				"('<vcl.inline>' Line %d Pos 9)\n"+
+				"\tbogus;\n--------#####-\n\n"+
+				"Running VCC-compiler failed, exited with 2\n"+
+				"VCL compilation failed", line),
+		},
+		AdmError{
+			addr: "192.0.2.2:6081",
+			err:  fmt.Errorf("EOF"),
+		},
+	})
+	want := "(generated from: VarnishConfig default/varnish-cfg " +
+		"spec.vcl line 2)"
+	if err := errs[0].Error(); !strings.HasSuffix(err, want) {
+		t.Errorf("srcErrs(): want suffix %s got %s", want, err)
+	}
+	want = "192.0.2.2:6081: EOF"
+	if err := errs[1].Error(); err != want {
+		t.Errorf("srcErrs(): want %s got %s", want, err)
+	}
+}
+
+func TestVcfgMetaSrc(t *testing.T) {
+	meta := VcfgMeta{
+		Configs: []Meta{
+			{Key: "default/platform"},
+			{Key: "default/team"},
+		},
+		Fields: map[string]FieldSrc{
+			"spec.acl[0]": {"default/platform", "spec.acl[0]"},
+			"spec.acl[1]": {"default/team", "spec.acl[0]"},
+			"spec.vcl":    {"default/team", "spec.vcl"},
+		},
+	}
+	for _, h := range []struct {
+		field string
+		want  FieldSrc
+		ok    bool
+	}{
+		{"spec.acl[1].addrs[2]", FieldSrc{"default/team",
+			"spec.acl[0].addrs[2]"}, true},
+		{"spec.acl[0]", FieldSrc{"default/platform", "spec.acl[0]"},
+			true},
+		{"spec.vcl line 3", FieldSrc{"default/team",
+			"spec.vcl line 3"}, true},
+		{"spec.rewrites[0]", FieldSrc{}, false},
+	} {
+		if got, ok := meta.Src(h.field); ok != h.ok || got != h.want {
+			t.Errorf("Src(%s): want %+v,%v got %+v,%v", h.field,
+				h.want, h.ok, got, ok)
+		}
+	}
+
+	meta = VcfgMeta{Configs: []Meta{{Key: "default/cfg"}}}
+	want := FieldSrc{"default/cfg", "spec.rewrites[0]"}
+	if got, ok := meta.Src("spec.rewrites[0]"); !ok || got != want {
+		t.Errorf("Src(): want %+v got %+v,%v", want, got, ok)
+	}
+
+	if kind := want.Kind(); kind != "VarnishConfig" {
+		t.Errorf("Kind(%s): want VarnishConfig got %s", want.Key, kind)
+	}
+	cluster := FieldSrc{Key: "baseline", Field: "spec.acl[0]"}
+	if kind := cluster.Kind(); kind != "ClusterVarnishConfig" {
+		t.Errorf("Kind(%s): want ClusterVarnishConfig got %s",
+			cluster.Key, kind)
+	}
+}
+
+func TestVCLSources(t *testing.T) {
+	if err := vcl.InitTemplates("vcl"); err != nil {
+		t.Fatal("InitTemplates():", err)
+	}
+	spec := &vclSpec{
+		spec: vcl.Spec{VCL: "sub vcl_recv {\n\tbogus;\n}\n"},
+		vcfg: VcfgMeta{Configs: []Meta{{Key: "default/varnish-cfg"}}},
+	}
+	srcs := newVCLSources(spec)
+	v6 := vcl.Version{Major: 6, Minor: 3}
+	v7 := vcl.Version{Major: 7, Minor: 0}
+	if _, err := srcs.get("192.0.2.2:6081", v7); err == nil {
+		t.Errorf("get(%v) without varnish-7 templates: expected error",
+			v7)
+	}
+
+	// Templates for Varnish 7 are the same as the defaults, except
+	// for the VCL syntax version.
+	dir, err := ioutil.TempDir("", "vcl-templates")
+	if err != nil {
+		t.Fatal("TempDir():", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		if err := vcl.InitTemplates("vcl"); err != nil {
+			t.Fatal("InitTemplates():", err)
+		}
+	}()
+	tmpls, err := filepath.Glob(filepath.Join("vcl", "*.tmpl"))
+	if err != nil {
+		t.Fatal("Glob():", err)
+	}
+	for _, tmpl := range tmpls {
+		src, err := ioutil.ReadFile(tmpl)
+		if err != nil {
+			t.Fatal("ReadFile():", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, filepath.Base(tmpl)),
+			src, 0644)
+		if err != nil {
+			t.Fatal("WriteFile():", err)
+		}
+	}
+	if err = os.Mkdir(filepath.Join(dir, "varnish-7"), 0755); err != nil {
+		t.Fatal("Mkdir():", err)
+	}
+	if err = vcl.InitTemplates(dir); err != nil {
+		t.Fatal("InitTemplates():", err)
+	}
+	srcs = newVCLSources(spec)
+
+	src6, err := srcs.get("192.0.2.1:6081", v6)
+	if err != nil {
+		t.Fatal("get():", err)
+	}
+	if mixed := srcs.mixedVersions(); mixed != "" {
+		t.Errorf("mixedVersions(): want \"\" got %s", mixed)
+	}
+	src7, err := srcs.get("192.0.2.2:6081", v7)
+	if err != nil {
+		t.Fatal("get():", err)
+	}
+	if !strings.HasPrefix(src6, "vcl 4.0;") {
+		t.Errorf("get(%v): want VCL 4.0", v6)
+	}
+	if !strings.HasPrefix(src7, "vcl 4.1;") {
+		t.Errorf("get(%v): want VCL 4.1", v7)
+	}
+	want := "6.3 at 192.0.2.1:6081; 7.0 at 192.0.2.2:6081"
+	if mixed := srcs.mixedVersions(); mixed != want {
+		t.Errorf("mixedVersions(): want %s got %s", want, mixed)
+	}
+
+	line := strings.Count(src7[:strings.Index(src7, "bogus")], "\n") + 1
+	errs := srcs.srcErrs(AdmErrors{
+		AdmError{
+			addr: "192.0.2.2:6081",
+			err: fmt.Errorf("Message from VCC-compiler:\n"+
+				"('<vcl.inline>' Line %d Pos 9)\n", line),
+		},
+	})
+	want = "(generated from: VarnishConfig default/varnish-cfg " +
+		"spec.vcl line 2)"
+	if err := errs[0].Error(); !strings.HasSuffix(err, want) {
+		t.Errorf("srcErrs(): want suffix %s got %s", want, err)
+	}
+}
+
+func TestCanaryInsts(t *testing.T) {
+	vSvc := &varnishSvc{}
+	for _, addr := range []string{
+		"192.0.2.4:6081", "192.0.2.2:6081", "192.0.2.3:6081",
+		"192.0.2.1:6081",
+	} {
+		vSvc.instances = append(vSvc.instances, &varnishInst{addr: addr})
+	}
+	vc := Controller{}
+
+	if insts := vc.canaryInsts(vSvc); insts != nil {
+		t.Errorf("canaryInsts() with canaries disabled: got %v", insts)
+	}
+
+	for _, test := range []struct {
+		canary string
+		want   []string
+	}{
+		{"1", []string{"192.0.2.1:6081"}},
+		{"2", []string{"192.0.2.1:6081", "192.0.2.2:6081"}},
+		{"4", nil},
+		{"25%", []string{"192.0.2.1:6081"}},
+		{"30%", []string{"192.0.2.1:6081", "192.0.2.2:6081"}},
+		{"100%", nil},
+		{"0", nil},
+	} {
+		if err := vc.SetCanary(test.canary, time.Minute); err != nil {
+			t.Fatalf("SetCanary(%s): %v", test.canary, err)
+		}
+		insts := vc.canaryInsts(vSvc)
+		if len(insts) != len(test.want) {
+			t.Errorf("canaryInsts() canary=%s: got %d instances "+
+				"want %d", test.canary, len(insts),
+				len(test.want))
+			continue
+		}
+		for i, inst := range insts {
+			if inst.addr != test.want[i] {
+				t.Errorf("canaryInsts() canary=%s: got %s "+
+					"want %s", test.canary, inst.addr,
+					test.want[i])
+			}
+		}
+	}
+
+	for _, canary := range []string{"foo", "-1", "101%"} {
+		if err := vc.SetCanary(canary, time.Minute); err == nil {
+			t.Errorf("SetCanary(%s): expected error", canary)
+		}
+	}
+}
+
+func TestCanaryFailed(t *testing.T) {
+	if err := vcl.InitTemplates("vcl"); err != nil {
+		t.Fatal("InitTemplates():", err)
+	}
+	vc := &Controller{
+		log:    logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard}),
+		svcs:   make(map[string]*varnishSvc),
+		svcEvt: nopEvtGenerator{},
+	}
+	spec := &vclSpec{spec: cafeSpec}
+	svc := vc.lockSvc("ns/varnish", true)
+	svc.secrName = "ns/secret"
+	svc.spec = spec
+	svc.loaded = &vclSpec{spec: vcl.Spec{}}
+	svc.canaryFailed = spec.configName()
+
+	if err := vc.updateVarnishSvc("ns/varnish", svc); err != nil {
+		t.Fatal("updateVarnishSvc() with failed canary config:", err)
+	}
+	if svc.canaryFailed != spec.configName() || svc.cfgLoaded {
+		t.Errorf("updateVarnishSvc() rolled out failed canary "+
+			"config: canaryFailed=%s cfgLoaded=%v",
+			svc.canaryFailed, svc.cfgLoaded)
+	}
+	svc.mtx.Unlock()
+	if state := vc.ServiceState("ns/varnish", false); state == nil ||
+		state.CanaryFailed != spec.configName() {
+		t.Errorf("ServiceState() canaryFailed want=%s got=%+v",
+			spec.configName(), state)
+	}
+
+	svc = vc.lockSvc("ns/varnish", false)
+	defer svc.mtx.Unlock()
+	svc.canaryFailed = "vk8s_old_config"
+	svc.loaded = spec
+	if err := vc.updateVarnishSvc("ns/varnish", svc); err != nil {
+		t.Fatal("updateVarnishSvc() with changed config:", err)
+	}
+	if svc.canaryFailed != "" {
+		t.Errorf("updateVarnishSvc() canaryFailed not cleared "+
+			"after config change: %s", svc.canaryFailed)
+	}
+}
+
+func TestCanaryRemoved(t *testing.T) {
+	vc := &Controller{
+		log:    logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard}),
+		svcs:   make(map[string]*varnishSvc),
+		svcEvt: nopEvtGenerator{},
+	}
+	kept := &varnishInst{addr: "192.0.2.1:6081"}
+	removed := &varnishInst{addr: "192.0.2.2:6081"}
+	added := &varnishInst{addr: "192.0.2.3:6081"}
+	svc := vc.lockSvc("ns/varnish", true)
+	svc.instances = []*varnishInst{kept, added}
+	insts := presentInsts(svc, []*varnishInst{removed, kept})
+	if len(insts) != 1 || insts[0] != kept {
+		t.Errorf("presentInsts() want=[%s] got=%v", kept.addr, insts)
+	}
+
+	// The only canary is removed during the soak time.
+	c := &canaryState{
+		cfg:      "vk8s_new_config",
+		prev:     "vk8s_prev_config",
+		insts:    []*varnishInst{removed},
+		loadedAt: []*varnishInst{removed, kept},
+		deadline: time.Now(),
+	}
+	svc.canary = c
+	svc.mtx.Unlock()
+	vc.soakCanary("ns/varnish", c)
+
+	svc = vc.lockSvc("ns/varnish", false)
+	defer svc.mtx.Unlock()
+	if svc.canary != nil {
+		t.Error("soakCanary() canary rollout not ended after all " +
+			"canaries were removed")
+	}
+	if svc.canaryFailed != "" {
+		t.Errorf("soakCanary() removed canary counted as failed: %s",
+			svc.canaryFailed)
+	}
+	if len(c.insts) != 0 || len(c.loadedAt) != 1 ||
+		c.loadedAt[0] != kept {
+		t.Errorf("soakCanary() insts=%v loadedAt=%v", c.insts,
+			c.loadedAt)
+	}
+}
+
+func TestBackendHealth(t *testing.T) {
+	list := `Backend name                   Admin      Probe                Last updated
+boot.vk8s_notfound             probe      Healthy (no probe)   Mon, 01 Jul 2019 10:00:00 GMT
+vk8s_ing_new.vk8s_notfound     probe      Healthy (no probe)   Mon, 01 Jul 2019 10:00:00 GMT
+vk8s_ing_new.vk8s_tea_1        probe      Healthy 5/5          Mon, 01 Jul 2019 10:00:00 GMT
+vk8s_ing_new.vk8s_tea_2        probe      Sick 0/5             Mon, 01 Jul 2019 10:00:00 GMT
+vk8s_ing_new.vk8s_tea_3        sick       Healthy 5/5          Mon, 01 Jul 2019 10:00:00 GMT
+vk8s_ing_old.vk8s_tea_1        probe      Healthy 5/5          Mon, 01 Jul 2019 10:00:00 GMT
+`
+	total, sick := backendHealth(list, "vk8s_ing_new")
+	if total != 4 || sick != 2 {
+		t.Errorf("backendHealth(): got total=%d sick=%d want total=4 "+
+			"sick=2", total, sick)
+	}
+	total, sick = backendHealth(list, "vk8s_ing_old")
+	if total != 1 || sick != 0 {
+		t.Errorf("backendHealth(): got total=%d sick=%d want total=1 "+
+			"sick=0", total, sick)
+	}
+}
+
+func TestConfigHistory(t *testing.T) {
+	vc := Controller{
+		log:    logrus.NewEntry(logrus.New()),
+		svcEvt: nopEvtGenerator{},
+	}
+	vc.SetHistoryLen(2)
+	vSvc := &varnishSvc{}
+
+	specs := []*vclSpec{
+		{spec: cafeSpec},
+		{spec: vcl.Spec{}},
+		{spec: vcl.Spec{VCL: "sub vcl_recv {}"}},
+	}
+	for _, spec := range specs {
+		vc.setLoaded(vSvc, spec)
+	}
+	if vSvc.loaded != specs[2] {
+		t.Error("setLoaded() did not set the loaded spec")
+	}
+	if len(vSvc.history) != 2 {
+		t.Fatalf("setLoaded(): history length got %d want 2",
+			len(vSvc.history))
+	}
+	if vSvc.history[0].name != specs[2].configName() ||
+		vSvc.history[1].name != specs[1].configName() {
+		t.Errorf("setLoaded(): unexpected history order: %+v",
+			vSvc.history)
+	}
+	if vSvc.histEntry(specs[0].configName()) != nil {
+		t.Error("histEntry(): oldest config not removed from history")
+	}
+
+	vc.setLoaded(vSvc, specs[1])
+	if len(vSvc.history) != 2 ||
+		vSvc.history[0].name != specs[1].configName() ||
+		vSvc.history[1].name != specs[2].configName() {
+		t.Errorf("setLoaded(config in history): unexpected history: "+
+			"%+v", vSvc.history)
+	}
+	retain := vSvc.retained()
+	for _, spec := range specs[1:] {
+		if _, ok := retain[spec.configName()]; !ok {
+			t.Errorf("retained(): config %s not retained",
+				spec.configName())
+		}
+	}
+
+	vSvc.pin = specs[2].configName()
+	pinned := vc.pinnedSpec("default/varnish", vSvc)
+	if pinned != specs[2] {
+		t.Errorf("pinnedSpec(): got %v want %v", pinned, specs[2])
+	}
+
+	// After a restart, the pinned config is not in the history, but
+	// may be generated by the current spec.
+	vSvc.history = nil
+	vSvc.spec = specs[2]
+	if pinned = vc.pinnedSpec("default/varnish", vSvc); pinned != specs[2] {
+		t.Errorf("pinnedSpec(current spec): got %v want %v", pinned,
+			specs[2])
+	}
+
+	vSvc.pin = specs[0].configName()
+	if pinned = vc.pinnedSpec("default/varnish", vSvc); pinned != nil {
+		t.Errorf("pinnedSpec(config not found): got %v want nil",
+			pinned)
+	}
+	if vSvc.pin != "" || vSvc.pinMissing != specs[0].configName() {
+		t.Errorf("pinnedSpec(config not found): pin not ignored: "+
+			"pin=%s pinMissing=%s", vSvc.pin, vSvc.pinMissing)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	var insts []*varnishInst
+	for i := 1; i <= 8; i++ {
+		insts = append(insts, &varnishInst{
+			addr: fmt.Sprintf("192.0.2.%d:6081", i),
+		})
+	}
+	vc := Controller{}
+	vc.SetUpdateConcurrency(3, 0)
+
+	var mtx sync.Mutex
+	running, maxRunning := 0, 0
+	results := vc.fanOut(loadPhase, insts,
+		func(inst *varnishInst, _ *instanceMetrics) (bool, error) {
+			mtx.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mtx.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mtx.Lock()
+			running--
+			mtx.Unlock()
+			if inst == insts[2] {
+				return false, fmt.Errorf("load failed")
+			}
+			return true, nil
+		})
+	if maxRunning > 3 {
+		t.Errorf("fanOut(): %d concurrent invocations, limit 3",
+			maxRunning)
+	}
+	if len(results) != len(insts) {
+		t.Fatalf("fanOut(): got %d results want %d", len(results),
+			len(insts))
+	}
+	for i, result := range results {
+		if result.inst != insts[i] {
+			t.Errorf("fanOut(): result %d for %s want %s", i,
+				result.inst.addr, insts[i].addr)
+		}
+	}
+	errs := results.errs()
+	if len(errs) != 1 || errs[0].addr != insts[2].addr {
+		t.Errorf("fanOut(): unexpected errors: %v", errs)
+	}
+	if len(results.succeeded()) != len(insts)-1 ||
+		len(results.newlyLoaded()) != len(insts)-1 {
+		t.Errorf("fanOut(): unexpected successful results: %+v",
+			results)
+	}
+
+	vc.SetUpdateConcurrency(0, 20*time.Millisecond)
+	block := make(chan struct{})
+	defer close(block)
+	results = vc.fanOut(loadPhase, insts[:2],
+		func(inst *varnishInst, _ *instanceMetrics) (bool, error) {
+			if inst == insts[0] {
+				<-block
+			}
+			return false, nil
+		})
+	errs = results.errs()
+	if len(errs) != 1 || errs[0].addr != insts[0].addr {
+		t.Errorf("fanOut() with deadline: unexpected errors: %v", errs)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		failures uint
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	} {
+		if got := backoff(tc.failures); got != tc.want {
+			t.Errorf("backoff(%d) want=%v got=%v", tc.failures,
+				tc.want, got)
+		}
+	}
+
+	for _, err := range []error{io.EOF, &net.OpError{Op: "read"}} {
+		if !isConnErr(err) {
+			t.Errorf("isConnErr(%v) want=true got=false", err)
+		}
+	}
+	if isConnErr(fmt.Errorf("VCL compilation failed")) {
+		t.Error("isConnErr(VCL compilation failed) want=false " +
+			"got=true")
+	}
+}
+
+type nopEvtGenerator struct{}
+
+func (nopEvtGenerator) SvcInfoEvent(svcKey, reason, msgFmt string,
+	args ...interface{}) {
+}
+
+func (nopEvtGenerator) SvcWarnEvent(svcKey, reason, msgFmt string,
+	args ...interface{}) {
+}
+
+// refusedAddr returns an address at which connections are refused.
+func refusedAddr(t *testing.T) vcl.Address {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return vcl.Address{IP: "127.0.0.1", Port: int32(port)}
+}
+
+func TestSvcLocks(t *testing.T) {
+	vc := &Controller{
+		log:     logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard}),
+		svcs:    make(map[string]*varnishSvc),
+		secrets: make(map[string]*admSecret),
+	}
+	svcA := vc.lockSvc("ns/a", true)
+
+	done := make(chan struct{})
+	go func() {
+		vc.HasConfig("ns/b", cafeSpec, ingsMeta, vcfgMeta, bcfgsMeta)
+		vc.lockSvc("ns/b", true).mtx.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Service ns/b blocked by the lock for Service ns/a")
+	}
+
+	got := make(chan *varnishSvc)
+	go func() {
+		svc := vc.lockSvc("ns/a", true)
+		svc.mtx.Unlock()
+		got <- svc
+	}()
+	vc.mtx.Lock()
+	delete(vc.svcs, "ns/a")
+	vc.mtx.Unlock()
+	svcA.deleted = true
+	svcA.mtx.Unlock()
+	if svc := <-got; svc == svcA {
+		t.Error("lockSvc() returned a deleted Service")
+	}
+	if keys := vc.svcKeys(); len(keys) != 2 || keys[0] != "ns/a" ||
+		keys[1] != "ns/b" {
+		t.Errorf("svcKeys() want=[ns/a ns/b] got=%v", keys)
+	}
+}
+
+// Run with go test -race.
+func TestConcurrentController(t *testing.T) {
+	if err := vcl.InitTemplates("vcl"); err != nil {
+		t.Fatal("Cannot parse templates:", err)
+	}
+	discard := logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard})
+	vc := &Controller{
+		log:     discard,
+		monLog:  discard,
+		svcEvt:  nopEvtGenerator{},
+		svcs:    make(map[string]*varnishSvc),
+		secrets: make(map[string]*admSecret),
+		wg:      new(sync.WaitGroup),
+	}
+	vc.SetUpdateConcurrency(2, 5*time.Second)
+	addrs := []vcl.Address{refusedAddr(t), refusedAddr(t)}
+	svcKeys := []string{"ns1/varnish", "ns2/varnish", "ns3/varnish"}
+	tenants := []Tenant{
+		{Name: "cafe", Spec: cafeSpec, Ings: ingsMeta},
+		{Name: "shuf", Spec: cafeSpecShuf},
+	}
+	iters := 10
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		for _, key := range svcKeys {
+			wg.Add(1)
+			go func(worker int, key string) {
+				defer wg.Done()
+				secrKey := strings.Split(key, "/")[0] + "/admin"
+				for i := 0; i < iters; i++ {
+					vc.SetAdmSecret(secrKey,
+						[]byte(fmt.Sprint("secret", i)))
+					vc.AddOrUpdateVarnishSvc(key,
+						addrs[:1+i%2], secrKey, true)
+					vc.Update(key, cafeSpec, ingsMeta,
+						vcfgMeta, bcfgsMeta)
+					if i%3 == 0 {
+						vc.UpdateTenants(key, tenants)
+					}
+					vc.HasConfig(key, cafeSpec, ingsMeta,
+						vcfgMeta, bcfgsMeta)
+					vc.UpdateSvcForSecret(key, secrKey)
+					vc.monitorSvc(key)
+					if worker == 0 && i == iters/2 {
+						vc.DeleteVarnishSvc(key)
+					}
+				}
+			}(worker, key)
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iters; i++ {
+			vc.SetRuntimeBackends(i%2 == 0)
+			vc.SetHistoryLen(uint(i))
+			vc.SetMaxLoadsPerMin(uint(100 * i))
+		}
+	}()
+	wg.Wait()
+	vc.Quit()
+
+	if keys := vc.svcKeys(); len(keys) != len(svcKeys) {
+		t.Errorf("Varnish Services want=%v got=%v", svcKeys, keys)
+	}
+	want := fmt.Sprint("secret", iters-1)
+	for _, key := range svcKeys {
+		svc := vc.lockSvc(key, false)
+		if svc == nil {
+			t.Errorf("Varnish Service %s not found", key)
+			continue
+		}
+		if n := len(svc.instances); n < 1 || n > len(addrs) {
+			t.Errorf("Varnish Service %s: %d instances", key, n)
+		}
+		for _, inst := range svc.instances {
+			if inst.admSecret == nil {
+				t.Errorf("%s: no admin secret", inst.addr)
+				continue
+			}
+			if got := string(inst.admSecret.get()); got != want {
+				t.Errorf("%s: admin secret want=%s got=%s",
+					inst.addr, want, got)
+			}
+		}
+		svc.mtx.Unlock()
+	}
+}
+
+func TestRecoverConfig(t *testing.T) {
+	cfg := "vk8s_ing_abc"
+	vcls := []admin.VCLData{
+		{Name: "boot", State: admin.ColdState},
+		{Name: readyCfg},
+		{Name: notAvailCfg},
+		{Name: cfg},
+		{Name: "vk8s_ing_old", State: admin.ColdState},
+		{Name: regularLabel, LabelVCL: cfg},
+		{Name: readinessLabel, LabelVCL: readyCfg},
+	}
+	active, ready := activeConfig(vcls)
+	if active != cfg || !ready {
+		t.Errorf("activeConfig() want=(%s, true) got=(%s, %v)", cfg,
+			active, ready)
+	}
+	vcls[len(vcls)-1].LabelVCL = notAvailCfg
+	if _, ready = activeConfig(vcls); ready {
+		t.Error("activeConfig(not available) ready want=false " +
+			"got=true")
+	}
+	if active, _ = activeConfig(vcls[:3]); active != "" {
+		t.Errorf("activeConfig(no label) want=\"\" got=%s", active)
+	}
+	if !hasConfig(vcls, "vk8s_ing_old") {
+		t.Error("hasConfig(vk8s_ing_old) want=true got=false")
+	}
+	if hasConfig(vcls, regularLabel) || hasConfig(vcls, "vk8s_ing_xyz") {
+		t.Error("hasConfig(label or unknown config) want=false " +
+			"got=true")
+	}
+
+	insts := []*varnishInst{{addr: "192.0.2.1:6081"},
+		{addr: "192.0.2.2:6081"}}
+	actives := map[*varnishInst]string{insts[0]: cfg, insts[1]: cfg}
+	readies := map[*varnishInst]bool{insts[0]: true, insts[1]: true}
+	if got := commonConfig(actives, readies, insts); got != cfg {
+		t.Errorf("commonConfig() want=%s got=%s", cfg, got)
+	}
+	readies[insts[1]] = false
+	if got := commonConfig(actives, readies, insts); got != "" {
+		t.Errorf("commonConfig(not ready) want=\"\" got=%s", got)
+	}
+	readies[insts[1]] = true
+	actives[insts[1]] = "vk8s_ing_old"
+	if got := commonConfig(actives, readies, insts); got != "" {
+		t.Errorf("commonConfig(different configs) want=\"\" got=%s",
+			got)
+	}
+}
+
+func TestPinRecovered(t *testing.T) {
+	if err := vcl.InitTemplates("vcl"); err != nil {
+		t.Fatal("InitTemplates():", err)
+	}
+	discard := logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard})
+	vc := &Controller{
+		log:     discard,
+		monLog:  discard,
+		svcEvt:  nopEvtGenerator{},
+		svcs:    make(map[string]*varnishSvc),
+		secrets: make(map[string]*admSecret),
+		wg:      new(sync.WaitGroup),
+	}
+	key := "ns/varnish"
+	pin := "vk8s_ing_pinned"
+	addr := refusedAddr(t)
+	vc.SetHistoryLen(3)
+	vc.SetAdmSecret("ns/admin", []byte("secret"))
+	vc.AddOrUpdateVarnishSvc(key, []vcl.Address{addr}, "ns/admin", false)
+
+	svc := vc.lockSvc(key, false)
+	spec := &vclSpec{spec: cafeSpec}
+	svc.spec = spec
+	vc.setLoaded(svc, spec)
+	svc.loaded = nil
+	svc.pin = pin
+	if svc.pinRecovered() {
+		t.Error("pinRecovered() before setPinRecovered want=false " +
+			"got=true")
+	}
+	vc.setPinRecovered(svc)
+	if !svc.pinRecovered() {
+		t.Error("pinRecovered() after setPinRecovered want=true " +
+			"got=false")
+	}
+	if len(svc.history) != 2 || svc.history[0].name != pin ||
+		svc.history[1].name != spec.configName() {
+		t.Errorf("setPinRecovered() history=%+v", svc.history)
+	}
+	if svc.histEntry(pin) != nil {
+		t.Error("histEntry(placeholder) want=nil")
+	}
+	if _, ok := svc.retained()[pin]; !ok {
+		t.Errorf("retained() does not include %s", pin)
+	}
+
+	// The instance refuses connections, so an update succeeds only if
+	// recoverState is not run again.
+	for i := 0; i < 2; i++ {
+		if err := vc.updateVarnishSvc(key, svc); err != nil {
+			t.Errorf("updateVarnishSvc() #%d with recovered pin: %v",
+				i+1, err)
+		}
+		if !svc.cfgLoaded || svc.pin != pin || svc.loaded != nil {
+			t.Errorf("updateVarnishSvc() #%d with recovered pin: "+
+				"cfgLoaded=%v pin=%s loaded=%v", i+1,
+				svc.cfgLoaded, svc.pin, svc.loaded)
+		}
+	}
+	svc.mtx.Unlock()
+
+	// An added instance clears the placeholder, so that the pinned
+	// config is recovered again.
+	vc.AddOrUpdateVarnishSvc(key, []vcl.Address{addr, refusedAddr(t)},
+		"ns/admin", false)
+	svc = vc.lockSvc(key, false)
+	defer svc.mtx.Unlock()
+	if svc.pinRecovered() {
+		t.Error("pinRecovered() after instance added want=false " +
+			"got=true")
+	}
+	if len(svc.history) != 1 ||
+		svc.history[0].name != spec.configName() {
+		t.Errorf("clearPinRecovered() history=%+v", svc.history)
+	}
+	if err := vc.updateVarnishSvc(key, svc); err == nil {
+		t.Error("updateVarnishSvc() with unreachable instances after " +
+			"placeholder cleared: expected error")
+	}
+	if svc.pin != "" || svc.pinMissing != pin {
+		t.Errorf("updateVarnishSvc() unrecoverable pin: pin=%s "+
+			"pinMissing=%s", svc.pin, svc.pinMissing)
+	}
+}
+
+func TestCheckMonitor(t *testing.T) {
+	vc := &Controller{opts: updateSettings{monIntvl: time.Second}}
+	if err := vc.CheckMonitor(time.Second); err != nil {
+		t.Errorf("CheckMonitor() before monitor start: %v", err)
+	}
+
+	vc.monBeat = time.Now().UnixNano()
+	if err := vc.CheckMonitor(time.Second); err != nil {
+		t.Errorf("CheckMonitor() after recent iteration: %v", err)
+	}
+
+	vc.monBeat = time.Now().Add(-3 * time.Second).UnixNano()
+	if err := vc.CheckMonitor(time.Second); err == nil {
+		t.Error("CheckMonitor() for stopped monitor: expected error")
+	}
+	if err := vc.CheckMonitor(0); err != nil {
+		t.Errorf("CheckMonitor() with timeout 0: %v", err)
+	}
+
+	vc.opts.monIntvl = 0
+	if err := vc.CheckMonitor(time.Second); err != nil {
+		t.Errorf("CheckMonitor() with monitor deactivated: %v", err)
+	}
+}
+
+func TestServiceState(t *testing.T) {
+	vc := &Controller{
+		log:     logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard}),
+		svcs:    make(map[string]*varnishSvc),
+		secrets: make(map[string]*admSecret),
+	}
+	if state := vc.ServiceState("ns/none", false); state != nil {
+		t.Errorf("ServiceState() for unknown Service: %+v", state)
+	}
+
+	spec := &vclSpec{
+		spec: cafeSpec,
+		ings: ingsMeta,
+		vcfg: vcfgMeta,
+		bcfg: bcfgsMeta,
+	}
+	insts := []*varnishInst{
+		&varnishInst{addr: "192.0.2.1:6081"},
+		&varnishInst{addr: "192.0.2.2:6081"},
+	}
+	svc := vc.lockSvc("ns/varnish", true)
+	svc.spec = spec
+	svc.instances = insts
+	instResults{
+		{inst: insts[0]},
+		{inst: insts[1], err: fmt.Errorf("VCL compilation failed")},
+	}.record(loadPhase, spec.configName())
+	svc.mtx.Unlock()
+
+	if names := vc.ServiceNames(); len(names) != 1 ||
+		names[0] != "ns/varnish" {
+		t.Errorf("ServiceNames() want=[ns/varnish] got=%v", names)
+	}
+	state := vc.ServiceState("ns/varnish", false)
+	if state == nil {
+		t.Fatal("ServiceState() returned nil")
+	}
+	if state.Config != spec.configName() {
+		t.Errorf("ServiceState() config want=%s got=%s",
+			spec.configName(), state.Config)
+	}
+	if state.Spec == nil ||
+		state.Spec.DeepHash() != cafeSpec.DeepHash() {
+		t.Errorf("ServiceState() spec want=%+v got=%+v", cafeSpec,
+			state.Spec)
+	}
+
+	svc = vc.lockSvc("ns/varnish", false)
+	authSpec := cafeSpec
+	authSpec.Auths = []vcl.Auth{{
+		Realm:       "cafe",
+		Credentials: []string{"Zm9vOmJhcg=="},
+		Status:      vcl.Basic,
+	}}
+	svc.spec = &vclSpec{spec: authSpec}
+	svc.mtx.Unlock()
+	state = vc.ServiceState("ns/varnish", false)
+	if state == nil || len(state.Spec.Auths) != 1 ||
+		state.Spec.Auths[0].Credentials[0] != redactedCred {
+		t.Errorf("ServiceState() credentials not redacted: %+v",
+			state)
+	}
+	if authSpec.Auths[0].Credentials[0] != "Zm9vOmJhcg==" {
+		t.Error("ServiceState() redaction modified the spec")
+	}
+	src, err := vc.ServiceVCL("ns/varnish")
+	if err != nil {
+		t.Fatal("ServiceVCL():", err)
+	}
+	if strings.Contains(src, "Zm9vOmJhcg==") ||
+		!strings.Contains(src, redactedCred) {
+		t.Error("ServiceVCL() credentials not redacted")
+	}
+	svc = vc.lockSvc("ns/varnish", false)
+	svc.spec = spec
+	svc.mtx.Unlock()
+	state = vc.ServiceState("ns/varnish", false)
+	if len(state.VarnishConfigs) != 1 ||
+		state.VarnishConfigs[0] != vcfgMeta.Configs[0] {
+		t.Errorf("ServiceState() VarnishConfigs want=%+v got=%+v",
+			vcfgMeta.Configs, state.VarnishConfigs)
+	}
+	if len(state.Ingresses) != len(ingsMeta) ||
+		len(state.BackendConfigs) != len(bcfgsMeta) {
+		t.Errorf("ServiceState() Ingresses=%v BackendConfigs=%v",
+			state.Ingresses, state.BackendConfigs)
+	}
+	if len(state.Instances) != 2 {
+		t.Fatalf("ServiceState() instances want=2 got=%d",
+			len(state.Instances))
+	}
+	for i, inst := range state.Instances {
+		if inst.Addr != insts[i].addr {
+			t.Errorf("ServiceState() instance %d addr want=%s "+
+				"got=%s", i, insts[i].addr, inst.Addr)
+		}
+		if inst.LastUpdate == nil ||
+			inst.LastUpdate.Phase != loadPhase ||
+			inst.LastUpdate.Config != spec.configName() {
+			t.Errorf("ServiceState() instance %d last update: %+v",
+				i, inst.LastUpdate)
+		}
+	}
+	if state.Instances[0].LastUpdate.Error != "" ||
+		state.Instances[1].LastUpdate.Error == "" {
+		t.Errorf("ServiceState() last update errors: %q %q",
+			state.Instances[0].LastUpdate.Error,
+			state.Instances[1].LastUpdate.Error)
+	}
+}
+
+func TestTenantErrors(t *testing.T) {
+	errs := TenantErrors{
+		"tea":    fmt.Errorf("VCL compilation failed"),
+		"coffee": fmt.Errorf("Deadline exceeded"),
+	}
+	want := "tenant coffee: Deadline exceeded; " +
+		"tenant tea: VCL compilation failed"
+	if got := errs.Error(); got != want {
+		t.Errorf("TenantErrors.Error() want=%q got=%q", want, got)
+	}
+}
+
+func TestUpdateTenants(t *testing.T) {
+	if err := vcl.InitTemplates("vcl"); err != nil {
+		t.Fatal("Cannot parse templates:", err)
+	}
+	discard := logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard})
+	vc := &Controller{
+		log:     discard,
+		monLog:  discard,
+		svcEvt:  nopEvtGenerator{},
+		svcs:    make(map[string]*varnishSvc),
+		secrets: make(map[string]*admSecret),
+		wg:      new(sync.WaitGroup),
+	}
+	key := "ns/varnish"
+	tenants := []Tenant{
+		{Name: "cafe", Spec: cafeSpec, Ings: ingsMeta, Vcfg: vcfgMeta},
+		{Name: "tea", Err: fmt.Errorf("no such Service")},
+	}
+	if err := vc.UpdateTenants(key, tenants); err == nil {
+		t.Error("UpdateTenants() with no instances: expected error")
+	}
+
+	vc.SetAdmSecret("ns/admin", []byte("secret"))
+	vc.AddOrUpdateVarnishSvc(key, []vcl.Address{refusedAddr(t)},
+		"ns/admin", false)
+	if err := vc.UpdateTenants(key, tenants); err == nil {
+		t.Error("UpdateTenants() with unreachable instance: " +
+			"expected error")
+	}
+	if vc.HasConfig(key, cafeSpec, ingsMeta, vcfgMeta, nil) {
+		t.Error("HasConfig() true for isolated tenants")
+	}
+	if !vc.Isolated(key) {
+		t.Error("Isolated() false after UpdateTenants()")
+	}
+
+	state := vc.ServiceState(key, false)
+	if state == nil || len(state.Tenants) != 2 {
+		t.Fatalf("ServiceState() tenants: %+v", state)
+	}
+	cafe, tea := state.Tenants[0], state.Tenants[1]
+	if cafe.Name != "cafe" || cafe.Label != vcl.TenantLabel("cafe") {
+		t.Errorf("ServiceState() tenant: %+v", cafe)
+	}
+	spec := vclSpec{spec: cafeSpec}
+	if cafe.Config != spec.configName() || cafe.Loaded != "" ||
+		cafe.Error == "" {
+		t.Errorf("ServiceState() tenant cafe: %+v", cafe)
+	}
+	if len(cafe.VarnishConfigs) != 1 ||
+		cafe.VarnishConfigs[0] != vcfgMeta.Configs[0] {
+		t.Errorf("ServiceState() tenant cafe VarnishConfigs: %+v",
+			cafe.VarnishConfigs)
+	}
+	if tea.Name != "tea" || tea.Config != "" || tea.Error == "" {
+		t.Errorf("ServiceState() tenant tea: %+v", tea)
+	}
+	if state.Spec != nil || state.Dispatch != "" {
+		t.Errorf("ServiceState() spec=%+v dispatch=%s", state.Spec,
+			state.Dispatch)
+	}
+
+	// A tenant whose spec cannot be generated keeps its loaded
+	// config.
+	svc := vc.lockSvc(key, false)
+	svc.tenants["cafe"].loaded = svc.tenants["cafe"].spec
+	loaded := svc.tenants["cafe"].loaded
+	svc.setTenants([]Tenant{
+		{Name: "cafe", Err: fmt.Errorf("no such Service")},
+	})
+	if cafe := svc.tenants["cafe"]; cafe.loaded != loaded ||
+		cafe.spec != loaded || cafe.err == nil {
+		t.Errorf("setTenants() with error: %+v", cafe)
+	}
+	if _, ok := svc.retained()[loaded.configName()]; !ok {
+		t.Errorf("retained() does not include the loaded tenant " +
+			"config")
+	}
+	svc.mtx.Unlock()
+
+	vc.Update(key, cafeSpec, ingsMeta, vcfgMeta, nil)
+	if state = vc.ServiceState(key, false); len(state.Tenants) != 0 ||
+		state.Spec == nil {
+		t.Errorf("ServiceState() after Update(): tenants=%+v spec=%+v",
+			state.Tenants, state.Spec)
+	}
+	if vc.Isolated(key) {
+		t.Error("Isolated() true after Update()")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package vcl
+
+// addrSet returns the set of addresses of a Service.
+func addrSet(svc Service) map[Address]struct{} {
+	set := make(map[Address]struct{}, len(svc.Addresses))
+	for _, addr := range svc.Addresses {
+		set[addr] = struct{}{}
+	}
+	return set
+}
+
+// subsetOf returns a copy of svc whose Addresses are replaced by the
+// Addresses of loaded, and true, if the addresses of svc are a subset
+// of the addresses of loaded. Otherwise the second return value is
+// false.
+func (svc Service) subsetOf(loaded Service) (Service, bool) {
+	loadedAddrs := addrSet(loaded)
+	for _, addr := range svc.Addresses {
+		if _, ok := loadedAddrs[addr]; !ok {
+			return svc, false
+		}
+	}
+	svc.Addresses = loaded.Addresses
+	return svc, true
+}
+
+// RuntimeBackends determines if the differences between spec and
+// loaded, the Spec from which a currently loaded VCL configuration
+// was generated, are limited to the removal (or re-addition) of
+// Service endpoints that are declared as backends in the loaded
+// VCL. If so, spec can be implemented without loading a new
+// configuration, by setting the health of backends in the loaded
+// VCL at runtime.
+//
+// If the second return value is true, the map is indexed by the
+// names of all backends declared for Services in the loaded VCL,
+// mapped to true if the backend is to be used (its health set to
+// auto), or false if it is to be set to sick. If the second return
+// value is false, then a new VCL configuration must be loaded.
+func (spec Spec) RuntimeBackends(loaded Spec) (map[string]bool, bool) {
+	if len(spec.AllServices) != len(loaded.AllServices) {
+		return nil, false
+	}
+	subst := spec
+	subst.AllServices = make(map[string]Service, len(spec.AllServices))
+	for name, svc := range spec.AllServices {
+		loadedSvc, exists := loaded.AllServices[name]
+		if !exists {
+			return nil, false
+		}
+		substSvc, ok := svc.subsetOf(loadedSvc)
+		if !ok {
+			return nil, false
+		}
+		subst.AllServices[name] = substSvc
+	}
+	if spec.DefaultService.Name != "" {
+		var ok bool
+		subst.DefaultService, ok = spec.DefaultService.subsetOf(
+			loaded.AllServices[spec.DefaultService.Name])
+		if !ok {
+			return nil, false
+		}
+	}
+	subst.Rules = make([]Rule, len(spec.Rules))
+	for i, rule := range spec.Rules {
+		subst.Rules[i] = Rule{
+			Host:    rule.Host,
+			PathMap: make(map[string]Service, len(rule.PathMap)),
+		}
+		for path, svc := range rule.PathMap {
+			substSvc, ok := svc.subsetOf(loaded.AllServices[svc.Name])
+			if !ok {
+				return nil, false
+			}
+			subst.Rules[i].PathMap[path] = substSvc
+		}
+	}
+	if subst.Canonical().DeepHash() != loaded.Canonical().DeepHash() {
+		return nil, false
+	}
+
+	states := make(map[string]bool)
+	for name, loadedSvc := range loaded.AllServices {
+		addrs := addrSet(spec.AllServices[name])
+		for _, addr := range loadedSvc.Addresses {
+			_, healthy := addrs[addr]
+			states[backendName(loadedSvc, addr.IP)] = healthy
+		}
+	}
+	return states, true
+}
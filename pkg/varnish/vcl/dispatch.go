@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package vcl
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// Route directs requests to the VCL config of a tenant of a Varnish
+// Service whose tenants are isolated, see Dispatch.
+//
+//    Label: the VCL label of the tenant's config (see TenantLabel)
+//    Hosts: the hosts in the Ingress rules of the tenant
+//    Default: true if the tenant defines the default backend
+type Route struct {
+	Label   string
+	Hosts   []string
+	Default bool
+}
+
+// Dispatch specifies the dispatcher config for a Varnish Service
+// whose tenants are isolated. The config for each tenant is loaded
+// separately under a label, and the dispatcher, which is the active
+// config, sends requests to the tenant by the Host header with
+// return(vcl(label)). Requests whose Host is not in any Route are
+// sent to the tenant with the default backend, if any, or receive a
+// 404 response. As in the boot config, readiness checks are sent to
+// the readiness label.
+type Dispatch struct {
+	Routes []Route
+}
+
+// TenantLabel returns the VCL label for the config of the tenant
+// identified by name.
+func TenantLabel(name string) string {
+	return mangle("tenant_" + name)
+}
+
+type hostRoute struct {
+	Host  string
+	Label string
+}
+
+type dispatchData struct {
+	Hosts   []hostRoute
+	Default string
+}
+
+// data returns the data for the dispatch template, with the hosts in
+// sorted order.
+func (d Dispatch) data() (dispatchData, error) {
+	var data dispatchData
+	for _, route := range d.Routes {
+		if route.Default {
+			if data.Default != "" {
+				return data, fmt.Errorf("Default backend "+
+					"defined for more than one tenant: "+
+					"%s and %s", data.Default, route.Label)
+			}
+			data.Default = route.Label
+		}
+		for _, host := range route.Hosts {
+			data.Hosts = append(data.Hosts, hostRoute{
+				Host:  host,
+				Label: route.Label,
+			})
+		}
+	}
+	sort.Slice(data.Hosts, func(i, j int) bool {
+		return data.Hosts[i].Host < data.Hosts[j].Host
+	})
+	for i := 1; i < len(data.Hosts); i++ {
+		if data.Hosts[i].Host == data.Hosts[i-1].Host {
+			return data, fmt.Errorf("Host %s defined for more than "+
+				"one tenant: %s and %s", data.Hosts[i].Host,
+				data.Hosts[i-1].Label, data.Hosts[i].Label)
+		}
+	}
+	return data, nil
+}
+
+// GetSrc returns the VCL source of the dispatcher config. Returns an
+// error if a host, or the default backend, is defined for more than
+// one tenant.
+func (d Dispatch) GetSrc() (string, error) {
+	data, err := d.data()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = dispatchTmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// DeepHash returns a hash for the dispatcher config, which is the
+// same for Dispatches that route the same hosts to the same labels.
+func (d Dispatch) DeepHash() string {
+	hash := sha512.New512_224()
+	data, _ := d.data()
+	for _, host := range data.Hosts {
+		hash.Write([]byte(host.Host))
+		hash.Write([]byte(host.Label))
+	}
+	hash.Write([]byte(data.Default))
+	h := new(big.Int)
+	h.SetBytes(hash.Sum(nil))
+	return h.Text(62)
+}
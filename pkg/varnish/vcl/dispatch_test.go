@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package vcl
+
+import (
+	"strings"
+	"testing"
+)
+
+var dispatch = Dispatch{
+	Routes: []Route{
+		{
+			Label: TenantLabel("tea"),
+			Hosts: []string{"tea.example.com"},
+		},
+		{
+			Label:   TenantLabel("coffee"),
+			Hosts:   []string{"coffee.example.com", "cafe.example.com"},
+			Default: true,
+		},
+	},
+}
+
+func TestDispatch(t *testing.T) {
+	gold := "dispatch.golden"
+
+	vcl, err := dispatch.GetSrc()
+	if err != nil {
+		t.Fatal("GetSrc():", err)
+	}
+
+	ok, err := cmpGold([]byte(vcl), gold)
+	if err != nil {
+		t.Fatalf("Reading %s: %v", gold, err)
+	}
+	if !ok {
+		t.Errorf("Generated VCL for dispatch does not match gold "+
+			"file: %s", gold)
+		if testing.Verbose() {
+			t.Log("Generated: ", vcl)
+		}
+	}
+
+	shuf := Dispatch{Routes: []Route{dispatch.Routes[1], dispatch.Routes[0]}}
+	if shuf.DeepHash() != dispatch.DeepHash() {
+		t.Error("DeepHash(): Equivalent dispatches have unequal hashes")
+	}
+	if (Dispatch{}).DeepHash() == dispatch.DeepHash() {
+		t.Error("DeepHash(): Distinct dispatches have equal hashes")
+	}
+
+	empty, err := Dispatch{}.GetSrc()
+	if err != nil {
+		t.Fatal("GetSrc() for no routes:", err)
+	}
+	if strings.Contains(empty, "vk8s_tenant_hosts") ||
+		!strings.Contains(empty, "return (synth(404));") {
+		t.Errorf("GetSrc() for no routes: unexpected source: %s",
+			empty)
+	}
+}
+
+func TestDispatchConflicts(t *testing.T) {
+	for _, d := range []Dispatch{
+		{Routes: []Route{
+			{Label: "a", Hosts: []string{"cafe.example.com"}},
+			{Label: "b", Hosts: []string{"cafe.example.com"}},
+		}},
+		{Routes: []Route{
+			{Label: "a", Default: true},
+			{Label: "b", Default: true},
+		}},
+	} {
+		if _, err := d.GetSrc(); err == nil {
+			t.Errorf("GetSrc(%+v): expected error", d)
+		}
+	}
+}
+
+func TestTenantLabel(t *testing.T) {
+	for _, name := range []string{"cafe", "cafe/tea-ingress",
+		"a-very-long-namespace-name-for-a-tenant/and-ingress"} {
+
+		label := TenantLabel(name)
+		if !strings.HasPrefix(label, "vk8s_tenant_") {
+			t.Errorf("TenantLabel(%s)=%s: missing prefix", name,
+				label)
+		}
+		if len(label) > maxSymLen {
+			t.Errorf("TenantLabel(%s)=%s: too long", name, label)
+		}
+		if vclIllegal.MatchString(label) {
+			t.Errorf("TenantLabel(%s)=%s: illegal characters",
+				name, label)
+		}
+	}
+	if TenantLabel("cafe/a.b") == TenantLabel("cafe/a-b") {
+		t.Error("TenantLabel(): distinct names have equal labels")
+	}
+}
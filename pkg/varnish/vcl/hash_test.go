@@ -127,6 +127,30 @@ func TestCanoncial(t *testing.T) {
 	}
 }
 
+func TestSnippetHash(t *testing.T) {
+	spec := snippetSpec
+	spec.Snippets = make([]Snippet, len(snippetSpec.Snippets))
+	copy(spec.Snippets, snippetSpec.Snippets)
+	if spec.DeepHash() != snippetSpec.DeepHash() {
+		t.Error("DeepHash(): Equal specs have unequal hashes")
+	}
+	spec.Snippets[1].VCL = `	set resp.http.Hello = "snippet";`
+	if spec.DeepHash() == snippetSpec.DeepHash() {
+		t.Error("DeepHash(): Specs with distinct snippets have equal " +
+			"hashes")
+	}
+
+	copy(spec.Snippets, snippetSpec.Snippets)
+	for i, j := 0, len(spec.Snippets)-1; i < j; i, j = i+1, j-1 {
+		spec.Snippets[i], spec.Snippets[j] =
+			spec.Snippets[j], spec.Snippets[i]
+	}
+	if !reflect.DeepEqual(spec.Canonical().Snippets, snippetSpec.Snippets) {
+		t.Errorf("Canonical(): snippets not ordered by priority and "+
+			"name: %+v", spec.Canonical().Snippets)
+	}
+}
+
 var names = []string{
 	"vk8s_cafe_example_com_url",
 	"vk8s_very_long_name_that_breaks_the_symbol_length_upper_bound",
@@ -145,3 +169,64 @@ func TestBound(t *testing.T) {
 		}
 	}
 }
+
+func TestRuntimeBackends(t *testing.T) {
+	loaded := Spec{
+		Rules: []Rule{{
+			Host: "cafe.example.com",
+			PathMap: map[string]Service{
+				"/tea": teaSvc,
+			},
+		}},
+		AllServices: map[string]Service{"tea-svc": teaSvc},
+	}
+
+	removed := teaSvc
+	removed.Addresses = teaSvc.Addresses[1:]
+	spec := Spec{
+		Rules: []Rule{{
+			Host: "cafe.example.com",
+			PathMap: map[string]Service{
+				"/tea": removed,
+			},
+		}},
+		AllServices: map[string]Service{"tea-svc": removed},
+	}
+	states, ok := spec.RuntimeBackends(loaded)
+	if !ok {
+		t.Fatal("RuntimeBackends(): endpoint removal not applicable " +
+			"at runtime")
+	}
+	if len(states) != len(teaSvc.Addresses) {
+		t.Errorf("RuntimeBackends(): got %d backend states, "+
+			"expected %d", len(states), len(teaSvc.Addresses))
+	}
+	for i, addr := range teaSvc.Addresses {
+		be := backendName(teaSvc, addr.IP)
+		healthy, exists := states[be]
+		if !exists {
+			t.Errorf("RuntimeBackends(): no state for %s", be)
+			continue
+		}
+		if healthy != (i != 0) {
+			t.Errorf("RuntimeBackends(): %s healthy=%v, expected "+
+				"%v", be, healthy, i != 0)
+		}
+	}
+
+	added := teaSvc
+	added.Addresses = append([]Address{{IP: "192.0.2.254", Port: 80}},
+		teaSvc.Addresses...)
+	spec.Rules[0].PathMap["/tea"] = added
+	spec.AllServices["tea-svc"] = added
+	if _, ok = spec.RuntimeBackends(loaded); ok {
+		t.Error("RuntimeBackends(): new endpoint applicable at runtime")
+	}
+
+	spec.Rules[0].PathMap["/tea"] = teaSvc
+	spec.AllServices["tea-svc"] = teaSvc
+	spec.Rules[0].Host = "tea.example.com"
+	if _, ok = spec.RuntimeBackends(loaded); ok {
+		t.Error("RuntimeBackends(): changed host applicable at runtime")
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package vcl
+
+import (
+	"fmt"
+	"sort"
+	"text/template"
+)
+
+const templateField = "spec.templates[%s]"
+
+// tmplSet is the set of templates that generate the VCL for a Spec:
+// the templates loaded by InitTemplates, with the replacements and
+// additions in Spec.Templates.
+//
+//    tmpls: templates indexed by name
+//    custom: names of the templates from Spec.Templates
+//    extra: names of the additional templates, in the order in
+//           which they are executed
+type tmplSet struct {
+	tmpls  map[string]*template.Template
+	custom map[string]bool
+	extra  []string
+}
+
+func (spec Spec) tmplSet(v Version) (tmplSet, error) {
+	set := tmplSet{
+		tmpls: map[string]*template.Template{
+			ingTmplSrc:     ingressTmpl,
+			shardTmplSrc:   shardTmpl,
+			authTmplSrc:    authTmpl,
+			aclTmplSrc:     aclTmpl,
+			rewriteTmplSrc: rewriteTmpl,
+			reqDispTmplSrc: reqDispTmpl,
+			snippetTmplSrc: snippetTmpl,
+		},
+		custom: make(map[string]bool, len(spec.Templates)),
+	}
+	for name, tmpl := range tmplsFor(v) {
+		set.tmpls[name] = tmpl
+	}
+	names := make([]string, 0, len(spec.Templates))
+	for name := range spec.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tmpl, err := template.New(name).Funcs(fMap).
+			Parse(spec.Templates[name])
+		if err != nil {
+			return set, fmt.Errorf("Cannot parse template %s: %v",
+				name, err)
+		}
+		if _, builtin := set.tmpls[name]; !builtin {
+			set.extra = append(set.extra, name)
+		}
+		set.tmpls[name] = tmpl
+		set.custom[name] = true
+	}
+	return set, nil
+}
+
+// origin returns the Origin for the code generated by the template
+// name, before any of the src* functions set marks within it.
+func (set tmplSet) origin(name string) Origin {
+	if !set.custom[name] {
+		return Origin{}
+	}
+	return Origin{
+		Kind:  VarnishConfigKind,
+		Field: fmt.Sprintf(templateField, name),
+	}
+}
+
+// validationSpec configures every feature of VCL generation, so that
+// every template executes all of its actions.
+var validationSpec = Spec{
+	DefaultService: Service{
+		Name:      "default-svc",
+		Addresses: []Address{{IP: "192.0.2.1", Port: 80}},
+	},
+	Rules: []Rule{{
+		Host: "example.com",
+		PathMap: map[string]Service{
+			"/": {
+				Name: "svc",
+				Addresses: []Address{
+					{IP: "192.0.2.2", Port: 80},
+				},
+			},
+		},
+	}},
+	AllServices: map[string]Service{
+		"svc": {
+			Name:      "svc",
+			Addresses: []Address{{IP: "192.0.2.2", Port: 80}},
+			Probe: &Probe{
+				URL:         "/healthz",
+				ExpResponse: 200,
+				Timeout:     "2s",
+				Interval:    "5s",
+				Initial:     "2",
+				Window:      "8",
+				Threshold:   "3",
+			},
+			Director:            &Director{Type: Shard, Warmup: 0.5},
+			HostHeader:          "example.com",
+			ConnectTimeout:      "1s",
+			FirstByteTimeout:    "2s",
+			BetweenBytesTimeout: "1s",
+			MaxConnections:      100,
+			ProxyHeader:         2,
+		},
+	},
+	ShardCluster: ShardCluster{
+		Nodes: []Service{{
+			Name:      "varnish-0",
+			Addresses: []Address{{IP: "192.0.2.3", Port: 80}},
+		}},
+		Probe: Probe{
+			Timeout:   "2s",
+			Interval:  "5s",
+			Initial:   "2",
+			Window:    "8",
+			Threshold: "3",
+		},
+		MaxSecondaryTTL: "5m",
+	},
+	Auths: []Auth{{
+		Realm:       "example",
+		Credentials: []string{"dXNlcjpwYXNz"},
+		Status:      Basic,
+		Conditions: []MatchTerm{{
+			Comparand: "req.http.Host",
+			Value:     "example.com",
+		}},
+	}},
+	ACLs: []ACL{{
+		Name:       "acl",
+		Comparand:  "client.ip",
+		FailStatus: 403,
+		Addresses:  []ACLAddress{{Addr: "192.0.2.0", MaskBits: 24}},
+		Conditions: []MatchTerm{{
+			Comparand: "req.url",
+			Value:     "/",
+		}},
+		ResultHdr: ResultHdrType{
+			Header:  "req.http.X-ACL",
+			Success: "match",
+			Failure: "no-match",
+		},
+	}},
+	Rewrites: []Rewrite{{
+		Rules:   []RewriteRule{{Value: "^/foo", Rewrite: "/bar"}},
+		Target:  "req.url",
+		Source:  "req.url",
+		Method:  Sub,
+		Compare: Match,
+		VCLSub:  Recv,
+	}},
+	Dispositions: []DispositionSpec{{
+		Conditions: []Condition{{
+			Values:    []string{"GET", "HEAD"},
+			Comparand: "req.method",
+			Compare:   Equal,
+			Negate:    true,
+		}},
+		Disposition: DispositionType{
+			Action: RecvSynth,
+			Status: 405,
+		},
+	}},
+	Snippets: []Snippet{
+		{Name: "before", Sub: "recv", Before: true, VCL: "\treturn (pass);"},
+		{Name: "after", Sub: "deliver", VCL: "\treturn (deliver);"},
+	},
+	VCL: "sub vcl_fini {\n\treturn (ok);\n}",
+}
+
+// ValidateTemplates returns an error if any of the templates in
+// srcs, as they would be specified in Spec.Templates, cannot be
+// parsed with the functions available for VCL generation, or cannot
+// be executed with the data model of a Spec. The templates are
+// executed for a Spec that configures every feature, so that errors
+// in actions that only run for some configurations are detected,
+// and for each version of Varnish for which templates were loaded.
+// This does not check the VCL that the templates generate.
+func ValidateTemplates(srcs map[string]string) error {
+	spec := validationSpec
+	spec.Templates = srcs
+	if _, _, err := spec.GetSrcMap(); err != nil {
+		return err
+	}
+	for _, set := range versionTmpls {
+		v := Version{Major: set.major}
+		if _, _, err := spec.GetSrcMapFor(v); err != nil {
+			return fmt.Errorf("Varnish %s: %v", v, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package vcl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTemplateOverride(t *testing.T) {
+	spec := srcMapSpec
+	spec.Templates = map[string]string{
+		"acl.tmpl": `{{range .ACLs}}
+# ACL {{.Name}} for {{.Comparand}}
+{{- end}}
+`,
+		"rules.tmpl": `
+sub vcl_deliver {
+	set resp.http.Rules = "{{len .Rules}}";
+}
+`,
+	}
+
+	src, srcMap, err := spec.GetSrcMap()
+	if err != nil {
+		t.Fatal("GetSrcMap():", err)
+	}
+	if !strings.Contains(src, "# ACL local for client.ip\n") {
+		t.Error("Generated VCL does not contain the overriding ACL " +
+			"template")
+	}
+	if strings.Contains(src, "acl vk8s_") {
+		t.Error("Generated VCL contains the replaced ACL template")
+	}
+	rules := strings.Index(src, `set resp.http.Rules = "1";`)
+	if rules == -1 {
+		t.Fatal("Generated VCL does not contain the additional " +
+			"template")
+	}
+	if custom := strings.Index(src, "resp.http.Hello"); custom < rules {
+		t.Error("Additional template not executed before custom VCL")
+	}
+
+	for _, tc := range []struct {
+		needle string
+		want   Origin
+	}{
+		{"# ACL local", Origin{
+			Kind:  VarnishConfigKind,
+			Field: "spec.templates[acl.tmpl]",
+		}},
+		{"resp.http.Rules", Origin{
+			Kind:  VarnishConfigKind,
+			Field: "spec.templates[rules.tmpl]",
+		}},
+		{"^/baz", Origin{
+			Kind:  VarnishConfigKind,
+			Field: "spec.rewrites[0].rules[1].value",
+		}},
+	} {
+		line, pos := vccCoord(src, tc.needle)
+		if got := srcMap.Lookup(line, pos); got != tc.want {
+			t.Errorf("Lookup(%d, %d) for %q: got %+v want %+v",
+				line, pos, tc.needle, got, tc.want)
+		}
+	}
+
+	if spec.DeepHash() == srcMapSpec.DeepHash() {
+		t.Error("DeepHash(): Specs with distinct templates have " +
+			"equal hashes")
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	if err := ValidateTemplates(nil); err != nil {
+		t.Errorf("ValidateTemplates(nil): %v", err)
+	}
+
+	good := []map[string]string{
+		{"acl.tmpl": `{{range .ACLs}}{{aclName .Name}}{{end}}`},
+		{"self-shard.tmpl": `{{range .Nodes}}# {{.Name}}{{end}}`},
+		{
+			"extra.tmpl": `{{range $svc := .AllServices}}` +
+				`{{srcBC $svc.Name "spec"}}{{$svc.Probe.URL}}` +
+				`{{end}}`,
+			"vcl.tmpl": `vcl 4.0;`,
+		},
+	}
+	for _, srcs := range good {
+		if err := ValidateTemplates(srcs); err != nil {
+			t.Errorf("ValidateTemplates(%v): %v", srcs, err)
+		}
+	}
+
+	bad := []map[string]string{
+		{"acl.tmpl": `{{range .ACLs}}`},
+		{"acl.tmpl": `{{noSuchFunc .ACLs}}`},
+		{"extra.tmpl": `{{.NoSuchField}}`},
+		{"extra.tmpl": `{{range .Rewrites}}{{.NoSuchField}}{{end}}`},
+		{"self-shard.tmpl": `{{range .Rules}}{{.Host}}{{end}}`},
+	}
+	for _, srcs := range bad {
+		if err := ValidateTemplates(srcs); err == nil {
+			t.Errorf("ValidateTemplates(%v): expected error got=nil",
+				srcs)
+		}
+	}
+}
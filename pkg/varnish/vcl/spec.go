@@ -747,6 +747,48 @@ func (reqDisp DispositionSpec) hash(hash hash.Hash) {
 	}
 }
 
+// Snippet is custom VCL code to be included in the built-in
+// subroutine vcl_<Sub>, derived from VarnishConfig.Spec.Snippets.
+//
+// If Before is true, the snippet is executed before any code
+// generated for the subroutine, otherwise after the generated
+// code. Snippets are included in the order of Priority, and then by
+// Name.
+type Snippet struct {
+	Name     string
+	Sub      string
+	Before   bool
+	Priority int32
+	VCL      string
+}
+
+func (snip Snippet) hash(hash hash.Hash) {
+	hash.Write([]byte(snip.Name))
+	hash.Write([]byte(snip.Sub))
+	if snip.Before {
+		hash.Write([]byte{1})
+	} else {
+		hash.Write([]byte{0})
+	}
+	prioBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(prioBytes, uint32(snip.Priority))
+	hash.Write(prioBytes)
+	hash.Write([]byte(snip.VCL))
+}
+
+// BySnippetOrder implements sort.Interface for []Snippet, ordering
+// the snippets by Priority, and then by Name.
+type BySnippetOrder []Snippet
+
+func (a BySnippetOrder) Len() int      { return len(a) }
+func (a BySnippetOrder) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a BySnippetOrder) Less(i, j int) bool {
+	if a[i].Priority != a[j].Priority {
+		return a[i].Priority < a[j].Priority
+	}
+	return a[i].Name < a[j].Name
+}
+
 // Spec is the specification for a VCL configuration derived from
 // Ingresses and VarnishConfig Custom Resources. This abstracts the
 // VCL to be loaded by all instances of a Varnish Service.
@@ -781,6 +823,15 @@ type Spec struct {
 	// disposition of client requests, derived from
 	// VarnishConfig.Spec.ReqDispositions.
 	Dispositions []DispositionSpec
+	// Snippets is a list of custom VCL snippets for built-in
+	// subroutines, derived from VarnishConfig.Spec.Snippets.
+	Snippets []Snippet
+	// Templates maps template names to the sources of templates
+	// that replace the templates of the same name loaded by
+	// InitTemplates, or that are executed in addition to them,
+	// derived from the ConfigMap named in
+	// VarnishConfig.Spec.Templates.
+	Templates map[string]string
 }
 
 // DeepHash computes a alphanumerically encoded hash value from a Spec
@@ -817,6 +868,18 @@ func (spec Spec) DeepHash() string {
 	for _, reqDisp := range spec.Dispositions {
 		reqDisp.hash(hash)
 	}
+	for _, snip := range spec.Snippets {
+		snip.hash(hash)
+	}
+	tmpls := make([]string, 0, len(spec.Templates))
+	for name := range spec.Templates {
+		tmpls = append(tmpls, name)
+	}
+	sort.Strings(tmpls)
+	for _, name := range tmpls {
+		hash.Write([]byte(name))
+		hash.Write([]byte(spec.Templates[name]))
+	}
 	h := new(big.Int)
 	h.SetBytes(hash.Sum(nil))
 	return h.Text(62)
@@ -837,6 +900,7 @@ func (spec Spec) Canonical() Spec {
 		ACLs:           make([]ACL, len(spec.ACLs)),
 		Rewrites:       make([]Rewrite, len(spec.Rewrites)),
 		Dispositions:   make([]DispositionSpec, len(spec.Dispositions)),
+		Snippets:       make([]Snippet, len(spec.Snippets)),
 	}
 	copy(canon.DefaultService.Addresses, spec.DefaultService.Addresses)
 	sort.Stable(byIPPort(canon.DefaultService.Addresses))
@@ -874,5 +938,13 @@ func (spec Spec) Canonical() Spec {
 			sort.Strings(cond.Values)
 		}
 	}
+	copy(canon.Snippets, spec.Snippets)
+	sort.Stable(BySnippetOrder(canon.Snippets))
+	if spec.Templates != nil {
+		canon.Templates = make(map[string]string, len(spec.Templates))
+		for name, src := range spec.Templates {
+			canon.Templates[name] = src
+		}
+	}
 	return canon
 }
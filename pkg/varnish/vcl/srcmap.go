@@ -0,0 +1,313 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package vcl
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/template"
+)
+
+// Kinds of resources from which parts of the VCL source are
+// generated.
+const (
+	// IngressKind for code generated from an Ingress rule
+	IngressKind = "Ingress"
+	// VarnishConfigKind for code generated from a VarnishConfig
+	VarnishConfigKind = "VarnishConfig"
+	// BackendConfigKind for code generated from a BackendConfig
+	BackendConfigKind = "BackendConfig"
+
+	customVCLField = "spec.vcl"
+	snippetField   = "spec.snippets[name=%s]"
+)
+
+// Origin identifies the configuration from which a part of the
+// generated VCL source was derived.
+//
+//    Kind: IngressKind, VarnishConfigKind or BackendConfigKind;
+//          empty for code that is generated for every
+//          configuration
+//    Name: the host of an Ingress rule, or the name of the Service
+//          to which a BackendConfig applies
+//    Field: the path of a field in the VarnishConfig or
+//           BackendConfig spec, such as
+//           spec.rewrites[2].rules[0].rewrite, or the path of an
+//           Ingress rule
+type Origin struct {
+	Kind  string
+	Name  string
+	Field string
+}
+
+func (o Origin) String() string {
+	switch o.Kind {
+	case "":
+		return "generated VCL"
+	case IngressKind:
+		s := fmt.Sprintf("Ingress rule for host %q", o.Name)
+		if o.Field != "" {
+			s += fmt.Sprintf(" path %q", o.Field)
+		}
+		return s
+	case BackendConfigKind:
+		return fmt.Sprintf("BackendConfig for Service %s %s", o.Name,
+			o.Field)
+	default:
+		return o.Kind + " " + o.Field
+	}
+}
+
+// srcMark records the Origin of the source beginning at line and
+// pos. If lines is true, the source following the mark is copied
+// verbatim from the field, and Lookup names the line in the field.
+type srcMark struct {
+	line   int
+	pos    int
+	origin Origin
+	lines  bool
+}
+
+// SrcMap maps positions in the VCL source generated for a Spec to
+// the configuration from which they were derived. See GetSrcMap.
+type SrcMap struct {
+	marks []srcMark
+}
+
+// Lookup returns the Origin of the VCL source at line and pos, as
+// reported by the VCL compiler: both count from 1, and tabs advance
+// pos to the next multiple of 8. For the custom VCL and VCL
+// snippets in VarnishConfig, the Field names the line in spec.vcl,
+// or in the snippet.
+func (m SrcMap) Lookup(line, pos int) Origin {
+	i := sort.Search(len(m.marks), func(i int) bool {
+		mark := m.marks[i]
+		return mark.line > line || (mark.line == line && mark.pos > pos)
+	})
+	if i == 0 {
+		return Origin{}
+	}
+	mark := m.marks[i-1]
+	origin := mark.origin
+	if mark.lines {
+		origin.Field = fmt.Sprintf("%s line %d", origin.Field,
+			line-mark.line+1)
+	}
+	return origin
+}
+
+// Location of an error in an inline VCL source, as reported by the
+// VCL compiler.
+var vccLoc = regexp.MustCompile(`\('<vcl\.inline>' Line (\d+) Pos (\d+)\)`)
+
+// Origins returns the Origins of the locations in the generated VCL
+// source that are reported in msg, an error message from the VCL
+// compiler, in the order in which they appear, without duplicates.
+func (m SrcMap) Origins(msg string) []Origin {
+	var origins []Origin
+	seen := make(map[Origin]bool)
+	for _, loc := range vccLoc.FindAllStringSubmatch(msg, -1) {
+		line, err := strconv.Atoi(loc[1])
+		if err != nil {
+			continue
+		}
+		pos, err := strconv.Atoi(loc[2])
+		if err != nil {
+			continue
+		}
+		origin := m.Lookup(line, pos)
+		if !seen[origin] {
+			seen[origin] = true
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// srcWriter collects the generated VCL source, and keeps track of
+// the current line and position as counted by the VCL compiler, at
+// which marks for the SrcMap are set while the templates execute.
+type srcWriter struct {
+	buf  bytes.Buffer
+	line int
+	pos  int
+	m    SrcMap
+	ver  Version
+}
+
+func (w *srcWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		switch b {
+		case '\n':
+			w.line++
+			w.pos = 0
+		case '\t':
+			w.pos = w.pos&^7 + 8
+		default:
+			w.pos++
+		}
+	}
+	return w.buf.Write(p)
+}
+
+func (w *srcWriter) mark(origin Origin) string {
+	w.m.marks = append(w.m.marks, srcMark{
+		line:   w.line,
+		pos:    w.pos + 1,
+		origin: origin,
+	})
+	return ""
+}
+
+func (w *srcWriter) markLines(origin Origin) string {
+	w.mark(origin)
+	w.m.marks[len(w.m.marks)-1].lines = true
+	return ""
+}
+
+// The template functions that set marks in the SrcMap. When templates
+// are executed without a srcWriter, the versions in fMap are used,
+// which do nothing.
+func (w *srcWriter) funcs() template.FuncMap {
+	return template.FuncMap{
+		"srcGen": func() string { return w.mark(Origin{}) },
+		"srcIng": func(host, path string) string {
+			return w.mark(Origin{
+				Kind:  IngressKind,
+				Name:  host,
+				Field: path,
+			})
+		},
+		"srcVC": func(format string, args ...interface{}) string {
+			return w.mark(Origin{
+				Kind:  VarnishConfigKind,
+				Field: fmt.Sprintf(format, args...),
+			})
+		},
+		"srcBC": func(svc, field string) string {
+			return w.mark(Origin{
+				Kind:  BackendConfigKind,
+				Name:  svc,
+				Field: field,
+			})
+		},
+		"srcSnip": func(name string) string {
+			return w.markLines(Origin{
+				Kind:  VarnishConfigKind,
+				Field: fmt.Sprintf(snippetField, name),
+			})
+		},
+		"vclSyntax":    func() string { return w.ver.vclSyntax() },
+		"varnishMajor": func() int { return w.ver.Major },
+	}
+}
+
+func (w *srcWriter) exec(set tmplSet, name string, data interface{}) error {
+	w.mark(set.origin(name))
+	clone, err := set.tmpls[name].Clone()
+	if err != nil {
+		return err
+	}
+	return clone.Funcs(w.funcs()).Execute(w, data)
+}
+
+// GetSrcMap returns the VCL generated to implement a Spec, and a map
+// from positions in the source to the configuration from which they
+// were derived, to identify the fields that cause errors reported by
+// the VCL compiler. The VCL is generated for an unknown version of
+// Varnish, with the default templates.
+func (spec Spec) GetSrcMap() (string, SrcMap, error) {
+	return spec.GetSrcMapFor(Version{})
+}
+
+// GetSrcMapFor returns the VCL source and SrcMap for a Spec, as
+// GetSrcMap does, generated for Varnish version v. Returns an error if
+// the version is not supported: a major version later than 6, for
+// which no templates were loaded from a varnish-N subdirectory of the
+// template directory.
+func (spec Spec) GetSrcMapFor(v Version) (string, SrcMap, error) {
+	w := &srcWriter{line: 1, ver: v}
+	if err := v.supported(); err != nil {
+		return "", w.m, err
+	}
+	set, err := spec.tmplSet(v)
+	if err != nil {
+		return "", w.m, err
+	}
+	if err := w.exec(set, ingTmplSrc, spec); err != nil {
+		return "", w.m, err
+	}
+	if len(spec.ShardCluster.Nodes) > 0 {
+		err := w.exec(set, shardTmplSrc, spec.ShardCluster)
+		if err != nil {
+			return "", w.m, err
+		}
+	}
+	if len(spec.ACLs) > 0 {
+		if err := w.exec(set, aclTmplSrc, spec); err != nil {
+			return "", w.m, err
+		}
+	}
+	if len(spec.Auths) > 0 {
+		if err := w.exec(set, authTmplSrc, spec); err != nil {
+			return "", w.m, err
+		}
+	}
+	if len(spec.Rewrites) > 0 {
+		if err := w.exec(set, rewriteTmplSrc, spec); err != nil {
+			return "", w.m, err
+		}
+	}
+	if len(spec.Dispositions) > 0 {
+		if err := w.exec(set, reqDispTmplSrc, spec); err != nil {
+			return "", w.m, err
+		}
+	}
+	for _, snip := range spec.Snippets {
+		if !snip.Before {
+			if err := w.exec(set, snippetTmplSrc, spec); err != nil {
+				return "", w.m, err
+			}
+			break
+		}
+	}
+	for _, name := range set.extra {
+		if err := w.exec(set, name, spec); err != nil {
+			return "", w.m, err
+		}
+	}
+	if spec.VCL != "" {
+		w.markLines(Origin{Kind: VarnishConfigKind, Field: customVCLField})
+		w.Write([]byte(spec.VCL))
+	}
+	return w.buf.String(), w.m, nil
+}
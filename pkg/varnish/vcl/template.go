@@ -29,7 +29,6 @@
 package vcl
 
 import (
-	"bytes"
 	"fmt"
 	"hash/fnv"
 	"math/big"
@@ -139,15 +138,28 @@ var fMap = template.FuncMap{
 	"reqNeedsMatcher": func(cond Condition) bool {
 		return reqNeedsMatcher(cond)
 	},
+	"srcGen": func() string { return "" },
+	"srcIng": func(host, path string) string { return "" },
+	"srcVC": func(format string, args ...interface{}) string {
+		return ""
+	},
+	"srcBC":   func(svc, field string) string { return "" },
+	"srcSnip": func(name string) string { return "" },
+	"vclSyntax": func() string {
+		return Version{}.vclSyntax()
+	},
+	"varnishMajor": func() int { return 0 },
 }
 
 const (
-	ingTmplSrc     = "vcl.tmpl"
-	shardTmplSrc   = "self-shard.tmpl"
-	authTmplSrc    = "auth.tmpl"
-	aclTmplSrc     = "acl.tmpl"
-	rewriteTmplSrc = "rewrite.tmpl"
-	reqDispTmplSrc = "recv_disposition.tmpl"
+	ingTmplSrc      = "vcl.tmpl"
+	shardTmplSrc    = "self-shard.tmpl"
+	authTmplSrc     = "auth.tmpl"
+	aclTmplSrc      = "acl.tmpl"
+	rewriteTmplSrc  = "rewrite.tmpl"
+	reqDispTmplSrc  = "recv_disposition.tmpl"
+	snippetTmplSrc  = "snippet.tmpl"
+	dispatchTmplSrc = "dispatch.tmpl"
 
 	// maxSymLen is a workaround for Varnish issue #2880
 	// https://github.com/varnishcache/varnish-cache/issues/2880
@@ -155,17 +167,27 @@ const (
 	maxSymLen = 46
 )
 
+// tmplNames are the names of the templates for VCL generation.
+var tmplNames = []string{
+	ingTmplSrc, shardTmplSrc, authTmplSrc, aclTmplSrc, rewriteTmplSrc,
+	reqDispTmplSrc, snippetTmplSrc,
+}
+
 var (
-	ingressTmpl *template.Template
-	shardTmpl   *template.Template
-	authTmpl    *template.Template
-	aclTmpl     *template.Template
-	rewriteTmpl *template.Template
-	reqDispTmpl *template.Template
-	vclIllegal  = regexp.MustCompile("[^[:word:]-]+")
+	ingressTmpl  *template.Template
+	shardTmpl    *template.Template
+	authTmpl     *template.Template
+	aclTmpl      *template.Template
+	rewriteTmpl  *template.Template
+	reqDispTmpl  *template.Template
+	snippetTmpl  *template.Template
+	dispatchTmpl *template.Template
+	vclIllegal   = regexp.MustCompile("[^[:word:]-]+")
 )
 
-// InitTemplates initializes templates for VCL generation.
+// InitTemplates initializes templates for VCL generation. Templates
+// for specific versions of Varnish are loaded from subdirectories of
+// tmplDir named varnish-<major version>, if any.
 func InitTemplates(tmplDir string) error {
 	var err error
 	ingTmplPath := path.Join(tmplDir, ingTmplSrc)
@@ -174,6 +196,8 @@ func InitTemplates(tmplDir string) error {
 	aclTmplPath := path.Join(tmplDir, aclTmplSrc)
 	rewriteTmplPath := path.Join(tmplDir, rewriteTmplSrc)
 	reqDispTmplPath := path.Join(tmplDir, reqDispTmplSrc)
+	snippetTmplPath := path.Join(tmplDir, snippetTmplSrc)
+	dispatchTmplPath := path.Join(tmplDir, dispatchTmplSrc)
 
 	ingressTmpl, err = template.New(ingTmplSrc).
 		Funcs(fMap).ParseFiles(ingTmplPath)
@@ -205,7 +229,17 @@ func InitTemplates(tmplDir string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	snippetTmpl, err = template.New(snippetTmplSrc).
+		Funcs(fMap).ParseFiles(snippetTmplPath)
+	if err != nil {
+		return err
+	}
+	dispatchTmpl, err = template.New(dispatchTmplSrc).
+		Funcs(fMap).ParseFiles(dispatchTmplPath)
+	if err != nil {
+		return err
+	}
+	return initVersionTmpls(tmplDir)
 }
 
 func replIllegal(ill []byte) []byte {
@@ -219,39 +253,8 @@ func replIllegal(ill []byte) []byte {
 
 // GetSrc returns the VCL generated to implement a Spec.
 func (spec Spec) GetSrc() (string, error) {
-	var buf bytes.Buffer
-	if err := ingressTmpl.Execute(&buf, spec); err != nil {
-		return "", err
-	}
-	if len(spec.ShardCluster.Nodes) > 0 {
-		if err := shardTmpl.Execute(&buf, spec.ShardCluster); err != nil {
-			return "", err
-		}
-	}
-	if len(spec.ACLs) > 0 {
-		if err := aclTmpl.Execute(&buf, spec); err != nil {
-			return "", err
-		}
-	}
-	if len(spec.Auths) > 0 {
-		if err := authTmpl.Execute(&buf, spec); err != nil {
-			return "", err
-		}
-	}
-	if len(spec.Rewrites) > 0 {
-		if err := rewriteTmpl.Execute(&buf, spec); err != nil {
-			return "", err
-		}
-	}
-	if len(spec.Dispositions) > 0 {
-		if err := reqDispTmpl.Execute(&buf, spec); err != nil {
-			return "", err
-		}
-	}
-	if spec.VCL != "" {
-		buf.WriteString(spec.VCL)
-	}
-	return buf.String(), nil
+	src, _, err := spec.GetSrcMap()
+	return src, err
 }
 
 func bound(s string, l int) string {
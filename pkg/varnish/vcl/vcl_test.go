@@ -34,6 +34,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"text/template"
 )
@@ -627,6 +628,59 @@ func TestCustomVCL(t *testing.T) {
 	}
 }
 
+var snippetSpec = Spec{
+	DefaultService: Service{},
+	Rules:          customVCLSpec.Rules,
+	AllServices:    customVCLSpec.AllServices,
+	Snippets: []Snippet{
+		{
+			Name:     "no-cookies",
+			Sub:      "recv",
+			Before:   true,
+			Priority: -1,
+			VCL:      `	unset req.http.Cookie;`,
+		},
+		{
+			Name: "hello",
+			Sub:  "deliver",
+			VCL:  `	set resp.http.Hello = "world";`,
+		},
+		{
+			Name:   "normalize-host",
+			Sub:    "recv",
+			Before: true,
+			VCL:    `	set req.http.Host = std.tolower(req.http.Host);`,
+		},
+		{
+			Name:     "goodbye",
+			Sub:      "deliver",
+			Priority: 10,
+			VCL:      `	set resp.http.Goodbye = "world";`,
+		},
+	},
+}
+
+func TestSnippets(t *testing.T) {
+	gold := "snippets.golden"
+
+	vcl, err := snippetSpec.GetSrc()
+	if err != nil {
+		t.Fatal("GetSrc():", err)
+	}
+
+	ok, err := cmpGold([]byte(vcl), gold)
+	if err != nil {
+		t.Fatalf("Reading %s: %v", gold, err)
+	}
+	if !ok {
+		t.Errorf("Generated VCL for snippets does not match gold "+
+			"file: %s", gold)
+		if testing.Verbose() {
+			t.Log("Generated: ", vcl)
+		}
+	}
+}
+
 var teaSvcProbeDir = Service{
 	Name: "tea-svc",
 	Addresses: []Address{
@@ -761,3 +815,129 @@ func TestBackendConfig(t *testing.T) {
 		}
 	}
 }
+
+var srcMapSpec = Spec{
+	Rules:       cafeSpec.Rules,
+	AllServices: cafeSpec.AllServices,
+	ACLs: []ACL{{
+		Name:      "local",
+		Comparand: "client.ip",
+		Addresses: []ACLAddress{
+			{Addr: "127.0.0.1", MaskBits: 255},
+			{Addr: "192.0.2.0", MaskBits: 24},
+		},
+	}},
+	Rewrites: []Rewrite{{
+		Target:  "req.url",
+		Source:  "req.url",
+		Method:  Sub,
+		Compare: Match,
+		VCLSub:  Recv,
+		Select:  First,
+		Rules: []RewriteRule{
+			{Value: "^/foo", Rewrite: "/bar"},
+			{Value: "^/baz", Rewrite: "/quux"},
+		},
+	}},
+	VCL: `sub vcl_deliver {
+	set resp.http.Hello = "world";
+}`,
+	Snippets: []Snippet{{
+		Name:   "xid",
+		Sub:    "deliver",
+		Before: true,
+		VCL: `	set resp.http.X-Xid = req.xid;
+	set resp.http.X-Before = "true";`,
+	}},
+}
+
+// vccCoord returns the line and position of the first occurrence of
+// needle in src, as counted by the VCL compiler.
+func vccCoord(src, needle string) (int, int) {
+	line, pos := 1, 0
+	for _, b := range []byte(src[:strings.Index(src, needle)]) {
+		switch b {
+		case '\n':
+			line++
+			pos = 0
+		case '\t':
+			pos = pos&^7 + 8
+		default:
+			pos++
+		}
+	}
+	return line, pos + 1
+}
+
+func TestSrcMap(t *testing.T) {
+	src, srcMap, err := srcMapSpec.GetSrcMap()
+	if err != nil {
+		t.Fatal("GetSrcMap():", err)
+	}
+	if gen, err := srcMapSpec.GetSrc(); err != nil {
+		t.Fatal("GetSrc():", err)
+	} else if gen != src {
+		t.Error("GetSrc() and GetSrcMap() generated different sources")
+	}
+
+	for _, tc := range []struct {
+		needle string
+		want   Origin
+	}{
+		{"vcl 4.0;", Origin{}},
+		{`"/coffee",`, Origin{
+			Kind:  IngressKind,
+			Name:  "cafe.example.com",
+			Field: "/coffee",
+		}},
+		{`"192.0.2.0"/24`, Origin{
+			Kind:  VarnishConfigKind,
+			Field: "spec.acl[0].addrs[1]",
+		}},
+		{`"^/baz"`, Origin{
+			Kind:  VarnishConfigKind,
+			Field: "spec.rewrites[0].rules[1].value",
+		}},
+		{`"/quux"`, Origin{
+			Kind:  VarnishConfigKind,
+			Field: "spec.rewrites[0].rules[1].rewrite",
+		}},
+		{"sub vcl_recv {\n\tif (vk8s_rewrite_0", Origin{
+			Kind:  VarnishConfigKind,
+			Field: "spec.rewrites[0].vcl-sub",
+		}},
+		{"resp.http.Hello", Origin{
+			Kind:  VarnishConfigKind,
+			Field: "spec.vcl line 2",
+		}},
+		{"resp.http.X-Before", Origin{
+			Kind:  VarnishConfigKind,
+			Field: "spec.snippets[name=xid] line 2",
+		}},
+	} {
+		if !strings.Contains(src, tc.needle) {
+			t.Fatalf("%q not found in generated VCL", tc.needle)
+		}
+		line, pos := vccCoord(src, tc.needle)
+		if got := srcMap.Lookup(line, pos); got != tc.want {
+			t.Errorf("Lookup(%d, %d) for %q: got %+v want %+v",
+				line, pos, tc.needle, got, tc.want)
+		}
+	}
+
+	line, pos := vccCoord(src, `"/quux"`)
+	msg := fmt.Sprintf("Message from VCC-compiler:\nSyntax error\n"+
+		"('<vcl.inline>' Line %d Pos %d)\n", line, pos)
+	origins := srcMap.Origins(msg)
+	if len(origins) != 1 {
+		t.Fatalf("Origins(): got %v, want 1 origin", origins)
+	}
+	want := "VarnishConfig spec.rewrites[0].rules[1].rewrite"
+	if got := origins[0].String(); got != want {
+		t.Errorf("Origin.String(): got %s want %s", got, want)
+	}
+	if origins = srcMap.Origins("VCL compilation failed"); origins != nil {
+		t.Errorf("Origins() without a location: got %v, want nil",
+			origins)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package vcl
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Version is a version of Varnish at which generated VCL is loaded,
+// as parsed from the banner of the Varnish CLI. The zero value means
+// that the version is unknown, for which VCL is generated with the
+// default templates.
+type Version struct {
+	Major int
+	Minor int
+}
+
+// Matches the version in a CLI banner such as:
+//
+//    varnish-6.3.2 revision 1ac09a7ba7f3c8a27ed34a1bd2d2d4f1a7a01e05
+var bannerVersion = regexp.MustCompile(`varnish-(?:plus-)?(\d+)\.(\d+)`)
+
+// ParseBanner returns the Varnish version reported in banner, the
+// greeting of the Varnish CLI. Returns false if no version is found.
+func ParseBanner(banner string) (Version, bool) {
+	match := bannerVersion.FindStringSubmatch(banner)
+	if match == nil {
+		return Version{}, false
+	}
+	major, err := strconv.Atoi(match[1])
+	if err != nil {
+		return Version{}, false
+	}
+	minor, err := strconv.Atoi(match[2])
+	if err != nil {
+		return Version{}, false
+	}
+	return Version{Major: major, Minor: minor}, true
+}
+
+func (v Version) String() string {
+	if v == (Version{}) {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// vclSyntax returns the VCL syntax version declared by the generated
+// VCL for Varnish version v.
+func (v Version) vclSyntax() string {
+	if v.Major >= 7 {
+		return "4.1"
+	}
+	return "4.0"
+}
+
+// Highest major version of Varnish for which the default templates
+// generate VCL. They use the vmod and parameter names of Varnish 6.
+const maxDefaultMajor = 6
+
+// supported returns an error if VCL cannot be generated for Varnish
+// version v: if the major version is greater than maxDefaultMajor,
+// and no templates were loaded for exactly that major version.
+func (v Version) supported() error {
+	if v.Major <= maxDefaultMajor {
+		return nil
+	}
+	for _, set := range versionTmpls {
+		if set.major == v.Major {
+			return nil
+		}
+	}
+	return fmt.Errorf("Varnish %s is not supported: the default "+
+		"templates generate VCL for Varnish %d, and no templates "+
+		"were found in the subdirectory %s%d of the template "+
+		"directory", v, maxDefaultMajor, verDirPrefix, v.Major)
+}
+
+// Prefix of the names of subdirectories of the template directory
+// that contain templates for a major version of Varnish, such as
+// varnish-7.
+const verDirPrefix = "varnish-"
+
+// verTmpls are the templates for a major version of Varnish and
+// later versions, which replace the default templates of the same
+// name.
+type verTmpls struct {
+	major int
+	tmpls map[string]*template.Template
+}
+
+// versionTmpls are the version-specific template sets, sorted by
+// major version.
+var versionTmpls []verTmpls
+
+// initVersionTmpls loads templates from subdirectories of tmplDir
+// whose names are verDirPrefix followed by a major version. A
+// subdirectory may contain any of the default templates; those that
+// are not present are taken from tmplDir.
+func initVersionTmpls(tmplDir string) error {
+	versionTmpls = nil
+	dirs, err := filepath.Glob(path.Join(tmplDir, verDirPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			continue
+		}
+		major, err := strconv.Atoi(strings.TrimPrefix(
+			filepath.Base(dir), verDirPrefix))
+		if err != nil || major <= 0 {
+			return fmt.Errorf("Invalid Varnish version in template "+
+				"directory name: %s", dir)
+		}
+		set := verTmpls{
+			major: major,
+			tmpls: make(map[string]*template.Template),
+		}
+		for _, name := range tmplNames {
+			tmplPath := path.Join(dir, name)
+			if _, err := os.Stat(tmplPath); os.IsNotExist(err) {
+				continue
+			}
+			tmpl, err := template.New(name).Funcs(fMap).
+				ParseFiles(tmplPath)
+			if err != nil {
+				return err
+			}
+			set.tmpls[name] = tmpl
+		}
+		versionTmpls = append(versionTmpls, set)
+	}
+	sort.Slice(versionTmpls, func(i, j int) bool {
+		return versionTmpls[i].major < versionTmpls[j].major
+	})
+	return nil
+}
+
+// tmplsFor returns the version-specific templates for Varnish
+// version v: the set for the highest major version that is not
+// greater than v.Major. Returns nil if there is no such set, or if
+// the version is unknown.
+func tmplsFor(v Version) map[string]*template.Template {
+	var tmpls map[string]*template.Template
+	for _, set := range versionTmpls {
+		if set.major > v.Major {
+			break
+		}
+		tmpls = set.tmpls
+	}
+	return tmpls
+}
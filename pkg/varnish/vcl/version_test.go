@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2019 UPLEX Nils Goroll Systemoptimierung
+ * All rights reserved
+ *
+ * Author: Geoffrey Simmons <geoffrey.simmons@uplex.de>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package vcl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBanner(t *testing.T) {
+	for _, tc := range []struct {
+		banner string
+		want   Version
+		ok     bool
+	}{
+		{
+			banner: "-----------------------------\n" +
+				"Varnish Cache CLI 1.0\n" +
+				"-----------------------------\n" +
+				"Linux,5.4.0,x86_64,-junix,-smalloc,-sdefault," +
+				"-hcritbit\n" +
+				"varnish-6.3.2 revision " +
+				"1ac09a7ba7f3c8a27ed34a1bd2d2d4f1a7a01e05\n\n" +
+				"Type 'help' for command list.\n" +
+				"Type 'quit' to close CLI session.\n",
+			want: Version{Major: 6, Minor: 3},
+			ok:   true,
+		},
+		{
+			banner: "varnish-7.0.1 revision " +
+				"b6a7a2fb3f8e5e5d6a2b4c0b3d6e8b4a9f2f8f60",
+			want: Version{Major: 7, Minor: 0},
+			ok:   true,
+		},
+		{
+			banner: "varnish-plus-6.0.9r3 revision 0123456789abcdef",
+			want:   Version{Major: 6, Minor: 0},
+			ok:     true,
+		},
+		{banner: "Varnish Cache CLI 1.0", ok: false},
+		{banner: "", ok: false},
+	} {
+		got, ok := ParseBanner(tc.banner)
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("ParseBanner(%q): want %v,%v got %v,%v",
+				tc.banner, tc.want, tc.ok, got, ok)
+		}
+	}
+	if s := (Version{}).String(); s != "unknown" {
+		t.Errorf("Version{}.String() want unknown got %s", s)
+	}
+	if s := (Version{Major: 7, Minor: 1}).String(); s != "7.1" {
+		t.Errorf("Version.String() want 7.1 got %s", s)
+	}
+}
+
+func TestVersionTemplates(t *testing.T) {
+	tmplDir := os.Getenv("TEMPLATE_DIR")
+	defer func() {
+		if err := InitTemplates(tmplDir); err != nil {
+			t.Fatal("InitTemplates():", err)
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "vcl-templates")
+	if err != nil {
+		t.Fatal("TempDir():", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range append([]string{dispatchTmplSrc}, tmplNames...) {
+		src, err := ioutil.ReadFile(filepath.Join(tmplDir, name))
+		if err != nil {
+			t.Fatal("ReadFile():", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, name), src, 0644)
+		if err != nil {
+			t.Fatal("WriteFile():", err)
+		}
+	}
+	verDir := filepath.Join(dir, "varnish-7")
+	if err = os.Mkdir(verDir, 0755); err != nil {
+		t.Fatal("Mkdir():", err)
+	}
+	aclTmpl := `{{range .ACLs}}
+# ACL {{.Name}} for Varnish {{varnishMajor}}
+{{- end}}
+`
+	err = ioutil.WriteFile(filepath.Join(verDir, "acl.tmpl"),
+		[]byte(aclTmpl), 0644)
+	if err != nil {
+		t.Fatal("WriteFile():", err)
+	}
+	if err = InitTemplates(dir); err != nil {
+		t.Fatal("InitTemplates():", err)
+	}
+
+	for _, tc := range []struct {
+		ver    Version
+		prefix string
+		acl    string
+	}{
+		{Version{}, "vcl 4.0;", "acl vk8s_"},
+		{Version{Major: 6, Minor: 3}, "vcl 4.0;", "acl vk8s_"},
+		{Version{Major: 7, Minor: 0}, "vcl 4.1;", "# ACL local for Varnish 7"},
+	} {
+		src, _, err := srcMapSpec.GetSrcMapFor(tc.ver)
+		if err != nil {
+			t.Fatalf("GetSrcMapFor(%v): %v", tc.ver, err)
+		}
+		if !strings.HasPrefix(src, tc.prefix) {
+			t.Errorf("GetSrcMapFor(%v): want prefix %q", tc.ver,
+				tc.prefix)
+		}
+		if !strings.Contains(src, tc.acl) {
+			t.Errorf("GetSrcMapFor(%v): %q not found", tc.ver,
+				tc.acl)
+		}
+	}
+	if err = ValidateTemplates(nil); err != nil {
+		t.Error("ValidateTemplates(nil):", err)
+	}
+	if _, _, err = srcMapSpec.GetSrcMapFor(Version{Major: 8}); err == nil {
+		t.Error("GetSrcMapFor(8.0) without varnish-8 templates: " +
+			"expected error got=nil")
+	}
+
+	badDir := filepath.Join(dir, "varnish-latest")
+	if err = os.Mkdir(badDir, 0755); err != nil {
+		t.Fatal("Mkdir():", err)
+	}
+	if err = InitTemplates(dir); err == nil {
+		t.Error("InitTemplates() with an invalid version directory: " +
+			"expected error got=nil")
+	}
+}
+
+func TestVersionSupported(t *testing.T) {
+	for _, tc := range []struct {
+		ver Version
+		ok  bool
+	}{
+		{Version{}, true},
+		{Version{Major: 6, Minor: 0}, true},
+		{Version{Major: 6, Minor: 6}, true},
+		{Version{Major: 7, Minor: 0}, false},
+		{Version{Major: 8, Minor: 1}, false},
+	} {
+		if err := tc.ver.supported(); (err == nil) != tc.ok {
+			t.Errorf("Version %s supported(): want ok=%v got %v",
+				tc.ver, tc.ok, err)
+		}
+	}
+	if _, _, err := srcMapSpec.GetSrcMapFor(Version{Major: 7}); err == nil {
+		t.Error("GetSrcMapFor(7.0) with the default templates: " +
+			"expected error got=nil")
+	}
+}